@@ -0,0 +1,300 @@
+package caddy2_radius_auth
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2866"
+	"layeh.com/radius/rfc2869"
+)
+
+func init() {
+	caddy.RegisterModule(ByteCounter{})
+}
+
+// AccountingConfig configures RADIUS accounting (RFC 2866)
+type AccountingConfig struct {
+	Enabled         bool   `json:"enabled,omitempty"`          // Send Start/Stop records for authenticated requests
+	Port            string `json:"port,omitempty"`             // Accounting port on each server (default "1813")
+	InterimInterval string `json:"interim_interval,omitempty"` // Interval between Interim-Update records (0 to disable)
+
+	// ByteCounts adds Acct-Input-Octets to Interim-Update and Stop records
+	// and Acct-Output-Octets to Stop records. Output octets need the
+	// radius_auth_byte_counter handler before the authentication handler,
+	// which the Caddyfile adds, or Caddy's access log for the site.
+	ByteCounts bool `json:"byte_counts,omitempty"`
+}
+
+// accountingSession tracks one accounted HTTP request
+type accountingSession struct {
+	id       string
+	username string
+	started  time.Time
+	in       *countingReader // Request body, nil unless ByteCounts is set
+	out      responseSizer   // Response, nil unless ByteCounts is set and its size is counted
+}
+
+// responseSizer reports the bytes written to a response so far
+type responseSizer interface {
+	Size() int
+}
+
+// countingReader counts the bytes read from a request body. The handler
+// reads while Interim-Update records are built, hence the atomic count.
+type countingReader struct {
+	io.ReadCloser
+	n atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// countingWriter counts the bytes written to a response. Interim-Update
+// records may be built while the handler writes, hence the atomic count.
+type countingWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	n atomic.Int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriterWrapper.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// ReadFrom keeps the underlying writer's io.ReaderFrom fast path, which
+// bypasses Write
+func (c *countingWriter) ReadFrom(r io.Reader) (int64, error) {
+	n, err := c.ResponseWriterWrapper.ReadFrom(r)
+	c.n.Add(n)
+	return n, err
+}
+
+// Size returns the number of bytes written so far
+func (c *countingWriter) Size() int {
+	return int(c.n.Load())
+}
+
+// ByteCounter counts the response bytes of every request for accounting
+// byte_counts. An authentication provider cannot replace the response
+// writer the later handlers use, so this handler wraps it beforehand; the
+// Caddyfile puts it in front of the authentication handler when
+// byte_counts is on.
+type ByteCounter struct{}
+
+// CaddyModule returns the Caddy module information.
+func (ByteCounter) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.radius_auth_byte_counter",
+		New: func() caddy.Module { return new(ByteCounter) },
+	}
+}
+
+func (ByteCounter) ServeHTTP(w http.ResponseWriter, req *http.Request, next caddyhttp.Handler) error {
+	return next.ServeHTTP(&countingWriter{ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w}}, req)
+}
+
+// responseCounter finds what counts the bytes written to w: the writer of
+// the radius_auth_byte_counter handler, or the recorder Caddy wraps around
+// the response writer when it logs the request. Other wrappers are looked
+// through.
+func responseCounter(w http.ResponseWriter) responseSizer {
+	for w != nil {
+		switch w := w.(type) {
+		case *countingWriter:
+			return w
+		case caddyhttp.ResponseRecorder:
+			return w
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil
+		}
+		w = u.Unwrap()
+	}
+	return nil
+}
+
+// newSessionID returns a random UUID (version 4), used as Acct-Session-Id
+// and for the session ID header
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// startAccounting sends an accounting Start record for the request and
+// arranges for Interim-Update and Stop records to follow. The Stop record is
+// sent once the request context ends, which happens when the rest of the
+// handler chain has finished writing the response. id is the request's
+// session ID, if one was assigned.
+func (r HTTPRadiusAuth) startAccounting(w http.ResponseWriter, req *http.Request, username, id string) {
+	if id == "" {
+		var err error
+		if id, err = newSessionID(); err != nil {
+			r.logger.Error("generating accounting session id", zap.Error(err))
+			return
+		}
+	}
+	sess := &accountingSession{id: id, username: username, started: time.Now()}
+	if r.Accounting.ByteCounts {
+		if req.Body != nil && req.Body != http.NoBody {
+			sess.in = &countingReader{ReadCloser: req.Body}
+			req.Body = sess.in
+		}
+		sess.out = responseCounter(w)
+		if sess.out == nil && r.uncountedOutput.CompareAndSwap(false, true) {
+			r.logger.Warn("accounting byte_counts cannot count response bytes without the radius_auth_byte_counter handler or access logging; only input octets will be sent")
+		}
+	}
+
+	if !r.inflight.enter() {
+		return
+	}
+	go func() {
+		defer r.inflight.leave()
+		r.sendAccounting(sess, rfc2866.AcctStatusType_Value_Start)
+
+		var tick <-chan time.Time
+		if r.interimInterval > 0 {
+			ticker := time.NewTicker(r.interimInterval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-tick:
+				r.sendAccounting(sess, rfc2866.AcctStatusType_Value_InterimUpdate)
+			case <-req.Context().Done():
+				r.sendAccounting(sess, rfc2866.AcctStatusType_Value_Stop)
+				return
+			case <-r.shutdownCtx.Done():
+				// The module is being replaced; close the session now
+				r.sendAccounting(sess, rfc2866.AcctStatusType_Value_Stop)
+				return
+			}
+		}
+	}()
+}
+
+// sendAccounting sends an accounting record, trying each server in order
+// until one acknowledges it
+func (r HTTPRadiusAuth) sendAccounting(sess *accountingSession, status rfc2866.AcctStatusType) {
+	for _, server := range r.pool.list() {
+		addr := r.accountingAddr(server)
+		packet, err := r.newAccountingRequest(server, sess, status)
+		if err != nil {
+			r.logger.Error("building accounting request", zap.Error(err))
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), r.timeoutFor(server))
+		// The accounting port is reached the same way as the server
+		resp, err := r.exchangeVia(ctx, packet, addr, r.transportFor(server))
+		cancel()
+		if err != nil {
+			r.logger.Debug("accounting request failed",
+				zap.String("server", addr),
+				zap.Stringer("status", status),
+				zap.Error(err))
+			continue
+		}
+		if resp.Code == radius.CodeAccountingResponse {
+			return
+		}
+	}
+	r.logger.Warn("no RADIUS server acknowledged accounting record",
+		zap.String("session_id", sess.id),
+		zap.Stringer("status", status))
+}
+
+// accountingAddr returns the accounting address for an authentication server.
+// RadSec carries accounting on the same connection port.
+func (r HTTPRadiusAuth) accountingAddr(server string) string {
+	if r.usesTLS(server) {
+		return server
+	}
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return server
+	}
+	return net.JoinHostPort(host, r.Accounting.Port)
+}
+
+// newAccountingRequest builds an Accounting-Request packet for the given server
+func (r HTTPRadiusAuth) newAccountingRequest(server string, sess *accountingSession, status rfc2866.AcctStatusType) (*radius.Packet, error) {
+	packet := radius.New(radius.CodeAccountingRequest, []byte(r.secretFor(server)))
+	if err := rfc2865.UserName_SetString(packet, sess.username); err != nil {
+		return nil, fmt.Errorf("rfc2865: setting username string error: %w", err)
+	}
+	if err := rfc2866.AcctStatusType_Set(packet, status); err != nil {
+		return nil, fmt.Errorf("rfc2866: setting status type error: %w", err)
+	}
+	if err := rfc2866.AcctSessionID_SetString(packet, sess.id); err != nil {
+		return nil, fmt.Errorf("rfc2866: setting session id error: %w", err)
+	}
+	if err := r.setNASAttributes(packet); err != nil {
+		return nil, err
+	}
+	if status != rfc2866.AcctStatusType_Value_Start {
+		seconds := rfc2866.AcctSessionTime(time.Since(sess.started) / time.Second)
+		if err := rfc2866.AcctSessionTime_Set(packet, seconds); err != nil {
+			return nil, fmt.Errorf("rfc2866: setting session time error: %w", err)
+		}
+		if err := setOctets(packet, sess, status); err != nil {
+			return nil, err
+		}
+	}
+	return packet, nil
+}
+
+// setOctets adds the byte counts of sess, if it has any, with the
+// Gigawords attributes of RFC 2869 carrying the part beyond 32 bits. Caddy's
+// response recorder is not safe to read while the response is being
+// written, so output octets are only reported by the Stop record.
+func setOctets(packet *radius.Packet, sess *accountingSession, status rfc2866.AcctStatusType) error {
+	if sess.in != nil {
+		n := uint64(sess.in.n.Load())
+		if err := rfc2866.AcctInputOctets_Set(packet, rfc2866.AcctInputOctets(n)); err != nil {
+			return fmt.Errorf("rfc2866: setting input octets error: %w", err)
+		}
+		if n>>32 > 0 {
+			if err := rfc2869.AcctInputGigawords_Set(packet, rfc2869.AcctInputGigawords(n>>32)); err != nil {
+				return fmt.Errorf("rfc2869: setting input gigawords error: %w", err)
+			}
+		}
+	}
+	if sess.out != nil && status == rfc2866.AcctStatusType_Value_Stop {
+		n := uint64(sess.out.Size())
+		if err := rfc2866.AcctOutputOctets_Set(packet, rfc2866.AcctOutputOctets(n)); err != nil {
+			return fmt.Errorf("rfc2866: setting output octets error: %w", err)
+		}
+		if n>>32 > 0 {
+			if err := rfc2869.AcctOutputGigawords_Set(packet, rfc2869.AcctOutputGigawords(n>>32)); err != nil {
+				return fmt.Errorf("rfc2869: setting output gigawords error: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var _ caddyhttp.MiddlewareHandler = (*ByteCounter)(nil)
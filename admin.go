@@ -0,0 +1,308 @@
+package caddy2_radius_auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// instances holds every provisioned HTTPRadiusAuth so the admin API can
+// report on them. Entries are added in Provision and removed in Cleanup.
+var instances sync.Map // map[*HTTPRadiusAuth]struct{}
+
+// adminAPI is a module that provides the /radius_auth/ endpoints for the
+// Caddy admin API
+type adminAPI struct{}
+
+// breakerStatus holds the circuit breaker state of a RADIUS server
+type breakerStatus struct {
+	Server   string `json:"server"`
+	State    string `json:"state"`
+	Failures int    `json:"failures"`
+}
+
+// credentialTest is the body of POST /radius_auth/test. Realm and Server
+// select the instance to test when more than one is configured.
+type credentialTest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Realm    string `json:"realm,omitempty"`  // Basic Auth realm of the site
+	Server   string `json:"server,omitempty"` // One of the instance's servers
+}
+
+// credentialTestResult is the response of POST /radius_auth/test
+type credentialTestResult struct {
+	Result    string  `json:"result"` // accept, reject or error
+	Server    string  `json:"server,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMS float64 `json:"latency_ms"`
+}
+
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.radius_auth",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes returns the admin routes for the radius_auth module
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/radius_auth/breakers",
+			Handler: caddy.AdminHandlerFunc(a.handleBreakers),
+		},
+		{
+			Pattern: "/radius_auth/cache",
+			Handler: caddy.AdminHandlerFunc(a.handleCache),
+		},
+		{
+			Pattern: "/radius_auth/cache/",
+			Handler: caddy.AdminHandlerFunc(a.handleCache),
+		},
+		{
+			Pattern: "/radius_auth/cache/bump_version",
+			Handler: caddy.AdminHandlerFunc(a.handleBumpVersion),
+		},
+		{
+			Pattern: "/radius_auth/lockouts",
+			Handler: caddy.AdminHandlerFunc(a.handleLockouts),
+		},
+		{
+			Pattern: "/radius_auth/servers",
+			Handler: caddy.AdminHandlerFunc(a.handleServers),
+		},
+		{
+			Pattern: "/radius_auth/test",
+			Handler: caddy.AdminHandlerFunc(a.handleTest),
+		},
+	}
+}
+
+// handleBreakers reports the circuit breaker state of every RADIUS server
+func (adminAPI) handleBreakers(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	results := []breakerStatus{}
+	instances.Range(func(key, _ any) bool {
+		r := key.(*HTTPRadiusAuth)
+		for _, server := range r.pool.list() {
+			b := r.pool.breaker(server)
+			if b == nil {
+				continue
+			}
+			state, failures := b.state()
+			results = append(results, breakerStatus{Server: server, State: state, Failures: failures})
+		}
+		return true
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(results)
+}
+
+// handleServers reports the health, latest outcome and circuit breaker
+// state of every RADIUS server, including those of realms
+func (adminAPI) handleServers(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	results := []serverStatus{}
+	instances.Range(func(key, _ any) bool {
+		r := key.(*HTTPRadiusAuth)
+		results = append(results, r.pool.status()...)
+		for i := range r.Realms {
+			if pool := r.Realms[i].pool; pool != nil {
+				results = append(results, pool.status()...)
+			}
+		}
+		return true
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(results)
+}
+
+// handleBumpVersion increments the cache key version of every instance,
+// invalidating all cached results without a config reload
+func (adminAPI) handleBumpVersion(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	versions := []int64{}
+	instances.Range(func(key, _ any) bool {
+		versions = append(versions, key.(*HTTPRadiusAuth).bumpCacheVersion())
+		return true
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(map[string][]int64{"versions": versions})
+}
+
+// handleLockouts lists the usernames with counted rejects or an active
+// lockout, per instance with lockout enabled
+func (adminAPI) handleLockouts(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	results := []lockoutStatus{}
+	instances.Range(func(key, _ any) bool {
+		r := key.(*HTTPRadiusAuth)
+		if r.lockout != nil {
+			results = append(results, r.lockout.snapshot()...)
+		}
+		return true
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(results)
+}
+
+// handleCache evicts cached results for one username, or every cached result
+// when no username is given
+func (adminAPI) handleCache(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodDelete {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	username := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/radius_auth/cache"), "/")
+
+	evicted := 0
+	instances.Range(func(key, _ any) bool {
+		r := key.(*HTTPRadiusAuth)
+		if username == "" {
+			evicted += r.flushCache()
+		} else {
+			evicted += r.evictUser(username)
+		}
+		return true
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(map[string]int{"evicted": evicted})
+}
+
+// handleTest checks a username and password against the RADIUS servers of
+// one instance, bypassing the cache. The instance is selected by the realm
+// and server given in the body, and may be left out when only one is
+// configured. The password is never logged.
+func (adminAPI) handleTest(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	var body credentialTest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("decoding request body: %v", err),
+		}
+	}
+	if body.Username == "" {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("username is required"),
+		}
+	}
+
+	var matches []*HTTPRadiusAuth
+	instances.Range(func(key, _ any) bool {
+		r := key.(*HTTPRadiusAuth)
+		if r.selectedBy(body.Realm, body.Server) {
+			matches = append(matches, r)
+		}
+		return true
+	})
+	switch len(matches) {
+	case 0:
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no radius_auth instance matches"),
+		}
+	case 1:
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusConflict,
+			Err:        fmt.Errorf("%d radius_auth instances match; select one with realm or server", len(matches)),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(matches[0].testCredentials(req, body.Username, body.Password))
+}
+
+// selectedBy reports whether a credential test with the given realm and
+// server, either of which may be empty, applies to r. Instances serving
+// on-demand TLS permissions are never selected.
+func (r *HTTPRadiusAuth) selectedBy(realm, server string) bool {
+	if r.permission {
+		return false
+	}
+	if realm != "" && realm != r.realmName() {
+		return false
+	}
+	return server == "" || slices.Contains(r.Servers, server)
+}
+
+// testCredentials authenticates username the way Authenticate would,
+// including realms and username transforms, but without the cache
+func (r HTTPRadiusAuth) testCredentials(req *http.Request, username, password string) credentialTestResult {
+	start := time.Now()
+	if realm := r.matchRealm(username); realm != nil {
+		r = r.withRealm(realm)
+	}
+	res, err := r.checkRadiusConcurrent(req.Context(), r.UsernameTransform.apply(username), password, requestInfo{})
+
+	result := credentialTestResult{Server: res.server}
+	switch {
+	case err != nil:
+		result.Result, result.Error = outcomeError, err.Error()
+	case res.ok:
+		result.Result = outcomeAccept
+	default:
+		result.Result = outcomeReject
+	}
+	result.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+	r.logger.Info("RADIUS credential test",
+		zap.String("username", username),
+		zap.String("result", result.Result),
+		zap.String("server", result.Server))
+	return result
+}
+
+// Interface guards
+var _ caddy.AdminRouter = (*adminAPI)(nil)
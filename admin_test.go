@@ -0,0 +1,287 @@
+package caddy2_radius_auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/wxccs/caddy2-radius-auth/internal/testradius"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"layeh.com/radius"
+)
+
+// adminRoute returns the handler the admin API serves pattern with
+func adminRoute(t *testing.T, pattern string) caddy.AdminHandler {
+	t.Helper()
+	for _, route := range (adminAPI{}).Routes() {
+		if route.Pattern == pattern {
+			return route.Handler
+		}
+	}
+	t.Fatalf("no admin route for %s", pattern)
+	return nil
+}
+
+func TestAdminCredentialTest(t *testing.T) {
+	const password = "correct horse battery staple"
+	mock := testradius.NewMockServer(t, map[string]radius.Code{
+		"alice": radius.CodeAccessAccept,
+		"bob":   radius.CodeAccessReject,
+	})
+	r := &HTTPRadiusAuth{
+		Servers:  []string{mock.Addr()},
+		Secret:   testradius.Secret,
+		CacheTTL: "1m",
+	}
+	provision(t, r)
+	core, logs := observer.New(zapcore.InfoLevel)
+	r.logger = zap.New(core)
+
+	handler := adminRoute(t, "/radius_auth/test")
+	for _, tc := range []struct {
+		username string
+		want     string
+	}{
+		{"alice", outcomeAccept},
+		{"alice", outcomeAccept}, // not answered from the cache
+		{"bob", outcomeReject},
+	} {
+		body := fmt.Sprintf(`{"username": %q, "password": %q}`, tc.username, password)
+		req := httptest.NewRequest(http.MethodPost, "/radius_auth/test", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		if err := handler.ServeHTTP(w, req); err != nil {
+			t.Fatalf("%s: %v", tc.username, err)
+		}
+		var result credentialTestResult
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Result != tc.want || result.Server != mock.Addr() {
+			t.Errorf("%s: got %+v, want result %s from %s", tc.username, result, tc.want, mock.Addr())
+		}
+	}
+	if n := mock.RequestCount(); n != 3 {
+		t.Errorf("RADIUS received %d requests, want 3", n)
+	}
+
+	if logs.FilterMessage("RADIUS credential test").Len() != 3 {
+		t.Errorf("logged %d credential tests, want 3", logs.FilterMessage("RADIUS credential test").Len())
+	}
+	for _, entry := range logs.All() {
+		for key, value := range entry.ContextMap() {
+			if strings.Contains(fmt.Sprint(value), password) {
+				t.Errorf("log field %s of %q contains the password", key, entry.Message)
+			}
+		}
+	}
+}
+
+func TestAdminCredentialTestErrors(t *testing.T) {
+	handler := adminRoute(t, "/radius_auth/test")
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		body   string
+		want   int
+	}{
+		{"wrong method", http.MethodGet, "", http.StatusMethodNotAllowed},
+		{"invalid body", http.MethodPost, "{", http.StatusBadRequest},
+		{"missing username", http.MethodPost, `{"password": "x"}`, http.StatusBadRequest},
+		{"no instance", http.MethodPost, `{"username": "alice", "password": "x"}`, http.StatusNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "/radius_auth/test", strings.NewReader(tc.body))
+			err := handler.ServeHTTP(httptest.NewRecorder(), req)
+			apiErr, ok := err.(caddy.APIError)
+			if !ok || apiErr.HTTPStatus != tc.want {
+				t.Errorf("got error %v, want status %d", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestAdminServers(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{
+		"alice": radius.CodeAccessAccept,
+		"bob":   0, // dropped
+	})
+	r := &HTTPRadiusAuth{
+		Servers: []string{mock.Addr()},
+		Secret:  testradius.Secret,
+		Timeout: "50ms",
+	}
+	provision(t, r)
+
+	for _, user := range []string{"alice", "bob"} {
+		req, _ := newCaddyRequest(user, "password")
+		r.Authenticate(httptest.NewRecorder(), req)
+	}
+
+	handler := adminRoute(t, "/radius_auth/servers")
+	w := httptest.NewRecorder()
+	if err := handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/radius_auth/servers", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	var entries []map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	var entry map[string]any
+	for _, e := range entries {
+		if e["addr"] == mock.Addr() {
+			entry = e
+		}
+	}
+	if entry == nil {
+		t.Fatalf("no entry for %s in %v", mock.Addr(), entries)
+	}
+	for _, key := range []string{"addr", "healthy", "last_error", "last_success_ms", "circuit_breaker_state"} {
+		if _, ok := entry[key]; !ok {
+			t.Errorf("entry has no %s: %v", key, entry)
+		}
+	}
+	if entry["healthy"] != true || entry["circuit_breaker_state"] != breakerClosed {
+		t.Errorf("got %v, want a healthy server with a closed breaker", entry)
+	}
+	// bob's timeout is the latest error; alice's exchange the latest success
+	if entry["last_error"] == "" {
+		t.Error("last_error is empty after a timeout")
+	}
+	if ms, _ := entry["last_success_ms"].(float64); ms <= 0 {
+		t.Errorf("last_success_ms = %v, want the latency of the accepted exchange", entry["last_success_ms"])
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/radius_auth/servers", nil)
+	if err, ok := handler.ServeHTTP(httptest.NewRecorder(), req).(caddy.APIError); !ok || err.HTTPStatus != http.StatusMethodNotAllowed {
+		t.Errorf("POST: got %v, want status %d", err, http.StatusMethodNotAllowed)
+	}
+}
+
+// postCredentialTest sends body to POST /radius_auth/test
+func postCredentialTest(t *testing.T, body string) (credentialTestResult, error) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/radius_auth/test", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	if err := adminRoute(t, "/radius_auth/test").ServeHTTP(w, req); err != nil {
+		return credentialTestResult{}, err
+	}
+	var result credentialTestResult
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return result, nil
+}
+
+func TestAdminCredentialTestSelectsInstance(t *testing.T) {
+	staff := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+	guests := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessReject})
+	provision(t, &HTTPRadiusAuth{Servers: []string{staff.Addr()}, Secret: testradius.Secret, Realm: "Staff"})
+	provision(t, &HTTPRadiusAuth{Servers: []string{guests.Addr()}, Secret: testradius.Secret, Realm: "Guests"})
+
+	// The permission instance would match every selector below but is
+	// never tested
+	perm := &PermissionByRADIUS{
+		HTTPRadiusAuth: HTTPRadiusAuth{Servers: []string{staff.Addr()}, Secret: testradius.Secret, Realm: "Staff"},
+		Token:          "token",
+	}
+	if err := perm.Provision(newTestContext(t)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { perm.Cleanup() })
+
+	_, err := postCredentialTest(t, `{"username": "alice", "password": "x"}`)
+	if apiErr, ok := err.(caddy.APIError); !ok || apiErr.HTTPStatus != http.StatusConflict {
+		t.Errorf("without a selector: got error %v, want status %d", err, http.StatusConflict)
+	}
+
+	for _, tc := range []struct {
+		selector   string
+		wantResult string
+		wantServer string
+	}{
+		{`"realm": "Staff"`, outcomeAccept, staff.Addr()},
+		{`"realm": "Guests"`, outcomeReject, guests.Addr()},
+		{fmt.Sprintf(`"server": %q`, guests.Addr()), outcomeReject, guests.Addr()},
+		{fmt.Sprintf(`"realm": "Staff", "server": %q`, staff.Addr()), outcomeAccept, staff.Addr()},
+	} {
+		result, err := postCredentialTest(t, `{"username": "alice", "password": "x", `+tc.selector+`}`)
+		if err != nil {
+			t.Errorf("%s: %v", tc.selector, err)
+			continue
+		}
+		if result.Result != tc.wantResult || result.Server != tc.wantServer {
+			t.Errorf("%s: got %+v, want result %s from %s", tc.selector, result, tc.wantResult, tc.wantServer)
+		}
+	}
+
+	_, err = postCredentialTest(t, `{"username": "alice", "password": "x", "realm": "Nobody"}`)
+	if apiErr, ok := err.(caddy.APIError); !ok || apiErr.HTTPStatus != http.StatusNotFound {
+		t.Errorf("unknown realm: got error %v, want status %d", err, http.StatusNotFound)
+	}
+}
+
+func TestAdminCredentialTestLoadedModule(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+
+	// Load both modules the way Caddy does when running a config
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	cfg := fmt.Sprintf(`{"servers": [%q], "secret": %q}`, mock.Addr(), testradius.Secret)
+	if _, err := ctx.LoadModuleByID("http.authentication.providers.radius_auth", json.RawMessage(cfg)); err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	info, err := caddy.GetModule("admin.api.radius_auth")
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	router, ok := info.New().(caddy.AdminRouter)
+	if !ok {
+		cancel()
+		t.Fatalf("admin.api.radius_auth is %T, not an AdminRouter", info.New())
+	}
+	var handler caddy.AdminHandler
+	for _, route := range router.Routes() {
+		if route.Pattern == "/radius_auth/test" {
+			handler = route.Handler
+		}
+	}
+
+	post := func() error {
+		req := httptest.NewRequest(http.MethodPost, "/radius_auth/test",
+			strings.NewReader(`{"username": "alice", "password": "x"}`))
+		w := httptest.NewRecorder()
+		if err := handler.ServeHTTP(w, req); err != nil {
+			return err
+		}
+		var result credentialTestResult
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Result != outcomeAccept || result.Server != mock.Addr() {
+			t.Errorf("got %+v, want accept from %s", result, mock.Addr())
+		}
+		return nil
+	}
+	if err := post(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stopping the config cleans the instance up and unregisters it
+	cancel()
+	err = post()
+	if apiErr, ok := err.(caddy.APIError); !ok || apiErr.HTTPStatus != http.StatusNotFound {
+		t.Errorf("after the context ended: got error %v, want status %d", err, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,531 @@
+package caddy2_radius_auth
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/wxccs/caddy2-radius-auth/internal/dictionary"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
+)
+
+// attrKind describes how an attribute value is encoded on the wire
+type attrKind int
+
+const (
+	attrString attrKind = iota
+	attrInteger
+	attrIPAddr
+)
+
+// attributeDef names a RADIUS attribute type
+type attributeDef struct {
+	Type   radius.Type // Vendor type for vendor-specific attributes
+	Name   string
+	Kind   attrKind
+	Vendor uint32            // Vendor ID, 0 for standard attributes
+	Values map[string]uint32 // Named integer values from a dictionary
+}
+
+// attributeDefs lists the RFC 2865 attributes the module knows by name
+var attributeDefs = []attributeDef{
+	{Type: rfc2865.UserName_Type, Name: "User-Name", Kind: attrString},
+	{Type: rfc2865.NASIPAddress_Type, Name: "NAS-IP-Address", Kind: attrIPAddr},
+	{Type: rfc2865.NASPort_Type, Name: "NAS-Port", Kind: attrInteger},
+	{Type: rfc2865.ServiceType_Type, Name: "Service-Type", Kind: attrInteger},
+	{Type: rfc2865.FramedProtocol_Type, Name: "Framed-Protocol", Kind: attrInteger},
+	{Type: rfc2865.FramedIPAddress_Type, Name: "Framed-IP-Address", Kind: attrIPAddr},
+	{Type: rfc2865.FramedIPNetmask_Type, Name: "Framed-IP-Netmask", Kind: attrIPAddr},
+	{Type: rfc2865.FilterID_Type, Name: "Filter-Id", Kind: attrString},
+	{Type: rfc2865.FramedMTU_Type, Name: "Framed-MTU", Kind: attrInteger},
+	{Type: rfc2865.LoginIPHost_Type, Name: "Login-IP-Host", Kind: attrIPAddr},
+	{Type: rfc2865.ReplyMessage_Type, Name: "Reply-Message", Kind: attrString},
+	{Type: rfc2865.CallbackNumber_Type, Name: "Callback-Number", Kind: attrString},
+	{Type: rfc2865.CallbackID_Type, Name: "Callback-Id", Kind: attrString},
+	{Type: rfc2865.FramedRoute_Type, Name: "Framed-Route", Kind: attrString},
+	{Type: rfc2865.State_Type, Name: "State", Kind: attrString},
+	{Type: rfc2865.Class_Type, Name: "Class", Kind: attrString},
+	{Type: rfc2865.SessionTimeout_Type, Name: "Session-Timeout", Kind: attrInteger},
+	{Type: rfc2865.IdleTimeout_Type, Name: "Idle-Timeout", Kind: attrInteger},
+	{Type: rfc2865.TerminationAction_Type, Name: "Termination-Action", Kind: attrInteger},
+	{Type: rfc2865.CalledStationID_Type, Name: "Called-Station-Id", Kind: attrString},
+	{Type: rfc2865.CallingStationID_Type, Name: "Calling-Station-Id", Kind: attrString},
+	{Type: rfc2865.NASIdentifier_Type, Name: "NAS-Identifier", Kind: attrString},
+	{Type: rfc2865.ProxyState_Type, Name: "Proxy-State", Kind: attrString},
+	{Type: rfc2865.NASPortType_Type, Name: "NAS-Port-Type", Kind: attrInteger},
+	{Type: rfc2865.PortLimit_Type, Name: "Port-Limit", Kind: attrInteger},
+}
+
+// attributeKey identifies an attribute on the wire
+type attributeKey struct {
+	vendor uint32
+	typ    radius.Type
+}
+
+// attributeDict resolves attributes by name and by wire type
+type attributeDict struct {
+	byName map[string]attributeDef
+	byType map[attributeKey]attributeDef
+}
+
+func newAttributeDict(defs []attributeDef) *attributeDict {
+	d := &attributeDict{
+		byName: make(map[string]attributeDef, len(defs)),
+		byType: make(map[attributeKey]attributeDef, len(defs)),
+	}
+	for _, def := range defs {
+		d.add(def)
+	}
+	return d
+}
+
+func (d *attributeDict) add(def attributeDef) {
+	d.byName[strings.ToLower(def.Name)] = def
+	d.byType[attributeKey{def.Vendor, def.Type}] = def
+}
+
+// lookup resolves an attribute name such as "Filter-Id" (case-insensitive)
+func (d *attributeDict) lookup(name string) (attributeDef, bool) {
+	def, ok := d.byName[strings.ToLower(name)]
+	return def, ok
+}
+
+// builtinAttributes holds the RFC 2865 attributes in attributeDefs
+var builtinAttributes = newAttributeDict(attributeDefs)
+
+// lookupAttribute resolves the name of a built-in attribute
+func lookupAttribute(name string) (attributeDef, bool) {
+	return builtinAttributes.lookup(name)
+}
+
+// loadDictionaries returns the built-in attributes extended with those of
+// the given FreeRADIUS dictionary files. Dictionary entries take precedence.
+func loadDictionaries(paths []string) (*attributeDict, error) {
+	dict, err := dictionary.ParseFiles(paths...)
+	if err != nil {
+		return nil, err
+	}
+	d := newAttributeDict(attributeDefs)
+	for _, attr := range dict.Attributes {
+		kind := attrString
+		switch attr.Type {
+		case "integer", "date":
+			kind = attrInteger
+		case "ipaddr":
+			kind = attrIPAddr
+		}
+		d.add(attributeDef{
+			Type:   radius.Type(attr.Code),
+			Name:   attr.Name,
+			Kind:   kind,
+			Vendor: attr.Vendor,
+			Values: attr.Values,
+		})
+	}
+	return d, nil
+}
+
+// attributes returns the attribute dictionary of the instance
+func (r HTTPRadiusAuth) attributes() *attributeDict {
+	if r.dict != nil {
+		return r.dict
+	}
+	return builtinAttributes
+}
+
+// parseUsernameAttribute resolves the attribute that carries the username:
+// a string attribute name such as "User-Name" or "NAS-Identifier", or a
+// numeric type such as "26". Attributes the module uses for the credentials
+// or the conversation itself are refused.
+func parseUsernameAttribute(name string) (radius.Type, error) {
+	var typ radius.Type
+	if n, err := strconv.Atoi(name); err == nil {
+		if n < 1 || n > 255 {
+			return 0, fmt.Errorf("invalid attribute type %d", n)
+		}
+		typ = radius.Type(n)
+	} else {
+		def, ok := lookupAttribute(name)
+		if !ok {
+			return 0, fmt.Errorf("unknown RADIUS attribute %s", name)
+		}
+		if def.Kind != attrString {
+			return 0, fmt.Errorf("%s does not hold a string", def.Name)
+		}
+		typ = def.Type
+	}
+	switch typ {
+	case rfc2865.UserPassword_Type, rfc2865.CHAPPassword_Type, rfc2865.State_Type,
+		rfc2869.EAPMessage_Type, rfc2869.MessageAuthenticator_Type:
+		return 0, fmt.Errorf("attribute type %d cannot carry the username", typ)
+	}
+	return typ, nil
+}
+
+// parseRequestIDAttribute resolves the attribute that carries the HTTP
+// request ID: a string attribute name, which may come from a dictionary, or
+// a numeric type. Attributes the module sets itself are refused.
+func (d *attributeDict) parseRequestIDAttribute(name string) (attributeDef, error) {
+	var def attributeDef
+	if n, err := strconv.Atoi(name); err == nil {
+		if n < 1 || n > 255 {
+			return attributeDef{}, fmt.Errorf("invalid attribute type %d", n)
+		}
+		var ok bool
+		if def, ok = d.byType[attributeKey{0, radius.Type(n)}]; !ok {
+			def = attributeDef{Type: radius.Type(n), Name: name, Kind: attrString}
+		}
+	} else {
+		var ok bool
+		if def, ok = d.lookup(name); !ok {
+			return attributeDef{}, fmt.Errorf("unknown RADIUS attribute %s", name)
+		}
+	}
+	if def.Kind != attrString {
+		return attributeDef{}, fmt.Errorf("%s does not hold a string", def.Name)
+	}
+	if def.Vendor == 0 {
+		switch def.Type {
+		case rfc2865.UserName_Type, rfc2865.UserPassword_Type, rfc2865.CHAPPassword_Type,
+			rfc2865.State_Type, rfc2865.ProxyState_Type, rfc2865.VendorSpecific_Type, rfc2869.EAPMessage_Type,
+			rfc2869.MessageAuthenticator_Type:
+			return attributeDef{}, fmt.Errorf("attribute type %d cannot carry the request ID", def.Type)
+		}
+	}
+	return def, nil
+}
+
+// placeholderName converts an attribute name to its placeholder form, e.g. "Filter-Id" -> "filter_id"
+func placeholderName(name string) string {
+	return strings.ReplaceAll(strings.ToLower(name), "-", "_")
+}
+
+// formatAttribute renders an attribute value as a string according to its kind
+func formatAttribute(def attributeDef, attr radius.Attribute) string {
+	switch def.Kind {
+	case attrInteger:
+		if v, err := radius.Integer(attr); err == nil {
+			return strconv.FormatUint(uint64(v), 10)
+		}
+	case attrIPAddr:
+		if ip, err := radius.IPAddr(attr); err == nil {
+			return ip.String()
+		}
+	}
+	return radius.String(attr)
+}
+
+// replyAttributes collects the known attributes of a reply packet by name,
+// including those inside Vendor-Specific attributes. Multi-valued
+// attributes keep every value in order.
+func (d *attributeDict) replyAttributes(packet *radius.Packet) map[string][]string {
+	attrs := make(map[string][]string)
+	if packet == nil {
+		return attrs
+	}
+	add := func(key attributeKey, value radius.Attribute) {
+		if def, ok := d.byType[key]; ok {
+			attrs[def.Name] = append(attrs[def.Name], formatAttribute(def, value))
+		}
+	}
+	for _, avp := range packet.Attributes {
+		if avp.Type != rfc2865.VendorSpecific_Type {
+			add(attributeKey{0, avp.Type}, avp.Attribute)
+			continue
+		}
+		vendor, value, err := radius.VendorSpecific(avp.Attribute)
+		if err != nil {
+			continue
+		}
+		// A Vendor-Specific attribute holds one or more type-length-value
+		// sub-attributes
+		for len(value) >= 2 {
+			length := int(value[1])
+			if length < 2 || length > len(value) {
+				break
+			}
+			add(attributeKey{vendor, radius.Type(value[0])}, value[2:length])
+			value = value[length:]
+		}
+	}
+	return attrs
+}
+
+// newAttribute encodes value as an attribute of the given kind
+func newAttribute(def attributeDef, value string) (radius.Attribute, error) {
+	switch def.Kind {
+	case attrInteger:
+		if n, ok := def.Values[value]; ok {
+			return radius.NewInteger(n), nil
+		}
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid integer %q", def.Name, value)
+		}
+		return radius.NewInteger(uint32(n)), nil
+	case attrIPAddr:
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("%s: invalid IP address %q", def.Name, value)
+		}
+		return radius.NewIPAddr(ip)
+	default:
+		return radius.NewString(value)
+	}
+}
+
+// avp wraps an attribute value for the wire, inside a Vendor-Specific
+// attribute for vendor attributes
+func (def attributeDef) avp(attr radius.Attribute) (*radius.AVP, error) {
+	if def.Vendor == 0 {
+		return &radius.AVP{Type: def.Type, Attribute: attr}, nil
+	}
+	// Vendor-Specific carries 4 bytes of vendor ID and 2 of sub-attribute header
+	if len(attr) > 253-6 {
+		return nil, fmt.Errorf("%s: value too long", def.Name)
+	}
+	sub := append([]byte{byte(def.Type), byte(len(attr) + 2)}, attr...)
+	vsa, err := radius.NewVendorSpecific(def.Vendor, sub)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", def.Name, err)
+	}
+	return &radius.AVP{Type: rfc2865.VendorSpecific_Type, Attribute: vsa}, nil
+}
+
+// checkRequestAttributes validates the names in RequestAttributes. The
+// attributes carrying the credentials and challenge state are set by the
+// module and cannot be overridden.
+func (r *HTTPRadiusAuth) checkRequestAttributes() error {
+	for name := range r.RequestAttributes {
+		def, ok := r.attributes().lookup(name)
+		if !ok {
+			return fmt.Errorf("request_attributes: unknown RADIUS attribute %s", name)
+		}
+		if def.Vendor == 0 && def.Type == rfc2865.CalledStationID_Type && r.CalledStationId != "" {
+			return fmt.Errorf("request_attributes: Called-Station-Id is already set by called_station_id")
+		}
+		if def.Vendor == 0 && (def.Type == rfc2865.UserName_Type || def.Type == rfc2865.State_Type) {
+			return fmt.Errorf("request_attributes: %s is set by the module", def.Name)
+		}
+	}
+	return nil
+}
+
+// checkUsernameAttribute refuses a UsernameAttribute that the module or the
+// configuration also sets, which would replace the username in the request
+// without any error.
+func (r *HTTPRadiusAuth) checkUsernameAttribute() error {
+	if r.usernameType == rfc2865.UserName_Type {
+		return nil
+	}
+	setBy := map[radius.Type]string{
+		// Every request carries the client address
+		rfc2865.CallingStationID_Type: "the client address",
+	}
+	if r.NASIdentifier != "" {
+		setBy[rfc2865.NASIdentifier_Type] = "nas_identifier"
+	}
+	if r.nasIP != nil {
+		setBy[rfc2865.NASIPAddress_Type] = "nas_ip_address"
+	}
+	if r.NASPortMode != nasPortNone {
+		setBy[rfc2865.NASPort_Type] = "nas_port_mode"
+	}
+	if r.serviceType != 0 {
+		setBy[rfc2865.ServiceType_Type] = "service_type"
+	}
+	if r.nasPortType != nil {
+		setBy[rfc2865.NASPortType_Type] = "nas_port_type"
+	}
+	if r.CalledStationId != "" {
+		setBy[rfc2865.CalledStationID_Type] = "called_station_id"
+	}
+	if r.requestIDAttr != nil && r.requestIDAttr.Vendor == 0 {
+		setBy[r.requestIDAttr.Type] = "request_id_attribute"
+	}
+	for name := range r.RequestAttributes {
+		if def, ok := r.attributes().lookup(name); ok && def.Vendor == 0 {
+			setBy[def.Type] = "request_attributes"
+		}
+	}
+	if source, ok := setBy[r.usernameType]; ok {
+		return fmt.Errorf("username_attribute: %s is also set by %s", r.UsernameAttribute, source)
+	}
+	return nil
+}
+
+// newRequestInfo gathers the per-request attributes for req. Each
+// RequestAttributes value is a placeholder expression such as
+// {http.request.host}, or otherwise the name of a request header.
+// Attributes that evaluate to an empty value are left out.
+func (r HTTPRadiusAuth) newRequestInfo(req *http.Request) (requestInfo, error) {
+	info := requestInfo{clientIP: r.clientIP(req)}
+	switch r.NASPortMode {
+	case nasPortHashIP:
+		h := fnv.New32a()
+		h.Write([]byte(info.clientIP))
+		port := h.Sum32()
+		info.nasPort = &port
+	case nasPortSequential:
+		port := r.nasPortCounter.Add(1)
+		info.nasPort = &port
+	}
+	if len(r.RequestAttributes) == 0 && r.CalledStationId == "" && r.requestIDAttr == nil {
+		return info, nil
+	}
+	repl, _ := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if repl == nil {
+		repl = caddy.NewReplacer()
+	}
+	if r.requestIDAttr != nil {
+		id := strings.TrimSpace(req.Header.Get("X-Request-ID"))
+		if id == "" {
+			id = repl.ReplaceAll("{http.request.uuid}", "")
+		}
+		if len(id) > 253 {
+			id = id[:253]
+		}
+		if id != "" {
+			avp, err := r.requestIDAttr.avp(radius.Attribute(id))
+			if err != nil {
+				return requestInfo{}, err
+			}
+			info.id = avp
+		}
+	}
+	// Called-Station-Id goes through attrs so it is part of the cache scope
+	if value := repl.ReplaceAll(r.CalledStationId, ""); value != "" {
+		info.attrs = append(info.attrs, &radius.AVP{Type: rfc2865.CalledStationID_Type, Attribute: radius.Attribute(value)})
+	}
+	for name, source := range r.RequestAttributes {
+		var value string
+		if strings.Contains(source, "{") {
+			value = repl.ReplaceAll(source, "")
+		} else {
+			value = req.Header.Get(source)
+		}
+		if value == "" {
+			continue
+		}
+		def, _ := r.attributes().lookup(name)
+		attr, err := newAttribute(def, value)
+		if err != nil {
+			return requestInfo{}, err
+		}
+		avp, err := def.avp(attr)
+		if err != nil {
+			return requestInfo{}, err
+		}
+		info.attrs = append(info.attrs, avp)
+	}
+	// Vendor-Specific attributes share a type, so order by value too
+	slices.SortFunc(info.attrs, func(a, b *radius.AVP) int {
+		if a.Type != b.Type {
+			return int(a.Type) - int(b.Type)
+		}
+		return bytes.Compare(a.Attribute, b.Attribute)
+	})
+	return info, nil
+}
+
+// cacheScope returns the request attribute values in a stable order, so
+// results for different attribute values are cached apart
+func (info requestInfo) cacheScope() string {
+	var b strings.Builder
+	for _, avp := range info.attrs {
+		fmt.Fprintf(&b, "%d=%x;", avp.Type, []byte(avp.Attribute))
+	}
+	return b.String()
+}
+
+// parseServiceType resolves a Service-Type name such as "Authenticate-Only".
+// The "-User" suffix may be left off, so "Login" means Login-User.
+func parseServiceType(name string) (rfc2865.ServiceType, bool) {
+	for value, s := range rfc2865.ServiceType_Strings {
+		if strings.EqualFold(s, name) || strings.EqualFold(s, name+"-User") {
+			return value, true
+		}
+	}
+	return 0, false
+}
+
+// parseNASPortType resolves a NAS-Port-Type name such as "Virtual" or
+// "Wireless-802.11"
+func parseNASPortType(name string) (rfc2865.NASPortType, bool) {
+	for value, s := range rfc2865.NASPortType_Strings {
+		if strings.EqualFold(s, name) {
+			return value, true
+		}
+	}
+	return 0, false
+}
+
+// exportAttributes publishes reply attributes as {radius.*} placeholders and
+// request vars, restricted to ExportAttributes when it is set
+func (r HTTPRadiusAuth) exportAttributes(req *http.Request, attrs map[string][]string) {
+	repl, _ := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	for name, values := range attrs {
+		key := placeholderName(name)
+		if len(r.ExportAttributes) > 0 && !r.exportsAttribute(key) {
+			continue
+		}
+		value := strings.Join(values, ",")
+		caddyhttp.SetVar(req.Context(), "radius."+key, value)
+		if repl != nil {
+			repl.Set("radius."+key, value)
+		}
+	}
+}
+
+// setAttributeHeaders copies reply attributes into the request headers named
+// by AttributeHeaders. Configured headers are always cleared first so clients
+// cannot supply them themselves.
+func (r HTTPRadiusAuth) setAttributeHeaders(req *http.Request, attrs map[string][]string) {
+	r.clearAttributeHeaders(req)
+	for name, header := range r.AttributeHeaders {
+		def, ok := r.attributes().lookup(name)
+		if !ok {
+			continue
+		}
+		if values := attrs[def.Name]; len(values) > 0 {
+			req.Header.Set(header, strings.Join(values, ","))
+		}
+	}
+	if r.RoleHeader != "" {
+		if def, ok := r.attributes().lookup(r.RoleAttribute); ok {
+			if roles := attrs[def.Name]; len(roles) > 0 {
+				req.Header.Set(r.RoleHeader, strings.Join(roles, ","))
+			}
+		}
+	}
+}
+
+// clearAttributeHeaders removes the headers filled from reply attributes, so
+// a client can never supply them itself
+func (r HTTPRadiusAuth) clearAttributeHeaders(req *http.Request) {
+	for _, header := range r.AttributeHeaders {
+		req.Header.Del(header)
+	}
+	if r.RoleHeader != "" {
+		req.Header.Del(r.RoleHeader)
+	}
+}
+
+// exportsAttribute reports whether the placeholder key is listed in ExportAttributes
+func (r HTTPRadiusAuth) exportsAttribute(key string) bool {
+	for _, name := range r.ExportAttributes {
+		if placeholderName(name) == key {
+			return true
+		}
+	}
+	return false
+}
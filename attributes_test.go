@@ -0,0 +1,588 @@
+package caddy2_radius_auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+	"github.com/wxccs/caddy2-radius-auth/internal/testradius"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2866"
+)
+
+// newCaddyRequest builds a request carrying the replacer and vars that Caddy's
+// HTTP server would attach
+func newCaddyRequest(user, pass string) (*http.Request, *caddy.Replacer) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth(user, pass)
+	repl := caddy.NewReplacer()
+	ctx := context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl)
+	ctx = context.WithValue(ctx, caddyhttp.VarsCtxKey, map[string]any{})
+	return req.WithContext(ctx), repl
+}
+
+func TestExportAttributesDownstream(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+	mock.SetReply("alice", func(resp *radius.Packet) {
+		rfc2865.FilterID_AddString(resp, "admins")
+		rfc2865.FilterID_AddString(resp, "staff")
+		rfc2865.Class_AddString(resp, "gold")
+		rfc2865.SessionTimeout_Set(resp, 3600)
+	})
+
+	for _, tc := range []struct {
+		name   string
+		export []string
+		want   map[string]string
+	}{
+		{
+			name: "all",
+			want: map[string]string{
+				"radius.filter_id":       "admins,staff",
+				"radius.class":           "gold",
+				"radius.session_timeout": "3600",
+			},
+		},
+		{
+			name:   "restricted",
+			export: []string{"Class"},
+			want: map[string]string{
+				"radius.filter_id":       "",
+				"radius.class":           "gold",
+				"radius.session_timeout": "",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &HTTPRadiusAuth{
+				Servers:          []string{mock.Addr()},
+				Secret:           testradius.Secret,
+				ExportAttributes: tc.export,
+			}
+			provision(t, r)
+			auth := caddyauth.Authentication{
+				Providers: map[string]caddyauth.Authenticator{"radius_auth": *r},
+			}
+
+			var called bool
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, req *http.Request) error {
+				called = true
+				repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+				for key, want := range tc.want {
+					if got := repl.ReplaceAll("{"+key+"}", ""); got != want {
+						t.Errorf("placeholder {%s} = %q, want %q", key, got, want)
+					}
+					got, _ := caddyhttp.GetVar(req.Context(), key).(string)
+					if got != want {
+						t.Errorf("var %s = %q, want %q", key, got, want)
+					}
+				}
+				return nil
+			})
+
+			req, _ := newCaddyRequest("alice", "password")
+			if err := auth.ServeHTTP(httptest.NewRecorder(), req, next); err != nil {
+				t.Fatalf("ServeHTTP: %v", err)
+			}
+			if !called {
+				t.Fatal("downstream handler was not called")
+			}
+		})
+	}
+}
+
+func TestAttributeHeadersProxied(t *testing.T) {
+	received := make(chan http.Header, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received <- req.Header.Clone()
+	}))
+	defer upstream.Close()
+	upstreamURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(upstreamURL)
+
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+	mock.SetReply("alice", func(resp *radius.Packet) {
+		rfc2865.FilterID_AddString(resp, "admins")
+		rfc2865.FilterID_AddString(resp, "staff")
+		rfc2865.SessionTimeout_Set(resp, 3600)
+	})
+
+	r := &HTTPRadiusAuth{
+		Servers: []string{mock.Addr()},
+		Secret:  testradius.Secret,
+		AttributeHeaders: map[string]string{
+			"Filter-Id":       "X-User-Group",
+			"Session-Timeout": "X-Session-Limit",
+			"Class":           "X-User-Class",
+		},
+	}
+	provision(t, r)
+	auth := caddyauth.Authentication{
+		Providers: map[string]caddyauth.Authenticator{"radius_auth": *r},
+	}
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, req *http.Request) error {
+		proxy.ServeHTTP(w, req)
+		return nil
+	})
+
+	req, _ := newCaddyRequest("alice", "password")
+	// A client must not be able to supply the configured headers itself
+	req.Header.Set("X-User-Class", "spoofed")
+	if err := auth.ServeHTTP(httptest.NewRecorder(), req, next); err != nil {
+		t.Fatalf("ServeHTTP: %v", err)
+	}
+
+	header := <-received
+	for name, want := range map[string]string{
+		"X-User-Group":    "admins,staff",
+		"X-Session-Limit": "3600",
+		"X-User-Class":    "",
+	} {
+		if got := header.Get(name); got != want {
+			t.Errorf("upstream saw %s %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestServiceType(t *testing.T) {
+	for _, tc := range []struct {
+		serviceType string
+		want        rfc2865.ServiceType
+	}{
+		{"", 0},
+		{"Authenticate-Only", rfc2865.ServiceType_Value_AuthenticateOnly},
+		{"Login", rfc2865.ServiceType_Value_LoginUser},
+		{"framed", rfc2865.ServiceType_Value_FramedUser},
+	} {
+		t.Run(tc.serviceType, func(t *testing.T) {
+			mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+			r := &HTTPRadiusAuth{
+				Servers:     []string{mock.Addr()},
+				Secret:      testradius.Secret,
+				ServiceType: tc.serviceType,
+			}
+			provision(t, r)
+
+			req, _ := newCaddyRequest("alice", "password")
+			if _, ok, err := r.Authenticate(httptest.NewRecorder(), req); !ok || err != nil {
+				t.Fatalf("Authenticate = %v, %v", ok, err)
+			}
+
+			requests := mock.Requests()
+			if len(requests) != 1 {
+				t.Fatalf("RADIUS received %d requests, want 1", len(requests))
+			}
+			_, present := requests[0].Lookup(rfc2865.ServiceType_Type)
+			if tc.want == 0 {
+				if present {
+					t.Error("Service-Type was sent although none is configured")
+				}
+				return
+			}
+			if got := rfc2865.ServiceType_Get(requests[0]); !present || got != tc.want {
+				t.Errorf("Service-Type = %v (present %v), want %v", got, present, tc.want)
+			}
+		})
+	}
+}
+
+func TestServiceTypeInvalid(t *testing.T) {
+	r := &HTTPRadiusAuth{
+		Servers:     []string{"127.0.0.1:1812"},
+		Secret:      testradius.Secret,
+		ServiceType: "Teleport",
+	}
+	if err := r.Provision(newTestContext(t)); err == nil {
+		t.Error("Provision accepted an unknown service_type")
+	}
+}
+
+func TestAttributeHeadersFromCache(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+	mock.SetReply("alice", func(resp *radius.Packet) {
+		rfc2865.FilterID_AddString(resp, "admins")
+	})
+	r := &HTTPRadiusAuth{
+		Servers:          []string{mock.Addr()},
+		Secret:           testradius.Secret,
+		CacheTTL:         "1m",
+		AttributeHeaders: map[string]string{"Filter-Id": "X-User-Group"},
+	}
+	provision(t, r)
+
+	for i := 0; i < 2; i++ {
+		req, _ := newCaddyRequest("alice", "password")
+		if _, ok, err := r.Authenticate(httptest.NewRecorder(), req); !ok || err != nil {
+			t.Fatalf("Authenticate = %v, %v", ok, err)
+		}
+		if got := req.Header.Get("X-User-Group"); got != "admins" {
+			t.Errorf("request %d: X-User-Group = %q, want admins", i, got)
+		}
+	}
+	if n := mock.RequestCount(); n != 1 {
+		t.Errorf("RADIUS received %d requests, want 1", n)
+	}
+}
+
+func TestRequestAttributes(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+	r := &HTTPRadiusAuth{
+		Servers:  []string{mock.Addr()},
+		Secret:   testradius.Secret,
+		CacheTTL: "1m",
+		RequestAttributes: map[string]string{
+			"Called-Station-Id": "{http.request.host}",
+			"NAS-Port":          "X-NAS-Port",
+		},
+	}
+	provision(t, r)
+
+	authenticate := func(host string) {
+		t.Helper()
+		req, _ := newCaddyRequest("alice", "password")
+		req.Host = host
+		req.Header.Set("X-NAS-Port", "7")
+		repl := caddyhttp.NewTestReplacer(req)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+		if _, ok, err := r.Authenticate(httptest.NewRecorder(), req); !ok || err != nil {
+			t.Fatalf("Authenticate(%s) = %v, %v", host, ok, err)
+		}
+	}
+	authenticate("app.example.com")
+	authenticate("app.example.com") // cached
+	authenticate("admin.example.com")
+
+	requests := mock.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("RADIUS received %d requests, want 2", len(requests))
+	}
+	for i, want := range []string{"app.example.com", "admin.example.com"} {
+		if got := rfc2865.CalledStationID_GetString(requests[i]); got != want {
+			t.Errorf("request %d: Called-Station-Id = %q, want %q", i, got, want)
+		}
+		if got := rfc2865.NASPort_Get(requests[i]); got != 7 {
+			t.Errorf("request %d: NAS-Port = %d, want 7", i, got)
+		}
+	}
+}
+
+func TestRequestAttributePlaceholder(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+	r := &HTTPRadiusAuth{
+		Servers: []string{mock.Addr()},
+		Secret:  testradius.Secret,
+		RequestAttributes: map[string]string{
+			"Class": "{http.request.header.X-Tenant-ID}",
+		},
+	}
+	provision(t, r)
+
+	req, _ := newCaddyRequest("alice", "password")
+	req.Header.Set("X-Tenant-ID", "tenant-42")
+	repl := caddyhttp.NewTestReplacer(req)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+	if _, ok, err := r.Authenticate(httptest.NewRecorder(), req); !ok || err != nil {
+		t.Fatalf("Authenticate = %v, %v", ok, err)
+	}
+
+	requests := mock.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("RADIUS received %d requests, want 1", len(requests))
+	}
+	if got := rfc2865.Class_GetString(requests[0]); got != "tenant-42" {
+		t.Errorf("Class = %q, want tenant-42", got)
+	}
+}
+
+func TestRequestAttributesInvalid(t *testing.T) {
+	for _, attrs := range []map[string]string{
+		{"No-Such-Attribute": "X-Header"},
+		{"User-Name": "X-User"},
+	} {
+		r := &HTTPRadiusAuth{
+			Servers:           []string{"127.0.0.1:1812"},
+			Secret:            testradius.Secret,
+			RequestAttributes: attrs,
+		}
+		provision(t, r)
+		if err := r.Validate(); err == nil {
+			t.Errorf("Validate accepted request_attributes %v", attrs)
+		}
+	}
+}
+
+func TestRoleHeader(t *testing.T) {
+	received := make(chan http.Header, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received <- req.Header.Clone()
+	}))
+	defer upstream.Close()
+	upstreamURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(upstreamURL)
+
+	mock := testradius.NewMockServer(t, map[string]radius.Code{
+		"alice": radius.CodeAccessAccept,
+		"bob":   radius.CodeAccessAccept,
+	})
+	mock.SetReply("alice", func(resp *radius.Packet) {
+		rfc2865.FilterID_AddString(resp, "admins")
+		rfc2865.FilterID_AddString(resp, "staff")
+	})
+
+	r := &HTTPRadiusAuth{
+		Servers:    []string{mock.Addr()},
+		Secret:     testradius.Secret,
+		CacheTTL:   "1m",
+		RoleHeader: "X-User-Roles",
+	}
+	provision(t, r)
+	auth := caddyauth.Authentication{
+		Providers: map[string]caddyauth.Authenticator{"radius_auth": *r},
+	}
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, req *http.Request) error {
+		proxy.ServeHTTP(w, req)
+		return nil
+	})
+
+	for _, tc := range []struct {
+		name, username, want string
+	}{
+		{"from RADIUS", "alice", "admins,staff"},
+		{"from cache", "alice", "admins,staff"},
+		{"no roles", "bob", ""},
+	} {
+		req, _ := newCaddyRequest(tc.username, "password")
+		// A client must not be able to supply its own roles
+		req.Header.Set("X-User-Roles", "admins")
+		w := httptest.NewRecorder()
+		if err := auth.ServeHTTP(w, req, next); err != nil {
+			t.Fatalf("%s: ServeHTTP: %v", tc.name, err)
+		}
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, want %d", tc.name, w.Code, http.StatusOK)
+		}
+		if got := (<-received).Get("X-User-Roles"); got != tc.want {
+			t.Errorf("%s: upstream saw X-User-Roles %q, want %q", tc.name, got, tc.want)
+		}
+	}
+	if n := mock.RequestCount(); n != 2 {
+		t.Errorf("RADIUS received %d requests, want 2", n)
+	}
+}
+
+func TestNASPortType(t *testing.T) {
+	for _, tc := range []struct {
+		portType string
+		want     *rfc2865.NASPortType
+	}{
+		{"", nil},
+		{"Virtual", ptr(rfc2865.NASPortType_Value_Virtual)},
+		{"wireless-802.11", ptr(rfc2865.NASPortType_Value_Wireless80211)},
+		{"Async", ptr(rfc2865.NASPortType_Value_Async)}, // encoded as 0
+	} {
+		t.Run(tc.portType, func(t *testing.T) {
+			mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+			r := &HTTPRadiusAuth{
+				Servers:     []string{mock.Addr()},
+				Secret:      testradius.Secret,
+				NASPortType: tc.portType,
+			}
+			provision(t, r)
+
+			req, _ := newCaddyRequest("alice", "password")
+			if _, ok, err := r.Authenticate(httptest.NewRecorder(), req); !ok || err != nil {
+				t.Fatalf("Authenticate = %v, %v", ok, err)
+			}
+
+			requests := mock.Requests()
+			if len(requests) != 1 {
+				t.Fatalf("RADIUS received %d requests, want 1", len(requests))
+			}
+			_, present := requests[0].Lookup(rfc2865.NASPortType_Type)
+			if tc.want == nil {
+				if present {
+					t.Error("NAS-Port-Type was sent although none is configured")
+				}
+				return
+			}
+			if got := rfc2865.NASPortType_Get(requests[0]); !present || got != *tc.want {
+				t.Errorf("NAS-Port-Type = %v (present %v), want %v", got, present, *tc.want)
+			}
+		})
+	}
+}
+
+func TestNASPortTypeCaddyfile(t *testing.T) {
+	var ra HTTPRadiusAuth
+	if err := json.Unmarshal(parseToJSON(t, `radius_auth {
+		servers 10.0.0.1:1812
+		secret s3cret
+		nas_port_type Virtual
+	}`), &ra); err != nil {
+		t.Fatal(err)
+	}
+	if ra.NASPortType != "Virtual" {
+		t.Errorf("NASPortType = %q, want Virtual", ra.NASPortType)
+	}
+
+	ra = HTTPRadiusAuth{Servers: []string{"127.0.0.1:1812"}, Secret: testradius.Secret, NASPortType: "Carrier-Pigeon"}
+	if err := ra.Provision(newTestContext(t)); err == nil {
+		ra.Cleanup()
+		t.Error("Provision accepted an unknown nas_port_type")
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestCalledStationID(t *testing.T) {
+	for _, tc := range []struct {
+		name, value, host, want string
+	}{
+		{"placeholder", "{http.request.host}", "app.example.com", "app.example.com"},
+		{"literal", "caddy-frontend", "app.example.com", "caddy-frontend"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+			r := &HTTPRadiusAuth{
+				Servers:         []string{mock.Addr()},
+				Secret:          testradius.Secret,
+				CalledStationId: tc.value,
+			}
+			provision(t, r)
+
+			req, _ := newCaddyRequest("alice", "password")
+			req.Host = tc.host
+			repl := caddyhttp.NewTestReplacer(req)
+			req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+			if _, ok, err := r.Authenticate(httptest.NewRecorder(), req); !ok || err != nil {
+				t.Fatalf("Authenticate = %v, %v", ok, err)
+			}
+
+			requests := mock.Requests()
+			if len(requests) != 1 {
+				t.Fatalf("RADIUS received %d requests, want 1", len(requests))
+			}
+			if got := rfc2865.CalledStationID_GetString(requests[0]); got != tc.want {
+				t.Errorf("Called-Station-Id = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRequestIDAttribute(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+	for _, tc := range []struct {
+		attr string
+		get  func(*radius.Packet) string
+	}{
+		{"Class", rfc2865.Class_GetString},
+		{"44", rfc2866.AcctSessionID_GetString}, // Acct-Session-Id, not a built-in name
+	} {
+		t.Run(tc.attr, func(t *testing.T) {
+			r := &HTTPRadiusAuth{
+				Servers:            []string{mock.Addr()},
+				Secret:             testradius.Secret,
+				RequestIDAttribute: tc.attr,
+			}
+			provision(t, r)
+
+			req, _ := newCaddyRequest("alice", "password")
+			req.Header.Set("X-Request-ID", "  3f2a9c1e-req  ")
+			before := mock.RequestCount()
+			if _, ok, err := r.Authenticate(httptest.NewRecorder(), req); !ok || err != nil {
+				t.Fatalf("Authenticate = %v, %v", ok, err)
+			}
+
+			requests := mock.Requests()
+			if len(requests) != before+1 {
+				t.Fatalf("RADIUS received %d requests, want 1", len(requests)-before)
+			}
+			if got := tc.get(requests[before]); got != "3f2a9c1e-req" {
+				t.Errorf("%s = %q, want 3f2a9c1e-req", tc.attr, got)
+			}
+		})
+	}
+}
+
+func TestRequestIDAttributeInvalid(t *testing.T) {
+	for _, attr := range []string{"User-Name", "NAS-Port", "No-Such-Attribute", "0", "256"} {
+		r := &HTTPRadiusAuth{
+			Servers:            []string{"127.0.0.1:1812"},
+			Secret:             testradius.Secret,
+			RequestIDAttribute: attr,
+		}
+		if err := r.Provision(newTestContext(t)); err == nil {
+			r.Cleanup()
+			t.Errorf("Provision accepted request_id_attribute %s", attr)
+		}
+	}
+}
+
+func TestUsernameAttribute(t *testing.T) {
+	// Without nas_identifier, NAS-Identifier is free to carry the username
+	r := &HTTPRadiusAuth{
+		Servers:           []string{"127.0.0.1:1812"},
+		Secret:            testradius.Secret,
+		NASIPAddress:      "192.0.2.1",
+		UsernameAttribute: "NAS-Identifier",
+	}
+	provision(t, r)
+	if err := r.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	packet, err := r.newRequest("127.0.0.1:1812", "alice", requestInfo{clientIP: "198.51.100.7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rfc2865.NASIdentifier_GetString(packet); got != "alice" {
+		t.Errorf("NAS-Identifier = %q, want alice", got)
+	}
+	if _, err := rfc2865.UserName_Lookup(packet); err == nil {
+		t.Error("request carries User-Name as well")
+	}
+}
+
+func TestUsernameAttributeCollisions(t *testing.T) {
+	for _, tc := range []struct {
+		attr string
+		set  func(*HTTPRadiusAuth)
+	}{
+		{"NAS-Identifier", func(r *HTTPRadiusAuth) { r.NASIdentifier = "caddy" }},
+		{"4", func(r *HTTPRadiusAuth) { r.NASIPAddress = "192.0.2.1" }},
+		{"Calling-Station-Id", func(*HTTPRadiusAuth) {}},
+		{"Called-Station-Id", func(r *HTTPRadiusAuth) { r.CalledStationId = "{http.request.host}" }},
+		{"5", func(r *HTTPRadiusAuth) { r.NASPortMode = nasPortSequential }},
+		{"6", func(r *HTTPRadiusAuth) { r.ServiceType = "Login" }},
+		{"61", func(r *HTTPRadiusAuth) { r.NASPortType = "Virtual" }},
+		{"Class", func(r *HTTPRadiusAuth) { r.RequestIDAttribute = "Class" }},
+		{"Filter-Id", func(r *HTTPRadiusAuth) { r.RequestAttributes = map[string]string{"Filter-Id": "X-Filter"} }},
+	} {
+		r := &HTTPRadiusAuth{
+			Servers:           []string{"127.0.0.1:1812"},
+			Secret:            testradius.Secret,
+			NASIdentifier:     "caddy",
+			UsernameAttribute: tc.attr,
+		}
+		tc.set(r)
+		provision(t, r)
+		if err := r.Validate(); err == nil {
+			t.Errorf("Validate accepted username_attribute %s set elsewhere too", tc.attr)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package caddy2_radius_auth
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/wxccs/caddy2-radius-auth/internal/testradius"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"layeh.com/radius"
+)
+
+func TestAuditLog(t *testing.T) {
+	const password = "s3cret-password"
+
+	mock := testradius.NewMockServer(t, map[string]radius.Code{
+		"alice": radius.CodeAccessAccept,
+		"bob":   radius.CodeAccessReject,
+		"carol": 0,
+	})
+	r := &HTTPRadiusAuth{
+		Servers:  []string{mock.Addr()},
+		Secret:   testradius.Secret,
+		Timeout:  "100ms",
+		CacheTTL: "1m",
+	}
+	provision(t, r)
+	core, logs := observer.New(zapcore.InfoLevel)
+	r.logger = zap.New(core)
+
+	tests := []struct {
+		username string
+		outcome  string
+		cacheHit bool
+	}{
+		{"alice", outcomeAccept, false},
+		{"alice", outcomeAccept, true},
+		{"bob", outcomeReject, false},
+		{"bob", outcomeReject, true},
+		{"carol", outcomeError, false},
+	}
+	for _, tc := range tests {
+		req, _ := newCaddyRequest(tc.username, password)
+		req.RemoteAddr = "192.0.2.10:51234"
+		r.Authenticate(httptest.NewRecorder(), req)
+	}
+
+	entries := logs.FilterMessage("authentication attempt").All()
+	if len(entries) != len(tests) {
+		t.Fatalf("logged %d audit entries, want %d", len(entries), len(tests))
+	}
+	for i, tc := range tests {
+		entry := entries[i]
+		if entry.Level != zapcore.InfoLevel {
+			t.Errorf("entry %d logged at %v, want info", i, entry.Level)
+		}
+		fields := entry.ContextMap()
+		want := map[string]any{
+			"username":  tc.username,
+			"client_ip": "192.0.2.10",
+			"outcome":   tc.outcome,
+			"cache_hit": tc.cacheHit,
+		}
+		for key, value := range want {
+			if fields[key] != value {
+				t.Errorf("entry %d: %s = %v, want %v", i, key, fields[key], value)
+			}
+		}
+		if _, ok := fields["latency_ms"].(float64); !ok {
+			t.Errorf("entry %d: latency_ms = %v, want a number", i, fields["latency_ms"])
+		}
+		server, hasServer := fields["server"]
+		if tc.cacheHit && hasServer {
+			t.Errorf("entry %d: cache hit logged server %v", i, server)
+		}
+		if !tc.cacheHit && tc.outcome != outcomeError && server != mock.Addr() {
+			t.Errorf("entry %d: server = %v, want %s", i, server, mock.Addr())
+		}
+		for key, value := range fields {
+			if strings.Contains(fmt.Sprint(value), password) {
+				t.Errorf("entry %d: field %s contains the password", i, key)
+			}
+		}
+	}
+}
+
+func TestAuditLogDisabled(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+	disabled := false
+	r := &HTTPRadiusAuth{
+		Servers:  []string{mock.Addr()},
+		Secret:   testradius.Secret,
+		AuditLog: &disabled,
+	}
+	provision(t, r)
+	core, logs := observer.New(zapcore.InfoLevel)
+	r.logger = zap.New(core)
+
+	req, _ := newCaddyRequest("alice", "password")
+	if _, ok, err := r.Authenticate(httptest.NewRecorder(), req); !ok || err != nil {
+		t.Fatalf("Authenticate = %v, %v", ok, err)
+	}
+	if n := logs.FilterMessage("authentication attempt").Len(); n != 0 {
+		t.Errorf("logged %d audit entries with audit_log off", n)
+	}
+}
+
+func TestDebugPackets(t *testing.T) {
+	const password = "s3cret-password"
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+
+	for _, enabled := range []bool{true, false} {
+		r := &HTTPRadiusAuth{
+			Servers:      []string{mock.Addr()},
+			Secret:       testradius.Secret,
+			DebugPackets: enabled,
+		}
+		provision(t, r)
+		core, logs := observer.New(zapcore.DebugLevel)
+		r.logger = zap.New(core)
+
+		req, _ := newCaddyRequest("alice", password)
+		if _, ok, err := r.Authenticate(httptest.NewRecorder(), req); !ok || err != nil {
+			t.Fatalf("Authenticate = %v, %v", ok, err)
+		}
+
+		sent := logs.FilterMessage("sending RADIUS packet").All()
+		received := logs.FilterMessage("received RADIUS packet").All()
+		if !enabled {
+			if len(sent)+len(received) != 0 {
+				t.Errorf("logged %d packets with debug_packets off", len(sent)+len(received))
+			}
+			continue
+		}
+		if len(sent) != 1 || len(received) != 1 {
+			t.Fatalf("logged %d sent and %d received packets, want 1 each", len(sent), len(received))
+		}
+		if entry := sent[0]; entry.Level != zapcore.DebugLevel {
+			t.Errorf("packet logged at %v, want debug", entry.Level)
+		}
+
+		logged := fmt.Sprint(sent[0].ContextMap())
+		if !strings.Contains(logged, "[REDACTED]") {
+			t.Errorf("User-Password not redacted in %s", logged)
+		}
+		if !strings.Contains(logged, "alice") {
+			t.Errorf("User-Name missing from %s", logged)
+		}
+		for _, entry := range logs.All() {
+			if strings.Contains(fmt.Sprint(entry.ContextMap()), password) {
+				t.Errorf("%q entry contains the password", entry.Message)
+			}
+		}
+	}
+}
+
+func TestDebugSecretCheck(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+
+	for _, tc := range []struct {
+		name     string
+		secret   string
+		enabled  bool
+		wantOK   bool
+		wantWarn bool
+	}{
+		{"wrong secret", "not-the-secret", true, false, true},
+		{"right secret", testradius.Secret, true, true, false},
+		{"disabled", "not-the-secret", false, false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &HTTPRadiusAuth{
+				Servers:          []string{mock.Addr()},
+				Secret:           tc.secret,
+				Timeout:          "200ms",
+				DebugSecretCheck: tc.enabled,
+			}
+			provision(t, r)
+			core, logs := observer.New(zapcore.WarnLevel)
+			r.logger = zap.New(core)
+
+			req, _ := newCaddyRequest("alice", "password")
+			if _, ok, _ := r.Authenticate(httptest.NewRecorder(), req); ok != tc.wantOK {
+				t.Errorf("Authenticate = %v, want %v", ok, tc.wantOK)
+			}
+			warnings := logs.FilterMessage("possible shared-secret mismatch").All()
+			if (len(warnings) > 0) != tc.wantWarn {
+				t.Fatalf("logged %d secret mismatch warnings, want warning: %v", len(warnings), tc.wantWarn)
+			}
+			for _, entry := range warnings {
+				if entry.ContextMap()["server"] != mock.Addr() {
+					t.Errorf("warning fields %v lack server %s", entry.ContextMap(), mock.Addr())
+				}
+				if strings.Contains(fmt.Sprint(entry.ContextMap()), tc.secret) {
+					t.Error("warning contains the secret")
+				}
+			}
+		})
+	}
+}
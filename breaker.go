@@ -0,0 +1,89 @@
+package caddy2_radius_auth
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// errBreakerOpen is reported for servers skipped because their circuit breaker is open
+var errBreakerOpen = errors.New("circuit breaker open")
+
+// Circuit breaker states
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// circuitBreaker tracks consecutive failures for a single RADIUS server.
+// After threshold consecutive failures the breaker opens and the server is
+// skipped until cooldown has elapsed, after which a single probe request is
+// let through (half-open). A successful probe closes the breaker again.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openedAt  time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether a request may be sent to the server
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.probing || time.Since(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// success records a response from the server and closes the breaker
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.probing = false
+}
+
+// failure records an error from the server, opening the breaker once the threshold is reached
+func (b *circuitBreaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.failures >= b.threshold {
+		b.openedAt = time.Now()
+	}
+}
+
+// release ends a request that got neither a response nor an error from the
+// server, such as one cancelled by the caller, so another probe may go through
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// state returns the current breaker state and consecutive failure count
+func (b *circuitBreaker) state() (string, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.failures < b.threshold:
+		return breakerClosed, b.failures
+	case b.probing || time.Since(b.openedAt) >= b.cooldown:
+		return breakerHalfOpen, b.failures
+	default:
+		return breakerOpen, b.failures
+	}
+}
@@ -0,0 +1,139 @@
+package caddy2_radius_auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/wxccs/caddy2-radius-auth/internal/testradius"
+	"layeh.com/radius"
+)
+
+// newBypassRequest returns a request for target with the HTTP placeholders
+// bypass_if expressions may use, and Basic Auth credentials if user is set
+func newBypassRequest(method, target, user string) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+	if user != "" {
+		req.SetBasicAuth(user, "password")
+	}
+	repl := caddyhttp.NewTestReplacer(req)
+	ctx := context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl)
+	ctx = context.WithValue(ctx, caddyhttp.VarsCtxKey, map[string]any{})
+	return req.WithContext(ctx)
+}
+
+func TestBypassIf(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+	r := &HTTPRadiusAuth{
+		Servers:  []string{mock.Addr()},
+		Secret:   testradius.Secret,
+		BypassIf: "method('OPTIONS') || path('/health')",
+	}
+	provision(t, r)
+
+	for _, tc := range []struct {
+		method, target, user string
+		wantOK               bool
+		wantUser             string
+	}{
+		{http.MethodGet, "/health", "", true, "__bypass__"},
+		{http.MethodOptions, "/app", "", true, "__bypass__"},
+		{http.MethodGet, "/app", "", false, ""},
+		{http.MethodGet, "/app", "alice", true, "alice"},
+	} {
+		req := newBypassRequest(tc.method, tc.target, tc.user)
+		user, ok, err := r.Authenticate(httptest.NewRecorder(), req)
+		if err != nil || ok != tc.wantOK || user.ID != tc.wantUser {
+			t.Errorf("%s %s as %q: got %q, %v, %v, want %q, %v", tc.method, tc.target, tc.user,
+				user.ID, ok, err, tc.wantUser, tc.wantOK)
+		}
+	}
+
+	// Only alice's request reached RADIUS
+	if n := mock.RequestCount(); n != 1 {
+		t.Errorf("RADIUS received %d requests, want 1", n)
+	}
+}
+
+func TestBypassIfFailsClosed(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessReject})
+	r := &HTTPRadiusAuth{
+		Servers:  []string{mock.Addr()},
+		Secret:   testradius.Secret,
+		BypassIf: "int({http.request.uri.query.n}) > 0",
+	}
+	provision(t, r)
+
+	if _, ok, _ := r.Authenticate(httptest.NewRecorder(), newBypassRequest(http.MethodGet, "/?n=1", "")); !ok {
+		t.Error("matching request was not bypassed")
+	}
+
+	// int() fails on a non-number, and the request must be authenticated
+	for _, user := range []string{"", "alice"} {
+		w := httptest.NewRecorder()
+		_, ok, err := r.Authenticate(w, newBypassRequest(http.MethodGet, "/?n=abc", user))
+		if ok || err != nil {
+			t.Errorf("as %q: got ok %v, err %v after the expression failed, want a refusal", user, ok, err)
+		}
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("as %q: status = %d, want %d", user, w.Code, http.StatusUnauthorized)
+		}
+	}
+	if n := mock.RequestCount(); n != 1 {
+		t.Errorf("RADIUS received %d requests, want 1 for alice", n)
+	}
+}
+
+func TestBypassIfInvalid(t *testing.T) {
+	r := &HTTPRadiusAuth{
+		Servers:  []string{"127.0.0.1:1812"},
+		Secret:   testradius.Secret,
+		BypassIf: "path(",
+	}
+	if err := r.Provision(newTestContext(t)); err == nil {
+		r.Cleanup()
+		t.Error("Provision accepted an invalid bypass_if expression")
+	}
+}
+
+func TestBypassIfCaddyfile(t *testing.T) {
+	for _, tc := range []struct {
+		directive string
+		want      string
+	}{
+		{`bypass_if path /health /static/*`, `path('/health', '/static/*')`},
+		{`bypass_if method OPTIONS`, `method('OPTIONS')`},
+		{`bypass_if "method('OPTIONS') || path('/health')"`, `method('OPTIONS') || path('/health')`},
+		{`bypass_if path /it's`, `path('/it\'s')`},
+	} {
+		raw := parseToJSON(t, `radius_auth 10.0.0.1:1812 s3cret {
+			`+tc.directive+`
+		}`)
+		var ra HTTPRadiusAuth
+		if err := json.Unmarshal(raw, &ra); err != nil {
+			t.Fatal(err)
+		}
+		if ra.BypassIf != tc.want {
+			t.Errorf("%s: got expression %q, want %q", tc.directive, ra.BypassIf, tc.want)
+		}
+	}
+
+	// The shorthand compiles and matches
+	raw := parseToJSON(t, `radius_auth 127.0.0.1:1812 s3cret {
+		bypass_if path /health /static/*
+	}`)
+	var r HTTPRadiusAuth
+	if err := json.Unmarshal(raw, &r); err != nil {
+		t.Fatal(err)
+	}
+	provision(t, &r)
+	for target, want := range map[string]bool{"/static/app.js": true, "/health": true, "/app": false} {
+		if _, ok, _ := r.Authenticate(httptest.NewRecorder(), newBypassRequest(http.MethodGet, target, "")); ok != want {
+			t.Errorf("%s: bypassed = %v, want %v", target, ok, want)
+		}
+	}
+}
@@ -0,0 +1,484 @@
+package caddy2_radius_auth
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// Cache backends
+const (
+	cacheBackendMemory = "memory"
+	cacheBackendRedis  = "redis"
+)
+
+// cachedSession is a cached authentication result. The reply attributes of
+// an accept are kept so cache hits can still export them.
+type cachedSession struct {
+	Allowed    bool                `json:"allowed"`
+	Attributes map[string][]string `json:"attributes,omitempty"`
+}
+
+// cacheProvider stores authentication results keyed by credential HMAC
+type cacheProvider interface {
+	// Get returns the cached result for key and whether one was found
+	Get(key string) (session cachedSession, found bool)
+	// Set caches the result for key with the provider's TTL, or with maxTTL
+	// if it is positive and shorter
+	Set(key string, session cachedSession, maxTTL time.Duration)
+	// Delete removes key and reports whether it was present
+	Delete(key string) bool
+	// Flush removes every entry and returns how many were removed
+	Flush() int
+}
+
+// ttlEntry is a value in a ttlCache with its expiry time
+type ttlEntry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+// ttlCache is a size-bounded LRU whose entries expire after a fixed TTL.
+// Expired entries are dropped when read or pushed out by newer ones, so
+// unlike expirable.LRU it needs no background goroutine that would outlive
+// the module on a config reload.
+type ttlCache[V any] struct {
+	c   *lru.Cache[string, ttlEntry[V]]
+	ttl time.Duration
+}
+
+// newTTLCache creates a cache holding at most maxSize entries; onEvicted,
+// if not nil, is called with every entry that expires, is pushed out or is
+// removed
+func newTTLCache[V any](ttl time.Duration, maxSize int, onEvicted func(key string, value V)) *ttlCache[V] {
+	var evict func(string, ttlEntry[V])
+	if onEvicted != nil {
+		evict = func(key string, e ttlEntry[V]) { onEvicted(key, e.value) }
+	}
+	// A size that is not positive, the only error NewWithEvict returns, is
+	// refused by Validate, which runs after the caches are built
+	c, _ := lru.NewWithEvict(max(maxSize, 1), evict)
+	return &ttlCache[V]{c: c, ttl: ttl}
+}
+
+func (t *ttlCache[V]) Get(key string) (V, bool) {
+	e, ok := t.c.Get(key)
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	if time.Now().After(e.expires) {
+		t.c.Remove(key)
+		var zero V
+		return zero, false
+	}
+	return e.value, true
+}
+
+func (t *ttlCache[V]) Add(key string, value V) {
+	t.AddWithTTL(key, value, t.ttl)
+}
+
+// AddWithTTL adds value with its own TTL instead of the cache's
+func (t *ttlCache[V]) AddWithTTL(key string, value V, ttl time.Duration) {
+	t.c.Add(key, ttlEntry[V]{value: value, expires: time.Now().Add(ttl)})
+}
+
+func (t *ttlCache[V]) Remove(key string) bool {
+	return t.c.Remove(key)
+}
+
+// removeOldest removes the least recently used entry
+func (t *ttlCache[V]) removeOldest() {
+	t.c.RemoveOldest()
+}
+
+func (t *ttlCache[V]) Len() int {
+	return t.c.Len()
+}
+
+func (t *ttlCache[V]) Purge() {
+	t.c.Purge()
+}
+
+// each calls fn for every unexpired entry, least recently used first
+func (t *ttlCache[V]) each(fn func(key string, value V, expires time.Time)) {
+	now := time.Now()
+	for _, key := range t.c.Keys() {
+		if e, ok := t.c.Peek(key); ok && now.Before(e.expires) {
+			fn(key, e.value, e.expires)
+		}
+	}
+}
+
+// addUntil adds value with a fixed expiry time, capped at the cache's TTL
+func (t *ttlCache[V]) addUntil(key string, value V, expires time.Time) {
+	if limit := time.Now().Add(t.ttl); expires.After(limit) {
+		expires = limit
+	}
+	t.c.Add(key, ttlEntry[V]{value: value, expires: expires})
+}
+
+// memoryCache is a per-process cacheProvider backed by a size-bounded LRU,
+// so a flood of distinct credentials cannot grow it without limit
+type memoryCache struct {
+	c        *ttlCache[cachedSession]
+	maxBytes int64        // Limit on the estimated size, 0 for none
+	bytes    atomic.Int64 // Estimated size of the entries
+	mu       sync.Mutex   // Serializes writes so bytes matches the entries
+	logger   *zap.Logger
+}
+
+// newMemoryCache creates an in-memory cache holding at most maxSize entries
+// and, if maxBytes is positive, at most about maxBytes of keys and values;
+// onEvicted is called with the key of every entry that expires, is pushed
+// out or is deleted
+func newMemoryCache(ttl time.Duration, maxSize int, maxBytes int64, logger *zap.Logger, onEvicted func(key string)) *memoryCache {
+	m := &memoryCache{maxBytes: maxBytes, logger: logger}
+	m.c = newTTLCache(ttl, maxSize, func(key string, session cachedSession) {
+		m.bytes.Add(-entrySize(key, session))
+		if onEvicted != nil {
+			onEvicted(key)
+		}
+	})
+	return m
+}
+
+// entrySize estimates the memory held by a cache entry: its strings plus a
+// fixed allowance for the LRU bookkeeping around them
+func entrySize(key string, session cachedSession) int64 {
+	const overhead = 128
+	size := int64(overhead + len(key))
+	for name, values := range session.Attributes {
+		size += int64(len(name))
+		for _, v := range values {
+			size += int64(len(v)) + 16
+		}
+	}
+	return size
+}
+
+func (m *memoryCache) Get(key string) (cachedSession, bool) {
+	return m.c.Get(key)
+}
+
+func (m *memoryCache) Set(key string, session cachedSession, maxTTL time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.makeRoom(key, entrySize(key, session))
+	m.c.AddWithTTL(key, session, capTTL(m.c.ttl, maxTTL))
+}
+
+// makeRoom removes any entry for key, shrinks the cache until size more
+// bytes fit and accounts for them. Replacing an entry does not call the
+// eviction callback, so the old one is removed first and its size is
+// subtracted exactly once, whether or not shrink would have pushed it out.
+// Callers hold m.mu.
+func (m *memoryCache) makeRoom(key string, size int64) {
+	m.c.Remove(key)
+	if m.maxBytes > 0 && m.bytes.Load()+size > m.maxBytes {
+		m.shrink(size)
+	}
+	m.bytes.Add(size)
+}
+
+// shrink evicts the least recently used tenth of the entries, repeatedly if
+// needed, until an entry of the given size fits within maxBytes
+func (m *memoryCache) shrink(size int64) {
+	evicted := 0
+	for m.c.Len() > 0 && m.bytes.Load()+size > m.maxBytes {
+		n := max(m.c.Len()/10, 1)
+		for range n {
+			m.c.removeOldest()
+		}
+		evicted += n
+	}
+	m.logger.Warn("memory cache reached max_cache_memory_mb; evicted oldest entries",
+		zap.Int("evicted", evicted),
+		zap.Int64("max_bytes", m.maxBytes))
+}
+
+func (m *memoryCache) Delete(key string) bool {
+	return m.c.Remove(key)
+}
+
+func (m *memoryCache) Flush() int {
+	n := m.c.Len()
+	m.c.Purge()
+	return n
+}
+
+// redisCache is a cacheProvider shared between Caddy instances through Redis.
+// Results are stored as JSON-encoded cachedSession values.
+type redisCache struct {
+	client  *redis.Client
+	prefix  string
+	ttl     time.Duration
+	timeout time.Duration
+	logger  *zap.Logger
+}
+
+func (c *redisCache) Get(key string) (cachedSession, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	val, err := c.client.Get(ctx, c.prefix+key).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			c.logger.Warn("redis cache lookup failed", zap.Error(err))
+		}
+		return cachedSession{}, false
+	}
+	var session cachedSession
+	if err := json.Unmarshal(val, &session); err != nil {
+		// Written by an older version or another application; treat as a miss
+		c.logger.Warn("decoding redis cache entry failed", zap.Error(err))
+		return cachedSession{}, false
+	}
+	return session, true
+}
+
+func (c *redisCache) Set(key string, session cachedSession, maxTTL time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	val, err := json.Marshal(session)
+	if err != nil {
+		c.logger.Warn("encoding redis cache entry failed", zap.Error(err))
+		return
+	}
+	if err := c.client.Set(ctx, c.prefix+key, val, capTTL(c.ttl, maxTTL)).Err(); err != nil {
+		c.logger.Warn("redis cache write failed", zap.Error(err))
+	}
+}
+
+func (c *redisCache) Delete(key string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	n, err := c.client.Del(ctx, c.prefix+key).Result()
+	if err != nil {
+		c.logger.Warn("redis cache delete failed", zap.Error(err))
+	}
+	return n > 0
+}
+
+func (c *redisCache) Flush() int {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	evicted := 0
+	iter := c.client.Scan(ctx, 0, c.prefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		n, err := c.client.Del(ctx, iter.Val()).Result()
+		if err != nil {
+			c.logger.Warn("redis cache delete failed", zap.Error(err))
+			continue
+		}
+		evicted += int(n)
+	}
+	if err := iter.Err(); err != nil {
+		c.logger.Warn("redis cache scan failed", zap.Error(err))
+	}
+	return evicted
+}
+
+// capTTL returns ttl, lowered to maxTTL if that is positive and shorter
+func capTTL(ttl, maxTTL time.Duration) time.Duration {
+	if maxTTL > 0 && maxTTL < ttl {
+		return maxTTL
+	}
+	return ttl
+}
+
+// newCacheProvider creates a cache for the configured backend. prefix
+// separates the positive and negative caches within a shared Redis.
+func (r *HTTPRadiusAuth) newCacheProvider(ttl time.Duration, prefix string) cacheProvider {
+	if r.CacheBackend == cacheBackendRedis {
+		timeout, _ := time.ParseDuration(r.Timeout)
+		return &redisCache{
+			client:  r.redisClient,
+			prefix:  "radius_auth:" + prefix + ":",
+			ttl:     ttl,
+			timeout: timeout,
+			logger:  r.logger,
+		}
+	}
+	return newMemoryCache(ttl, r.CacheMaxSize, int64(r.MaxCacheMemoryMB)<<20, r.logger, r.cacheIndex.remove)
+}
+
+// usernameIndex maps usernames to the cache keys stored for them. Cache keys
+// are HMACs of the credentials, so without it entries could not be found by
+// username when an operator needs to evict them.
+type usernameIndex struct {
+	mu    sync.RWMutex
+	keys  map[string][]string // username -> cache keys, oldest first
+	users map[string]string   // cache key -> username
+	limit int                 // Maximum keys per username, 0 for unlimited
+
+	// The memory cache reports its evictions through remove; Redis expires
+	// keys on its own, so for it the index forgets its oldest keys beyond
+	// maxKeys instead
+	maxKeys int
+	order   []string // Keys oldest first, possibly already removed; nil when maxKeys is 0
+}
+
+// newUsernameIndex creates an index keeping at most limit keys per
+// username and maxKeys keys in total, 0 meaning any number
+func newUsernameIndex(limit, maxKeys int) *usernameIndex {
+	return &usernameIndex{
+		keys:    make(map[string][]string),
+		users:   make(map[string]string),
+		limit:   limit,
+		maxKeys: maxKeys,
+	}
+}
+
+// add records that key was cached for username. If that takes username
+// over the limit, its oldest keys are forgotten and returned so the caller
+// can evict them.
+func (i *usernameIndex) add(username, key string) (evicted []string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if _, ok := i.users[key]; ok {
+		return nil
+	}
+	i.users[key] = username
+	keys := append(i.keys[username], key)
+	if i.limit > 0 && len(keys) > i.limit {
+		evicted = slices.Clone(keys[:len(keys)-i.limit])
+		keys = slices.Delete(keys, 0, len(evicted))
+		for _, k := range evicted {
+			delete(i.users, k)
+		}
+	}
+	i.keys[username] = keys
+	if i.maxKeys > 0 {
+		i.order = append(i.order, key)
+		i.trim()
+	}
+	return evicted
+}
+
+// trim forgets the oldest keys beyond maxKeys. Their cache entries are
+// left to expire.
+func (i *usernameIndex) trim() {
+	for len(i.users) > i.maxKeys {
+		oldest := i.order[0]
+		i.order = i.order[1:]
+		i.removeLocked(oldest)
+	}
+	// Drop keys removed by other means once they make up half the queue
+	if len(i.order) > 2*i.maxKeys {
+		i.order = slices.DeleteFunc(i.order, func(k string) bool {
+			_, ok := i.users[k]
+			return !ok
+		})
+	}
+}
+
+// remove forgets key, typically after the cache evicted it
+func (i *usernameIndex) remove(key string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.removeLocked(key)
+}
+
+func (i *usernameIndex) removeLocked(key string) {
+	username, ok := i.users[key]
+	if !ok {
+		return
+	}
+	delete(i.users, key)
+	keys := slices.DeleteFunc(i.keys[username], func(k string) bool { return k == key })
+	if len(keys) == 0 {
+		delete(i.keys, username)
+	} else {
+		i.keys[username] = keys
+	}
+}
+
+// take removes and returns every key recorded for username
+func (i *usernameIndex) take(username string) []string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	keys := i.keys[username]
+	delete(i.keys, username)
+	for _, key := range keys {
+		delete(i.users, key)
+	}
+	return keys
+}
+
+// username returns the username key was cached for
+func (i *usernameIndex) username(key string) (string, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	username, ok := i.users[key]
+	return username, ok
+}
+
+// reset forgets every key
+func (i *usernameIndex) reset() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.keys = make(map[string][]string)
+	i.users = make(map[string]string)
+	i.order = nil
+}
+
+// recordCacheKey indexes key under username and evicts the user's oldest
+// results beyond MaxCacheEntriesPerUser, so one account cannot fill the
+// cache with wrong passwords
+func (r *HTTPRadiusAuth) recordCacheKey(username, key string) {
+	for _, old := range r.cacheIndex.add(username, key) {
+		if r.cache != nil {
+			r.cache.Delete(old)
+		}
+		if r.negativeCache != nil {
+			r.negativeCache.Delete(old)
+		}
+	}
+}
+
+// evictUser removes every cached result for username and returns how many
+// entries were removed
+func (r *HTTPRadiusAuth) evictUser(username string) int {
+	evicted := 0
+	for _, key := range r.cacheIndex.take(r.UsernameTransform.apply(username)) {
+		if r.cache != nil && r.cache.Delete(key) {
+			evicted++
+		}
+		if r.negativeCache != nil && r.negativeCache.Delete(key) {
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// bumpCacheVersion switches to the next cache key version, orphaning every
+// cached result of this instance, and returns the new version
+func (r *HTTPRadiusAuth) bumpCacheVersion() int64 {
+	v := r.cacheVersion.Add(1)
+	// The old entries can never be hit again; free them now where possible
+	if r.CacheBackend != cacheBackendRedis {
+		r.flushCache()
+	}
+	return v
+}
+
+// flushCache removes every cached result and returns how many entries were removed
+func (r *HTTPRadiusAuth) flushCache() int {
+	evicted := 0
+	if r.cache != nil {
+		evicted += r.cache.Flush()
+	}
+	if r.negativeCache != nil {
+		evicted += r.negativeCache.Flush()
+	}
+	r.cacheIndex.reset()
+	return evicted
+}
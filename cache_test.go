@@ -0,0 +1,870 @@
+package caddy2_radius_auth
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	gocache "github.com/patrickmn/go-cache"
+	"github.com/wxccs/caddy2-radius-auth/internal/testradius"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+// fakeRedis is a minimal in-process Redis speaking enough RESP2 for the
+// commands the redis cache and coordination backends use
+type fakeRedis struct {
+	mu          sync.Mutex
+	values      map[string]string
+	expires     map[string]time.Time
+	subscribers map[string][]*fakeRedisConn // channel -> subscribed connections
+	setNX       int                         // SET NX commands received
+}
+
+// fakeRedisConn serializes writes to a client connection, which PUBLISH on
+// another connection writes to as well
+type fakeRedisConn struct {
+	mu sync.Mutex
+	net.Conn
+}
+
+func (c *fakeRedisConn) write(reply string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := io.WriteString(c.Conn, reply)
+	return err
+}
+
+// startFakeRedis starts a fakeRedis on a loopback port
+func startFakeRedis(tb testing.TB) (*fakeRedis, string) {
+	tb.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { ln.Close() })
+
+	f := &fakeRedis{
+		values:      make(map[string]string),
+		expires:     make(map[string]time.Time),
+		subscribers: make(map[string][]*fakeRedisConn),
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f, ln.Addr().String()
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	c := &fakeRedisConn{Conn: conn}
+	defer f.unsubscribe(c)
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(rd)
+		if err != nil {
+			return
+		}
+		if err := c.write(f.exec(c, args)); err != nil {
+			return
+		}
+	}
+}
+
+// unsubscribe removes c from every channel
+func (f *fakeRedis) unsubscribe(c *fakeRedisConn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for channel, conns := range f.subscribers {
+		f.subscribers[channel] = slices.DeleteFunc(conns, func(sub *fakeRedisConn) bool { return sub == c })
+	}
+}
+
+// readCommand reads one RESP array of bulk strings
+func readCommand(rd *bufio.Reader) ([]string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func (f *fakeRedis) exec(c *fakeRedisConn, args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		if f.subscribed(c) {
+			return "*2\r\n" + bulk("pong") + bulk("")
+		}
+		return "+PONG\r\n"
+	case "GET":
+		val, ok := f.lookup(args[1])
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulk(val)
+	case "SET":
+		if slices.ContainsFunc(args[3:], func(arg string) bool { return strings.EqualFold(arg, "NX") }) {
+			f.setNX++
+			if _, ok := f.lookup(args[1]); ok {
+				return "$-1\r\n"
+			}
+		}
+		f.values[args[1]] = args[2]
+		delete(f.expires, args[1])
+		for i := 3; i+1 < len(args); i += 2 {
+			n, _ := strconv.Atoi(args[i+1])
+			switch strings.ToUpper(args[i]) {
+			case "EX":
+				f.expires[args[1]] = time.Now().Add(time.Duration(n) * time.Second)
+			case "PX":
+				f.expires[args[1]] = time.Now().Add(time.Duration(n) * time.Millisecond)
+			}
+		}
+		return "+OK\r\n"
+	case "DEL":
+		n := 0
+		for _, key := range args[1:] {
+			if _, ok := f.lookup(key); ok {
+				delete(f.values, key)
+				delete(f.expires, key)
+				n++
+			}
+		}
+		return ":" + strconv.Itoa(n) + "\r\n"
+	case "SCAN":
+		pattern := "*"
+		for i := 2; i+1 < len(args); i += 2 {
+			if strings.ToUpper(args[i]) == "MATCH" {
+				pattern = args[i+1]
+			}
+		}
+		var keys []string
+		for key := range f.values {
+			if _, ok := f.lookup(key); !ok {
+				continue
+			}
+			if ok, _ := path.Match(pattern, key); ok {
+				keys = append(keys, key)
+			}
+		}
+		reply := "*2\r\n" + bulk("0") + "*" + strconv.Itoa(len(keys)) + "\r\n"
+		for _, key := range keys {
+			reply += bulk(key)
+		}
+		return reply
+	case "EVALSHA":
+		// Scripts are only run by source, as clients do after NOSCRIPT
+		return "-NOSCRIPT No matching script.\r\n"
+	case "EVAL":
+		// The only script in use is releaseLock: DEL KEYS[1] if it holds
+		// ARGV[1]
+		if val, ok := f.lookup(args[3]); ok && val == args[4] {
+			delete(f.values, args[3])
+			delete(f.expires, args[3])
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "SUBSCRIBE":
+		var reply string
+		for _, channel := range args[1:] {
+			f.subscribers[channel] = append(f.subscribers[channel], c)
+			reply += "*3\r\n" + bulk("subscribe") + bulk(channel) + ":1\r\n"
+		}
+		return reply
+	case "PUBLISH":
+		conns := f.subscribers[args[1]]
+		for _, sub := range conns {
+			go sub.write("*3\r\n" + bulk("message") + bulk(args[1]) + bulk(args[2]))
+		}
+		return ":" + strconv.Itoa(len(conns)) + "\r\n"
+	default:
+		return "-ERR unknown command '" + args[0] + "'\r\n"
+	}
+}
+
+// subscribed reports whether c has subscribed to a channel
+func (f *fakeRedis) subscribed(c *fakeRedisConn) bool {
+	for _, conns := range f.subscribers {
+		if slices.Contains(conns, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// subscriberCount returns the number of connections subscribed to channel
+func (f *fakeRedis) subscriberCount(channel string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.subscribers[channel])
+}
+
+// setNXCount returns the number of SET NX commands received
+func (f *fakeRedis) setNXCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.setNX
+}
+
+// get returns the live value of key
+func (f *fakeRedis) get(key string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lookup(key)
+}
+
+// set stores value under key without expiry, as another client would
+func (f *fakeRedis) set(key, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.values[key] = value
+	delete(f.expires, key)
+}
+
+// lookup returns the value of key, dropping it if it has expired
+func (f *fakeRedis) lookup(key string) (string, bool) {
+	if exp, ok := f.expires[key]; ok && time.Now().After(exp) {
+		delete(f.values, key)
+		delete(f.expires, key)
+		return "", false
+	}
+	val, ok := f.values[key]
+	return val, ok
+}
+
+// keys returns the number of live keys
+func (f *fakeRedis) keys() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for key := range f.values {
+		if _, ok := f.lookup(key); ok {
+			n++
+		}
+	}
+	return n
+}
+
+func bulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+func TestMemoryCache(t *testing.T) {
+	testCacheProvider(t, newMemoryCache(time.Minute, 100, 0, zap.NewNop(), nil))
+}
+
+func TestMemoryCacheMaxSize(t *testing.T) {
+	var evicted []string
+	c := newMemoryCache(time.Minute, 2, 0, zap.NewNop(), func(key string) { evicted = append(evicted, key) })
+
+	c.Set("first", cachedSession{Allowed: true}, 0)
+	c.Set("second", cachedSession{Allowed: true}, 0)
+	c.Get("first") // mark first as recently used
+	c.Set("third", cachedSession{Allowed: true}, 0)
+
+	if _, found := c.Get("second"); found {
+		t.Error("least recently used entry was not evicted")
+	}
+	for _, key := range []string{"first", "third"} {
+		if _, found := c.Get(key); !found {
+			t.Errorf("%s was evicted", key)
+		}
+	}
+	if len(evicted) != 1 || evicted[0] != "second" {
+		t.Errorf("eviction callback saw %q, want [second]", evicted)
+	}
+}
+
+// cacheSink keeps the benchmarked cache reachable while its heap is measured
+var cacheSink any
+
+// BenchmarkCacheMemory compares the heap held by 100k distinct entries in the
+// bounded LRU against the unbounded go-cache it replaced
+func BenchmarkCacheMemory(b *testing.B) {
+	const entries = 100_000
+	r := HTTPRadiusAuth{cacheKeySecret: []byte("benchmark"), cacheVersion: new(atomic.Int64)}
+	keys := make([]string, entries)
+	for i := range keys {
+		keys[i] = r.cacheKey(fmt.Sprintf("user%d", i), "password", "")
+	}
+
+	for _, tc := range []struct {
+		name string
+		fill func() any
+	}{
+		{"go-cache", func() any {
+			c := gocache.New(time.Minute, 0)
+			for _, key := range keys {
+				c.SetDefault(key, true)
+			}
+			return c
+		}},
+		{"lru", func() any {
+			c := newMemoryCache(time.Minute, 10000, 0, zap.NewNop(), nil)
+			for _, key := range keys {
+				c.Set(key, cachedSession{Allowed: true}, 0)
+			}
+			return c
+		}},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			var heap uint64
+			for i := 0; i < b.N; i++ {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				cacheSink = tc.fill()
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				cacheSink = nil
+				if after.HeapAlloc > before.HeapAlloc {
+					heap += after.HeapAlloc - before.HeapAlloc
+				}
+			}
+			b.ReportMetric(float64(heap)/float64(b.N), "heap-bytes/op")
+		})
+	}
+}
+
+func TestRedisCache(t *testing.T) {
+	_, addr := startFakeRedis(t)
+	r := &HTTPRadiusAuth{
+		Servers:        []string{"127.0.0.1:1812"},
+		Secret:         testradius.Secret,
+		CacheTTL:       "1m",
+		CacheKeySecret: "key secret",
+		CacheBackend:   cacheBackendRedis,
+		RedisAddr:      addr,
+	}
+	provision(t, r)
+	testCacheProvider(t, r.cache)
+}
+
+// testCacheProvider exercises the behaviour every cacheProvider must share
+func testCacheProvider(t *testing.T, c cacheProvider) {
+	t.Helper()
+
+	if _, found := c.Get("missing"); found {
+		t.Error("Get found a key that was never set")
+	}
+
+	accepted := cachedSession{
+		Allowed:    true,
+		Attributes: map[string][]string{"Filter-Id": {"admins", "staff"}},
+	}
+	c.Set("accepted", accepted, 0)
+	c.Set("rejected", cachedSession{}, 0)
+	if session, found := c.Get("accepted"); !found || !reflect.DeepEqual(session, accepted) {
+		t.Errorf("Get(accepted) = %+v, %v, want %+v, true", session, found, accepted)
+	}
+	if session, found := c.Get("rejected"); !found || session.Allowed {
+		t.Errorf("Get(rejected) = %+v, %v, want a reject", session, found)
+	}
+
+	if !c.Delete("accepted") {
+		t.Error("Delete(accepted) reported no entry")
+	}
+	if c.Delete("accepted") {
+		t.Error("Delete(accepted) reported an entry after it was deleted")
+	}
+	if _, found := c.Get("accepted"); found {
+		t.Error("Get found a deleted key")
+	}
+
+	c.Set("another", cachedSession{Allowed: true}, 0)
+	if n := c.Flush(); n != 2 {
+		t.Errorf("Flush removed %d entries, want 2", n)
+	}
+	if _, found := c.Get("rejected"); found {
+		t.Error("Get found a key after Flush")
+	}
+
+	c.Set("short", cachedSession{Allowed: true}, 50*time.Millisecond)
+	if _, found := c.Get("short"); !found {
+		t.Error("Get did not find a key set with a shorter TTL")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, found := c.Get("short"); found {
+		t.Error("Get found a key after its shorter TTL passed")
+	}
+}
+
+func TestAuthenticateRedisCache(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+	redisServer, redisAddr := startFakeRedis(t)
+
+	// Two instances sharing one Redis stand in for a multi-instance deployment
+	newInstance := func() *HTTPRadiusAuth {
+		r := &HTTPRadiusAuth{
+			Servers:        []string{mock.Addr()},
+			Secret:         testradius.Secret,
+			CacheTTL:       "1m",
+			CacheKeySecret: "shared key secret",
+			CacheBackend:   cacheBackendRedis,
+			RedisAddr:      redisAddr,
+		}
+		provision(t, r)
+		return r
+	}
+	first, second := newInstance(), newInstance()
+
+	for _, r := range []*HTTPRadiusAuth{first, second, first} {
+		req, _ := newCaddyRequest("alice", "password")
+		if _, ok, err := r.Authenticate(httptest.NewRecorder(), req); !ok || err != nil {
+			t.Fatalf("Authenticate = %v, %v", ok, err)
+		}
+	}
+
+	if n := mock.RequestCount(); n != 1 {
+		t.Errorf("RADIUS was called %d times, want 1", n)
+	}
+	if n := redisServer.keys(); n != 1 {
+		t.Errorf("redis holds %d keys, want 1", n)
+	}
+}
+
+func TestCleanupStopsGoroutines(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+	runtime.GC()
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 10; i++ {
+		r := &HTTPRadiusAuth{
+			Servers:          []string{mock.Addr()},
+			Secret:           testradius.Secret,
+			CacheTTL:         "5m",
+			NegativeCacheTTL: "1m",
+		}
+		if err := r.Provision(newTestContext(t)); err != nil {
+			t.Fatalf("Provision: %v", err)
+		}
+		req, _ := newCaddyRequest("alice", "password")
+		if _, ok, err := r.Authenticate(httptest.NewRecorder(), req); !ok || err != nil {
+			t.Fatalf("Authenticate = %v, %v", ok, err)
+		}
+		if err := r.Cleanup(); err != nil {
+			t.Fatalf("Cleanup: %v", err)
+		}
+		if n := r.cache.Flush(); n != 0 {
+			t.Errorf("cache holds %d entries after Cleanup, want 0", n)
+		}
+	}
+
+	waitForGoroutines(t, before, time.Second)
+}
+
+func TestCacheRespectsSessionTimeout(t *testing.T) {
+	disabled := false
+	for _, tc := range []struct {
+		name           string
+		sessionTimeout uint32 // 0 leaves the attribute out
+		zeroTimeout    bool
+		respect        *bool
+		wantTTL        time.Duration
+		wantCached     bool
+	}{
+		{name: "no Session-Timeout", wantTTL: time.Hour, wantCached: true},
+		{name: "shorter Session-Timeout", sessionTimeout: 60, wantTTL: time.Minute, wantCached: true},
+		{name: "longer Session-Timeout", sessionTimeout: 7200, wantTTL: time.Hour, wantCached: true},
+		{name: "zero Session-Timeout", zeroTimeout: true},
+		{name: "opted out", sessionTimeout: 60, respect: &disabled, wantTTL: time.Hour, wantCached: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+			mock.SetReply("alice", func(resp *radius.Packet) {
+				if tc.sessionTimeout > 0 || tc.zeroTimeout {
+					rfc2865.SessionTimeout_Set(resp, rfc2865.SessionTimeout(tc.sessionTimeout))
+				}
+			})
+			r := &HTTPRadiusAuth{
+				Servers:               []string{mock.Addr()},
+				Secret:                testradius.Secret,
+				CacheTTL:              "1h",
+				RespectSessionTimeout: tc.respect,
+			}
+			provision(t, r)
+
+			req, _ := newCaddyRequest("alice", "password")
+			if _, ok, err := r.Authenticate(httptest.NewRecorder(), req); !ok || err != nil {
+				t.Fatalf("Authenticate = %v, %v", ok, err)
+			}
+
+			entry, found := r.cache.(*memoryCache).c.c.Peek(r.cacheKey("alice", "password", ""))
+			if found != tc.wantCached {
+				t.Fatalf("accept cached = %v, want %v", found, tc.wantCached)
+			}
+			if !found {
+				return
+			}
+			// Allow for the time the exchange took after the entry was set
+			if ttl := time.Until(entry.expires); ttl > tc.wantTTL || ttl < tc.wantTTL-5*time.Second {
+				t.Errorf("cache TTL = %v, want %v", ttl, tc.wantTTL)
+			}
+		})
+	}
+}
+
+func TestPersistCache(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{
+		"alice": radius.CodeAccessAccept,
+		"bob":   radius.CodeAccessReject,
+	})
+	path := filepath.Join(t.TempDir(), "cache.gob")
+	newAuth := func() *HTTPRadiusAuth {
+		r := &HTTPRadiusAuth{
+			Servers:          []string{mock.Addr()},
+			Secret:           testradius.Secret,
+			CacheTTL:         "1m",
+			NegativeCacheTTL: "1m",
+			CacheKeySecret:   "persist",
+			PersistCachePath: path,
+		}
+		if err := r.Provision(newTestContext(t)); err != nil {
+			t.Fatalf("Provision: %v", err)
+		}
+		return r
+	}
+	authenticate := func(r *HTTPRadiusAuth, user string, want bool) {
+		t.Helper()
+		req, _ := newCaddyRequest(user, "password")
+		if _, ok, _ := r.Authenticate(httptest.NewRecorder(), req); ok != want {
+			t.Errorf("Authenticate(%s) = %v, want %v", user, ok, want)
+		}
+	}
+
+	first := newAuth()
+	authenticate(first, "alice", true)
+	authenticate(first, "bob", false)
+	if err := first.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+
+	second := newAuth()
+	defer second.Cleanup()
+	authenticate(second, "alice", true)
+	authenticate(second, "bob", false)
+	if n := mock.RequestCount(); n != 2 {
+		t.Errorf("RADIUS received %d requests, want 2 from before the restart", n)
+	}
+	// The username index was rebuilt along with the entries
+	if n := second.evictUser("alice"); n != 1 {
+		t.Errorf("evictUser(alice) evicted %d entries, want 1", n)
+	}
+}
+
+func TestPersistCacheSkipsExpired(t *testing.T) {
+	now := time.Now()
+	entries := []persistedEntry{
+		{Key: "live", Username: "alice", Session: cachedSession{Allowed: true}, Expires: now.Add(time.Minute)},
+		{Key: "expired", Username: "bob", Session: cachedSession{Allowed: true}, Expires: now.Add(-time.Second)},
+		{Key: "too-long", Username: "carol", Session: cachedSession{Allowed: true}, Expires: now.Add(time.Hour)},
+	}
+
+	path := filepath.Join(t.TempDir(), "cache.gob")
+	r := &HTTPRadiusAuth{
+		PersistCachePath: path,
+		cache:            newMemoryCache(10*time.Minute, 100, 0, zap.NewNop(), nil),
+		cacheIndex:       newUsernameIndex(0, 0),
+	}
+	r.cache.(*memoryCache).restore(entries, r.recordCacheKey)
+	if err := r.saveCache(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := &HTTPRadiusAuth{
+		PersistCachePath: path,
+		cache:            newMemoryCache(10*time.Minute, 100, 0, zap.NewNop(), nil),
+		cacheIndex:       newUsernameIndex(0, 0),
+	}
+	n, err := restored.loadCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("restored %d entries, want 2", n)
+	}
+	if _, found := restored.cache.Get("expired"); found {
+		t.Error("expired entry was restored")
+	}
+	for _, key := range []string{"live", "too-long"} {
+		if _, found := restored.cache.Get(key); !found {
+			t.Errorf("%s was not restored", key)
+		}
+	}
+	// Entries never outlive the TTL of the cache they are restored into
+	entry, _ := restored.cache.(*memoryCache).c.c.Peek("too-long")
+	if ttl := time.Until(entry.expires); ttl > 10*time.Minute {
+		t.Errorf("too-long expires in %v, want at most 10m", ttl)
+	}
+}
+
+func TestMemoryCacheMaxBytes(t *testing.T) {
+	r := HTTPRadiusAuth{cacheKeySecret: []byte("limit"), cacheVersion: new(atomic.Int64)}
+	key := func(i int) string { return r.cacheKey(fmt.Sprintf("user%d", i), "password", "") }
+	session := cachedSession{Allowed: true}
+	perEntry := entrySize(key(0), session)
+
+	core, logs := observer.New(zapcore.WarnLevel)
+	const fits = 100
+	c := newMemoryCache(time.Minute, 10000, fits*perEntry, zap.New(core), nil)
+
+	for i := 0; i < fits; i++ {
+		c.Set(key(i), session, 0)
+	}
+	if logs.Len() != 0 {
+		t.Fatalf("evicted before the limit was reached: %v", logs.All())
+	}
+
+	c.Set(key(fits), session, 0)
+	if got := c.bytes.Load(); got > fits*perEntry {
+		t.Errorf("cache holds %d bytes, want at most %d", got, fits*perEntry)
+	}
+	// The oldest tenth made room for the new entry
+	if n := c.c.Len(); n != fits-fits/10+1 {
+		t.Errorf("cache holds %d entries, want %d", n, fits-fits/10+1)
+	}
+	for i := 0; i < fits/10; i++ {
+		if _, found := c.Get(key(i)); found {
+			t.Errorf("entry %d was not evicted", i)
+		}
+	}
+	for _, i := range []int{fits / 10, fits} {
+		if _, found := c.Get(key(i)); !found {
+			t.Errorf("entry %d was evicted", i)
+		}
+	}
+	if logs.FilterMessage("memory cache reached max_cache_memory_mb; evicted oldest entries").Len() != 1 {
+		t.Errorf("logged %v, want one eviction warning", logs.All())
+	}
+
+	c.Flush()
+	if got := c.bytes.Load(); got != 0 {
+		t.Errorf("cache accounts for %d bytes after Flush, want 0", got)
+	}
+}
+
+// liveBytes sums the estimated size of the entries c holds
+func liveBytes(c *memoryCache) int64 {
+	var total int64
+	for _, key := range c.c.c.Keys() {
+		if e, ok := c.c.c.Peek(key); ok {
+			total += entrySize(key, e.value)
+		}
+	}
+	return total
+}
+
+func TestMemoryCacheMaxBytesOverwrite(t *testing.T) {
+	small := cachedSession{Allowed: true}
+	large := cachedSession{Allowed: true, Attributes: map[string][]string{"Filter-Id": {strings.Repeat("f", 512)}}}
+	const fits = 20
+	c := newMemoryCache(time.Minute, 10000, fits*entrySize("key00", small), zap.NewNop(), nil)
+	for i := 0; i < fits; i++ {
+		c.Set(fmt.Sprintf("key%02d", i), small, 0)
+	}
+
+	// Overwriting the oldest entry with a larger one at the limit makes
+	// shrink evict entries, the old one among them if it were still there
+	c.Set("key00", large, 0)
+	if got, want := c.bytes.Load(), liveBytes(c); got != want {
+		t.Errorf("cache accounts for %d bytes, entries hold %d", got, want)
+	}
+	if session, found := c.Get("key00"); !found || len(session.Attributes) == 0 {
+		t.Errorf("overwritten entry = %+v, %v, want the new value", session, found)
+	}
+
+	// Concurrent overwrites of the same keys
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				session := small
+				if (g+i)%2 == 0 {
+					session = large
+				}
+				c.Set(fmt.Sprintf("key%02d", i%fits), session, 0)
+			}
+		}()
+	}
+	wg.Wait()
+	if got, want := c.bytes.Load(), liveBytes(c); got != want {
+		t.Errorf("after concurrent overwrites, cache accounts for %d bytes, entries hold %d", got, want)
+	}
+	if got := c.bytes.Load(); got > c.maxBytes {
+		t.Errorf("cache holds %d bytes, want at most %d", got, c.maxBytes)
+	}
+}
+
+func TestMaxCacheEntriesPerUser(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{
+		"alice": radius.CodeAccessAccept,
+		"bob":   radius.CodeAccessAccept,
+	})
+	r := &HTTPRadiusAuth{
+		Servers:                []string{mock.Addr()},
+		Secret:                 testradius.Secret,
+		CacheTTL:               "1m",
+		MaxCacheEntriesPerUser: 2,
+	}
+	provision(t, r)
+
+	authenticate := func(user, pass string) {
+		t.Helper()
+		req, _ := newCaddyRequest(user, pass)
+		if _, ok, err := r.Authenticate(httptest.NewRecorder(), req); !ok || err != nil {
+			t.Fatalf("Authenticate(%s, %s) = %v, %v", user, pass, ok, err)
+		}
+	}
+
+	authenticate("bob", "password")
+	for _, pass := range []string{"one", "two", "three"} {
+		authenticate("alice", pass)
+	}
+	if n := len(r.cacheIndex.keys["alice"]); n != 2 {
+		t.Errorf("alice has %d indexed results, want 2", n)
+	}
+
+	// The oldest result is evicted first; other users keep theirs
+	before := mock.RequestCount()
+	authenticate("alice", "three")
+	authenticate("alice", "two")
+	authenticate("bob", "password")
+	if n := mock.RequestCount() - before; n != 0 {
+		t.Errorf("RADIUS received %d requests for cached results, want 0", n)
+	}
+	authenticate("alice", "one")
+	if n := mock.RequestCount() - before; n != 1 {
+		t.Errorf("RADIUS received %d requests for the evicted result, want 1", n)
+	}
+}
+
+// TestReloadChangesCacheTTL replaces an instance the way a config reload
+// does: the new one is provisioned in a fresh context, then the old one is
+// cleaned up
+func TestReloadChangesCacheTTL(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+	authenticate := func(r *HTTPRadiusAuth) {
+		t.Helper()
+		req, _ := newCaddyRequest("alice", "password")
+		if _, ok, err := r.Authenticate(httptest.NewRecorder(), req); !ok || err != nil {
+			t.Fatalf("Authenticate = %v, %v", ok, err)
+		}
+	}
+
+	oldCtx, cancelOld := caddy.NewContext(caddy.Context{Context: context.Background()})
+	old := &HTTPRadiusAuth{Servers: []string{mock.Addr()}, Secret: testradius.Secret, CacheTTL: "1h"}
+	if err := old.Provision(oldCtx); err != nil {
+		t.Fatal(err)
+	}
+	authenticate(old)
+	authenticate(old)
+	if n := mock.RequestCount(); n != 1 {
+		t.Fatalf("RADIUS received %d requests, want 1", n)
+	}
+
+	newCtx, cancelNew := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancelNew()
+	r := &HTTPRadiusAuth{Servers: []string{mock.Addr()}, Secret: testradius.Secret, CacheTTL: "100ms"}
+	if err := r.Provision(newCtx); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Cleanup()
+	if err := old.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	cancelOld()
+
+	// The new instance starts with its own cache and applies its own TTL
+	authenticate(r)
+	authenticate(r)
+	if n := mock.RequestCount(); n != 2 {
+		t.Fatalf("RADIUS received %d requests, want 2", n)
+	}
+	time.Sleep(150 * time.Millisecond)
+	authenticate(r)
+	if n := mock.RequestCount(); n != 3 {
+		t.Errorf("RADIUS received %d requests, want 3 once the new cache_ttl expired", n)
+	}
+}
+
+func TestUsernameIndexMaxKeys(t *testing.T) {
+	index := newUsernameIndex(0, 3)
+	for i := 0; i < 100; i++ {
+		index.add(fmt.Sprintf("user%d", i%2), fmt.Sprintf("key%d", i))
+		// Keys removed by the caller must not make the queue grow either
+		if i%10 == 0 {
+			index.remove(fmt.Sprintf("key%d", i))
+		}
+	}
+	if n := len(index.users); n != 3 {
+		t.Errorf("index holds %d keys, want 3", n)
+	}
+	if n := len(index.order); n > 6 {
+		t.Errorf("order queue holds %d keys, want at most 6", n)
+	}
+	for _, key := range []string{"key97", "key98", "key99"} {
+		if _, ok := index.username(key); !ok {
+			t.Errorf("newest key %s was forgotten", key)
+		}
+	}
+	if keys := index.take("user1"); !reflect.DeepEqual(keys, []string{"key97", "key99"}) {
+		t.Errorf("user1 keys = %v, want [key97 key99]", keys)
+	}
+}
@@ -1,13 +1,19 @@
 package caddy2_radius_auth
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
@@ -22,80 +28,1249 @@ func init() {
 	// Users will need to specify the order in their Caddyfile if needed:
 	// order radius_auth before basic_auth
 	httpcaddyfile.RegisterDirectiveOrder("radius_auth", httpcaddyfile.Before, "basic_auth")
+
+	// Named settings that several sites can share with `pool <name>`
+	httpcaddyfile.RegisterGlobalOption("radius_auth_pool", parseGlobalPool)
+}
+
+// parseGlobalPool parses a radius_auth_pool global option:
+//
+//	radius_auth_pool <name> {
+//	    servers ...
+//	    secret ...
+//	}
+//
+// Each occurrence adds one named pool to the map kept for the site blocks.
+// The options are checked here but kept as tokens, so that mergePool can
+// combine them with a site block directive by directive.
+func parseGlobalPool(d *caddyfile.Dispenser, existingVal any) (any, error) {
+	pools, ok := existingVal.(map[string][]caddyfile.Segment)
+	if !ok {
+		pools = make(map[string][]caddyfile.Segment)
+	}
+
+	d.Next() // consume option name
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	name := d.Val()
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	if _, dup := pools[name]; dup {
+		return nil, d.Errf("radius_auth_pool %s is already defined", name)
+	}
+
+	segs := blockSegments(d)
+	pool, err := parseRadiusSegments(segs, &HTTPRadiusAuth{})
+	if err != nil {
+		return nil, err
+	}
+	if pool != "" {
+		return nil, d.Errf("radius_auth_pool %s: pools cannot reference other pools", name)
+	}
+	pools[name] = segs
+	return pools, nil
+}
+
+// mergePool returns the site's options followed by every option of the named
+// pool that the site did not set. Options set in the site block always win;
+// when both set a block such as tls, the blocks are merged the same way, so a
+// site can change one setting of the pool's block and keep the rest.
+func mergePool(h httpcaddyfile.Helper, name string, site []caddyfile.Segment) ([]caddyfile.Segment, error) {
+	pools, _ := h.Option("radius_auth_pool").(map[string][]caddyfile.Segment)
+	pool, ok := pools[name]
+	if !ok {
+		return nil, h.Errf("unknown radius_auth_pool: %s", name)
+	}
+	return mergeSegments(site, pool), nil
+}
+
+// mergeSegments appends to site each segment of pool whose option site does
+// not set, and merges the blocks of options both set
+func mergeSegments(site, pool []caddyfile.Segment) []caddyfile.Segment {
+	merged := slices.Clone(site)
+	index := make(map[string]int, len(site))
+	for i, seg := range site {
+		index[segmentKey(seg)] = i
+	}
+	for _, seg := range pool {
+		i, ok := index[segmentKey(seg)]
+		if !ok {
+			merged = append(merged, seg)
+			continue
+		}
+		merged[i] = mergeBlocks(merged[i], seg)
+	}
+	return merged
+}
+
+// mergeBlocks returns site with the block options of pool that site does not
+// set added to its block. The directive line always comes from site.
+func mergeBlocks(site, pool caddyfile.Segment) caddyfile.Segment {
+	poolHead, poolOpts, poolBlock := splitSegment(pool)
+	if !poolBlock {
+		return site
+	}
+	head, opts, block := splitSegment(site)
+	// Braces are taken from the side that has them so that the tokens
+	// keep their positions for line-based parsing
+	open, closing := pool[len(poolHead)], pool[len(pool)-1]
+	if block {
+		open, closing = site[len(head)], site[len(site)-1]
+	}
+
+	out := append(slices.Clone(head), open)
+	for _, opt := range mergeSegments(opts, poolOpts) {
+		out = append(out, opt...)
+	}
+	return append(out, closing)
+}
+
+// splitSegment splits seg into its directive line and the options of the
+// block that follows it, reporting whether there is a block
+func splitSegment(seg caddyfile.Segment) (caddyfile.Segment, []caddyfile.Segment, bool) {
+	d := caddyfile.NewDispenser(seg)
+	d.Next()
+	n := 1
+	for d.NextArg() {
+		n++
+	}
+	opts := blockSegments(d)
+	return seg[:n], opts, n < len(seg)
+}
+
+// segmentKey names the option a segment sets. Options that take a key as
+// their first argument, such as server_secret, are told apart by that key so
+// that a site can add to a pool's map without replacing it.
+func segmentKey(seg caddyfile.Segment) string {
+	name := seg[0].Text
+	switch name {
+	case "server_secret", "server_timeout", "server_weight", "attribute_header",
+		"request_attribute", "claim":
+		if len(seg) > 1 {
+			return name + " " + seg[1].Text
+		}
+	case "realm":
+		// A realm with a block defines a realm; without one it sets the
+		// Basic Auth realm
+		if _, _, block := splitSegment(seg); block && len(seg) > 1 {
+			return name + " " + seg[1].Text
+		}
+	}
+	return name
+}
+
+// blockSegments returns one segment per option in the block that follows the
+// current token, including any nested block
+func blockSegments(d *caddyfile.Dispenser) []caddyfile.Segment {
+	var segs []caddyfile.Segment
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		segs = append(segs, d.NextSegment())
+	}
+	return segs
+}
+
+// inlineSegment makes an option segment from an argument of the one-line
+// form, so that it is parsed and merged like the same option in a block
+func inlineSegment(name string, arg caddyfile.Token) caddyfile.Segment {
+	opt := arg
+	opt.Text = name
+	return caddyfile.Segment{opt, arg}
 }
 
 // parseCaddyfile sets up the HTTPRadiusAuth middleware from Caddyfile configuration.
+// Simple setups can be written on one line:
+//
+//	radius_auth <server:port> <secret> [realm]
+//
+// Settings shared between sites can come from a radius_auth_pool global
+// option with `pool <name>`.
 func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
 	h.Next() // consume directive name
 
+	var segs []caddyfile.Segment
+	if args := h.RemainingArgsAsTokens(); len(args) > 0 {
+		if len(args) > 3 {
+			return nil, h.Err("usage: radius_auth <server:port> <secret> [realm]")
+		}
+		if len(args) < 2 {
+			return nil, h.Err("radius_auth requires a secret after the server address")
+		}
+		segs = append(segs, inlineSegment("servers", args[0]), inlineSegment("secret", args[1]))
+		if len(args) == 3 {
+			segs = append(segs, inlineSegment("realm", args[2]))
+		}
+	}
+	segs = append(segs, blockSegments(h.Dispenser)...)
+
 	var ra HTTPRadiusAuth
+	pool, err := parseRadiusSegments(segs, &ra)
+	if err != nil {
+		return nil, err
+	}
+	if pool != "" {
+		if segs, err = mergePool(h, pool, segs); err != nil {
+			return nil, err
+		}
+		ra = HTTPRadiusAuth{}
+		if _, err := parseRadiusSegments(segs, &ra); err != nil {
+			return nil, err
+		}
+	}
 
-	for h.NextBlock(0) {
-		switch h.Val() {
+	if len(ra.Servers) == 0 && ra.SRVName == "" {
+		return nil, fmt.Errorf("at least one RADIUS server (or srv_name) must be defined")
+	}
+	if ra.Secret == "" && ra.SecretFile == "" && ra.SecretEnv == "" {
+		return nil, fmt.Errorf("radius secret must be set (secret, secret_file or secret_env)")
+	}
+	auth := caddyauth.Authentication{
+		ProvidersRaw: caddy.ModuleMap{
+			"radius_auth": caddyconfig.JSON(ra, nil),
+		},
+	}
+	if ra.Accounting == nil || !ra.Accounting.ByteCounts {
+		return auth, nil
+	}
+	// Response bytes can only be counted by a handler that runs before the
+	// authentication handler and wraps the response writer
+	return &caddyhttp.Subroute{
+		Routes: caddyhttp.RouteList{{
+			HandlersRaw: []json.RawMessage{
+				caddyconfig.JSONModuleObject(ByteCounter{}, "handler", "radius_auth_byte_counter", nil),
+				caddyconfig.JSONModuleObject(auth, "handler", "authentication", nil),
+			},
+		}},
+	}, nil
+}
+
+// parseRadiusBlock reads the options block of a radius_auth directive into
+// ra. It returns the name given to a pool option, if any.
+func parseRadiusBlock(d *caddyfile.Dispenser, ra *HTTPRadiusAuth) (string, error) {
+	return parseRadiusSegments(blockSegments(d), ra)
+}
+
+// parseRadiusSegments reads options into ra, one segment per option as
+// returned by blockSegments. It returns the name given to a pool option, if
+// any.
+func parseRadiusSegments(segs []caddyfile.Segment, ra *HTTPRadiusAuth) (string, error) {
+	var pool string
+	for _, seg := range segs {
+		d := caddyfile.NewDispenser(seg)
+		d.Next()
+		switch d.Val() {
+
+		case "pool":
+			if !d.NextArg() {
+				return "", d.ArgErr()
+			}
+			pool = d.Val()
+			if d.NextArg() {
+				return "", d.ArgErr()
+			}
 
 		case "servers":
-			args := h.RemainingArgs()
+			args := d.RemainingArgs()
 			if len(args) == 0 {
-				return nil, h.Err("servers requires at least one address")
+				return "", d.Err("servers requires at least one address")
 			}
 
 			for _, s := range args {
-				if !strings.Contains(s, ":") {
-					return nil, h.Errf("invalid RADIUS server address: %s (must include port)", s)
+				if err := checkServerAddr(d, s); err != nil {
+					return "", err
 				}
-				host, port, err := net.SplitHostPort(s)
-				if err != nil || host == "" || port == "" {
-					return nil, h.Errf("invalid RADIUS server format: %s", s)
+				if slices.Contains(ra.Servers, s) {
+					return "", d.Errf("duplicate RADIUS server: %s", s)
 				}
 				ra.Servers = append(ra.Servers, s)
 			}
 
+		case "srv_name":
+			if !d.NextArg() {
+				return "", d.Err("srv_name requires an SRV record name")
+			}
+			ra.SRVName = d.Val()
+
+		case "srv_refresh_interval":
+			if !d.NextArg() {
+				return "", d.Err("srv_refresh_interval requires a duration value (e.g. 5m)")
+			}
+			_, err := time.ParseDuration(d.Val())
+			if err != nil {
+				return "", d.Errf("invalid srv_refresh_interval duration: %v", err)
+			}
+			ra.SRVRefreshInterval = d.Val()
+
 		case "secret":
-			if !h.NextArg() {
-				return nil, h.Err("secret requires a value")
+			if !d.NextArg() {
+				return "", d.Err("secret requires a value")
+			}
+			ra.Secret = d.Val()
+
+		case "secret_file":
+			if !d.NextArg() {
+				return "", d.Err("secret_file requires a file path")
+			}
+			ra.SecretFile = d.Val()
+
+		case "secret_env":
+			if !d.NextArg() {
+				return "", d.Err("secret_env requires an environment variable name")
+			}
+			ra.SecretEnv = d.Val()
+
+		case "server_secret":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return "", d.Err("server_secret requires a server address and a secret")
+			}
+			if ra.ServerSecrets == nil {
+				ra.ServerSecrets = make(map[string]string)
+			}
+			ra.ServerSecrets[args[0]] = args[1]
+
+		case "server_timeout":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return "", d.Err("server_timeout requires a server address and a duration")
+			}
+			if _, err := time.ParseDuration(args[1]); err != nil {
+				return "", d.Errf("invalid server_timeout duration: %v", err)
+			}
+			if ra.ServerTimeouts == nil {
+				ra.ServerTimeouts = make(map[string]string)
+			}
+			ra.ServerTimeouts[args[0]] = args[1]
+
+		case "server_weight":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return "", d.Err("server_weight requires a server address and a weight")
+			}
+			weight, err := strconv.Atoi(args[1])
+			if err != nil || weight <= 0 {
+				return "", d.Errf("invalid server_weight: %s", args[1])
 			}
-			ra.Secret = h.Val()
+			if ra.ServerWeights == nil {
+				ra.ServerWeights = make(map[string]int)
+			}
+			ra.ServerWeights[args[0]] = weight
+
+		case "realm_charset":
+			if !d.NextArg() {
+				return "", d.Err("realm_charset requires a value (e.g. UTF-8)")
+			}
+			ra.RealmCharset = d.Val()
 
 		case "realm":
-			if !h.NextArg() {
-				return nil, h.Err("realm requires a value")
+			if !d.NextArg() {
+				return "", d.Err("realm requires a value")
+			}
+			// "realm <name>" sets the Basic Auth realm; with a block it
+			// defines a RADIUS realm with its own servers
+			realm := RealmConfig{Realm: d.Val()}
+			isBlock := false
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				isBlock = true
+				switch d.Val() {
+				case "servers":
+					args := d.RemainingArgs()
+					if len(args) == 0 {
+						return "", d.Err("servers requires at least one address")
+					}
+					realm.Servers = append(realm.Servers, args...)
+				case "secret":
+					if !d.NextArg() {
+						return "", d.Err("secret requires a value")
+					}
+					realm.Secret = d.Val()
+				case "timeout":
+					if !d.NextArg() {
+						return "", d.Err("timeout requires a duration value (e.g. 3s)")
+					}
+					if err := checkDuration(d.Val()); err != nil {
+						return "", d.Errf("invalid timeout duration: %v", err)
+					}
+					realm.Timeout = d.Val()
+				default:
+					return "", d.Errf("unrecognized realm option: %s", d.Val())
+				}
+			}
+			if isBlock {
+				ra.Realms = append(ra.Realms, realm)
+			} else {
+				ra.Realm = realm.Realm
 			}
-			ra.Realm = h.Val()
 
 		case "timeout":
-			if !h.NextArg() {
-				return nil, h.Err("timeout requires a duration value (e.g. 3s)")
+			if !d.NextArg() {
+				return "", d.Err("timeout requires a duration value (e.g. 3s)")
 			}
-			_, err := time.ParseDuration(h.Val())
-			if err != nil {
-				return nil, h.Errf("invalid timeout duration: %v", err)
+			if err := checkDuration(d.Val()); err != nil {
+				return "", d.Errf("invalid timeout duration: %v", err)
+			}
+			ra.Timeout = d.Val()
+
+		case "connect_timeout", "response_timeout":
+			name := d.Val()
+			if !d.NextArg() {
+				return "", d.Errf("%s requires a duration value (e.g. 3s)", name)
+			}
+			if err := checkDuration(d.Val()); err != nil {
+				return "", d.Errf("invalid %s duration: %v", name, err)
+			}
+			if name == "connect_timeout" {
+				ra.ConnectTimeout = d.Val()
+			} else {
+				ra.ResponseTimeout = d.Val()
 			}
-			ra.Timeout = h.Val()
 
 		case "cache_ttl":
-			if !h.NextArg() {
-				return nil, h.Err("cache_ttl requires a duration value (e.g. 300s)")
+			if !d.NextArg() {
+				return "", d.Err("cache_ttl requires a duration value (e.g. 300s)")
+			}
+			if err := checkDuration(d.Val()); err != nil {
+				return "", d.Errf("invalid cache_ttl duration: %v", err)
+			}
+			ra.CacheTTL = d.Val()
+
+		case "negative_cache_ttl":
+			if !d.NextArg() {
+				return "", d.Err("negative_cache_ttl requires a duration value (e.g. 60s)")
+			}
+			_, err := time.ParseDuration(d.Val())
+			if err != nil {
+				return "", d.Errf("invalid negative_cache_ttl duration: %v", err)
+			}
+			ra.NegativeCacheTTL = d.Val()
+
+		case "cache_max_size":
+			if !d.NextArg() {
+				return "", d.Err("cache_max_size requires a number")
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil || n <= 0 {
+				return "", d.Errf("invalid cache_max_size: %s", d.Val())
+			}
+			ra.CacheMaxSize = n
+
+		case "max_cache_entries_per_user":
+			if !d.NextArg() {
+				return "", d.Err("max_cache_entries_per_user requires a number")
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil || n <= 0 {
+				return "", d.Errf("invalid max_cache_entries_per_user: %s", d.Val())
+			}
+			ra.MaxCacheEntriesPerUser = n
+
+		case "max_cache_memory_mb":
+			if !d.NextArg() {
+				return "", d.Err("max_cache_memory_mb requires a number")
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil || n <= 0 {
+				return "", d.Errf("invalid max_cache_memory_mb: %s", d.Val())
+			}
+			ra.MaxCacheMemoryMB = n
+
+		case "cache_backend":
+			if !d.NextArg() {
+				return "", d.Err("cache_backend requires a value (memory or redis)")
+			}
+			switch d.Val() {
+			case "memory", "redis":
+				ra.CacheBackend = d.Val()
+			default:
+				return "", d.Errf("unknown cache_backend: %s", d.Val())
+			}
+
+		case "redis_addr":
+			if !d.NextArg() {
+				return "", d.Err("redis_addr requires an address")
+			}
+			ra.RedisAddr = d.Val()
+
+		case "redis_password":
+			if !d.NextArg() {
+				return "", d.Err("redis_password requires a value")
+			}
+			ra.RedisPassword = d.Val()
+
+		case "coordination_backend":
+			if !d.NextArg() {
+				return "", d.Err("coordination_backend requires a value (redis)")
+			}
+			if d.Val() != coordinationRedis {
+				return "", d.Errf("unknown coordination_backend: %s", d.Val())
+			}
+			ra.CoordinationBackend = d.Val()
+			if d.NextArg() {
+				if _, err := time.ParseDuration(d.Val()); err != nil {
+					return "", d.Errf("invalid coordination_timeout duration: %v", err)
+				}
+				ra.CoordinationTimeout = d.Val()
+			}
+
+		case "persist_cache_path":
+			if !d.NextArg() {
+				return "", d.Err("persist_cache_path requires a file path")
+			}
+			ra.PersistCachePath = d.Val()
+
+		case "cache_key_secret":
+			if !d.NextArg() {
+				return "", d.Err("cache_key_secret requires a value")
+			}
+			ra.CacheKeySecret = d.Val()
+
+		case "cache_key_version":
+			if !d.NextArg() {
+				return "", d.Err("cache_key_version requires a number")
+			}
+			n, err := strconv.ParseInt(d.Val(), 10, 64)
+			if err != nil {
+				return "", d.Errf("invalid cache_key_version: %s", d.Val())
+			}
+			ra.CacheKeyVersion = n
+
+		case "max_concurrent":
+			if !d.NextArg() {
+				return "", d.Err("max_concurrent requires a number")
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil || n < 0 {
+				return "", d.Errf("invalid max_concurrent: %s", d.Val())
+			}
+			ra.MaxConcurrent = n
+
+		case "strategy":
+			if !d.NextArg() {
+				return "", d.Err("strategy requires a value (concurrent, round_robin, failover or weighted_random)")
+			}
+			switch d.Val() {
+			case "concurrent", "round_robin", "failover", "weighted_random":
+				ra.Strategy = d.Val()
+			default:
+				return "", d.Errf("unknown strategy: %s", d.Val())
+			}
+
+		case "quorum_policy":
+			if !d.NextArg() {
+				return "", d.Err("quorum_policy requires a value (any, all or majority)")
+			}
+			switch d.Val() {
+			case "any", "all", "majority":
+				ra.QuorumPolicy = d.Val()
+			default:
+				return "", d.Errf("unknown quorum_policy: %s", d.Val())
+			}
+
+		case "single_flight":
+			enabled, err := parseOnOff(d)
+			if err != nil {
+				return "", err
+			}
+			ra.SingleFlight = &enabled
+
+		case "retry_count":
+			if !d.NextArg() {
+				return "", d.Err("retry_count requires a number")
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil || n < 0 {
+				return "", d.Errf("invalid retry_count: %s", d.Val())
+			}
+			ra.RetryCount = n
+
+		case "retry_delay":
+			if !d.NextArg() {
+				return "", d.Err("retry_delay requires a duration value (e.g. 500ms)")
+			}
+			_, err := time.ParseDuration(d.Val())
+			if err != nil {
+				return "", d.Errf("invalid retry_delay duration: %v", err)
+			}
+			ra.RetryDelay = d.Val()
+
+		case "health_check_interval":
+			if !d.NextArg() {
+				return "", d.Err("health_check_interval requires a duration value (e.g. 30s)")
+			}
+			_, err := time.ParseDuration(d.Val())
+			if err != nil {
+				return "", d.Errf("invalid health_check_interval duration: %v", err)
+			}
+			ra.HealthCheckInterval = d.Val()
+
+		case "breaker_threshold":
+			if !d.NextArg() {
+				return "", d.Err("breaker_threshold requires a number")
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return "", d.Errf("invalid breaker_threshold: %v", err)
+			}
+			ra.BreakerThreshold = n
+
+		case "breaker_cooldown":
+			if !d.NextArg() {
+				return "", d.Err("breaker_cooldown requires a duration value (e.g. 30s)")
+			}
+			_, err := time.ParseDuration(d.Val())
+			if err != nil {
+				return "", d.Errf("invalid breaker_cooldown duration: %v", err)
+			}
+			ra.BreakerCooldown = d.Val()
+
+		case "max_username_length", "max_password_length":
+			name := d.Val()
+			if !d.NextArg() {
+				return "", d.Errf("%s requires a number", name)
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil || n <= 0 {
+				return "", d.Errf("invalid %s: %s", name, d.Val())
+			}
+			if name == "max_username_length" {
+				ra.MaxUsernameLength = n
+			} else {
+				ra.MaxPasswordLength = n
+			}
+
+		case "credential_headers":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return "", d.Err("credential_headers requires a username header and a password header")
 			}
-			_, err := time.ParseDuration(h.Val())
+			ra.CredentialHeaders = &CredentialHeaders{UsernameHeader: args[0], PasswordHeader: args[1]}
+
+		case "attribute_header":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return "", d.Err("attribute_header requires an attribute name and a header name")
+			}
+			if ra.AttributeHeaders == nil {
+				ra.AttributeHeaders = make(map[string]string)
+			}
+			ra.AttributeHeaders[args[0]] = args[1]
+
+		case "role_header":
+			args := d.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return "", d.Err("usage: role_header <header> [attribute]")
+			}
+			ra.RoleHeader = args[0]
+			if len(args) == 2 {
+				ra.RoleAttribute = args[1]
+			}
+
+		case "session_id_header":
+			if !d.NextArg() {
+				return "", d.Err("session_id_header requires a header name")
+			}
+			ra.SessionIDHeader = d.Val()
+
+		case "dictionary":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return "", d.Err("dictionary requires at least one file")
+			}
+			ra.DictionaryFiles = append(ra.DictionaryFiles, args...)
+
+		case "request_attribute":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return "", d.Err("request_attribute requires an attribute name and a header name or placeholder")
+			}
+			if ra.RequestAttributes == nil {
+				ra.RequestAttributes = make(map[string]string)
+			}
+			ra.RequestAttributes[args[0]] = args[1]
+
+		case "ip_allowlist":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return "", d.Err("ip_allowlist requires at least one CIDR")
+			}
+			for _, cidr := range args {
+				if _, _, err := net.ParseCIDR(cidr); err != nil {
+					return "", d.Errf("invalid ip_allowlist entry: %v", err)
+				}
+			}
+			ra.IPAllowList = append(ra.IPAllowList, args...)
+
+		case "bypass_if":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return "", d.Err("usage: bypass_if <expression> | bypass_if <matcher> <args...>")
+			}
+			ra.BypassIf = bypassExpression(args)
+
+		case "trust_forwarded_for":
+			enabled, err := parseOnOff(d)
+			if err != nil {
+				return "", err
+			}
+			ra.TrustForwardedFor = enabled
+
+		case "nas_identifier":
+			if !d.NextArg() {
+				return "", d.Err("nas_identifier requires a value")
+			}
+			ra.NASIdentifier = d.Val()
+
+		case "called_station_id":
+			if !d.NextArg() {
+				return "", d.Err("called_station_id requires a value or placeholder")
+			}
+			ra.CalledStationId = d.Val()
+
+		case "nas_ip_address":
+			if !d.NextArg() {
+				return "", d.Err("nas_ip_address requires an IP address")
+			}
+			if net.ParseIP(d.Val()) == nil {
+				return "", d.Errf("invalid nas_ip_address: %s", d.Val())
+			}
+			ra.NASIPAddress = d.Val()
+
+		case "digest":
+			enabled, err := parseOnOff(d)
+			if err != nil {
+				return "", err
+			}
+			ra.SupportDigest = enabled
+
+		case "access_challenge":
+			enabled, err := parseOnOff(d)
+			if err != nil {
+				return "", err
+			}
+			ra.AccessChallenge = enabled
+
+		case "tracing":
+			enabled, err := parseOnOff(d)
+			if err != nil {
+				return "", err
+			}
+			ra.Tracing = enabled
+
+		case "rate_limit":
+			args := d.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return "", d.Err("usage: rate_limit <max_attempts> [window]")
+			}
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n <= 0 {
+				return "", d.Errf("rate_limit: invalid max_attempts: %s", args[0])
+			}
+			ra.RateLimit = &RateLimitConfig{MaxAttempts: n}
+			if len(args) == 2 {
+				if _, err := time.ParseDuration(args[1]); err != nil {
+					return "", d.Errf("rate_limit: invalid window duration: %v", err)
+				}
+				ra.RateLimit.Window = args[1]
+			}
+
+		case "lockout":
+			args := d.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return "", d.Err("usage: lockout <threshold> [duration]")
+			}
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n <= 0 {
+				return "", d.Errf("lockout: invalid threshold: %s", args[0])
+			}
+			ra.LockoutThreshold = n
+			if len(args) == 2 {
+				if _, err := time.ParseDuration(args[1]); err != nil {
+					return "", d.Errf("lockout: invalid duration: %v", err)
+				}
+				ra.LockoutDuration = args[1]
+			}
+
+		case "respect_session_timeout":
+			enabled, err := parseOnOff(d)
+			if err != nil {
+				return "", err
+			}
+			ra.RespectSessionTimeout = &enabled
+
+		case "audit_log":
+			enabled, err := parseOnOff(d)
+			if err != nil {
+				return "", err
+			}
+			ra.AuditLog = &enabled
+
+		case "dry_run":
+			// Only a literal on/off is accepted, never a placeholder
+			enabled, err := parseOnOff(d)
+			if err != nil {
+				return "", err
+			}
+			ra.DryRun = enabled
+
+		case "probe_on_start":
+			enabled, err := parseOnOff(d)
+			if err != nil {
+				return "", err
+			}
+			ra.ProbeOnStart = enabled
+
+		case "debug_packets":
+			enabled, err := parseOnOff(d)
+			if err != nil {
+				return "", err
+			}
+			ra.DebugPackets = enabled
+
+		case "debug_secret_check":
+			enabled, err := parseOnOff(d)
+			if err != nil {
+				return "", err
+			}
+			ra.DebugSecretCheck = enabled
+
+		case "probe_timeout":
+			if !d.NextArg() {
+				return "", d.Err("probe_timeout requires a duration value (e.g. 5s)")
+			}
+			_, err := time.ParseDuration(d.Val())
+			if err != nil {
+				return "", d.Errf("invalid probe_timeout duration: %v", err)
+			}
+			ra.ProbeTimeout = d.Val()
+
+		case "error_format":
+			if !d.NextArg() {
+				return "", d.Err("error_format requires text or json")
+			}
+			switch d.Val() {
+			case errorFormatText, errorFormatJSON:
+				ra.ErrorFormat = d.Val()
+			default:
+				return "", d.Errf("unknown error_format: %s", d.Val())
+			}
+
+		case "reject_status":
+			if !d.NextArg() {
+				return "", d.Err("reject_status requires a status code")
+			}
+			code, err := strconv.Atoi(d.Val())
+			if err != nil || code < 400 || code > 499 {
+				return "", d.Errf("invalid reject_status: %s (must be a 4xx status)", d.Val())
+			}
+			ra.RejectStatusCode = code
+
+		case "fallback":
+			if !d.NextArg() {
+				return "", d.Err("fallback requires a provider (basic_auth)")
+			}
+			if d.Val() != fallbackBasicAuth {
+				return "", d.Errf("unknown fallback provider: %s", d.Val())
+			}
+			ra.FallbackProvider = d.Val()
+			if ra.FallbackBasicAuth == nil {
+				ra.FallbackBasicAuth = make(map[string]string)
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				user := d.Val()
+				if !d.NextArg() {
+					return "", d.Errf("fallback user %s requires a bcrypt hash", user)
+				}
+				ra.FallbackBasicAuth[user] = d.Val()
+				if d.NextArg() {
+					return "", d.ArgErr()
+				}
+			}
+
+		case "fail_behavior":
+			if !d.NextArg() {
+				return "", d.Err("fail_behavior requires deny, error, allow or service_unavailable")
+			}
+			switch d.Val() {
+			case failDeny, failError, failAllow, failServiceUnavailable:
+				ra.FailBehavior = d.Val()
+			default:
+				return "", d.Errf("unknown fail_behavior: %s", d.Val())
+			}
+
+		case "accept_codes":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return "", d.Err("accept_codes requires at least one RADIUS code")
+			}
+			for _, arg := range args {
+				n, err := strconv.Atoi(arg)
+				if err != nil || n < 1 || n > 255 {
+					return "", d.Errf("invalid RADIUS code: %s", arg)
+				}
+				ra.AcceptCodes = append(ra.AcceptCodes, n)
+			}
+
+		case "unknown_code_policy":
+			if !d.NextArg() {
+				return "", d.Err("unknown_code_policy requires deny, allow or error")
+			}
+			switch d.Val() {
+			case unknownCodeDeny, unknownCodeAllow, unknownCodeError:
+				ra.UnknownCodePolicy = d.Val()
+			default:
+				return "", d.Errf("unknown unknown_code_policy: %s", d.Val())
+			}
+
+		case "eap":
+			eap, err := parseOnOff(d)
+			if err != nil {
+				return "", err
+			}
+			ra.EAP = eap
+
+		case "auth_protocol":
+			if !d.NextArg() {
+				return "", d.Err("auth_protocol requires pap or chap")
+			}
+			switch d.Val() {
+			case authProtocolPAP, authProtocolCHAP:
+				ra.AuthProtocol = d.Val()
+			default:
+				return "", d.Errf("unknown auth_protocol: %s", d.Val())
+			}
+
+		case "nas_port_mode":
+			if !d.NextArg() {
+				return "", d.Err("nas_port_mode requires none, hash_client_ip or sequential")
+			}
+			switch d.Val() {
+			case nasPortNone, nasPortHashIP, nasPortSequential:
+				ra.NASPortMode = d.Val()
+			default:
+				return "", d.Errf("unknown nas_port_mode: %s", d.Val())
+			}
+
+		case "service_type":
+			if !d.NextArg() {
+				return "", d.Err("service_type requires a value (e.g. Authenticate-Only)")
+			}
+			if _, ok := parseServiceType(d.Val()); !ok {
+				return "", d.Errf("unknown service_type: %s", d.Val())
+			}
+			ra.ServiceType = d.Val()
+
+		case "username_attribute":
+			if !d.NextArg() {
+				return "", d.Err("username_attribute requires an attribute name or number")
+			}
+			if _, err := parseUsernameAttribute(d.Val()); err != nil {
+				return "", d.Errf("username_attribute: %v", err)
+			}
+			ra.UsernameAttribute = d.Val()
+
+		case "request_id_attribute":
+			if !d.NextArg() {
+				return "", d.Err("request_id_attribute requires an attribute name or number")
+			}
+			ra.RequestIDAttribute = d.Val()
+
+		case "nas_port_type":
+			if !d.NextArg() {
+				return "", d.Err("nas_port_type requires a value (e.g. Virtual)")
+			}
+			if _, ok := parseNASPortType(d.Val()); !ok {
+				return "", d.Errf("unknown nas_port_type: %s", d.Val())
+			}
+			ra.NASPortType = d.Val()
+
+		case "export_attributes":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return "", d.Err("export_attributes requires at least one attribute name")
+			}
+			ra.ExportAttributes = append(ra.ExportAttributes, args...)
+
+		case "allow_users":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return "", d.Err("allow_users requires at least one username pattern")
+			}
+			ra.UsernameAllowList = append(ra.UsernameAllowList, args...)
+
+		case "deny_users":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return "", d.Err("deny_users requires at least one username pattern")
+			}
+			ra.UsernameDenyList = append(ra.UsernameDenyList, args...)
+
+		case "username_transform":
+			ra.UsernameTransform = &UsernameTransform{}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "lower_case":
+					ra.UsernameTransform.LowerCase = true
+				case "strip_suffix":
+					if !d.NextArg() {
+						return "", d.Err("strip_suffix requires a value")
+					}
+					ra.UsernameTransform.StripSuffix = d.Val()
+				case "strip_prefix":
+					if !d.NextArg() {
+						return "", d.Err("strip_prefix requires a value")
+					}
+					ra.UsernameTransform.StripPrefix = d.Val()
+				case "regexp":
+					args := d.RemainingArgs()
+					if len(args) != 2 {
+						return "", d.Err("regexp requires a pattern and a replacement")
+					}
+					if _, err := regexp.Compile(args[0]); err != nil {
+						return "", d.Errf("invalid regexp: %v", err)
+					}
+					ra.UsernameTransform.Regexp = args[0]
+					ra.UsernameTransform.RegexpReplace = args[1]
+				default:
+					return "", d.Errf("unrecognized username_transform option: %s", d.Val())
+				}
+			}
+
+		case "accounting":
+			ra.Accounting = &AccountingConfig{Enabled: true}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "port":
+					if !d.NextArg() {
+						return "", d.Err("port requires a value")
+					}
+					ra.Accounting.Port = d.Val()
+				case "interim_interval":
+					if !d.NextArg() {
+						return "", d.Err("interim_interval requires a duration value (e.g. 5m)")
+					}
+					_, err := time.ParseDuration(d.Val())
+					if err != nil {
+						return "", d.Errf("invalid interim_interval duration: %v", err)
+					}
+					ra.Accounting.InterimInterval = d.Val()
+				case "byte_counts":
+					enabled, err := parseOnOff(d)
+					if err != nil {
+						return "", err
+					}
+					ra.Accounting.ByteCounts = enabled
+				default:
+					return "", d.Errf("unrecognized accounting option: %s", d.Val())
+				}
+			}
+
+		case "jwt":
+			ra.JWT = &JWTConfig{Enabled: true}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "signing_key":
+					if !d.NextArg() {
+						return "", d.Err("signing_key requires a value")
+					}
+					ra.JWT.SigningKey = d.Val()
+				case "signing_alg":
+					if !d.NextArg() {
+						return "", d.Err("signing_alg requires a value (HS256, HS384 or HS512)")
+					}
+					ra.JWT.SigningAlg = d.Val()
+				case "expiry":
+					if !d.NextArg() {
+						return "", d.Err("expiry requires a duration value (e.g. 1h)")
+					}
+					if err := checkDuration(d.Val()); err != nil {
+						return "", d.Errf("invalid expiry duration: %v", err)
+					}
+					ra.JWT.Expiry = d.Val()
+				case "claim":
+					args := d.RemainingArgs()
+					if len(args) != 2 {
+						return "", d.Err("claim requires a name and a value")
+					}
+					if ra.JWT.Claims == nil {
+						ra.JWT.Claims = make(map[string]string)
+					}
+					ra.JWT.Claims[args[0]] = args[1]
+				case "cookie_name":
+					if !d.NextArg() {
+						return "", d.Err("cookie_name requires a value")
+					}
+					ra.JWT.CookieName = d.Val()
+				default:
+					return "", d.Errf("unrecognized jwt option: %s", d.Val())
+				}
+			}
+
+		case "prefer_ipv6":
+			enabled, err := parseOnOff(d)
+			if err != nil {
+				return "", err
+			}
+			ra.PreferIPv6 = enabled
+
+		case "tcp_mode":
+			enabled, err := parseOnOff(d)
 			if err != nil {
-				return nil, h.Errf("invalid cache_ttl duration: %v", err)
+				return "", err
+			}
+			ra.TCPMode = enabled
+
+		case "tls":
+			ra.TLS = &TLSConfig{Enabled: true}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "ca_cert":
+					if !d.NextArg() {
+						return "", d.Err("ca_cert requires a file path")
+					}
+					if err := checkFile(d, d.Val()); err != nil {
+						return "", err
+					}
+					ra.TLS.CACert = d.Val()
+				case "client_cert":
+					if !d.NextArg() {
+						return "", d.Err("client_cert requires a file path")
+					}
+					if err := checkFile(d, d.Val()); err != nil {
+						return "", err
+					}
+					ra.TLS.ClientCert = d.Val()
+				case "client_key":
+					if !d.NextArg() {
+						return "", d.Err("client_key requires a file path")
+					}
+					if err := checkFile(d, d.Val()); err != nil {
+						return "", err
+					}
+					ra.TLS.ClientKey = d.Val()
+				case "server_name":
+					if !d.NextArg() {
+						return "", d.Err("server_name requires a value")
+					}
+					ra.TLS.ServerName = d.Val()
+				case "pool_size":
+					if !d.NextArg() {
+						return "", d.Err("pool_size requires a number")
+					}
+					n, err := strconv.Atoi(d.Val())
+					if err != nil || n < 0 {
+						return "", d.Errf("invalid pool_size: %s", d.Val())
+					}
+					ra.TLS.PoolSize = n
+				case "idle_conn_timeout":
+					if !d.NextArg() {
+						return "", d.Err("idle_conn_timeout requires a duration value (e.g. 60s)")
+					}
+					if dur, err := time.ParseDuration(d.Val()); err != nil || dur <= 0 {
+						return "", d.Errf("invalid idle_conn_timeout duration: %s", d.Val())
+					}
+					ra.TLS.IdleConnTimeout = d.Val()
+				case "min_version":
+					if !d.NextArg() {
+						return "", d.Err("min_version requires a TLS version")
+					}
+					if _, err := parseTLSVersion(d.Val()); err != nil {
+						return "", d.Err(err.Error())
+					}
+					ra.TLS.MinVersion = d.Val()
+				case "require_client_cert":
+					enabled, err := parseOnOff(d)
+					if err != nil {
+						return "", err
+					}
+					ra.TLS.RequireClientCert = enabled
+				case "cert_rotation":
+					enabled, err := parseOnOff(d)
+					if err != nil {
+						return "", err
+					}
+					ra.TLS.CertRotation = enabled
+				default:
+					return "", d.Errf("unrecognized tls option: %s", d.Val())
+				}
 			}
-			ra.CacheTTL = h.Val()
 
 		default:
-			return nil, h.Errf("unrecognized directive: %s", h.Val())
+			return "", d.Errf("unrecognized directive: %s", d.Val())
+		}
+		if d.NextArg() {
+			return "", d.ArgErr()
 		}
 	}
+	return pool, nil
+}
 
-	if len(ra.Servers) == 0 {
-		return nil, fmt.Errorf("at least one RADIUS server must be defined")
+// checkFile reports an error at the current token if path does not name a
+// readable regular file
+func checkFile(d *caddyfile.Dispenser, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return d.Errf("%v", err)
 	}
-	if ra.Secret == "" {
-		return nil, fmt.Errorf("radius secret must be set")
+	if info.IsDir() {
+		return d.Errf("%s is a directory", path)
+	}
+	return nil
+}
+
+// bypassExpression turns bypass_if arguments into a CEL expression. A single
+// argument is an expression already; otherwise the first names a request
+// matcher and the rest are its arguments, so "path /health" becomes
+// "path('/health')".
+func bypassExpression(args []string) string {
+	if len(args) == 1 {
+		return args[0]
+	}
+	escape := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	quoted := make([]string, len(args)-1)
+	for i, arg := range args[1:] {
+		quoted[i] = "'" + escape.Replace(arg) + "'"
+	}
+	return args[0] + "(" + strings.Join(quoted, ", ") + ")"
+}
+
+// checkServerAddr validates a host:port server argument, leaving placeholders
+// to be resolved in Provision
+func checkServerAddr(d *caddyfile.Dispenser, s string) error {
+	if strings.Contains(s, "{") {
+		return nil
+	}
+	if !strings.Contains(s, ":") {
+		return d.Errf("invalid RADIUS server address: %s (must include port)", s)
+	}
+	if !isValidServerAddr(s) {
+		return d.Errf("invalid RADIUS server format: %s", s)
+	}
+	return nil
+}
+
+// checkDuration validates a duration argument, leaving placeholders such as
+// {env.RADIUS_TIMEOUT} to be resolved in Provision
+func checkDuration(s string) error {
+	if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+		return nil
+	}
+	_, err := time.ParseDuration(s)
+	return err
+}
+
+// parseOnOff reads a single on/off argument for the current directive
+func parseOnOff(d *caddyfile.Dispenser) (bool, error) {
+	name := d.Val()
+	if !d.NextArg() {
+		return false, d.Errf("%s requires on or off", name)
+	}
+	switch d.Val() {
+	case "on", "true":
+		return true, nil
+	case "off", "false":
+		return false, nil
+	default:
+		return false, d.Errf("%s: expected on or off, got %s", name, d.Val())
 	}
-	return caddyauth.Authentication{
-		ProvidersRaw: caddy.ModuleMap{
-			"radius_auth": caddyconfig.JSON(ra, nil),
-		},
-	}, nil
 }
@@ -0,0 +1,376 @@
+package caddy2_radius_auth
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+)
+
+// parseToJSON parses a radius_auth directive and returns the provider's JSON
+func parseToJSON(t *testing.T, input string) []byte {
+	t.Helper()
+	h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(input)}
+	handler, err := parseCaddyfile(h)
+	if err != nil {
+		t.Fatalf("parsing %q: %v", input, err)
+	}
+	auth, ok := handler.(caddyauth.Authentication)
+	if !ok {
+		t.Fatalf("parsing %q returned %T", input, handler)
+	}
+	return auth.ProvidersRaw["radius_auth"]
+}
+
+func TestCaddyfileInlineMatchesBlock(t *testing.T) {
+	for _, tc := range []struct {
+		inline, block string
+	}{
+		{
+			inline: `radius_auth 10.0.0.1:1812 s3cret`,
+			block: `radius_auth {
+				servers 10.0.0.1:1812
+				secret s3cret
+			}`,
+		},
+		{
+			inline: `radius_auth 10.0.0.1:1812 s3cret "Staff Only"`,
+			block: `radius_auth {
+				servers 10.0.0.1:1812
+				secret s3cret
+				realm "Staff Only"
+			}`,
+		},
+	} {
+		inline, block := parseToJSON(t, tc.inline), parseToJSON(t, tc.block)
+		if !bytes.Equal(inline, block) {
+			t.Errorf("inline form\n\t%s\nblock form\n\t%s", inline, block)
+		}
+
+		var ra HTTPRadiusAuth
+		if err := json.Unmarshal(inline, &ra); err != nil {
+			t.Fatal(err)
+		}
+		if len(ra.Servers) != 1 || ra.Servers[0] != "10.0.0.1:1812" || ra.Secret != "s3cret" {
+			t.Errorf("inline form parsed to %s", inline)
+		}
+	}
+}
+
+func TestCaddyfileInlineErrors(t *testing.T) {
+	for _, input := range []string{
+		`radius_auth 10.0.0.1:1812`,
+		`radius_auth 10.0.0.1:1812 s3cret realm extra`,
+		`radius_auth not-an-address s3cret`,
+	} {
+		h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(input)}
+		if _, err := parseCaddyfile(h); err == nil {
+			t.Errorf("parsing %q succeeded", input)
+		}
+	}
+}
+
+func TestCaddyfileTLS(t *testing.T) {
+	cert, caFile := newCertificate(t, x509.ExtKeyUsageClientAuth)
+	certFile, keyFile := writeKeyPair(t, cert)
+
+	raw := parseToJSON(t, fmt.Sprintf(`radius_auth {
+		servers 10.0.0.1:2083
+		secret radsec
+		tls {
+			ca_cert %s
+			client_cert %s
+			client_key %s
+			server_name radius.example.com
+			min_version 1.3
+		}
+	}`, caFile, certFile, keyFile))
+
+	var r HTTPRadiusAuth
+	if err := json.Unmarshal(raw, &r); err != nil {
+		t.Fatal(err)
+	}
+	want := TLSConfig{
+		Enabled:    true,
+		CACert:     caFile,
+		ClientCert: certFile,
+		ClientKey:  keyFile,
+		ServerName: "radius.example.com",
+		MinVersion: "1.3",
+	}
+	if r.TLS == nil || *r.TLS != want {
+		t.Fatalf("got tls %+v, want %+v", r.TLS, want)
+	}
+
+	// The JSON representation survives a round trip unchanged
+	out, err := json.Marshal(&r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var again HTTPRadiusAuth
+	if err := json.Unmarshal(out, &again); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r, again) {
+		t.Errorf("round trip changed the configuration:\n got %+v\nwant %+v", again, r)
+	}
+
+	cfg, err := r.TLS.buildTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MinVersion != tls.VersionTLS13 || cfg.ServerName != "radius.example.com" {
+		t.Errorf("got MinVersion %x, ServerName %q", cfg.MinVersion, cfg.ServerName)
+	}
+}
+
+func TestCaddyfileTLSErrors(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		name, block string
+	}{
+		{"missing file", "ca_cert " + filepath.Join(dir, "missing.pem")},
+		{"directory", "ca_cert " + dir},
+		{"unsupported version", "min_version 1.1"},
+		{"missing argument", "client_cert"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			input := fmt.Sprintf(`radius_auth {
+				servers 10.0.0.1:2083
+				secret radsec
+				tls {
+					%s
+				}
+			}`, tc.block)
+			h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(input)}
+			if _, err := parseCaddyfile(h); err == nil {
+				t.Errorf("parsing %q succeeded", tc.block)
+			}
+		})
+	}
+}
+
+// adaptProvider adapts a whole Caddyfile and returns the radius_auth provider
+// of its only site
+func adaptProvider(t *testing.T, input string) HTTPRadiusAuth {
+	t.Helper()
+	adapter := caddyfile.Adapter{ServerType: httpcaddyfile.ServerType{}}
+	out, _, err := adapter.Adapt([]byte(input), nil)
+	if err != nil {
+		t.Fatalf("adapting Caddyfile: %v", err)
+	}
+	var cfg any
+	if err := json.Unmarshal(out, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	provider := findProvider(cfg)
+	if provider == nil {
+		t.Fatalf("no radius_auth provider in %s", out)
+	}
+	raw, err := json.Marshal(provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ra HTTPRadiusAuth
+	if err := json.Unmarshal(raw, &ra); err != nil {
+		t.Fatal(err)
+	}
+	return ra
+}
+
+// findProvider searches adapted JSON for the radius_auth provider
+func findProvider(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		if providers, ok := v["providers"].(map[string]any); ok && providers["radius_auth"] != nil {
+			return providers["radius_auth"]
+		}
+		for _, child := range v {
+			if found := findProvider(child); found != nil {
+				return found
+			}
+		}
+	case []any:
+		for _, child := range v {
+			if found := findProvider(child); found != nil {
+				return found
+			}
+		}
+	}
+	return nil
+}
+
+func TestCaddyfilePoolInherited(t *testing.T) {
+	ra := adaptProvider(t, `{
+		radius_auth_pool corp {
+			servers 10.0.0.1:1812 10.0.0.2:1812
+			secret  pool-secret
+			timeout 5s
+		}
+	}
+	:8080 {
+		radius_auth {
+			pool  corp
+			realm "B Team"
+		}
+	}`)
+	if !slices.Equal(ra.Servers, []string{"10.0.0.1:1812", "10.0.0.2:1812"}) {
+		t.Errorf("got servers %v", ra.Servers)
+	}
+	if ra.Secret != "pool-secret" || ra.Timeout != "5s" || ra.Realm != "B Team" {
+		t.Errorf("got secret %q, timeout %q, realm %q", ra.Secret, ra.Timeout, ra.Realm)
+	}
+}
+
+func TestCaddyfilePoolSiteOverrides(t *testing.T) {
+	ra := adaptProvider(t, `{
+		radius_auth_pool corp {
+			servers 10.0.0.1:1812 10.0.0.2:1812
+			secret  pool-secret
+			tcp_mode on
+			trust_forwarded_for on
+			prefer_ipv6 on
+			retry_count 3
+		}
+	}
+	:8080 {
+		radius_auth 10.0.0.3:1812 site-secret {
+			pool corp
+			tcp_mode off
+			trust_forwarded_for off
+			prefer_ipv6 off
+			retry_count 0
+		}
+	}`)
+	if !slices.Equal(ra.Servers, []string{"10.0.0.3:1812"}) || ra.Secret != "site-secret" {
+		t.Errorf("got servers %v, secret %q", ra.Servers, ra.Secret)
+	}
+	if ra.TCPMode || ra.TrustForwardedFor || ra.PreferIPv6 {
+		t.Errorf("site off values lost: tcp_mode %v, trust_forwarded_for %v, prefer_ipv6 %v",
+			ra.TCPMode, ra.TrustForwardedFor, ra.PreferIPv6)
+	}
+	if ra.RetryCount != 0 {
+		t.Errorf("got retry_count %d, want 0", ra.RetryCount)
+	}
+}
+
+func TestCaddyfilePoolMergesBlocks(t *testing.T) {
+	_, caFile := newCertificate(t, x509.ExtKeyUsageServerAuth)
+	ra := adaptProvider(t, fmt.Sprintf(`{
+		radius_auth_pool corp {
+			servers 10.0.0.1:2083 10.0.0.2:2083
+			secret  pool-secret
+			server_secret 10.0.0.1:2083 one
+			tls {
+				ca_cert %s
+				server_name pool.example.com
+			}
+			accounting {
+				byte_counts on
+			}
+		}
+	}
+	:8080 {
+		radius_auth {
+			pool corp
+			server_secret 10.0.0.2:2083 two
+			tls {
+				server_name site.example.com
+			}
+			accounting {
+				byte_counts off
+				port 1813
+			}
+		}
+	}`, caFile))
+
+	want := TLSConfig{Enabled: true, CACert: caFile, ServerName: "site.example.com"}
+	if ra.TLS == nil || *ra.TLS != want {
+		t.Errorf("got tls %+v, want %+v", ra.TLS, want)
+	}
+	wantSecrets := map[string]string{"10.0.0.1:2083": "one", "10.0.0.2:2083": "two"}
+	if !reflect.DeepEqual(ra.ServerSecrets, wantSecrets) {
+		t.Errorf("got server secrets %v, want %v", ra.ServerSecrets, wantSecrets)
+	}
+	if ra.Accounting == nil || ra.Accounting.ByteCounts || ra.Accounting.Port != "1813" {
+		t.Errorf("got accounting %+v", ra.Accounting)
+	}
+}
+
+func TestCaddyfilePoolErrors(t *testing.T) {
+	for _, input := range []string{
+		`:8080 {
+			radius_auth {
+				pool missing
+			}
+		}`,
+		`{
+			radius_auth_pool corp {
+				pool other
+			}
+		}`,
+		`{
+			radius_auth_pool corp {
+				secret a b
+			}
+		}`,
+	} {
+		adapter := caddyfile.Adapter{ServerType: httpcaddyfile.ServerType{}}
+		if _, _, err := adapter.Adapt([]byte(input), nil); err == nil {
+			t.Errorf("adapting %q succeeded", input)
+		}
+	}
+}
+
+func TestCaddyfileByteCounter(t *testing.T) {
+	h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(`radius_auth 10.0.0.1:1812 s3cret {
+		accounting {
+			byte_counts on
+		}
+	}`)}
+	handler, err := parseCaddyfile(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr, ok := handler.(*caddyhttp.Subroute)
+	if !ok || len(sr.Routes) != 1 {
+		t.Fatalf("byte_counts on: got %T, want a subroute", handler)
+	}
+	var names []string
+	for _, raw := range sr.Routes[0].HandlersRaw {
+		var h struct {
+			Handler string `json:"handler"`
+		}
+		if err := json.Unmarshal(raw, &h); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, h.Handler)
+	}
+	if want := []string{"radius_auth_byte_counter", "authentication"}; !slices.Equal(names, want) {
+		t.Errorf("handlers = %q, want %q", names, want)
+	}
+
+	// Without byte_counts the directive is the authentication handler alone
+	raw := parseToJSON(t, `radius_auth 10.0.0.1:1812 s3cret {
+		accounting {
+			port 1813
+		}
+	}`)
+	var ra HTTPRadiusAuth
+	if err := json.Unmarshal(raw, &ra); err != nil {
+		t.Fatal(err)
+	}
+	if ra.Accounting == nil || ra.Accounting.ByteCounts {
+		t.Errorf("accounting = %+v", ra.Accounting)
+	}
+}
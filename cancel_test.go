@@ -0,0 +1,144 @@
+package caddy2_radius_auth
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/wxccs/caddy2-radius-auth/internal/testradius"
+	"layeh.com/radius"
+)
+
+// waitForGoroutines waits up to within for the goroutine count to drop back
+// to at most n and fails the test if it does not
+func waitForGoroutines(t *testing.T, n int, within time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(within)
+	for {
+		got := runtime.NumGoroutine()
+		if got <= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%d goroutines still running, want at most %d:\n%s", got, n, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCancelStopsRadiusExchanges(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		singleFlight bool
+		timeout      string
+		drainWithin  time.Duration
+	}{
+		// Without single-flight the exchanges stop as soon as the client goes
+		{name: "single-flight off", singleFlight: false, timeout: "10s", drainWithin: time.Second},
+		// A shared exchange outlives the client that started it, but no
+		// longer than the server timeout
+		{name: "single-flight on", singleFlight: true, timeout: "300ms", drainWithin: 2 * time.Second},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			silent := []string{
+				testradius.NewMockServer(t, map[string]radius.Code{"alice": 0}).Addr(),
+				testradius.NewMockServer(t, map[string]radius.Code{"alice": 0}).Addr(),
+			}
+			r := &HTTPRadiusAuth{
+				Servers:      silent,
+				Secret:       testradius.Secret,
+				Timeout:      tc.timeout,
+				SingleFlight: &tc.singleFlight,
+			}
+			provision(t, r)
+
+			before := runtime.NumGoroutine()
+
+			req, _ := newCaddyRequest("alice", "password")
+			ctx, cancel := context.WithCancel(req.Context())
+			req = req.WithContext(ctx)
+			time.AfterFunc(50*time.Millisecond, cancel)
+
+			start := time.Now()
+			if _, ok, _ := r.Authenticate(httptest.NewRecorder(), req); ok {
+				t.Fatal("Authenticate succeeded against silent servers")
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("Authenticate returned %v after the client went away", elapsed)
+			}
+
+			waitForGoroutines(t, before, tc.drainWithin)
+		})
+	}
+}
+
+func TestCleanupStopsBackgroundWork(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+	_, port, _ := net.SplitHostPort(mock.Addr())
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 100; i++ {
+		r := &HTTPRadiusAuth{
+			Servers:             []string{mock.Addr()},
+			Secret:              testradius.Secret,
+			HealthCheckInterval: "10ms",
+			Accounting:          &AccountingConfig{Enabled: true, Port: port, InterimInterval: "10ms"},
+		}
+		if err := r.Provision(newTestContext(t)); err != nil {
+			t.Fatalf("Provision: %v", err)
+		}
+		// The request never finishes, so only Cleanup ends its accounting
+		req, _ := newCaddyRequest("alice", "password")
+		if _, ok, err := r.Authenticate(httptest.NewRecorder(), req); !ok || err != nil {
+			t.Fatalf("Authenticate = %v, %v", ok, err)
+		}
+		if err := r.Cleanup(); err != nil {
+			t.Fatalf("Cleanup: %v", err)
+		}
+	}
+
+	waitForGoroutines(t, before, time.Second)
+
+	// Each instance sent at least a Start and a Stop record
+	accounting := 0
+	for _, packet := range mock.Requests() {
+		if packet.Code == radius.CodeAccountingRequest {
+			accounting++
+		}
+	}
+	if accounting < 200 {
+		t.Errorf("RADIUS received %d accounting records, want at least 200", accounting)
+	}
+}
+
+func TestCancelDoesNotTripBreaker(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": 0})
+	r := &HTTPRadiusAuth{
+		Servers:          []string{mock.Addr()},
+		Secret:           testradius.Secret,
+		Timeout:          "10s",
+		BreakerThreshold: 1,
+	}
+	provision(t, r)
+
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		res := r.exchangeServer(ctx, newAccessRequest("alice"), mock.Addr())
+		cancel()
+		if res.err == nil {
+			t.Fatal("exchange with a silent server succeeded")
+		}
+	}
+
+	if state, failures := r.pool.breaker(mock.Addr()).state(); state != breakerClosed || failures != 0 {
+		t.Errorf("breaker is %s with %d failures after cancelled exchanges, want closed with 0", state, failures)
+	}
+	status := r.pool.status()
+	if len(status) != 1 || status[0].LastError != "" {
+		t.Errorf("cancelled exchanges recorded as server errors: %+v", status)
+	}
+}
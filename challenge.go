@@ -0,0 +1,204 @@
+package caddy2_radius_auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+	"go.uber.org/zap"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+const (
+	challengeCookie = "radius_challenge"   // Cookie identifying a pending challenge
+	challengeHeader = "X-RADIUS-Challenge" // Header carrying the challenge Reply-Message
+	challengeTTL    = 2 * time.Minute      // Time a client has to answer a challenge
+)
+
+// challengeError reports that a server answered with Access-Challenge
+type challengeError struct {
+	server     string
+	state      []byte
+	proxyState [][]byte
+	message    string
+}
+
+func (e *challengeError) Error() string {
+	return fmt.Sprintf("%s returned an access challenge", e.server)
+}
+
+// pendingChallenge is a challenge waiting for the client's answer
+type pendingChallenge struct {
+	server     string
+	username   string
+	state      []byte
+	proxyState [][]byte // Proxy-State of the challenge, echoed in the answer
+	expires    time.Time
+}
+
+// challengeStore holds pending challenges keyed by cookie value
+type challengeStore struct {
+	mu      sync.Mutex
+	pending map[string]pendingChallenge
+}
+
+func newChallengeStore() *challengeStore {
+	return &challengeStore{pending: make(map[string]pendingChallenge)}
+}
+
+// put stores c and returns the id to hand to the client
+func (s *challengeStore) put(c pendingChallenge) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for k, p := range s.pending {
+		if now.After(p.expires) {
+			delete(s.pending, k)
+		}
+	}
+	s.pending[id] = c
+	return id, nil
+}
+
+// take removes and returns the challenge stored under id, if it has not expired
+func (s *challengeStore) take(id string) (pendingChallenge, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.pending[id]
+	if !ok {
+		return pendingChallenge{}, false
+	}
+	delete(s.pending, id)
+	if time.Now().After(c.expires) {
+		return pendingChallenge{}, false
+	}
+	return c, true
+}
+
+// takeChallenge returns the pending challenge referenced by the request's
+// cookie, if it belongs to username
+func (r HTTPRadiusAuth) takeChallenge(req *http.Request, username string) (pendingChallenge, bool) {
+	cookie, err := req.Cookie(challengeCookie)
+	if err != nil {
+		return pendingChallenge{}, false
+	}
+	c, ok := r.challenges.take(cookie.Value)
+	if !ok || c.username != username {
+		return pendingChallenge{}, false
+	}
+	return c, true
+}
+
+// sendChallenge stores the challenge and answers 401 with the challenge
+// message, so the client can retry with the response as its password
+func (r HTTPRadiusAuth) sendChallenge(w http.ResponseWriter, req *http.Request, username string, challenge *challengeError) (caddyauth.User, bool, error) {
+	id, err := r.challenges.put(pendingChallenge{
+		server:     challenge.server,
+		username:   username,
+		state:      challenge.state,
+		proxyState: challenge.proxyState,
+		expires:    time.Now().Add(challengeTTL),
+	})
+	if err != nil {
+		observeOutcome(outcomeError)
+		r.writeError(w, http.StatusInternalServerError, fmt.Sprintf("RADIUS error: %v", err))
+		return r.promptForCredentials(w, nil)
+	}
+
+	observeOutcome(outcomeChallenge)
+	http.SetCookie(w, &http.Cookie{
+		Name:     challengeCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(challengeTTL / time.Second),
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	w.Header().Set(challengeHeader, challenge.message)
+	r.writeError(w, http.StatusUnauthorized, "Unauthorized")
+	return r.promptForCredentials(w, nil)
+}
+
+// answerChallenge sends the client's response to a challenge back to the
+// server that issued it, along with the State and Proxy-State it returned
+func (r HTTPRadiusAuth) answerChallenge(ctx context.Context, username, password string, info requestInfo, c pendingChallenge) (radiusResult, error) {
+	packet, err := r.newAccessRequest(c.server, username, password, info)
+	if err != nil {
+		return radiusResult{}, err
+	}
+	if err := rfc2865.State_Set(packet, c.state); err != nil {
+		return radiusResult{}, fmt.Errorf("rfc2865: setting state error: %w", err)
+	}
+	if err := addProxyState(packet, c.proxyState); err != nil {
+		return radiusResult{}, err
+	}
+
+	res := radiusResult{server: c.server}
+	sr := r.exchangeServer(ctx, packet, c.server)
+	if sr.err != nil {
+		return res, sr.err
+	}
+	switch {
+	case r.isAccept(sr.code):
+		res.ok, res.reply = true, sr.resp
+		return res, nil
+	case sr.code == radius.CodeAccessReject:
+		return res, nil
+	case sr.code == radius.CodeAccessChallenge:
+		return res, newChallengeError(c.server, sr.resp)
+	}
+	switch r.UnknownCodePolicy {
+	case unknownCodeAllow:
+		r.logger.Warn("treating unknown RADIUS response code as accept",
+			zap.String("server", c.server), zap.Stringer("code", sr.code))
+		res.ok, res.reply = true, sr.resp
+		return res, nil
+	case unknownCodeError:
+		return res, &unknownCodeErr{server: c.server, code: sr.code}
+	default:
+		return res, nil
+	}
+}
+
+// newChallengeError extracts State, Proxy-State and Reply-Message from an
+// Access-Challenge
+func newChallengeError(server string, resp *radius.Packet) *challengeError {
+	return &challengeError{
+		server:     server,
+		state:      rfc2865.State_Get(resp),
+		proxyState: proxyStates(resp),
+		message:    rfc2865.ReplyMessage_GetString(resp),
+	}
+}
+
+// proxyStates returns the Proxy-State attributes of p
+func proxyStates(p *radius.Packet) [][]byte {
+	// Byte values never fail to decode
+	states, _ := rfc2865.ProxyState_Gets(p)
+	return states
+}
+
+// addProxyState copies the Proxy-State attributes of a challenge into the
+// request answering it, in their original order, so proxies between us and
+// the server can match the conversation up
+func addProxyState(packet *radius.Packet, states [][]byte) error {
+	for _, state := range states {
+		if err := rfc2865.ProxyState_Add(packet, state); err != nil {
+			return fmt.Errorf("rfc2865: adding proxy state error: %w", err)
+		}
+	}
+	return nil
+}
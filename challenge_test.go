@@ -0,0 +1,74 @@
+package caddy2_radius_auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/wxccs/caddy2-radius-auth/internal/testradius"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+func TestChallengeEchoesProxyState(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessChallenge})
+	calls := 0
+	mock.SetReply("alice", func(resp *radius.Packet) {
+		calls++
+		if calls > 1 {
+			// The answer to the challenge is accepted
+			resp.Code = radius.CodeAccessAccept
+			return
+		}
+		rfc2865.State_Set(resp, []byte("challenge-1"))
+		rfc2865.ProxyState_Add(resp, []byte("proxy-a"))
+		rfc2865.ProxyState_Add(resp, []byte("proxy-b"))
+		rfc2865.ReplyMessage_SetString(resp, "Enter your one-time code")
+	})
+
+	r := &HTTPRadiusAuth{
+		Servers:         []string{mock.Addr()},
+		Secret:          testradius.Secret,
+		AccessChallenge: true,
+	}
+	provision(t, r)
+
+	req, _ := newCaddyRequest("alice", "password")
+	w := httptest.NewRecorder()
+	if _, ok, _ := r.Authenticate(w, req); ok {
+		t.Fatal("Authenticate succeeded before the challenge was answered")
+	}
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if got := w.Header().Get(challengeHeader); got != "Enter your one-time code" {
+		t.Errorf("%s = %q, want the Reply-Message", challengeHeader, got)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != challengeCookie {
+		t.Fatalf("got cookies %v, want %s", cookies, challengeCookie)
+	}
+
+	req, _ = newCaddyRequest("alice", "123456")
+	req.AddCookie(cookies[0])
+	if _, ok, err := r.Authenticate(httptest.NewRecorder(), req); !ok || err != nil {
+		t.Fatalf("answering the challenge: Authenticate = %v, %v", ok, err)
+	}
+
+	requests := mock.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("RADIUS received %d requests, want 2", len(requests))
+	}
+	if states, _ := rfc2865.ProxyState_Gets(requests[0]); len(states) != 0 {
+		t.Errorf("first request carried Proxy-State %q", states)
+	}
+	answer := requests[1]
+	if got := string(rfc2865.State_Get(answer)); got != "challenge-1" {
+		t.Errorf("State = %q, want challenge-1", got)
+	}
+	states, _ := rfc2865.ProxyState_Gets(answer)
+	if want := [][]byte{[]byte("proxy-a"), []byte("proxy-b")}; !reflect.DeepEqual(states, want) {
+		t.Errorf("Proxy-State = %q, want %q", states, want)
+	}
+}
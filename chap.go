@@ -0,0 +1,43 @@
+package caddy2_radius_auth
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+// Authentication protocols for the password in an Access-Request
+const (
+	authProtocolPAP  = "pap"
+	authProtocolCHAP = "chap"
+)
+
+// setCHAPPassword adds CHAP-Challenge and CHAP-Password (RFC 2865 section
+// 5.3) to packet. Basic Auth gives us the plaintext password rather than a
+// CHAP exchange with the client, so the module computes the response itself.
+// The challenge is an HMAC of the username, so the same credentials always
+// produce the same CHAP-Password.
+func (r HTTPRadiusAuth) setCHAPPassword(packet *radius.Packet, username, password string) error {
+	mac := hmac.New(sha256.New, r.cacheKeySecret)
+	mac.Write([]byte("chap:" + username))
+	sum := mac.Sum(nil)
+	challenge, ident := sum[:16], sum[16]
+
+	h := md5.New()
+	h.Write([]byte{ident})
+	h.Write([]byte(password))
+	h.Write(challenge)
+	response := append([]byte{ident}, h.Sum(nil)...)
+
+	if err := rfc2865.CHAPChallenge_Set(packet, challenge); err != nil {
+		return fmt.Errorf("rfc2865: setting chap challenge error: %w", err)
+	}
+	if err := rfc2865.CHAPPassword_Set(packet, response); err != nil {
+		return fmt.Errorf("rfc2865: setting chap password error: %w", err)
+	}
+	return nil
+}
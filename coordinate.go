@@ -0,0 +1,128 @@
+package caddy2_radius_auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"layeh.com/radius"
+)
+
+// Coordination backends
+const coordinationRedis = "redis"
+
+// coordinator shares RADIUS exchanges between Caddy instances: the instance
+// that takes a Redis lock for the credentials performs the exchange and
+// publishes the result, and the others wait for it instead of sending
+// their own request. It is the cluster-wide counterpart of single-flight.
+type coordinator struct {
+	client  *redis.Client
+	timeout time.Duration // Lock lifetime and the longest wait for a result
+	logger  *zap.Logger
+}
+
+// coordinatedResult is the result published to waiting instances. Errors,
+// including Access-Challenges, are published as Failed so the waiters
+// perform their own exchange.
+type coordinatedResult struct {
+	Failed     bool           `json:"failed,omitempty"`
+	OK         bool           `json:"ok,omitempty"`
+	Server     string         `json:"server,omitempty"`
+	Attributes []rawAttribute `json:"attributes,omitempty"` // Reply attributes of an accept
+}
+
+// rawAttribute is a reply attribute as sent on the wire
+type rawAttribute struct {
+	Type  radius.Type `json:"type"`
+	Value []byte      `json:"value"`
+}
+
+func (c *coordinator) lockKey(key string) string { return "radius_auth:lock:" + key }
+func (c *coordinator) channel(key string) string { return "radius_auth:result:" + key }
+
+// do returns the result of exchange for the credentials identified by key,
+// running it here if this instance takes the lock and waiting for the
+// instance that holds it otherwise. If Redis fails, or no result arrives
+// within the timeout, exchange is run directly.
+func (c *coordinator) do(ctx context.Context, key string, exchange func() (radiusResult, error)) (radiusResult, error) {
+	// Subscribe before trying the lock, so a result published by the holder
+	// between the two steps is not missed
+	sub := c.client.Subscribe(ctx, c.channel(key))
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		c.logger.Warn("redis coordination subscribe failed", zap.Error(err))
+		return exchange()
+	}
+
+	token := make([]byte, 16)
+	rand.Read(token)
+	owner := hex.EncodeToString(token)
+	locked, err := c.client.SetNX(ctx, c.lockKey(key), owner, c.timeout).Result()
+	if err != nil {
+		c.logger.Warn("redis coordination lock failed", zap.Error(err))
+		return exchange()
+	}
+	if locked {
+		sub.Close()
+		res, err := exchange()
+		c.publish(key, owner, res, err)
+		return res, err
+	}
+
+	wait, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	msg, err := sub.ReceiveMessage(wait)
+	if err != nil {
+		if ctx.Err() != nil {
+			return radiusResult{}, ctx.Err()
+		}
+		c.logger.Debug("no coordinated RADIUS result, authenticating directly", zap.Error(err))
+		return exchange()
+	}
+	var published coordinatedResult
+	if err := json.Unmarshal([]byte(msg.Payload), &published); err != nil || published.Failed {
+		return exchange()
+	}
+	res := radiusResult{ok: published.OK, server: published.Server}
+	if published.OK {
+		res.reply = radius.New(radius.CodeAccessAccept, nil)
+		for _, attr := range published.Attributes {
+			res.reply.Add(attr.Type, radius.Attribute(attr.Value))
+		}
+	}
+	return res, nil
+}
+
+// publish sends the result to the waiting instances and releases the lock
+// if this instance still holds it
+func (c *coordinator) publish(key, owner string, res radiusResult, err error) {
+	published := coordinatedResult{Failed: err != nil, OK: res.ok, Server: res.server}
+	if err == nil && res.reply != nil {
+		for _, avp := range res.reply.Attributes {
+			published.Attributes = append(published.Attributes, rawAttribute{Type: avp.Type, Value: avp.Attribute})
+		}
+	}
+	payload, _ := json.Marshal(published)
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	if err := c.client.Publish(ctx, c.channel(key), payload).Err(); err != nil {
+		c.logger.Warn("redis coordination publish failed", zap.Error(err))
+	}
+	if err := releaseLock.Run(ctx, c.client, []string{c.lockKey(key)}, owner).Err(); err != nil {
+		c.logger.Warn("redis coordination unlock failed", zap.Error(err))
+	}
+}
+
+// releaseLock deletes the lock only if it still belongs to the caller; an
+// expired lock may have been taken by another instance since
+var releaseLock = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
@@ -0,0 +1,273 @@
+package caddy2_radius_auth
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/wxccs/caddy2-radius-auth/internal/testradius"
+	"go.uber.org/zap"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+// newTestCoordinator returns a coordinator using the Redis at addr
+func newTestCoordinator(t *testing.T, addr string, timeout time.Duration) *coordinator {
+	t.Helper()
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	t.Cleanup(func() { client.Close() })
+	return &coordinator{client: client, timeout: timeout, logger: zap.NewNop()}
+}
+
+// waitFor polls cond until it holds or a second has passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// countingExchange returns an exchange that counts its calls and returns res
+func countingExchange(calls *atomic.Int32, res radiusResult, err error) func() (radiusResult, error) {
+	return func() (radiusResult, error) {
+		calls.Add(1)
+		return res, err
+	}
+}
+
+// coordinatedWait starts a lock holder whose exchange blocks until the
+// returned release function is called, then a waiter, and returns once the
+// waiter has failed to take the lock
+func coordinatedWait(t *testing.T, f *fakeRedis, holder, waiter *coordinator, holderRes radiusResult, holderErr error,
+	waiterExchange func() (radiusResult, error)) (release func(), waiterResult func() (radiusResult, error)) {
+	t.Helper()
+	const key = "credentials"
+
+	unblock := make(chan struct{})
+	holderDone := make(chan struct{})
+	go func() {
+		defer close(holderDone)
+		holder.do(context.Background(), key, func() (radiusResult, error) {
+			<-unblock
+			return holderRes, holderErr
+		})
+	}()
+	waitFor(t, "the lock", func() bool {
+		_, ok := f.get(holder.lockKey(key))
+		return ok
+	})
+
+	var (
+		res  radiusResult
+		err  error
+		done = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		res, err = waiter.do(context.Background(), key, waiterExchange)
+	}()
+	waitFor(t, "the waiter", func() bool { return f.setNXCount() == 2 })
+
+	release = func() {
+		close(unblock)
+		<-holderDone
+	}
+	waiterResult = func() (radiusResult, error) {
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("waiter did not return")
+		}
+		return res, err
+	}
+	return release, waiterResult
+}
+
+func TestCoordinatorWaiterReceivesAccept(t *testing.T) {
+	f, addr := startFakeRedis(t)
+	holder, waiter := newTestCoordinator(t, addr, 2*time.Second), newTestCoordinator(t, addr, 2*time.Second)
+
+	reply := radius.New(radius.CodeAccessAccept, nil)
+	rfc2865.FilterID_AddString(reply, "admins")
+	rfc2865.Class_AddString(reply, "gold")
+
+	var waiterCalls atomic.Int32
+	release, result := coordinatedWait(t, f, holder, waiter,
+		radiusResult{ok: true, reply: reply, server: "10.0.0.1:1812"}, nil,
+		countingExchange(&waiterCalls, radiusResult{}, errors.New("waiter exchanged")))
+	release()
+
+	res, err := result()
+	if err != nil || !res.ok || res.server != "10.0.0.1:1812" {
+		t.Fatalf("waiter got %+v, %v, want the holder's accept", res, err)
+	}
+	if got := rfc2865.FilterID_GetString(res.reply); got != "admins" {
+		t.Errorf("Filter-Id = %q, want admins", got)
+	}
+	if got := rfc2865.Class_GetString(res.reply); got != "gold" {
+		t.Errorf("Class = %q, want gold", got)
+	}
+	if n := waiterCalls.Load(); n != 0 {
+		t.Errorf("waiter exchanged %d times, want 0", n)
+	}
+	if _, ok := f.get(holder.lockKey("credentials")); ok {
+		t.Error("lock still held after the result was published")
+	}
+}
+
+func TestCoordinatorWaiterReceivesReject(t *testing.T) {
+	f, addr := startFakeRedis(t)
+	holder, waiter := newTestCoordinator(t, addr, 2*time.Second), newTestCoordinator(t, addr, 2*time.Second)
+
+	var waiterCalls atomic.Int32
+	release, result := coordinatedWait(t, f, holder, waiter,
+		radiusResult{server: "10.0.0.1:1812"}, nil,
+		countingExchange(&waiterCalls, radiusResult{ok: true}, nil))
+	release()
+
+	if res, err := result(); err != nil || res.ok || res.reply != nil {
+		t.Errorf("waiter got %+v, %v, want the holder's reject", res, err)
+	}
+	if n := waiterCalls.Load(); n != 0 {
+		t.Errorf("waiter exchanged %d times, want 0", n)
+	}
+}
+
+func TestCoordinatorFailedFallsBack(t *testing.T) {
+	f, addr := startFakeRedis(t)
+	holder, waiter := newTestCoordinator(t, addr, 2*time.Second), newTestCoordinator(t, addr, 2*time.Second)
+
+	var waiterCalls atomic.Int32
+	release, result := coordinatedWait(t, f, holder, waiter,
+		radiusResult{}, errors.New("all servers timed out"),
+		countingExchange(&waiterCalls, radiusResult{ok: true, server: "10.0.0.2:1812"}, nil))
+	release()
+
+	res, err := result()
+	if err != nil || !res.ok || res.server != "10.0.0.2:1812" {
+		t.Errorf("waiter got %+v, %v, want its own exchange's result", res, err)
+	}
+	if n := waiterCalls.Load(); n != 1 {
+		t.Errorf("waiter exchanged %d times, want 1", n)
+	}
+}
+
+func TestCoordinatorTimeoutFallsBack(t *testing.T) {
+	f, addr := startFakeRedis(t)
+	c := newTestCoordinator(t, addr, 100*time.Millisecond)
+
+	// Another instance holds the lock but never publishes
+	f.set(c.lockKey("credentials"), "someone else")
+
+	var calls atomic.Int32
+	start := time.Now()
+	res, err := c.do(context.Background(), "credentials", countingExchange(&calls, radiusResult{ok: true}, nil))
+	if err != nil || !res.ok {
+		t.Errorf("got %+v, %v, want the direct exchange's accept", res, err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("exchanged %d times, want 1", n)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("fell back after %v, before the timeout", elapsed)
+	}
+	if owner, _ := f.get(c.lockKey("credentials")); owner != "someone else" {
+		t.Errorf("lock owner = %q, want the other instance's", owner)
+	}
+
+	// A request that goes away while waiting returns its context's error
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.do(ctx, "credentials", countingExchange(&calls, radiusResult{ok: true}, nil)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("cancelled wait returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestCoordinatorReleasesOwnLockOnly(t *testing.T) {
+	f, addr := startFakeRedis(t)
+	c := newTestCoordinator(t, addr, 2*time.Second)
+	lock := c.lockKey("credentials")
+
+	// The lock expires during a slow exchange and another instance takes
+	// it; the first must not delete the new owner's lock
+	res, err := c.do(context.Background(), "credentials", func() (radiusResult, error) {
+		if owner, ok := f.get(lock); !ok || owner == "" {
+			t.Error("exchange ran without the lock")
+		}
+		f.set(lock, "new owner")
+		return radiusResult{ok: true}, nil
+	})
+	if err != nil || !res.ok {
+		t.Fatalf("got %+v, %v", res, err)
+	}
+	if owner, ok := f.get(lock); !ok || owner != "new owner" {
+		t.Errorf("lock = %q, %v after the old owner finished, want the new owner's", owner, ok)
+	}
+
+	// Its own lock is released
+	if _, err := c.do(context.Background(), "other", countingExchange(new(atomic.Int32), radiusResult{}, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.get(c.lockKey("other")); ok {
+		t.Error("lock still held after the owner finished")
+	}
+}
+
+func TestCoordinatorRedisDown(t *testing.T) {
+	c := newTestCoordinator(t, "127.0.0.1:1", time.Second)
+
+	var calls atomic.Int32
+	res, err := c.do(context.Background(), "credentials", countingExchange(&calls, radiusResult{ok: true}, nil))
+	if err != nil || !res.ok || calls.Load() != 1 {
+		t.Errorf("got %+v, %v after %d exchanges, want one direct exchange", res, err, calls.Load())
+	}
+}
+
+func TestAuthenticateCoordinated(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+	mock.SetDelay(200 * time.Millisecond)
+	_, redisAddr := startFakeRedis(t)
+
+	// Two instances sharing one Redis stand in for a multi-instance
+	// deployment; neither caches, so only coordination can save a request
+	newInstance := func() *HTTPRadiusAuth {
+		r := &HTTPRadiusAuth{
+			Servers:             []string{mock.Addr()},
+			Secret:              testradius.Secret,
+			CacheKeySecret:      "shared key secret",
+			CoordinationBackend: coordinationRedis,
+			RedisAddr:           redisAddr,
+		}
+		provision(t, r)
+		return r
+	}
+	instances := []*HTTPRadiusAuth{newInstance(), newInstance()}
+
+	var wg sync.WaitGroup
+	for i, r := range instances {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := newCaddyRequest("alice", "password")
+			if _, ok, err := r.Authenticate(httptest.NewRecorder(), req); !ok || err != nil {
+				t.Errorf("instance %d: Authenticate = %v, %v", i, ok, err)
+			}
+		}()
+		// Let the first instance take the lock
+		time.Sleep(50 * time.Millisecond)
+	}
+	wg.Wait()
+
+	if n := mock.RequestCount(); n != 1 {
+		t.Errorf("RADIUS was called %d times, want 1", n)
+	}
+}
@@ -0,0 +1,277 @@
+package caddy2_radius_auth
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2869"
+)
+
+// RFC 5090 attribute types. The RADIUS server, which knows the password,
+// verifies the digest response; the module only relays it.
+const (
+	digestResponseType   radius.Type = 103
+	digestRealmType      radius.Type = 104
+	digestNonceType      radius.Type = 105
+	digestMethodType     radius.Type = 108
+	digestURIType        radius.Type = 109
+	digestQopType        radius.Type = 110
+	digestAlgorithmType  radius.Type = 111
+	digestCNonceType     radius.Type = 113
+	digestNonceCountType radius.Type = 114
+	digestUsernameType   radius.Type = 115
+)
+
+// digestNonceLifetime is how long a nonce is accepted; clients then retry
+// with a fresh one without asking the user again
+const digestNonceLifetime = 5 * time.Minute
+
+// digestNonceUse is the highest nonce count seen with one nonce
+type digestNonceUse struct {
+	count  uint64
+	issued time.Time
+}
+
+// digestNonceUses remembers the nonce counts used with each nonce until the
+// nonce expires, so that a captured digest response cannot be replayed
+type digestNonceUses struct {
+	mu        sync.Mutex
+	uses      map[string]digestNonceUse
+	lastSweep time.Time
+}
+
+func newDigestNonceUses() *digestNonceUses {
+	return &digestNonceUses{uses: make(map[string]digestNonceUse)}
+}
+
+// use records count for nonce and reports whether it is higher than every
+// count used with nonce before. Responses without qop carry no count, so
+// their nonce can be used once.
+func (u *digestNonceUses) use(nonce string, count uint64, issued time.Time) bool {
+	now := time.Now()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	// Expired nonces are refused before they get here, so their entries
+	// can go; sweeping once per lifetime keeps the map bounded
+	if now.Sub(u.lastSweep) > digestNonceLifetime {
+		for n, use := range u.uses {
+			if now.Sub(use.issued) > digestNonceLifetime {
+				delete(u.uses, n)
+			}
+		}
+		u.lastSweep = now
+	}
+
+	if last, seen := u.uses[nonce]; seen && count <= last.count {
+		return false
+	}
+	u.uses[nonce] = digestNonceUse{count: count, issued: issued}
+	return true
+}
+
+// errStaleNonce is returned for a digest response to an expired nonce
+var errStaleNonce = errors.New("stale digest nonce")
+
+// digestCredentials are the parameters of an Authorization: Digest header
+type digestCredentials struct {
+	username  string
+	realm     string
+	nonce     string
+	uri       string
+	response  string
+	qop       string
+	nc        string
+	count     uint64 // nc as a number, 0 without qop
+	cnonce    string
+	algorithm string
+	method    string // Request method, part of the digest
+}
+
+// parseDigestAuthorization parses the parameters of a Digest authorization
+// header value (RFC 7616), without the "Digest " prefix
+func parseDigestAuthorization(value string) (*digestCredentials, error) {
+	params := make(map[string]string)
+	for value = strings.TrimSpace(value); value != ""; {
+		name, rest, ok := strings.Cut(value, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed digest parameter: %s", value)
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		rest = strings.TrimSpace(rest)
+		var val string
+		if strings.HasPrefix(rest, `"`) {
+			end := 1
+			var b strings.Builder
+			for ; end < len(rest) && rest[end] != '"'; end++ {
+				if rest[end] == '\\' && end+1 < len(rest) {
+					end++
+				}
+				b.WriteByte(rest[end])
+			}
+			if end == len(rest) {
+				return nil, fmt.Errorf("unterminated digest parameter %s", name)
+			}
+			val, rest = b.String(), rest[end+1:]
+		} else {
+			val, rest, _ = strings.Cut(rest, ",")
+			val = strings.TrimSpace(val)
+			rest = "," + rest
+		}
+		params[name] = val
+		value = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(rest), ","))
+	}
+
+	d := &digestCredentials{
+		username:  params["username"],
+		realm:     params["realm"],
+		nonce:     params["nonce"],
+		uri:       params["uri"],
+		response:  params["response"],
+		qop:       params["qop"],
+		nc:        params["nc"],
+		cnonce:    params["cnonce"],
+		algorithm: params["algorithm"],
+	}
+	if d.username == "" || d.nonce == "" || d.uri == "" || d.response == "" {
+		return nil, fmt.Errorf("digest authorization lacks username, nonce, uri or response")
+	}
+	if d.algorithm != "" && !strings.EqualFold(d.algorithm, "MD5") {
+		return nil, fmt.Errorf("unsupported digest algorithm: %s", d.algorithm)
+	}
+	if d.qop != "" && (d.qop != "auth" || d.nc == "" || d.cnonce == "") {
+		return nil, fmt.Errorf("unsupported digest qop: %s", d.qop)
+	}
+	if d.nc != "" {
+		count, err := strconv.ParseUint(d.nc, 16, 32)
+		if err != nil || len(d.nc) != 8 {
+			return nil, fmt.Errorf("malformed digest nonce count: %s", d.nc)
+		}
+		d.count = count
+	}
+	return d, nil
+}
+
+// digestCredentials returns the Digest credentials of req. ok is false
+// when the request carries none; an error means they are unusable.
+func (r HTTPRadiusAuth) digestCredentials(req *http.Request) (d *digestCredentials, ok bool, err error) {
+	value, found := strings.CutPrefix(req.Header.Get("Authorization"), "Digest ")
+	if !found {
+		return nil, false, nil
+	}
+	d, err = parseDigestAuthorization(value)
+	if err != nil {
+		return nil, true, err
+	}
+	if d.realm != r.realmName() {
+		return nil, true, fmt.Errorf("digest realm %q does not match", d.realm)
+	}
+	// The URI is part of the digest, so a response captured for one
+	// resource cannot be replayed against another
+	if d.uri != req.RequestURI {
+		return nil, true, fmt.Errorf("digest uri %q does not match the request", d.uri)
+	}
+	issued, err := r.checkDigestNonce(d.nonce)
+	if err != nil {
+		return nil, true, err
+	}
+	// Each response must use a higher nonce count than the last one sent
+	// with its nonce. A repeated count is treated like an expired nonce,
+	// so a client that lost track retries with a fresh one.
+	if !r.digestNonces.use(d.nonce, d.count, issued) {
+		return nil, true, fmt.Errorf("digest nonce count %q was already used: %w", d.nc, errStaleNonce)
+	}
+	d.method = req.Method
+	return d, true, nil
+}
+
+// newDigestNonce returns a nonce that the module can check without keeping
+// state: the issue time and an HMAC of it under the cache key secret
+func (r HTTPRadiusAuth) newDigestNonce() string {
+	ts := make([]byte, 8)
+	binary.BigEndian.PutUint64(ts, uint64(time.Now().Unix()))
+	return hex.EncodeToString(ts) + hex.EncodeToString(r.digestNonceMAC(ts))
+}
+
+func (r HTTPRadiusAuth) digestNonceMAC(ts []byte) []byte {
+	mac := hmac.New(sha256.New, r.cacheKeySecret)
+	mac.Write([]byte("digest nonce "))
+	mac.Write(ts)
+	return mac.Sum(nil)[:16]
+}
+
+// checkDigestNonce verifies that the module issued nonce and that it has
+// not expired, and returns the time it was issued
+func (r HTTPRadiusAuth) checkDigestNonce(nonce string) (time.Time, error) {
+	b, err := hex.DecodeString(nonce)
+	if err != nil || len(b) != 8+16 {
+		return time.Time{}, fmt.Errorf("malformed digest nonce")
+	}
+	if !hmac.Equal(b[8:], r.digestNonceMAC(b[:8])) {
+		return time.Time{}, fmt.Errorf("digest nonce was not issued here")
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint64(b[:8])), 0)
+	if time.Since(issued) > digestNonceLifetime {
+		return time.Time{}, errStaleNonce
+	}
+	return issued, nil
+}
+
+// digestChallenge returns the WWW-Authenticate value offering Digest
+func (r HTTPRadiusAuth) digestChallenge(stale bool) string {
+	challenge := fmt.Sprintf(`Digest realm="%s", qop="auth", algorithm=MD5, nonce="%s"`, r.realmName(), r.newDigestNonce())
+	if stale {
+		challenge += ", stale=true"
+	}
+	return challenge
+}
+
+// setDigestAttributes adds the RFC 5090 attributes carrying d to packet,
+// signed with the Message-Authenticator the RFC requires
+func setDigestAttributes(packet *radius.Packet, d *digestCredentials) error {
+	add := func(typ radius.Type, value string) {
+		if value != "" {
+			packet.Add(typ, radius.Attribute(value))
+		}
+	}
+	add(digestResponseType, d.response)
+	add(digestRealmType, d.realm)
+	add(digestNonceType, d.nonce)
+	add(digestMethodType, d.method)
+	add(digestURIType, d.uri)
+	add(digestQopType, d.qop)
+	add(digestAlgorithmType, d.algorithm)
+	add(digestCNonceType, d.cnonce)
+	add(digestNonceCountType, d.nc)
+	add(digestUsernameType, d.username)
+	return signMessageAuthenticator(packet)
+}
+
+// signMessageAuthenticator sets the RFC 3579 Message-Authenticator of
+// packet: HMAC-MD5 over the packet with a zeroed Message-Authenticator
+func signMessageAuthenticator(packet *radius.Packet) error {
+	if err := rfc2869.MessageAuthenticator_Set(packet, make([]byte, md5.Size)); err != nil {
+		return fmt.Errorf("rfc2869: setting message authenticator error: %w", err)
+	}
+	b, err := packet.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(md5.New, packet.Secret)
+	mac.Write(b)
+	if err := rfc2869.MessageAuthenticator_Set(packet, mac.Sum(nil)); err != nil {
+		return fmt.Errorf("rfc2869: setting message authenticator error: %w", err)
+	}
+	return nil
+}
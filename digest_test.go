@@ -0,0 +1,243 @@
+package caddy2_radius_auth
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wxccs/caddy2-radius-auth/internal/testradius"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
+)
+
+// digestHeader returns an Authorization value for alice answering nonce.
+// The response itself is opaque to the module, which only relays it.
+func digestHeader(nonce, uri, nc string) string {
+	return fmt.Sprintf(`Digest username="alice", realm="restricted", nonce="%s", uri="%s", `+
+		`qop=auth, nc=%s, cnonce="0a4f113b", response="6629fae49393a05397450978507c4ef1", algorithm=MD5`,
+		nonce, uri, nc)
+}
+
+// newDigestRequest returns a request for uri carrying header
+func newDigestRequest(uri, header string) *http.Request {
+	req, _ := newCaddyRequest("", "")
+	req.Header.Set("Authorization", header)
+	req.RequestURI = uri
+	return req
+}
+
+// expiredNonce returns a nonce r issued longer than digestNonceLifetime ago
+func expiredNonce(r *HTTPRadiusAuth) string {
+	ts := make([]byte, 8)
+	binary.BigEndian.PutUint64(ts, uint64(time.Now().Add(-digestNonceLifetime-time.Minute).Unix()))
+	return hex.EncodeToString(ts) + hex.EncodeToString(r.digestNonceMAC(ts))
+}
+
+func TestParseDigestAuthorization(t *testing.T) {
+	d, err := parseDigestAuthorization(`username="Mufasa", realm="http-auth@example.org", ` +
+		`uri="/dir/index.html", algorithm=MD5, nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", ` +
+		`nc=00000001, cnonce="f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ", qop=auth, ` +
+		`response="8ca523f5e9506fed4657c9700eebdbec", opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS", ` +
+		`note="a \"quoted\" \\ value"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := digestCredentials{
+		username:  "Mufasa",
+		realm:     "http-auth@example.org",
+		nonce:     "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v",
+		uri:       "/dir/index.html",
+		response:  "8ca523f5e9506fed4657c9700eebdbec",
+		qop:       "auth",
+		nc:        "00000001",
+		count:     1,
+		cnonce:    "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ",
+		algorithm: "MD5",
+	}
+	if *d != want {
+		t.Errorf("got %+v\nwant %+v", *d, want)
+	}
+
+	for _, value := range []string{
+		`realm="r", nonce="n", uri="/", response="x"`,
+		`username="a", realm="r", uri="/", response="x"`,
+		`username="a", nonce="n", uri="/", response="x", algorithm=SHA-256`,
+		`username="a", nonce="n", uri="/", response="x", qop=auth-int, nc=00000001, cnonce="c"`,
+		`username="a", nonce="n", uri="/", response="x", qop=auth, cnonce="c"`,
+		`username="a", nonce="n", uri="/", response="x", qop=auth, nc=1, cnonce="c"`,
+		`username="a", nonce="n", uri="/", response="x", qop=auth, nc=0000000g, cnonce="c"`,
+		`username="a", nonce="n", uri="/", response="unterminated`,
+		`username`,
+	} {
+		if _, err := parseDigestAuthorization(value); err == nil {
+			t.Errorf("parsed %q", value)
+		}
+	}
+}
+
+func TestDigestNonce(t *testing.T) {
+	r := &HTTPRadiusAuth{Servers: []string{"127.0.0.1:1812"}, Secret: testradius.Secret, SupportDigest: true}
+	provision(t, r)
+
+	nonce := r.newDigestNonce()
+	if _, err := r.checkDigestNonce(nonce); err != nil {
+		t.Fatalf("fresh nonce refused: %v", err)
+	}
+
+	// Change the issue time without updating the MAC
+	tampered := "f" + nonce[1:]
+	if nonce[0] == 'f' {
+		tampered = "e" + nonce[1:]
+	}
+	if _, err := r.checkDigestNonce(tampered); err == nil {
+		t.Error("tampered nonce accepted")
+	}
+
+	other := &HTTPRadiusAuth{Servers: []string{"127.0.0.1:1812"}, Secret: testradius.Secret, SupportDigest: true}
+	provision(t, other)
+	if _, err := other.checkDigestNonce(nonce); err == nil {
+		t.Error("nonce accepted by an instance with another cache_key_secret")
+	}
+
+	if _, err := r.checkDigestNonce("not hex"); err == nil {
+		t.Error("malformed nonce accepted")
+	}
+	if _, err := r.checkDigestNonce(expiredNonce(r)); !errors.Is(err, errStaleNonce) {
+		t.Errorf("expired nonce: got %v, want %v", err, errStaleNonce)
+	}
+}
+
+func TestDigestNonceCount(t *testing.T) {
+	r := &HTTPRadiusAuth{Servers: []string{"127.0.0.1:1812"}, Secret: testradius.Secret, SupportDigest: true}
+	provision(t, r)
+	nonce := r.newDigestNonce()
+
+	for _, tc := range []struct {
+		nc      string
+		wantErr error
+	}{
+		{"00000001", nil},
+		{"00000001", errStaleNonce}, // replayed
+		{"00000003", nil},
+		{"00000002", errStaleNonce}, // lower than the last count
+	} {
+		_, ok, err := r.digestCredentials(newDigestRequest("/app", digestHeader(nonce, "/app", tc.nc)))
+		if !ok || !errors.Is(err, tc.wantErr) {
+			t.Errorf("nc %s: got ok %v, err %v, want %v", tc.nc, ok, err, tc.wantErr)
+		}
+	}
+
+	// Without qop a nonce can be used once
+	nonce = r.newDigestNonce()
+	header := fmt.Sprintf(`Digest username="alice", realm="restricted", nonce="%s", uri="/app", response="x"`, nonce)
+	if _, _, err := r.digestCredentials(newDigestRequest("/app", header)); err != nil {
+		t.Errorf("first use without qop: %v", err)
+	}
+	if _, _, err := r.digestCredentials(newDigestRequest("/app", header)); !errors.Is(err, errStaleNonce) {
+		t.Errorf("second use without qop: got %v, want %v", err, errStaleNonce)
+	}
+}
+
+func TestDigestCredentialsMismatch(t *testing.T) {
+	r := &HTTPRadiusAuth{Servers: []string{"127.0.0.1:1812"}, Secret: testradius.Secret, SupportDigest: true}
+	provision(t, r)
+
+	if _, ok, err := r.digestCredentials(newDigestRequest("/other", digestHeader(r.newDigestNonce(), "/app", "00000001"))); !ok || err == nil {
+		t.Errorf("uri mismatch: got ok %v, err %v", ok, err)
+	}
+	header := strings.Replace(digestHeader(r.newDigestNonce(), "/app", "00000001"), `realm="restricted"`, `realm="other"`, 1)
+	if _, ok, err := r.digestCredentials(newDigestRequest("/app", header)); !ok || err == nil {
+		t.Errorf("realm mismatch: got ok %v, err %v", ok, err)
+	}
+	if _, ok, err := r.digestCredentials(newDigestRequest("/app", "Basic YWxpY2U6eA==")); ok || err != nil {
+		t.Errorf("basic credentials: got ok %v, err %v", ok, err)
+	}
+}
+
+func TestDigestAuthenticate(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+	r := &HTTPRadiusAuth{Servers: []string{mock.Addr()}, Secret: testradius.Secret, SupportDigest: true}
+	provision(t, r)
+
+	// The challenge offers both schemes
+	w := httptest.NewRecorder()
+	req, _ := newCaddyRequest("", "")
+	req.Header.Del("Authorization")
+	if _, ok, _ := r.Authenticate(w, req); ok {
+		t.Fatal("request without credentials authenticated")
+	}
+	challenges := w.Header().Values("WWW-Authenticate")
+	if len(challenges) != 2 || !strings.HasPrefix(challenges[1], `Digest realm="restricted", qop="auth", algorithm=MD5, nonce="`) {
+		t.Fatalf("WWW-Authenticate = %q", challenges)
+	}
+
+	nonce := r.newDigestNonce()
+	req = newDigestRequest("/app?x=1", digestHeader(nonce, "/app?x=1", "00000001"))
+	req.Method = http.MethodPost
+	user, ok, err := r.Authenticate(httptest.NewRecorder(), req)
+	if err != nil || !ok || user.ID != "alice" {
+		t.Fatalf("Authenticate = %q, %v, %v", user.ID, ok, err)
+	}
+
+	requests := mock.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("RADIUS received %d requests, want 1", len(requests))
+	}
+	packet := requests[0]
+	for typ, want := range map[radius.Type]string{
+		digestResponseType:   "6629fae49393a05397450978507c4ef1",
+		digestRealmType:      "restricted",
+		digestNonceType:      nonce,
+		digestMethodType:     http.MethodPost,
+		digestURIType:        "/app?x=1",
+		digestQopType:        "auth",
+		digestAlgorithmType:  "MD5",
+		digestCNonceType:     "0a4f113b",
+		digestNonceCountType: "00000001",
+		digestUsernameType:   "alice",
+	} {
+		if got := string(packet.Get(typ)); got != want {
+			t.Errorf("attribute %d = %q, want %q", typ, got, want)
+		}
+	}
+	if rfc2865.UserName_GetString(packet) != "alice" {
+		t.Errorf("User-Name = %q, want alice", rfc2865.UserName_GetString(packet))
+	}
+	if packet.Get(rfc2865.UserPassword_Type) != nil {
+		t.Error("a digest request carries User-Password")
+	}
+	if len(rfc2869.MessageAuthenticator_Get(packet)) != 16 {
+		t.Error("a digest request lacks Message-Authenticator")
+	}
+
+	// Replaying the same header asks the client for a fresh nonce and
+	// does not reach RADIUS
+	req = newDigestRequest("/app?x=1", digestHeader(nonce, "/app?x=1", "00000001"))
+	w = httptest.NewRecorder()
+	if _, ok, _ := r.Authenticate(w, req); ok {
+		t.Error("replayed digest response authenticated")
+	}
+	if !strings.Contains(strings.Join(w.Header().Values("WWW-Authenticate"), "\n"), "stale=true") {
+		t.Errorf("WWW-Authenticate after a replay = %q, want stale=true", w.Header().Values("WWW-Authenticate"))
+	}
+
+	// An expired nonce is answered the same way
+	req = newDigestRequest("/app", digestHeader(expiredNonce(r), "/app", "00000001"))
+	w = httptest.NewRecorder()
+	if _, ok, _ := r.Authenticate(w, req); ok {
+		t.Error("digest response to an expired nonce authenticated")
+	}
+	if !strings.Contains(strings.Join(w.Header().Values("WWW-Authenticate"), "\n"), "stale=true") {
+		t.Errorf("WWW-Authenticate after an expired nonce = %q, want stale=true", w.Header().Values("WWW-Authenticate"))
+	}
+	if n := mock.RequestCount(); n != 1 {
+		t.Errorf("RADIUS received %d requests, want 1", n)
+	}
+}
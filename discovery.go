@@ -0,0 +1,214 @@
+package caddy2_radius_auth
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// serverPool holds the servers in use, their circuit breakers and health.
+// With SRV discovery the list is replaced at runtime, so it is only read
+// under lock.
+type serverPool struct {
+	mu           sync.RWMutex
+	servers      []string
+	breakers     map[string]*circuitBreaker
+	serverHealth map[string]bool          // Health check results; servers not yet checked are healthy
+	outcomes     map[string]serverOutcome // Latest exchange per server, for the admin API
+	newBreaker   func() *circuitBreaker   // nil when circuit breakers are disabled
+}
+
+// serverOutcome is the result of the latest exchange with a server
+type serverOutcome struct {
+	lastError   string        // Error of the latest exchange, empty if it succeeded
+	lastLatency time.Duration // Round trip of the latest successful exchange
+}
+
+// serverStatus is one entry of GET /radius_auth/servers
+type serverStatus struct {
+	Addr                string  `json:"addr"`
+	Healthy             bool    `json:"healthy"`
+	LastError           string  `json:"last_error"`
+	LastSuccessMS       float64 `json:"last_success_ms"`
+	CircuitBreakerState string  `json:"circuit_breaker_state,omitempty"`
+}
+
+func newServerPool(servers []string, newBreaker func() *circuitBreaker) *serverPool {
+	p := &serverPool{newBreaker: newBreaker}
+	p.set(servers)
+	return p
+}
+
+// list returns the current servers. The slice is replaced, never modified,
+// so callers may keep it.
+func (p *serverPool) list() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.servers
+}
+
+// healthy returns the servers not marked unhealthy by the health check. If
+// every server is unhealthy all are returned, so requests still get a chance.
+func (p *serverPool) healthy() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	servers := make([]string, 0, len(p.servers))
+	for _, s := range p.servers {
+		if healthy, ok := p.serverHealth[s]; !ok || healthy {
+			servers = append(servers, s)
+		}
+	}
+	if len(servers) == 0 {
+		return p.servers
+	}
+	return servers
+}
+
+// setHealth records the health of server and reports whether it changed
+func (p *serverPool) setHealth(server string, healthy bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !slices.Contains(p.servers, server) {
+		return false
+	}
+	previous, ok := p.serverHealth[server]
+	if !ok {
+		previous = true
+	}
+	p.serverHealth[server] = healthy
+	return previous != healthy
+}
+
+// observe records the outcome of an exchange or health check with server
+func (p *serverPool) observe(server string, latency time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !slices.Contains(p.servers, server) {
+		return
+	}
+	o := p.outcomes[server]
+	if err != nil {
+		o.lastError = err.Error()
+	} else {
+		o.lastError, o.lastLatency = "", latency
+	}
+	p.outcomes[server] = o
+}
+
+// status reports the health, latest outcome and breaker state of every server
+func (p *serverPool) status() []serverStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	list := make([]serverStatus, 0, len(p.servers))
+	for _, s := range p.servers {
+		healthy, ok := p.serverHealth[s]
+		o := p.outcomes[s]
+		status := serverStatus{
+			Addr:          s,
+			Healthy:       !ok || healthy,
+			LastError:     o.lastError,
+			LastSuccessMS: float64(o.lastLatency.Microseconds()) / 1000,
+		}
+		if b := p.breakers[s]; b != nil {
+			status.CircuitBreakerState, _ = b.state()
+		}
+		list = append(list, status)
+	}
+	return list
+}
+
+// breaker returns the circuit breaker for server, or nil if it has none
+func (p *serverPool) breaker(server string) *circuitBreaker {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.breakers[server]
+}
+
+// set replaces the server list, keeping the breaker state and health of
+// servers that remain
+func (p *serverPool) set(servers []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	breakers := make(map[string]*circuitBreaker, len(servers))
+	health := make(map[string]bool, len(servers))
+	outcomes := make(map[string]serverOutcome, len(servers))
+	for _, s := range servers {
+		if o, ok := p.outcomes[s]; ok {
+			outcomes[s] = o
+		}
+		if p.newBreaker != nil {
+			if b, ok := p.breakers[s]; ok {
+				breakers[s] = b
+			} else {
+				breakers[s] = p.newBreaker()
+			}
+		}
+		if healthy, ok := p.serverHealth[s]; ok {
+			health[s] = healthy
+		}
+	}
+	p.servers = servers
+	p.breakers = breakers
+	p.serverHealth = health
+	p.outcomes = outcomes
+}
+
+// lookupSRVServers resolves an SRV record such as "_radius._udp.example.com"
+// into host:port addresses, ordered by priority and weight
+func lookupSRVServers(ctx context.Context, name string) ([]string, error) {
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, fmt.Errorf("looking up SRV record %s: %v", name, err)
+	}
+	servers := make([]string, 0, len(records))
+	for _, rec := range records {
+		host := strings.TrimSuffix(rec.Target, ".")
+		servers = append(servers, net.JoinHostPort(host, strconv.Itoa(int(rec.Port))))
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("SRV record %s has no targets", name)
+	}
+	return servers, nil
+}
+
+// refreshSRV re-resolves SRVName every interval until ctx is done. Lookup
+// failures keep the previous server list.
+func (r HTTPRadiusAuth) refreshSRV(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		lookupCtx, cancel := context.WithTimeout(ctx, r.timeoutFor(""))
+		servers, err := lookupSRVServers(lookupCtx, r.SRVName)
+		cancel()
+		if err != nil {
+			r.logger.Warn("refreshing RADIUS servers from SRV record failed", zap.Error(err))
+			continue
+		}
+		if !sameServers(servers, r.pool.list()) {
+			r.logger.Info("RADIUS servers changed", zap.Strings("servers", servers))
+		}
+		// Set even when unchanged, as the weighted order varies between lookups
+		r.pool.set(servers)
+	}
+}
+
+// sameServers reports whether a and b hold the same servers in any order
+func sameServers(a, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
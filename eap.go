@@ -0,0 +1,125 @@
+package caddy2_radius_auth
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
+)
+
+// EAP codes and types used by EAP-MD5 (RFC 3748)
+const (
+	eapCodeRequest  = 1
+	eapCodeResponse = 2
+
+	eapTypeIdentity = 1
+	eapTypeMD5      = 4
+)
+
+// eapPacket is a decoded EAP packet
+type eapPacket struct {
+	code       byte
+	identifier byte
+	typ        byte
+	data       []byte
+}
+
+func (p eapPacket) encode() []byte {
+	b := make([]byte, 5+len(p.data))
+	b[0] = p.code
+	b[1] = p.identifier
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	b[4] = p.typ
+	copy(b[5:], p.data)
+	return b
+}
+
+func decodeEAP(b []byte) (eapPacket, error) {
+	if len(b) < 5 || int(binary.BigEndian.Uint16(b[2:4])) != len(b) {
+		return eapPacket{}, errors.New("malformed EAP message")
+	}
+	return eapPacket{code: b[0], identifier: b[1], typ: b[4], data: b[5:]}, nil
+}
+
+// exchangeEAP authenticates username against server with EAP-MD5: it sends
+// an EAP-Response/Identity, answers the server's MD5-Challenge with a hash of
+// the password, and returns the result of that final exchange. Each step goes
+// through exchangeServer, so retries, breakers and limits apply per packet.
+func (r HTTPRadiusAuth) exchangeEAP(ctx context.Context, server, username, password string, info requestInfo) serverResult {
+	identity := eapPacket{code: eapCodeResponse, typ: eapTypeIdentity, data: []byte(username)}
+	packet, err := r.newEAPRequest(server, username, info, identity, nil)
+	if err != nil {
+		return serverResult{err: err, server: server}
+	}
+	res := r.exchangeServer(ctx, packet, server)
+	if res.err != nil || res.code != radius.CodeAccessChallenge {
+		// A reject or accept without a challenge ends the conversation
+		return res
+	}
+
+	challenge, err := decodeEAP(rfc2869.EAPMessage_Get(res.resp))
+	if err != nil {
+		return serverResult{err: fmt.Errorf("%s: %v", server, err), server: server}
+	}
+	if challenge.code != eapCodeRequest || challenge.typ != eapTypeMD5 {
+		return serverResult{err: fmt.Errorf("%s requested unsupported EAP type %d", server, challenge.typ), server: server}
+	}
+	if len(challenge.data) < 1 || len(challenge.data) < 1+int(challenge.data[0]) {
+		return serverResult{err: fmt.Errorf("%s: malformed EAP-MD5 challenge", server), server: server}
+	}
+	value := challenge.data[1 : 1+int(challenge.data[0])]
+
+	// RFC 1994: MD5(identifier || password || challenge)
+	h := md5.New()
+	h.Write([]byte{challenge.identifier})
+	h.Write([]byte(password))
+	h.Write(value)
+	response := eapPacket{
+		code:       eapCodeResponse,
+		identifier: challenge.identifier,
+		typ:        eapTypeMD5,
+		data:       append([]byte{md5.Size}, h.Sum(nil)...),
+	}
+	packet, err = r.newEAPRequest(server, username, info, response, res.resp)
+	if err != nil {
+		return serverResult{err: err, server: server}
+	}
+	res = r.exchangeServer(ctx, packet, server)
+	if res.err == nil && res.code == radius.CodeAccessChallenge {
+		return serverResult{err: fmt.Errorf("%s sent an unexpected EAP challenge", server), server: server}
+	}
+	return res
+}
+
+// newEAPRequest builds an Access-Request carrying msg as EAP-Message, with
+// the State and Proxy-State of the challenge it answers, if any, and the
+// Message-Authenticator EAP requires
+func (r HTTPRadiusAuth) newEAPRequest(server, username string, info requestInfo, msg eapPacket, challenge *radius.Packet) (*radius.Packet, error) {
+	packet, err := r.newRequest(server, username, info)
+	if err != nil {
+		return nil, err
+	}
+	if err := rfc2869.EAPMessage_Set(packet, msg.encode()); err != nil {
+		return nil, fmt.Errorf("rfc2869: setting eap message error: %w", err)
+	}
+	if challenge != nil {
+		if state := rfc2865.State_Get(challenge); state != nil {
+			if err := rfc2865.State_Set(packet, state); err != nil {
+				return nil, fmt.Errorf("rfc2865: setting state error: %w", err)
+			}
+		}
+		if err := addProxyState(packet, proxyStates(challenge)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := signMessageAuthenticator(packet); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
@@ -0,0 +1,63 @@
+package caddy2_radius_auth
+
+import (
+	"crypto/rand"
+	"fmt"
+	"maps"
+	"slices"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Fallback providers consulted when no RADIUS server answers
+const fallbackBasicAuth = "basic_auth"
+
+// checkFallback validates the FallbackBasicAuth settings and prepares the
+// hash compared against for unknown users
+func (r *HTTPRadiusAuth) checkFallback() error {
+	switch r.FallbackProvider {
+	case "":
+		if len(r.FallbackBasicAuth) > 0 {
+			return fmt.Errorf("fallback_basic_auth requires fallback_provider basic_auth")
+		}
+		return nil
+	case fallbackBasicAuth:
+	default:
+		return fmt.Errorf("unknown fallback_provider: %s", r.FallbackProvider)
+	}
+	if len(r.FallbackBasicAuth) == 0 {
+		return fmt.Errorf("fallback_provider basic_auth requires at least one user in fallback_basic_auth")
+	}
+
+	cost := bcrypt.MinCost
+	for _, user := range slices.Sorted(maps.Keys(r.FallbackBasicAuth)) {
+		c, err := bcrypt.Cost([]byte(r.FallbackBasicAuth[user]))
+		if err != nil {
+			return fmt.Errorf("fallback_basic_auth: invalid bcrypt hash for %s: %v", user, err)
+		}
+		cost = max(cost, c)
+	}
+
+	// Unknown users are compared against a hash of the same cost, so the
+	// response time does not reveal which users exist
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return fmt.Errorf("generating fallback dummy hash: %v", err)
+	}
+	dummy, err := bcrypt.GenerateFromPassword(secret, cost)
+	if err != nil {
+		return fmt.Errorf("generating fallback dummy hash: %v", err)
+	}
+	r.fallbackDummy = dummy
+	return nil
+}
+
+// fallbackAuthenticate checks the credentials against FallbackBasicAuth
+func (r HTTPRadiusAuth) fallbackAuthenticate(username, password string) bool {
+	hash, ok := r.FallbackBasicAuth[username]
+	if !ok {
+		bcrypt.CompareHashAndPassword(r.fallbackDummy, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
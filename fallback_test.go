@@ -0,0 +1,93 @@
+package caddy2_radius_auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/wxccs/caddy2-radius-auth/internal/testradius"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/crypto/bcrypt"
+	"layeh.com/radius"
+)
+
+func TestFallbackBasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("local-password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Requests for alice and bob are dropped; carol is rejected by RADIUS
+	mock := testradius.NewMockServer(t, map[string]radius.Code{
+		"alice": 0,
+		"bob":   0,
+		"carol": radius.CodeAccessReject,
+	})
+	r := &HTTPRadiusAuth{
+		Servers:          []string{mock.Addr()},
+		Secret:           testradius.Secret,
+		Timeout:          "100ms",
+		FallbackProvider: fallbackBasicAuth,
+		FallbackBasicAuth: map[string]string{
+			"alice": string(hash),
+			"carol": string(hash),
+		},
+	}
+	provision(t, r)
+	core, logs := observer.New(zapcore.WarnLevel)
+	r.logger = zap.New(core)
+
+	for _, tc := range []struct {
+		name, username, password string
+		want                     bool
+		wantFallback             bool
+	}{
+		{"fallback accepts", "alice", "local-password", true, true},
+		{"fallback rejects wrong password", "alice", "wrong", false, true},
+		{"fallback rejects unknown user", "bob", "local-password", false, true},
+		// RADIUS answered, so its reject stands
+		{"no fallback on reject", "carol", "local-password", false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			before := logs.FilterMessage("RADIUS unavailable, checking fallback credentials").Len()
+			req, _ := newCaddyRequest(tc.username, tc.password)
+			w := httptest.NewRecorder()
+			_, ok, err := r.Authenticate(w, req)
+			if ok != tc.want || err != nil {
+				t.Fatalf("Authenticate = %v, %v, want %v", ok, err, tc.want)
+			}
+			if !ok && w.Code != http.StatusUnauthorized {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+			}
+			fallback := logs.FilterMessage("RADIUS unavailable, checking fallback credentials").Len() > before
+			if fallback != tc.wantFallback {
+				t.Errorf("fallback triggered = %v, want %v", fallback, tc.wantFallback)
+			}
+		})
+	}
+}
+
+func TestFallbackBasicAuthInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		provider string
+		users    map[string]string
+	}{
+		{"unknown provider", "ldap", map[string]string{"alice": "x"}},
+		{"no users", fallbackBasicAuth, nil},
+		{"users without provider", "", map[string]string{"alice": "x"}},
+		{"invalid hash", fallbackBasicAuth, map[string]string{"alice": "not a hash"}},
+	} {
+		r := &HTTPRadiusAuth{
+			Servers:           []string{"127.0.0.1:1812"},
+			Secret:            testradius.Secret,
+			FallbackProvider:  tc.provider,
+			FallbackBasicAuth: tc.users,
+		}
+		if err := r.Provision(newTestContext(t)); err == nil {
+			r.Cleanup()
+			t.Errorf("%s: Provision accepted the configuration", tc.name)
+		}
+	}
+}
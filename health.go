@@ -0,0 +1,50 @@
+package caddy2_radius_auth
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// runHealthChecks probes every server each interval until ctx is done,
+// marking servers that do not answer as unhealthy
+func (r HTTPRadiusAuth) runHealthChecks(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		r.checkHealth(ctx)
+		for i := range r.Realms {
+			r.withRealm(&r.Realms[i]).checkHealth(ctx)
+		}
+	}
+}
+
+// checkHealth probes the servers of r.pool once. Any reply, typically an
+// Access-Reject, counts as healthy.
+func (r HTTPRadiusAuth) checkHealth(ctx context.Context) {
+	for _, server := range r.pool.list() {
+		probeCtx, cancel := context.WithTimeout(ctx, r.timeoutFor(server))
+		start := time.Now()
+		_, err := r.probeServer(probeCtx, server)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		r.pool.observe(server, time.Since(start), err)
+
+		if r.pool.setHealth(server, err == nil) {
+			if err == nil {
+				r.logger.Info("RADIUS server is healthy again", zap.String("server", server))
+			} else {
+				r.logger.Warn("RADIUS server failed health check", zap.String("server", server), zap.Error(err))
+			}
+		}
+	}
+}
@@ -0,0 +1,197 @@
+// Package dictionary parses RADIUS dictionaries in the FreeRADIUS format, so
+// vendor-specific attributes can be referred to by name.
+//
+// The supported subset is:
+//
+//	VENDOR       <name> <number>
+//	BEGIN-VENDOR <name>
+//	END-VENDOR   <name>
+//	ATTRIBUTE    <name> <number> <type> [<vendor>|<flags>]
+//	VALUE        <attribute> <name> <number>
+//	$INCLUDE     <file>
+//
+// Attribute flags such as "encrypt=1" are ignored, as are other keywords.
+package dictionary
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxIncludeDepth bounds $INCLUDE nesting, catching include loops
+const maxIncludeDepth = 16
+
+// Vendor is a vendor declared with VENDOR
+type Vendor struct {
+	Name string
+	ID   uint32
+}
+
+// Attribute is an attribute declared with ATTRIBUTE. Vendor is 0 for
+// standard attributes.
+type Attribute struct {
+	Name   string
+	Code   uint8
+	Type   string // Data type as written, e.g. "string", "integer" or "ipaddr"
+	Vendor uint32
+	Values map[string]uint32 // Named values declared with VALUE
+}
+
+// Dictionary is the result of parsing one or more dictionary files
+type Dictionary struct {
+	Vendors    []Vendor
+	Attributes []*Attribute
+}
+
+// parser holds the state shared by a file and the files it includes
+type parser struct {
+	dict    *Dictionary
+	vendors map[string]uint32
+	attrs   map[string]*Attribute // lower-case name -> attribute
+}
+
+func newParser() *parser {
+	return &parser{
+		dict:    new(Dictionary),
+		vendors: make(map[string]uint32),
+		attrs:   make(map[string]*Attribute),
+	}
+}
+
+// ParseFiles parses the given dictionary files in order. Later files may
+// refer to vendors and attributes declared by earlier ones.
+func ParseFiles(paths ...string) (*Dictionary, error) {
+	p := newParser()
+	for _, path := range paths {
+		if err := p.parseFile(path, 0); err != nil {
+			return nil, err
+		}
+	}
+	return p.dict, nil
+}
+
+func (p *parser) parseFile(path string, depth int) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("%s: $INCLUDE nested too deeply", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return p.parse(f, path, depth)
+}
+
+func (p *parser) parse(r io.Reader, name string, depth int) error {
+	var vendor uint32 // Set between BEGIN-VENDOR and END-VENDOR
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		errorf := func(format string, args ...any) error {
+			return fmt.Errorf("%s:%d: %s", name, line, fmt.Sprintf(format, args...))
+		}
+
+		switch strings.ToUpper(fields[0]) {
+		case "VENDOR":
+			if len(fields) < 3 {
+				return errorf("VENDOR requires a name and a number")
+			}
+			id, err := parseNumber(fields[2], 32)
+			if err != nil {
+				return errorf("invalid vendor number %s", fields[2])
+			}
+			p.vendors[strings.ToLower(fields[1])] = uint32(id)
+			p.dict.Vendors = append(p.dict.Vendors, Vendor{Name: fields[1], ID: uint32(id)})
+
+		case "BEGIN-VENDOR":
+			if len(fields) < 2 {
+				return errorf("BEGIN-VENDOR requires a vendor name")
+			}
+			id, ok := p.vendors[strings.ToLower(fields[1])]
+			if !ok {
+				return errorf("unknown vendor %s", fields[1])
+			}
+			vendor = id
+
+		case "END-VENDOR":
+			vendor = 0
+
+		case "ATTRIBUTE":
+			if len(fields) < 4 {
+				return errorf("ATTRIBUTE requires a name, a number and a type")
+			}
+			code, err := parseNumber(fields[2], 8)
+			if err != nil || code == 0 {
+				return errorf("invalid attribute number %s", fields[2])
+			}
+			attr := &Attribute{
+				Name:   fields[1],
+				Code:   uint8(code),
+				Type:   strings.ToLower(fields[3]),
+				Vendor: vendor,
+			}
+			// The old format names the vendor in the fourth field; flags
+			// contain "=" or ","
+			if len(fields) > 4 && !strings.ContainsAny(fields[4], "=,") {
+				id, ok := p.vendors[strings.ToLower(fields[4])]
+				if !ok {
+					return errorf("unknown vendor %s", fields[4])
+				}
+				attr.Vendor = id
+			}
+			p.attrs[strings.ToLower(attr.Name)] = attr
+			p.dict.Attributes = append(p.dict.Attributes, attr)
+
+		case "VALUE":
+			if len(fields) < 4 {
+				return errorf("VALUE requires an attribute, a name and a number")
+			}
+			attr, ok := p.attrs[strings.ToLower(fields[1])]
+			if !ok {
+				// Values for attributes defined elsewhere, such as the
+				// standard dictionary, are of no use without them
+				continue
+			}
+			n, err := parseNumber(fields[3], 32)
+			if err != nil {
+				return errorf("invalid value %s", fields[3])
+			}
+			if attr.Values == nil {
+				attr.Values = make(map[string]uint32)
+			}
+			attr.Values[fields[2]] = uint32(n)
+
+		case "$INCLUDE":
+			if len(fields) < 2 {
+				return errorf("$INCLUDE requires a file name")
+			}
+			path := fields[1]
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(filepath.Dir(name), path)
+			}
+			if err := p.parseFile(path, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// parseNumber parses a decimal or 0x-prefixed hexadecimal number
+func parseNumber(s string, bits int) (uint64, error) {
+	if hex, ok := strings.CutPrefix(strings.ToLower(s), "0x"); ok {
+		return strconv.ParseUint(hex, 16, bits)
+	}
+	return strconv.ParseUint(s, 10, bits)
+}
@@ -0,0 +1,214 @@
+package dictionary
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes files into a temporary directory and returns it
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestParseFiles(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		vendors []Vendor
+		attrs   []*Attribute
+	}{
+		{
+			name: "vendor block",
+			content: `
+				VENDOR       Example 0x7FFF   # hex vendor number
+				BEGIN-VENDOR Example
+				ATTRIBUTE    Example-Group 1 string
+				ATTRIBUTE    Example-Level 0x0a integer
+				END-VENDOR   Example
+				ATTRIBUTE    Standard-Attr 200 string`,
+			vendors: []Vendor{{Name: "Example", ID: 32767}},
+			attrs: []*Attribute{
+				{Name: "Example-Group", Code: 1, Type: "string", Vendor: 32767},
+				{Name: "Example-Level", Code: 10, Type: "integer", Vendor: 32767},
+				{Name: "Standard-Attr", Code: 200, Type: "string"},
+			},
+		},
+		{
+			name: "old vendor field",
+			content: `
+				VENDOR    Cisco 9
+				ATTRIBUTE Cisco-AVPair 1 string Cisco
+				ATTRIBUTE Cisco-Level 2 INTEGER cisco`,
+			vendors: []Vendor{{Name: "Cisco", ID: 9}},
+			attrs: []*Attribute{
+				{Name: "Cisco-AVPair", Code: 1, Type: "string", Vendor: 9},
+				{Name: "Cisco-Level", Code: 2, Type: "integer", Vendor: 9},
+			},
+		},
+		{
+			name: "flags are not a vendor",
+			content: `
+				VENDOR       Example 32767
+				BEGIN-VENDOR Example
+				ATTRIBUTE    Example-Secret 3 string encrypt=1
+				ATTRIBUTE    Example-Tagged 4 string has_tag,encrypt=2
+				END-VENDOR   Example`,
+			vendors: []Vendor{{Name: "Example", ID: 32767}},
+			attrs: []*Attribute{
+				{Name: "Example-Secret", Code: 3, Type: "string", Vendor: 32767},
+				{Name: "Example-Tagged", Code: 4, Type: "string", Vendor: 32767},
+			},
+		},
+		{
+			name: "values",
+			content: `
+				VALUE     Example-Level Early 9   # before its attribute: ignored
+				ATTRIBUTE Example-Level 1 integer
+				VALUE     Example-Level Low 1
+				VALUE     example-level High 0x10
+				VALUE     Framed-Protocol PPP 1   # attribute not in this dictionary`,
+			attrs: []*Attribute{
+				{Name: "Example-Level", Code: 1, Type: "integer", Values: map[string]uint32{"Low": 1, "High": 16}},
+			},
+		},
+		{
+			name: "comments and unknown keywords",
+			content: `
+				# A comment
+				PROTOCOL  RADIUS 1
+				FLAGS     internal
+				ATTRIBUTE Reply-Note 201 string   # trailing comment`,
+			attrs: []*Attribute{{Name: "Reply-Note", Code: 201, Type: "string"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := writeFiles(t, map[string]string{"dictionary": tc.content})
+			dict, err := ParseFiles(filepath.Join(dir, "dictionary"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(dict.Vendors, tc.vendors) {
+				t.Errorf("vendors = %+v, want %+v", dict.Vendors, tc.vendors)
+			}
+			if !reflect.DeepEqual(dict.Attributes, tc.attrs) {
+				t.Errorf("attributes:")
+				for _, attr := range dict.Attributes {
+					t.Errorf("  got  %+v", *attr)
+				}
+				for _, attr := range tc.attrs {
+					t.Errorf("  want %+v", *attr)
+				}
+			}
+		})
+	}
+}
+
+func TestParseFilesErrors(t *testing.T) {
+	for _, tc := range []struct {
+		content string
+		wantErr string
+	}{
+		{"VENDOR Example", "dictionary:1: VENDOR requires a name and a number"},
+		{"VENDOR Example 4294967296", "invalid vendor number"},
+		{"VENDOR Example 0xZZ", "invalid vendor number"},
+		{"BEGIN-VENDOR", "BEGIN-VENDOR requires a vendor name"},
+		{"BEGIN-VENDOR Nobody", "unknown vendor Nobody"},
+		{"ATTRIBUTE Example 1", "ATTRIBUTE requires a name, a number and a type"},
+		{"ATTRIBUTE Example 256 string", "invalid attribute number 256"},
+		{"ATTRIBUTE Example 0x100 string", "invalid attribute number 0x100"},
+		{"ATTRIBUTE Example 0 string", "invalid attribute number 0"},
+		{"ATTRIBUTE Example -1 string", "invalid attribute number -1"},
+		{"ATTRIBUTE Example 1 string Nobody", "unknown vendor Nobody"},
+		{"ATTRIBUTE Example 1 integer\nVALUE Example Low", "dictionary:2: VALUE requires"},
+		{"ATTRIBUTE Example 1 integer\nVALUE Example Low one", "invalid value one"},
+		{"$INCLUDE", "$INCLUDE requires a file name"},
+		{"$INCLUDE missing", "missing"},
+	} {
+		dir := writeFiles(t, map[string]string{"dictionary": tc.content})
+		_, err := ParseFiles(filepath.Join(dir, "dictionary"))
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%q: got error %v, want %q", tc.content, err, tc.wantErr)
+		}
+	}
+}
+
+func TestParseFilesInclude(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"dictionary": `
+			$INCLUDE vendors/dictionary.example
+			ATTRIBUTE Example-Extra 3 string Example`,
+		"vendors/dictionary.example": `
+			VENDOR Example 32767
+			$INCLUDE dictionary.values`,
+		"vendors/dictionary.values": `
+			ATTRIBUTE Example-Level 1 integer Example
+			VALUE     Example-Level Low 1`,
+	})
+	dict, err := ParseFiles(filepath.Join(dir, "dictionary"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Attribute{
+		{Name: "Example-Level", Code: 1, Type: "integer", Vendor: 32767, Values: map[string]uint32{"Low": 1}},
+		{Name: "Example-Extra", Code: 3, Type: "string", Vendor: 32767},
+	}
+	if !reflect.DeepEqual(dict.Attributes, want) {
+		t.Errorf("attributes = %+v, want %+v", dict.Attributes, want)
+	}
+
+	// Later files see what earlier ones declared
+	other := writeFiles(t, map[string]string{"dictionary.local": "ATTRIBUTE Example-Local 4 string Example"})
+	dict, err = ParseFiles(filepath.Join(dir, "dictionary"), filepath.Join(other, "dictionary.local"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(dict.Attributes); n != 3 || dict.Attributes[2].Vendor != 32767 {
+		t.Errorf("attributes = %+v, want Example-Local from the second file", dict.Attributes)
+	}
+}
+
+func TestParseFilesIncludeDepth(t *testing.T) {
+	// A chain exactly maxIncludeDepth includes deep is allowed
+	files := map[string]string{}
+	for i := 0; i < maxIncludeDepth; i++ {
+		files[fmt.Sprintf("d%d", i)] = fmt.Sprintf("$INCLUDE d%d", i+1)
+	}
+	files[fmt.Sprintf("d%d", maxIncludeDepth)] = "ATTRIBUTE Deep 1 string"
+	dir := writeFiles(t, files)
+	dict, err := ParseFiles(filepath.Join(dir, "d0"))
+	if err != nil {
+		t.Fatalf("%d includes deep: %v", maxIncludeDepth, err)
+	}
+	if len(dict.Attributes) != 1 {
+		t.Errorf("attributes = %+v, want Deep", dict.Attributes)
+	}
+
+	// One more is not
+	files[fmt.Sprintf("d%d", maxIncludeDepth)] = fmt.Sprintf("$INCLUDE d%d", maxIncludeDepth+1)
+	files[fmt.Sprintf("d%d", maxIncludeDepth+1)] = "ATTRIBUTE Deep 1 string"
+	dir = writeFiles(t, files)
+	if _, err := ParseFiles(filepath.Join(dir, "d0")); err == nil || !strings.Contains(err.Error(), "nested too deeply") {
+		t.Errorf("%d includes deep: got %v, want a nesting error", maxIncludeDepth+1, err)
+	}
+
+	// An include loop hits the same limit
+	dir = writeFiles(t, map[string]string{"a": "$INCLUDE b", "b": "$INCLUDE a"})
+	if _, err := ParseFiles(filepath.Join(dir, "a")); err == nil || !strings.Contains(err.Error(), "nested too deeply") {
+		t.Errorf("include loop: got %v, want a nesting error", err)
+	}
+}
@@ -0,0 +1,292 @@
+// Package testradius provides an in-process RADIUS server for tests, so the
+// module can be exercised without a real RADIUS deployment.
+package testradius
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+// Secret is the shared secret used by every MockServer
+const Secret = "testing123"
+
+// MockServer is a RADIUS server that answers Access-Requests with a fixed
+// code per username and acknowledges every Accounting-Request
+type MockServer struct {
+	conn      net.PacketConn
+	ln        net.Listener
+	server    *radius.PacketServer
+	responses map[string]radius.Code
+
+	mu       sync.Mutex
+	requests []*radius.Packet
+	delay    time.Duration
+	replies  map[string]func(*radius.Packet)
+	inFlight int
+	peak     int
+	failures int
+	accepted int
+	idle     time.Duration
+}
+
+// NewMockServer starts a MockServer on a random local UDP port. Requests for
+// usernames in responses are answered with the mapped code; a code of 0
+// drops the request so the client times out. Unknown usernames are rejected.
+// The server is shut down when the test finishes.
+func NewMockServer(t testing.TB, responses map[string]radius.Code) *MockServer {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("testradius: listening: %v", err)
+	}
+
+	m := &MockServer{conn: conn, responses: responses}
+	m.server = &radius.PacketServer{
+		SecretSource: radius.StaticSecretSource([]byte(Secret)),
+		Handler:      radius.HandlerFunc(m.serveRADIUS),
+	}
+	go m.server.Serve(conn)
+
+	t.Cleanup(func() {
+		m.server.Shutdown(context.Background())
+	})
+	return m
+}
+
+// NewMockTLSServer is like NewMockServer but serves RadSec (RFC 6614) on a
+// random local TCP port using config
+func NewMockTLSServer(t testing.TB, responses map[string]radius.Code, config *tls.Config) *MockServer {
+	t.Helper()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatalf("testradius: listening: %v", err)
+	}
+	return newStreamServer(t, ln, responses)
+}
+
+// NewMockTCPServer is like NewMockServer but serves RADIUS over TCP
+// (RFC 6613) on a random local port
+func NewMockTCPServer(t testing.TB, responses map[string]radius.Code) *MockServer {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("testradius: listening: %v", err)
+	}
+	return newStreamServer(t, ln, responses)
+}
+
+// newStreamServer serves length-delimited RADIUS packets on ln
+func newStreamServer(t testing.TB, ln net.Listener, responses map[string]radius.Code) *MockServer {
+	m := &MockServer{ln: ln, responses: responses}
+	var wg sync.WaitGroup
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			m.mu.Lock()
+			m.accepted++
+			m.mu.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				m.serveStream(conn)
+			}()
+		}
+	}()
+
+	t.Cleanup(func() {
+		ln.Close()
+		wg.Wait()
+	})
+	return m
+}
+
+func (m *MockServer) serveStream(conn net.Conn) {
+	defer conn.Close()
+	for {
+		m.mu.Lock()
+		idle := m.idle
+		m.mu.Unlock()
+		if idle > 0 {
+			conn.SetReadDeadline(time.Now().Add(idle))
+		}
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		length := int(binary.BigEndian.Uint16(header[2:4]))
+		if length < 20 || length > radius.MaxPacketLength {
+			return
+		}
+		wire := make([]byte, length)
+		copy(wire, header)
+		if _, err := io.ReadFull(conn, wire[4:]); err != nil {
+			return
+		}
+
+		packet, err := radius.Parse(wire, []byte(Secret))
+		if err != nil {
+			return
+		}
+		resp := m.respond(packet)
+		if resp == nil {
+			continue
+		}
+		out, err := resp.Encode()
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(out); err != nil {
+			return
+		}
+	}
+}
+
+func (m *MockServer) serveRADIUS(w radius.ResponseWriter, r *radius.Request) {
+	if resp := m.respond(r.Packet); resp != nil {
+		w.Write(resp)
+	}
+}
+
+// respond records packet and builds its response, or returns nil to drop it
+func (m *MockServer) respond(packet *radius.Packet) *radius.Packet {
+	m.mu.Lock()
+	m.requests = append(m.requests, packet)
+	delay := m.delay
+	m.inFlight++
+	m.peak = max(m.peak, m.inFlight)
+	fail := m.failures > 0
+	if fail {
+		m.failures--
+	}
+	m.mu.Unlock()
+
+	time.Sleep(delay)
+
+	m.mu.Lock()
+	m.inFlight--
+	m.mu.Unlock()
+
+	if fail {
+		return nil
+	}
+
+	if packet.Code == radius.CodeAccountingRequest {
+		return packet.Response(radius.CodeAccountingResponse)
+	}
+
+	username := rfc2865.UserName_GetString(packet)
+	m.mu.Lock()
+	code, ok := m.responses[username]
+	m.mu.Unlock()
+	if !ok {
+		code = radius.CodeAccessReject
+	}
+	if code == 0 {
+		return nil
+	}
+
+	resp := packet.Response(code)
+	m.mu.Lock()
+	reply := m.replies[username]
+	m.mu.Unlock()
+	if reply != nil {
+		reply(resp)
+	}
+	return resp
+}
+
+// Addr returns the host:port the server listens on
+func (m *MockServer) Addr() string {
+	if m.ln != nil {
+		return m.ln.Addr().String()
+	}
+	return m.conn.LocalAddr().String()
+}
+
+// RequestCount returns how many requests the server has received
+func (m *MockServer) RequestCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.requests)
+}
+
+// ConnectionCount returns how many connections a stream server has
+// accepted; it is always 0 for UDP
+func (m *MockServer) ConnectionCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.accepted
+}
+
+// PeakConcurrency returns the largest number of requests the server has
+// handled at the same time
+func (m *MockServer) PeakConcurrency() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.peak
+}
+
+// Requests returns the packets received so far, for inspecting attributes
+func (m *MockServer) Requests() []*radius.Packet {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*radius.Packet(nil), m.requests...)
+}
+
+// SetDelay makes the server wait d before answering each request
+func (m *MockServer) SetDelay(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.delay = d
+}
+
+// SetIdleTimeout makes a stream server close connections that carry no
+// request for d, as a firewall dropping idle flows would
+func (m *MockServer) SetIdleTimeout(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.idle = d
+}
+
+// FailFirst makes the server drop the next n requests, so clients time out
+func (m *MockServer) FailFirst(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures = n
+}
+
+// SetReply registers fn to add attributes to every response sent to username
+func (m *MockServer) SetReply(username string, fn func(resp *radius.Packet)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.replies == nil {
+		m.replies = make(map[string]func(*radius.Packet))
+	}
+	m.replies[username] = fn
+}
+
+// SetResponse changes the code username is answered with, as if the user's
+// account changed on the server
+func (m *MockServer) SetResponse(username string, code radius.Code) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.responses == nil {
+		m.responses = make(map[string]radius.Code)
+	}
+	m.responses[username] = code
+}
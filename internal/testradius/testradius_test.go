@@ -0,0 +1,74 @@
+package testradius
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+func exchange(t *testing.T, addr, username string) (*radius.Packet, error) {
+	t.Helper()
+	packet := radius.New(radius.CodeAccessRequest, []byte(Secret))
+	rfc2865.UserName_SetString(packet, username)
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	return radius.Exchange(ctx, packet, addr)
+}
+
+func TestMockServer(t *testing.T) {
+	m := NewMockServer(t, map[string]radius.Code{
+		"alice": radius.CodeAccessAccept,
+		"bob":   radius.CodeAccessReject,
+		"carol": 0,
+	})
+	m.SetReply("alice", func(resp *radius.Packet) {
+		rfc2865.FilterID_SetString(resp, "admins")
+	})
+
+	for _, tc := range []struct {
+		username string
+		want     radius.Code
+	}{
+		{"alice", radius.CodeAccessAccept},
+		{"bob", radius.CodeAccessReject},
+		{"unknown", radius.CodeAccessReject},
+	} {
+		resp, err := exchange(t, m.Addr(), tc.username)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.username, err)
+		}
+		if resp.Code != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.username, resp.Code, tc.want)
+		}
+		if tc.username == "alice" && rfc2865.FilterID_GetString(resp) != "admins" {
+			t.Error("reply attributes were not added for alice")
+		}
+	}
+
+	if _, err := exchange(t, m.Addr(), "carol"); err == nil {
+		t.Error("a request mapped to code 0 was answered")
+	}
+
+	if n := m.RequestCount(); n != 4 {
+		t.Errorf("RequestCount = %d, want 4", n)
+	}
+	if got := rfc2865.UserName_GetString(m.Requests()[1]); got != "bob" {
+		t.Errorf("second request was for %q, want bob", got)
+	}
+}
+
+func TestMockServerAccounting(t *testing.T) {
+	m := NewMockServer(t, nil)
+
+	packet := radius.New(radius.CodeAccountingRequest, []byte(Secret))
+	resp, err := radius.Exchange(context.Background(), packet, m.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != radius.CodeAccountingResponse {
+		t.Errorf("got %v, want Accounting-Response", resp.Code)
+	}
+}
@@ -0,0 +1,110 @@
+package caddy2_radius_auth
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWTConfig configures issuing a JWT after a successful RADIUS authentication
+type JWTConfig struct {
+	Enabled    bool              `json:"enabled,omitempty"`     // Issue a token for every accepted user
+	SigningKey string            `json:"signing_key,omitempty"` // HMAC signing key
+	SigningAlg string            `json:"signing_alg,omitempty"` // HS256 (default), HS384 or HS512
+	Expiry     string            `json:"expiry,omitempty"`      // Token lifetime (default "1h")
+	Claims     map[string]string `json:"claims,omitempty"`      // Static claims added to every token
+	CookieName string            `json:"cookie_name,omitempty"` // Cookie carrying the token (default "radius_jwt")
+
+	method *jwt.SigningMethodHMAC
+	expiry time.Duration
+	tokens *ttlCache[issuedToken] // Issued tokens keyed by username
+}
+
+// issuedToken is a signed token and the expiry it carries
+type issuedToken struct {
+	token   string
+	expires time.Time
+}
+
+// provision applies defaults and validates the settings
+func (c *JWTConfig) provision(maxSize int) error {
+	if c.SigningKey == "" {
+		return fmt.Errorf("jwt: signing_key is required")
+	}
+	if c.SigningAlg == "" {
+		c.SigningAlg = "HS256"
+	}
+	switch c.SigningAlg {
+	case "HS256":
+		c.method = jwt.SigningMethodHS256
+	case "HS384":
+		c.method = jwt.SigningMethodHS384
+	case "HS512":
+		c.method = jwt.SigningMethodHS512
+	default:
+		return fmt.Errorf("jwt: unsupported signing_alg %s", c.SigningAlg)
+	}
+	if c.Expiry == "" {
+		c.Expiry = "1h"
+	}
+	expiry, err := time.ParseDuration(c.Expiry)
+	if err != nil || expiry <= 0 {
+		return fmt.Errorf("jwt: invalid expiry duration: %s", c.Expiry)
+	}
+	c.expiry = expiry
+	if c.CookieName == "" {
+		c.CookieName = "radius_jwt"
+	}
+	// Reuse a token while it has at least half its lifetime left
+	c.tokens = newTTLCache[issuedToken](expiry/2, maxSize, nil)
+	return nil
+}
+
+// token returns a signed token for username, reusing a recently issued one
+func (c *JWTConfig) token(username string) (issuedToken, error) {
+	if issued, ok := c.tokens.Get(username); ok {
+		return issued, nil
+	}
+
+	now := time.Now()
+	expires := now.Add(c.expiry)
+	claims := jwt.MapClaims{}
+	for k, v := range c.Claims {
+		claims[k] = v
+	}
+	claims["sub"] = username
+	claims["iat"] = now.Unix()
+	claims["exp"] = expires.Unix()
+
+	token, err := jwt.NewWithClaims(c.method, claims).SignedString([]byte(c.SigningKey))
+	if err != nil {
+		return issuedToken{}, fmt.Errorf("jwt: signing token: %v", err)
+	}
+	// exp has whole seconds, and the cookie must not outlive it
+	issued := issuedToken{token: token, expires: time.Unix(expires.Unix(), 0)}
+	c.tokens.Add(username, issued)
+	return issued, nil
+}
+
+// issueJWT hands a token for username to the client as a cookie and to
+// upstream handlers as a bearer Authorization header. The cookie expires
+// with the token, which may have been issued earlier.
+func (r HTTPRadiusAuth) issueJWT(w http.ResponseWriter, req *http.Request, username string) error {
+	issued, err := r.JWT.token(username)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     r.JWT.CookieName,
+		Value:    issued.token,
+		Path:     "/",
+		MaxAge:   max(int(time.Until(issued.expires)/time.Second), 1),
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	req.Header.Set("Authorization", "Bearer "+issued.token)
+	return nil
+}
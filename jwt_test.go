@@ -0,0 +1,215 @@
+package caddy2_radius_auth
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/wxccs/caddy2-radius-auth/internal/testradius"
+	"layeh.com/radius"
+)
+
+// parseJWT verifies token with key and alg and returns its claims
+func parseJWT(t *testing.T, token, key, alg string) jwt.MapClaims {
+	t.Helper()
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (any, error) {
+		return []byte(key), nil
+	}, jwt.WithValidMethods([]string{alg}))
+	if err != nil {
+		t.Fatalf("parsing token: %v", err)
+	}
+	return claims
+}
+
+// jwtCookie returns the cookie named name set on w
+func jwtCookie(t *testing.T, w *httptest.ResponseRecorder, name string) *http.Cookie {
+	t.Helper()
+	for _, c := range w.Result().Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	t.Fatalf("no %s cookie in %q", name, w.Header().Values("Set-Cookie"))
+	return nil
+}
+
+func TestJWTClaims(t *testing.T) {
+	for _, alg := range []string{"HS256", "HS384", "HS512"} {
+		c := &JWTConfig{
+			SigningKey: "jwt key",
+			SigningAlg: alg,
+			Expiry:     "10m",
+			Claims:     map[string]string{"iss": "caddy", "sub": "overridden"},
+		}
+		if err := c.provision(10); err != nil {
+			t.Fatal(err)
+		}
+		before := time.Now().Unix()
+		issued, err := c.token("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims := parseJWT(t, issued.token, "jwt key", alg)
+		if claims["sub"] != "alice" || claims["iss"] != "caddy" {
+			t.Errorf("%s: claims = %v, want sub alice and iss caddy", alg, claims)
+		}
+		iat, _ := claims.GetIssuedAt()
+		exp, _ := claims.GetExpirationTime()
+		if iat == nil || exp == nil || iat.Unix() < before || exp.Unix() != iat.Unix()+600 {
+			t.Errorf("%s: iat %v, exp %v, want exp ten minutes after iat", alg, iat, exp)
+		}
+		if !issued.expires.Equal(exp.Time) {
+			t.Errorf("%s: cached expiry %v, token exp %v", alg, issued.expires, exp.Time)
+		}
+
+		// The token does not verify with another key or algorithm
+		if _, err := jwt.Parse(issued.token, func(*jwt.Token) (any, error) { return []byte("other key"), nil }); err == nil {
+			t.Errorf("%s: token verified with another key", alg)
+		}
+		other := map[string]string{"HS256": "HS512", "HS384": "HS256", "HS512": "HS384"}[alg]
+		if _, err := jwt.Parse(issued.token, func(*jwt.Token) (any, error) { return []byte("jwt key"), nil },
+			jwt.WithValidMethods([]string{other})); err == nil {
+			t.Errorf("%s: token accepted as %s", alg, other)
+		}
+	}
+}
+
+func TestJWTReused(t *testing.T) {
+	c := &JWTConfig{SigningKey: "jwt key", Expiry: "1h"}
+	if err := c.provision(10); err != nil {
+		t.Fatal(err)
+	}
+	first, err := c.token("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := c.token("alice"); again != first {
+		t.Error("token was not reused")
+	}
+	if bob, _ := c.token("bob"); bob.token == first.token {
+		t.Error("bob got alice's token")
+	}
+}
+
+func TestJWTCookie(t *testing.T) {
+	r := HTTPRadiusAuth{JWT: &JWTConfig{Enabled: true, SigningKey: "jwt key", Expiry: "1h", CookieName: "session"}}
+	if err := r.JWT.provision(10); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	if err := r.issueJWT(w, req, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	cookie := jwtCookie(t, w, "session")
+	if cookie.Path != "/" || !cookie.HttpOnly || cookie.Secure || cookie.SameSite != http.SameSiteLaxMode {
+		t.Errorf("cookie = %+v, want Path /, HttpOnly, SameSite=Lax and not Secure over HTTP", cookie)
+	}
+	if cookie.MaxAge < 3598 || cookie.MaxAge > 3600 {
+		t.Errorf("MaxAge = %d, want the token's lifetime of 3600", cookie.MaxAge)
+	}
+	if got := req.Header.Get("Authorization"); got != "Bearer "+cookie.Value {
+		t.Errorf("Authorization = %q, want the cookie's token as a bearer token", got)
+	}
+	claims := parseJWT(t, cookie.Value, "jwt key", "HS256")
+	if claims["sub"] != "alice" {
+		t.Errorf("sub = %v, want alice", claims["sub"])
+	}
+
+	req.TLS = &tls.ConnectionState{}
+	w = httptest.NewRecorder()
+	if err := r.issueJWT(w, req, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if !jwtCookie(t, w, "session").Secure {
+		t.Error("cookie is not Secure over HTTPS")
+	}
+
+	// A reused token's cookie expires with the token, not a full lifetime
+	// after it was reused
+	r.JWT.tokens.Add("bob", issuedToken{token: "reused", expires: time.Now().Add(20 * time.Minute)})
+	w = httptest.NewRecorder()
+	if err := r.issueJWT(w, req, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	cookie = jwtCookie(t, w, "session")
+	if cookie.Value != "reused" || cookie.MaxAge < 1198 || cookie.MaxAge > 1200 {
+		t.Errorf("reused token: value %q, MaxAge %d, want the token's remaining 1200 seconds", cookie.Value, cookie.MaxAge)
+	}
+}
+
+func TestJWTAuthenticate(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+	r := &HTTPRadiusAuth{
+		Servers: []string{mock.Addr()},
+		Secret:  testradius.Secret,
+		JWT:     &JWTConfig{Enabled: true, SigningKey: "jwt key", SigningAlg: "HS384"},
+	}
+	provision(t, r)
+
+	req, _ := newCaddyRequest("alice", "password")
+	w := httptest.NewRecorder()
+	if _, ok, err := r.Authenticate(w, req); !ok || err != nil {
+		t.Fatalf("Authenticate = %v, %v", ok, err)
+	}
+	cookie := jwtCookie(t, w, "radius_jwt")
+	if claims := parseJWT(t, cookie.Value, "jwt key", "HS384"); claims["sub"] != "alice" {
+		t.Errorf("sub = %v, want alice", claims["sub"])
+	}
+	if got := req.Header.Get("Authorization"); got != "Bearer "+cookie.Value {
+		t.Errorf("Authorization = %q, want the bearer token", got)
+	}
+
+	// No token for a rejected user
+	req, _ = newCaddyRequest("mallory", "password")
+	w = httptest.NewRecorder()
+	if _, ok, _ := r.Authenticate(w, req); ok {
+		t.Fatal("mallory authenticated")
+	}
+	if strings.Contains(strings.Join(w.Header().Values("Set-Cookie"), "\n"), "radius_jwt") {
+		t.Error("a rejected request got a token")
+	}
+}
+
+func TestJWTCaddyfile(t *testing.T) {
+	raw := parseToJSON(t, `radius_auth 10.0.0.1:1812 s3cret {
+		jwt {
+			signing_key {env.JWT_KEY}
+			signing_alg HS512
+			expiry 30m
+			claim iss caddy
+			claim aud intranet
+			cookie_name session
+		}
+	}`)
+	var ra HTTPRadiusAuth
+	if err := json.Unmarshal(raw, &ra); err != nil {
+		t.Fatal(err)
+	}
+	c := ra.JWT
+	if c == nil || !c.Enabled || c.SigningKey != "{env.JWT_KEY}" || c.SigningAlg != "HS512" || c.Expiry != "30m" ||
+		c.Claims["iss"] != "caddy" || c.Claims["aud"] != "intranet" || c.CookieName != "session" {
+		t.Errorf("jwt = %+v", c)
+	}
+}
+
+func TestJWTInvalid(t *testing.T) {
+	for _, c := range []JWTConfig{
+		{},
+		{SigningKey: "k", SigningAlg: "RS256"},
+		{SigningKey: "k", SigningAlg: "none"},
+		{SigningKey: "k", Expiry: "soon"},
+		{SigningKey: "k", Expiry: "-1h"},
+	} {
+		if err := c.provision(10); err == nil {
+			t.Errorf("provision accepted %+v", c)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package caddy2_radius_auth
+
+import (
+	"cmp"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/wxccs/caddy2-radius-auth/internal/testradius"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"layeh.com/radius"
+)
+
+func TestCredentialLengthLimits(t *testing.T) {
+	responses := map[string]radius.Code{
+		"alice":                 radius.CodeAccessAccept,
+		strings.Repeat("u", 20): radius.CodeAccessAccept,
+	}
+
+	for _, tc := range []struct {
+		name         string
+		maxUser      int
+		maxPass      int
+		user, pass   string
+		wantRADIUS   bool
+		wantAccepted bool
+	}{
+		{name: "within defaults", user: "alice", pass: strings.Repeat("p", 128), wantRADIUS: true, wantAccepted: true},
+		{name: "default password limit", user: "alice", pass: strings.Repeat("p", 129)},
+		{name: "default username limit", user: strings.Repeat("u", 254), pass: "password"},
+		{name: "configured password limit", maxPass: 10, user: "alice", pass: "elevenchars"},
+		{name: "configured username limit", maxUser: 20, user: strings.Repeat("u", 21), pass: "password"},
+		{name: "at configured limits", maxUser: 20, maxPass: 10, user: strings.Repeat("u", 20), pass: "tenchars10", wantRADIUS: true, wantAccepted: true},
+		{name: "huge password", user: "alice", pass: strings.Repeat("p", 1<<16)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := testradius.NewMockServer(t, responses)
+			r := &HTTPRadiusAuth{
+				Servers:           []string{mock.Addr()},
+				Secret:            testradius.Secret,
+				MaxUsernameLength: tc.maxUser,
+				MaxPasswordLength: tc.maxPass,
+			}
+			provision(t, r)
+			core, logs := observer.New(zapcore.InfoLevel)
+			r.logger = zap.New(core)
+
+			req, _ := newCaddyRequest(tc.user, tc.pass)
+			w := httptest.NewRecorder()
+			_, ok, err := r.Authenticate(w, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tc.wantAccepted {
+				t.Errorf("Authenticate = %v, want %v", ok, tc.wantAccepted)
+			}
+
+			if tc.wantRADIUS {
+				if n := mock.RequestCount(); n != 1 {
+					t.Errorf("RADIUS received %d requests, want 1", n)
+				}
+				return
+			}
+			if n := mock.RequestCount(); n != 0 {
+				t.Errorf("over-length credentials reached RADIUS (%d requests)", n)
+			}
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+			}
+			if logs.FilterMessage("refusing over-length credentials").Len() != 1 {
+				t.Error("no warning logged for over-length credentials")
+			}
+			audit := logs.FilterMessage("authentication attempt").All()
+			if len(audit) != 1 {
+				t.Fatalf("logged %d audit entries, want 1", len(audit))
+			}
+			fields := audit[0].ContextMap()
+			maxUser := cmp.Or(tc.maxUser, 253)
+			if fields["outcome"] != outcomeReject || fields["username"] != tc.user[:min(len(tc.user), maxUser)] {
+				t.Errorf("audit entry = %v, want a reject for the username cut to %d bytes", fields, maxUser)
+			}
+		})
+	}
+}
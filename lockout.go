@@ -0,0 +1,145 @@
+package caddy2_radius_auth
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lockoutEntry counts one username's consecutive rejects
+type lockoutEntry struct {
+	mu          sync.Mutex
+	failCount   int32
+	lockedUntil time.Time
+	lastFailure time.Time
+}
+
+// lockoutTracker locks usernames out after LockoutThreshold consecutive
+// rejects, for LockoutDuration
+type lockoutTracker struct {
+	threshold int32
+	duration  time.Duration
+	entries   sync.Map // username -> *lockoutEntry
+	lastSweep atomic.Int64
+}
+
+// lockoutStatus is one entry of GET /radius_auth/lockouts
+type lockoutStatus struct {
+	Username    string     `json:"username"`
+	Failures    int32      `json:"failures"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+}
+
+// newLockoutTracker validates the lockout settings and creates the tracker
+func newLockoutTracker(threshold int, duration string) (*lockoutTracker, error) {
+	if threshold <= 0 {
+		return nil, fmt.Errorf("lockout_threshold must be positive")
+	}
+	if duration == "" {
+		duration = "15m"
+	}
+	d, err := time.ParseDuration(duration)
+	if err != nil || d <= 0 {
+		return nil, fmt.Errorf("invalid lockout_duration: %s", duration)
+	}
+	return &lockoutTracker{threshold: int32(threshold), duration: d}, nil
+}
+
+// lockedFor reports how long username remains locked out, or 0
+func (t *lockoutTracker) lockedFor(username string) time.Duration {
+	v, ok := t.entries.Load(username)
+	if !ok {
+		return 0
+	}
+	e := v.(*lockoutEntry)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.lockedUntil.IsZero() {
+		return 0
+	}
+	if wait := time.Until(e.lockedUntil); wait > 0 {
+		return wait
+	}
+	// The lockout is over; the next rejects count from zero
+	e.lockedUntil = time.Time{}
+	e.failCount = 0
+	return 0
+}
+
+// failure records a reject for username and reports whether it locked the
+// username out
+func (t *lockoutTracker) failure(username string) bool {
+	now := time.Now()
+	t.sweep(now)
+	v, _ := t.entries.LoadOrStore(username, new(lockoutEntry))
+	e := v.(*lockoutEntry)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.lastFailure = now
+	if now.Before(e.lockedUntil) {
+		return false
+	}
+	e.failCount++
+	if e.failCount < t.threshold {
+		return false
+	}
+	e.failCount = 0
+	e.lockedUntil = now.Add(t.duration)
+	return true
+}
+
+// success clears the rejects recorded for username
+func (t *lockoutTracker) success(username string) {
+	t.entries.Delete(username)
+}
+
+// sweep forgets usernames that are not locked out and have not failed for
+// a whole lockout duration, at most once per duration, so rejects for many
+// distinct usernames cannot grow the map without limit
+func (t *lockoutTracker) sweep(now time.Time) {
+	last := t.lastSweep.Load()
+	if now.UnixNano()-last < int64(t.duration) || !t.lastSweep.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+	t.entries.Range(func(key, v any) bool {
+		e := v.(*lockoutEntry)
+		e.mu.Lock()
+		stale := now.After(e.lockedUntil) && now.Sub(e.lastFailure) > t.duration
+		e.mu.Unlock()
+		if stale {
+			t.entries.Delete(key)
+		}
+		return true
+	})
+}
+
+// snapshot returns the usernames with recorded rejects or an active
+// lockout, sorted by username
+func (t *lockoutTracker) snapshot() []lockoutStatus {
+	now := time.Now()
+	var list []lockoutStatus
+	t.entries.Range(func(key, v any) bool {
+		e := v.(*lockoutEntry)
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		status := lockoutStatus{Username: key.(string), Failures: e.failCount}
+		if now.Before(e.lockedUntil) {
+			until := e.lockedUntil
+			status.LockedUntil = &until
+		}
+		if status.Failures > 0 || status.LockedUntil != nil {
+			list = append(list, status)
+		}
+		return true
+	})
+	slices.SortFunc(list, func(a, b lockoutStatus) int { return strings.Compare(a.Username, b.Username) })
+	return list
+}
+
+// reset forgets every entry
+func (t *lockoutTracker) reset() {
+	t.entries.Clear()
+}
@@ -0,0 +1,177 @@
+package caddy2_radius_auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/wxccs/caddy2-radius-auth/internal/testradius"
+	"layeh.com/radius"
+)
+
+// authenticateAs runs Authenticate for user and returns the response
+func authenticateAs(t *testing.T, r *HTTPRadiusAuth, user, pass string) *httptest.ResponseRecorder {
+	t.Helper()
+	req, _ := newCaddyRequest(user, pass)
+	w := httptest.NewRecorder()
+	if _, _, err := r.Authenticate(w, req); err != nil {
+		t.Fatalf("Authenticate(%s): %v", user, err)
+	}
+	return w
+}
+
+func TestLockout(t *testing.T) {
+	const threshold = 3
+	mock := testradius.NewMockServer(t, map[string]radius.Code{
+		"alice": radius.CodeAccessReject,
+		"bob":   radius.CodeAccessAccept,
+	})
+	r := &HTTPRadiusAuth{
+		Servers:          []string{mock.Addr()},
+		Secret:           testradius.Secret,
+		NegativeCacheTTL: "1m",
+		LockoutThreshold: threshold,
+		LockoutDuration:  "1m",
+	}
+	provision(t, r)
+
+	// Only the first reject reaches RADIUS; the negative cache answers
+	// the rest, and those count towards the lockout as well
+	for i := 0; i < threshold; i++ {
+		if w := authenticateAs(t, r, "alice", "wrong"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: status = %d, want %d", i+1, w.Code, http.StatusUnauthorized)
+		}
+	}
+	if n := mock.RequestCount(); n != 1 {
+		t.Errorf("RADIUS received %d requests, want 1", n)
+	}
+
+	w := authenticateAs(t, r, "alice", "other")
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("attempt %d: status = %d, want %d", threshold+1, w.Code, http.StatusForbidden)
+	}
+	if secs, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || secs < 1 || secs > 60 {
+		t.Errorf("Retry-After = %q, want 1 to 60 seconds", w.Header().Get("Retry-After"))
+	}
+	if n := mock.RequestCount(); n != 1 {
+		t.Errorf("RADIUS received %d requests while locked out, want 1", n)
+	}
+
+	// Other users are not affected
+	if w := authenticateAs(t, r, "bob", "password"); w.Code != http.StatusOK {
+		t.Errorf("bob: status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/radius_auth/lockouts", nil)
+	if err := adminRoute(t, "/radius_auth/lockouts").ServeHTTP(rec, req); err != nil {
+		t.Fatal(err)
+	}
+	var list []lockoutStatus
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Username != "alice" || list[0].LockedUntil == nil {
+		t.Errorf("lockouts = %+v, want alice locked out", list)
+	}
+}
+
+func TestLockoutExpires(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessReject})
+	r := &HTTPRadiusAuth{
+		Servers:          []string{mock.Addr()},
+		Secret:           testradius.Secret,
+		LockoutThreshold: 2,
+		LockoutDuration:  "100ms",
+	}
+	provision(t, r)
+
+	authenticateAs(t, r, "alice", "wrong")
+	authenticateAs(t, r, "alice", "wrong")
+	if w := authenticateAs(t, r, "alice", "wrong"); w.Code != http.StatusForbidden {
+		t.Fatalf("status = %d after reaching the threshold, want %d", w.Code, http.StatusForbidden)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	// The count starts again from zero once the lockout is over
+	if w := authenticateAs(t, r, "alice", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d after the lockout expired, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if w := authenticateAs(t, r, "alice", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d on the second reject after expiry, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if w := authenticateAs(t, r, "alice", "wrong"); w.Code != http.StatusForbidden {
+		t.Errorf("status = %d after reaching the threshold again, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestLockoutResetOnAccept(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessReject})
+	r := &HTTPRadiusAuth{
+		Servers:          []string{mock.Addr()},
+		Secret:           testradius.Secret,
+		LockoutThreshold: 3,
+		LockoutDuration:  "1m",
+	}
+	provision(t, r)
+
+	authenticateAs(t, r, "alice", "wrong")
+	authenticateAs(t, r, "alice", "wrong")
+
+	mock.SetResponse("alice", radius.CodeAccessAccept)
+	if w := authenticateAs(t, r, "alice", "right"); w.Code != http.StatusOK {
+		t.Fatalf("accept: status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if list := r.lockout.snapshot(); len(list) != 0 {
+		t.Errorf("lockouts after an accept = %+v, want none", list)
+	}
+
+	// Two rejects before the accept no longer count towards the threshold
+	mock.SetResponse("alice", radius.CodeAccessReject)
+	for i := 0; i < 3; i++ {
+		if w := authenticateAs(t, r, "alice", "wrong"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("reject %d after the accept: status = %d, want %d", i+1, w.Code, http.StatusUnauthorized)
+		}
+	}
+	if w := authenticateAs(t, r, "alice", "wrong"); w.Code != http.StatusForbidden {
+		t.Errorf("status = %d after three new rejects, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestLockoutSweep(t *testing.T) {
+	l, err := newLockoutTracker(3, "50ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.failure("alice")
+	time.Sleep(120 * time.Millisecond)
+
+	// The next failure sweeps alice, whose single reject is older than
+	// the lockout duration
+	l.failure("bob")
+	if _, ok := l.entries.Load("alice"); ok {
+		t.Error("alice was not swept")
+	}
+	if list := l.snapshot(); len(list) != 1 || list[0].Username != "bob" || list[0].Failures != 1 {
+		t.Errorf("snapshot = %+v, want one failure for bob", list)
+	}
+}
+
+func TestLockoutInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		threshold int
+		duration  string
+	}{
+		{0, ""},
+		{3, "soon"},
+		{3, "-1m"},
+	} {
+		if _, err := newLockoutTracker(tc.threshold, tc.duration); err == nil {
+			t.Errorf("newLockoutTracker(%d, %q) succeeded", tc.threshold, tc.duration)
+		}
+	}
+}
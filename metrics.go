@@ -0,0 +1,79 @@
+package caddy2_radius_auth
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"layeh.com/radius"
+)
+
+// Authentication outcomes reported by the radius_auth_total counter
+const (
+	outcomeAccept      = "accept"
+	outcomeReject      = "reject"
+	outcomeError       = "error"
+	outcomeCacheHit    = "cache_hit"
+	outcomeChallenge   = "challenge"
+	outcomeRateLimited = "rate_limited"
+	outcomeLockedOut   = "locked_out"
+)
+
+var radiusMetrics = struct {
+	once            sync.Once
+	authTotal       *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	lastCode        *prometheus.GaugeVec
+}{}
+
+func initRadiusMetrics() {
+	radiusMetrics.once.Do(func() {
+		radiusMetrics.authTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "radius_auth_total",
+			Help: "Counter of RADIUS authentication outcomes.",
+		}, []string{"outcome"})
+		radiusMetrics.requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "radius_request_duration_seconds",
+			Help:    "Histogram of RADIUS exchange durations per server.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"server"})
+		radiusMetrics.lastCode = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "radius_last_response_code",
+			Help: "Code of the last RADIUS response received from each server.",
+		}, []string{"server"})
+	})
+}
+
+// registerMetrics registers the module's collectors with registry. Several
+// instances may share one registry, so duplicate registration is not an error.
+func registerMetrics(registry prometheus.Registerer) error {
+	initRadiusMetrics()
+	for _, c := range []prometheus.Collector{radiusMetrics.authTotal, radiusMetrics.requestDuration, radiusMetrics.lastCode} {
+		if err := registry.Register(c); err != nil && !errors.As(err, &prometheus.AlreadyRegisteredError{}) {
+			return err
+		}
+	}
+	return nil
+}
+
+// unregisterMetrics removes the module's collectors from registry
+func unregisterMetrics(registry prometheus.Registerer) {
+	registry.Unregister(radiusMetrics.authTotal)
+	registry.Unregister(radiusMetrics.requestDuration)
+	registry.Unregister(radiusMetrics.lastCode)
+}
+
+// observeOutcome increments radius_auth_total for the given outcome
+func observeOutcome(outcome string) {
+	radiusMetrics.authTotal.WithLabelValues(outcome).Inc()
+}
+
+// observeDuration records the duration of a single RADIUS exchange
+func observeDuration(server string, seconds float64) {
+	radiusMetrics.requestDuration.WithLabelValues(server).Observe(seconds)
+}
+
+// observeResponseCode records the code of the last response from server
+func observeResponseCode(server string, code radius.Code) {
+	radiusMetrics.lastCode.WithLabelValues(server).Set(float64(code))
+}
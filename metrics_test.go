@@ -0,0 +1,107 @@
+package caddy2_radius_auth
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/wxccs/caddy2-radius-auth/internal/testradius"
+	"layeh.com/radius"
+)
+
+func TestAuthMetrics(t *testing.T) {
+	// carol's requests are dropped, which times out as an error
+	mock := testradius.NewMockServer(t, map[string]radius.Code{
+		"alice": radius.CodeAccessAccept,
+		"bob":   radius.CodeAccessReject,
+		"carol": 0,
+	})
+
+	r := &HTTPRadiusAuth{
+		Servers:  []string{mock.Addr()},
+		Secret:   testradius.Secret,
+		Timeout:  "200ms",
+		CacheTTL: "1m",
+	}
+	ctx := provision(t, r)
+
+	registry := ctx.GetMetricsRegistry()
+	if !isRegistered(t, registry, "radius_auth_total") {
+		t.Error("radius_auth_total is not registered with the Caddy metrics registry")
+	}
+
+	before := make(map[string]float64)
+	for _, outcome := range []string{outcomeAccept, outcomeReject, outcomeError, outcomeCacheHit} {
+		before[outcome] = authTotal(t, registry, outcome)
+	}
+
+	for _, creds := range [][2]string{
+		{"alice", "password"}, // accept
+		{"alice", "password"}, // cache hit
+		{"alice", "password"}, // cache hit
+		{"bob", "password"},   // reject
+		{"carol", "password"}, // error
+	} {
+		req, _ := newCaddyRequest(creds[0], creds[1])
+		r.Authenticate(httptest.NewRecorder(), req)
+	}
+
+	want := map[string]float64{
+		outcomeAccept:   1,
+		outcomeReject:   1,
+		outcomeError:    1,
+		outcomeCacheHit: 2,
+	}
+	for outcome, n := range want {
+		got := authTotal(t, registry, outcome) - before[outcome]
+		if got != n {
+			t.Errorf("radius_auth_total{outcome=%q} increased by %v, want %v", outcome, got, n)
+		}
+	}
+
+	if !isRegistered(t, registry, "radius_request_duration_seconds") {
+		t.Error("radius_request_duration_seconds is not registered with the Caddy metrics registry")
+	}
+
+	r.Cleanup()
+	if isRegistered(t, registry, "radius_auth_total") {
+		t.Error("radius_auth_total is still registered after Cleanup")
+	}
+}
+
+// authTotal gathers radius_auth_total for outcome from registry
+func authTotal(t *testing.T, registry *prometheus.Registry, outcome string) float64 {
+	t.Helper()
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range families {
+		if mf.GetName() != "radius_auth_total" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "outcome" && label.GetValue() == outcome {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+// isRegistered reports whether registry gathers a metric family called name
+func isRegistered(t *testing.T, registry *prometheus.Registry, name string) bool {
+	t.Helper()
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range families {
+		if mf.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
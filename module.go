@@ -1,30 +1,225 @@
 package caddy2_radius_auth
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net"
 	"net/http"
+	"net/netip"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
-	"github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
+	"golang.org/x/net/idna"
+	"golang.org/x/sync/singleflight"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
 )
 
+// Version is the release of this module, logged when it is provisioned
+const Version = "0.1.0"
+
 func init() {
 	caddy.RegisterModule(HTTPRadiusAuth{})
 }
 
+// CredentialHeaders names a pair of request headers carrying the username and password
+type CredentialHeaders struct {
+	UsernameHeader string `json:"username_header,omitempty"` // e.g. "X-Auth-User"
+	PasswordHeader string `json:"password_header,omitempty"` // e.g. "X-Auth-Pass"
+}
+
 type HTTPRadiusAuth struct {
-	Servers  []string     `json:"servers,omitempty"`   // List of RADIUS servers
-	Secret   string       `json:"secret,omitempty"`    // Shared secret
-	Realm    string       `json:"realm,omitempty"`     // Basic Auth realm
-	Timeout  string       `json:"timeout,omitempty"`   // Connection timeout (default "3s")
-	CacheTTL string       `json:"cache_ttl,omitempty"` // Cache TTL (0 to disable, default "0s")
-	cache    *cache.Cache // Internal cache instance
-	logger   *zap.Logger
+	Servers        []string `json:"servers,omitempty"`          // List of RADIUS servers
+	Secret         string   `json:"secret,omitempty"`           // Shared secret
+	Realm          string   `json:"realm,omitempty"`            // Basic Auth realm
+	RealmCharset   string   `json:"realm_charset,omitempty"`    // charset parameter of the Basic challenge, e.g. "UTF-8"
+	Timeout        string   `json:"timeout,omitempty"`          // Connection timeout (default "3s")
+	CacheTTL       string   `json:"cache_ttl,omitempty"`        // Cache TTL (0 to disable, default "0s")
+	CacheKeySecret string   `json:"cache_key_secret,omitempty"` // HMAC key for cache keys (random if empty)
+
+	CacheKeyVersion int64 `json:"cache_key_version,omitempty"` // Change to invalidate every cached result, including shared ones
+
+	RespectSessionTimeout *bool `json:"respect_session_timeout,omitempty"` // Cache accepts no longer than their Session-Timeout (default true)
+
+	SecretFile string `json:"secret_file,omitempty"` // File containing the shared secret (overrides Secret)
+	SecretEnv  string `json:"secret_env,omitempty"`  // Environment variable holding the shared secret (overrides Secret)
+
+	NegativeCacheTTL       string `json:"negative_cache_ttl,omitempty"`         // Reject cache TTL (0 to disable, default "0s")
+	CacheBackend           string `json:"cache_backend,omitempty"`              // Cache backend: memory (default) or redis
+	CacheMaxSize           int    `json:"cache_max_size,omitempty"`             // Maximum entries per memory cache (default 10000)
+	MaxCacheMemoryMB       int    `json:"max_cache_memory_mb,omitempty"`        // Approximate memory limit per memory cache in MiB (0 for none)
+	MaxCacheEntriesPerUser int    `json:"max_cache_entries_per_user,omitempty"` // Cached results kept per username, oldest evicted first (0 for unlimited)
+	RedisAddr              string `json:"redis_addr,omitempty"`                 // Redis address for the redis backend
+	RedisPassword          string `json:"redis_password,omitempty"`             // Redis password for the redis backend
+	PersistCachePath       string `json:"persist_cache_path,omitempty"`         // File the memory caches are saved to on shutdown and restored from on startup
+
+	CoordinationBackend string `json:"coordination_backend,omitempty"` // Share RADIUS exchanges between Caddy instances: "redis" (requires redis_addr)
+	CoordinationTimeout string `json:"coordination_timeout,omitempty"` // Longest wait for another instance's result before authenticating directly (default "10s")
+
+	Realms []RealmConfig `json:"realms,omitempty"` // Per-domain server pools, matched on the part of the username after "@"
+
+	HealthCheckInterval string `json:"health_check_interval,omitempty"` // Interval between server health checks (default "30s", 0 to disable)
+
+	SRVName            string `json:"srv_name,omitempty"`             // SRV record listing the servers, e.g. "_radius._udp.example.com"
+	SRVRefreshInterval string `json:"srv_refresh_interval,omitempty"` // How often the SRV record is re-resolved (default "5m")
+
+	ServerEntries  []ServerEntry     `json:"server_entries,omitempty"`  // Servers with their own port, secret, weight and timeout, added to Servers
+	ServerSecrets  map[string]string `json:"server_secrets,omitempty"`  // Per-server shared secrets keyed by address
+	ServerTimeouts map[string]string `json:"server_timeouts,omitempty"` // Per-server timeouts keyed by address (override Timeout)
+	ServerWeights  map[string]int    `json:"server_weights,omitempty"`  // Per-server weights for round_robin and weighted_random (default 1)
+	TLS            *TLSConfig        `json:"tls,omitempty"`             // RadSec (RADIUS over TLS) settings
+	TCPMode        bool              `json:"tcp_mode,omitempty"`        // Use RADIUS over TCP (RFC 6613) instead of UDP when TLS is not enabled
+	PreferIPv6     bool              `json:"prefer_ipv6,omitempty"`     // Dial server hostnames at their IPv6 address when they have one
+	SingleFlight   *bool             `json:"single_flight,omitempty"`   // Collapse concurrent identical auth requests (default true)
+	Strategy       string            `json:"strategy,omitempty"`        // Server selection: concurrent (default), round_robin or failover
+	QuorumPolicy   string            `json:"quorum_policy,omitempty"`   // Accepts needed to grant access: any (default), all or majority
+	Accounting     *AccountingConfig `json:"accounting,omitempty"`      // RADIUS accounting settings
+	JWT            *JWTConfig        `json:"jwt,omitempty"`             // JWT issued after successful authentication
+
+	RetryCount int    `json:"retry_count,omitempty"` // Retries per server after a failed exchange (default 0)
+	RetryDelay string `json:"retry_delay,omitempty"` // Pause between retries (default "0s")
+
+	// ConnectTimeout bounds dialing a server, including the TLS handshake
+	// for RadSec, or name resolution and socket setup for UDP, and
+	// ResponseTimeout the wait for its answer; both default to Timeout.
+	// ServerTimeouts and realm timeouts override ResponseTimeout.
+	ConnectTimeout  string `json:"connect_timeout,omitempty"`
+	ResponseTimeout string `json:"response_timeout,omitempty"`
+
+	BreakerThreshold int    `json:"breaker_threshold,omitempty"` // Consecutive failures before a server is skipped (default 5, negative disables)
+	BreakerCooldown  string `json:"breaker_cooldown,omitempty"`  // Time a tripped server is skipped before probing (default "30s")
+
+	ExportAttributes []string `json:"export_attributes,omitempty"` // Reply attributes exported as {radius.*} placeholders (all if empty)
+
+	AttributeHeaders  map[string]string `json:"attribute_headers,omitempty"`  // Reply attributes copied to request headers, e.g. {"Filter-Id": "X-User-Group"}
+	SessionIDHeader   string            `json:"session_id_header,omitempty"`  // Request header carrying a per-request session ID, e.g. "X-RADIUS-Session-ID"
+	RoleHeader        string            `json:"role_header,omitempty"`        // Request header listing the user's roles, e.g. "X-User-Roles"
+	RoleAttribute     string            `json:"role_attribute,omitempty"`     // Reply attribute holding the roles (default "Filter-Id")
+	RequestAttributes map[string]string `json:"request_attributes,omitempty"` // Attributes added to every Access-Request, from a header name or placeholder, e.g. {"Called-Station-Id": "{http.request.host}"}
+	DictionaryFiles   []string          `json:"dictionary_files,omitempty"`   // FreeRADIUS dictionary files naming further (e.g. vendor-specific) attributes
+
+	RateLimit *RateLimitConfig `json:"rate_limit,omitempty"` // Limit failed logins per username
+
+	LockoutThreshold int    `json:"lockout_threshold,omitempty"` // Consecutive rejects that lock a username out (0 disables)
+	LockoutDuration  string `json:"lockout_duration,omitempty"`  // Time a username stays locked out (default "15m")
+
+	UsernameTransform *UsernameTransform `json:"username_transform,omitempty"`  // Rewrite rules applied to usernames before RADIUS
+	UsernameAllowList []string           `json:"username_allow_list,omitempty"` // Glob patterns of usernames allowed to authenticate (all if empty)
+	UsernameDenyList  []string           `json:"username_deny_list,omitempty"`  // Glob patterns of usernames refused without asking RADIUS
+
+	TrustForwardedFor bool     `json:"trust_forwarded_for,omitempty"` // Take the client IP from X-Forwarded-For (only behind a trusted proxy)
+	IPAllowList       []string `json:"ip_allowlist,omitempty"`        // CIDRs whose clients skip authentication entirely
+	BypassIf          string   `json:"bypass_if,omitempty"`           // CEL expression; matching requests skip authentication, e.g. "method('OPTIONS')"
+
+	CredentialHeaders *CredentialHeaders `json:"credential_headers,omitempty"` // Headers carrying credentials as an alternative to Basic Auth
+
+	MaxUsernameLength int `json:"max_username_length,omitempty"` // Longer usernames are refused (default 253)
+	MaxPasswordLength int `json:"max_password_length,omitempty"` // Longer passwords are refused (default 128)
+
+	UsernameAttribute  string `json:"username_attribute,omitempty"`   // Attribute carrying the username: a name or numeric type (default "User-Name")
+	RequestIDAttribute string `json:"request_id_attribute,omitempty"` // Attribute carrying the HTTP request ID (X-Request-ID or Caddy's request UUID), e.g. "44" for Acct-Session-Id
+
+	NASIdentifier   string `json:"nas_identifier,omitempty"`    // NAS-Identifier sent with every request
+	CalledStationId string `json:"called_station_id,omitempty"` // Called-Station-Id sent with every Access-Request, a literal or placeholder, e.g. "{http.request.host}"
+	NASPortMode     string `json:"nas_port_mode,omitempty"`     // NAS-Port per request: "none" (default), "hash_client_ip" or "sequential"
+	NASIPAddress    string `json:"nas_ip_address,omitempty"`    // NAS-IP-Address sent with every request (detected if neither is set)
+	ServiceType     string `json:"service_type,omitempty"`      // Service-Type sent with every Access-Request, e.g. "Authenticate-Only"
+	NASPortType     string `json:"nas_port_type,omitempty"`     // NAS-Port-Type sent with every Access-Request, e.g. "Virtual" or "Ethernet"
+	AuthProtocol    string `json:"auth_protocol,omitempty"`     // Password encoding: "pap" (default) or "chap"
+	EAP             bool   `json:"eap,omitempty"`               // Authenticate with EAP-MD5 instead of AuthProtocol
+	SupportDigest   bool   `json:"support_digest,omitempty"`    // Also accept HTTP Digest credentials, verified by the server per RFC 5090
+
+	AccessChallenge bool `json:"access_challenge,omitempty"` // Relay Access-Challenge to the client (e.g. for OTP prompts)
+
+	ErrorFormat       string `json:"error_format,omitempty"`        // Error response bodies: "text" (default) or "json"
+	RejectStatusCode  int    `json:"reject_status_code,omitempty"`  // Status for rejected credentials, e.g. 403 (default 401); missing credentials always get 401
+	FailBehavior      string `json:"fail_behavior,omitempty"`       // When no server answers: "deny" (403, default), "error" (500), "allow" or "service_unavailable" (503)
+	UnknownCodePolicy string `json:"unknown_code_policy,omitempty"` // Response codes other than accept, reject and challenge: "deny" (default), "allow" or "error"
+	AcceptCodes       []int  `json:"accept_codes,omitempty"`        // Vendor response codes treated as Access-Accept
+	MaxConcurrent     int    `json:"max_concurrent,omitempty"`      // Maximum in-flight RADIUS exchanges (0 for unlimited)
+
+	Tracing      bool  `json:"tracing,omitempty"`       // Emit OpenTelemetry spans for RADIUS exchanges
+	AuditLog     *bool `json:"audit_log,omitempty"`     // Log every authentication attempt at info level (default true)
+	DebugPackets bool  `json:"debug_packets,omitempty"` // Log every packet sent and received at debug level, passwords redacted
+
+	// DebugSecretCheck reports responses that fail verification with the
+	// shared secret, the usual sign of a secret mismatch, instead of
+	// dropping them until the exchange times out
+	DebugSecretCheck bool `json:"debug_secret_check,omitempty"`
+
+	// FallbackProvider checks credentials locally when no RADIUS server
+	// answers. "basic_auth" uses FallbackBasicAuth, a map of usernames to
+	// bcrypt hashes.
+	FallbackProvider  string            `json:"fallback_provider,omitempty"`
+	FallbackBasicAuth map[string]string `json:"fallback_basic_auth,omitempty"`
+
+	// DryRun accepts every request without contacting RADIUS, for local
+	// testing. It is a plain bool so no placeholder can switch it on.
+	DryRun bool `json:"dry_run,omitempty"`
+
+	ProbeOnStart bool   `json:"probe_on_start,omitempty"` // Check that servers respond during Provision
+	ProbeTimeout string `json:"probe_timeout,omitempty"`  // Time to wait for each probe (default "5s")
+
+	cache           cacheProvider // Internal cache instance
+	negativeCache   cacheProvider // Cache of rejected credentials, nil when disabled
+	redisClient     *redis.Client
+	coordinator     *coordinator // Cross-instance exchange sharing, nil when disabled
+	cacheIndex      *usernameIndex
+	initialized     bool // Provision has run; a second call cleans up first
+	permission      bool // Embedded in a PermissionByRADIUS rather than serving HTTP
+	cacheKeySecret  []byte
+	connectTimeout  time.Duration       // Parsed ConnectTimeout
+	tlsConfig       *tls.Config         // RadSec client config, nil when no server uses TLS
+	connPool        *connPool           // Idle RadSec and TCP connections, nil when every server uses UDP
+	serverTransport map[string]string   // Transport of servers given as udp://, tls:// or tcp:// URLs
+	group           *singleflight.Group // In-flight RADIUS calls, nil when single-flight is disabled
+	pool            *serverPool         // Servers in use and their circuit breakers
+	shutdownCtx     context.Context     // Cancelled by Cleanup to abort in-flight work
+	shutdown        context.CancelFunc
+	inflight        *inflightTracker // Exchanges and background goroutines Cleanup waits for
+	metrics         prometheus.Registerer
+	cacheVersion    *atomic.Int64  // CacheKeyVersion plus bumps through the admin API
+	rrCounter       *atomic.Uint64 // Round-robin position
+	nasPortCounter  *atomic.Uint32 // Last NAS-Port assigned in sequential mode
+	interimInterval time.Duration
+	uncountedOutput *atomic.Bool               // Set once the missing output byte count has been reported
+	nasIP           net.IP                     // NAS-IP-Address, nil when not sent
+	ipAllowList     []*net.IPNet               // Parsed IPAllowList
+	bypass          *caddyhttp.MatchExpression // Compiled BypassIf, nil when unset
+	usernameType    radius.Type                // Attribute carrying the username
+	dict            *attributeDict             // Attributes from DictionaryFiles, nil when unset
+	requestIDAttr   *attributeDef              // Attribute carrying the request ID, nil when not sent
+	serviceType     rfc2865.ServiceType        // 0 when not sent
+	nasPortType     *rfc2865.NASPortType       // nil when not sent; Async is 0
+	challenges      *challengeStore            // Pending Access-Challenges, nil when disabled
+	digestNonces    *digestNonceUses           // Nonce counts used with Digest, nil when disabled
+	lockout         *lockoutTracker            // Consecutive rejects per username, nil when disabled
+	rateLimiter     *rateLimiter               // Failed logins per username, nil when RateLimit is not set
+	sem             chan struct{}              // In-flight exchange slots, nil when unlimited
+	retryDelay      time.Duration
+	fallbackDummy   []byte // bcrypt hash compared for unknown fallback users
+	logger          *zap.Logger
 }
 
 func (HTTPRadiusAuth) CaddyModule() caddy.ModuleInfo {
@@ -34,33 +229,181 @@ func (HTTPRadiusAuth) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
-// Provision validates configuration and initializes middleware
+// Provision validates configuration and initializes middleware. It may be
+// called again on a provisioned instance, which first releases everything
+// the previous call set up.
 func (r *HTTPRadiusAuth) Provision(ctx caddy.Context) error {
+	if r.initialized {
+		if err := r.Cleanup(); err != nil {
+			r.logger.Warn("releasing resources before re-provisioning", zap.Error(err))
+		}
+	} else {
+		// Server entries are folded into Servers, which a second call
+		// would otherwise do again
+		if err := r.mergeServerEntries(); err != nil {
+			return err
+		}
+	}
+	r.initialized = true
+
 	r.logger = ctx.Logger()
+	r.shutdownCtx, r.shutdown = context.WithCancel(context.Background())
+	r.inflight = new(inflightTracker)
+	r.expandPlaceholders()
+	if r.SRVName != "" {
+		servers, err := lookupSRVServers(ctx, r.SRVName)
+		if err != nil {
+			return err
+		}
+		r.Servers = servers
+	}
 	if len(r.Servers) == 0 {
 		return fmt.Errorf("no RADIUS servers configured")
 	}
+	if r.SecretFile != "" {
+		b, err := os.ReadFile(r.SecretFile)
+		if err != nil {
+			return fmt.Errorf("reading secret_file: %v", err)
+		}
+		r.Secret = strings.TrimSpace(string(b))
+	} else if r.SecretEnv != "" {
+		r.Secret = os.Getenv(r.SecretEnv)
+	}
 	if r.Secret == "" {
-		return fmt.Errorf("missing RADIUS shared secret")
+		return fmt.Errorf("missing RADIUS shared secret (set secret, secret_file or secret_env)")
 	}
 	if r.Timeout == "" {
 		r.Timeout = "3s"
 	}
+	if r.ConnectTimeout == "" {
+		r.ConnectTimeout = r.Timeout
+	}
+	if r.ResponseTimeout == "" {
+		r.ResponseTimeout = r.Timeout
+	}
+	r.connectTimeout, _ = time.ParseDuration(r.ConnectTimeout)
 	if r.CacheTTL == "" {
 		r.CacheTTL = "0s"
 	}
+	if r.NegativeCacheTTL == "" {
+		r.NegativeCacheTTL = "0s"
+	}
 
 	// Initialize cache
 	cacheTTL, err := time.ParseDuration(r.CacheTTL)
 	if err != nil {
 		return fmt.Errorf("invalid cache_ttl duration: %v", err)
 	}
-	// Use a reasonable default capacity of 1000 items
+	if r.CacheKeySecret != "" {
+		r.cacheKeySecret = []byte(r.CacheKeySecret)
+	} else {
+		r.cacheKeySecret = make([]byte, 32)
+		if _, err := rand.Read(r.cacheKeySecret); err != nil {
+			return fmt.Errorf("generating cache key secret: %v", err)
+		}
+	}
+	negativeCacheTTL, err := time.ParseDuration(r.NegativeCacheTTL)
+	if err != nil {
+		return fmt.Errorf("invalid negative_cache_ttl duration: %v", err)
+	}
+
+	if r.MaxUsernameLength == 0 {
+		r.MaxUsernameLength = 253
+	}
+	if r.MaxPasswordLength == 0 {
+		r.MaxPasswordLength = 128
+	}
+
+	if r.CacheMaxSize == 0 {
+		r.CacheMaxSize = 10000
+	}
+
+	switch r.CacheBackend {
+	case "":
+		r.CacheBackend = cacheBackendMemory
+	case cacheBackendMemory:
+	case cacheBackendRedis:
+		if r.RedisAddr == "" {
+			return fmt.Errorf("cache_backend redis requires redis_addr")
+		}
+		// Every instance must derive the same keys to share entries
+		if r.CacheKeySecret == "" {
+			return fmt.Errorf("cache_backend redis requires cache_key_secret")
+		}
+	default:
+		return fmt.Errorf("unknown cache_backend: %s", r.CacheBackend)
+	}
+	r.coordinator = nil
+	switch r.CoordinationBackend {
+	case "":
+	case coordinationRedis:
+		if r.RedisAddr == "" {
+			return fmt.Errorf("coordination_backend redis requires redis_addr")
+		}
+		// Instances find each other's locks by cache key
+		if r.CacheKeySecret == "" {
+			return fmt.Errorf("coordination_backend redis requires cache_key_secret")
+		}
+		if r.CoordinationTimeout == "" {
+			r.CoordinationTimeout = "10s"
+		}
+		timeout, err := time.ParseDuration(r.CoordinationTimeout)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid coordination_timeout: %s", r.CoordinationTimeout)
+		}
+		r.coordinator = &coordinator{timeout: timeout, logger: r.logger}
+	default:
+		return fmt.Errorf("unknown coordination_backend: %s", r.CoordinationBackend)
+	}
+	r.redisClient = nil
+	if r.CacheBackend == cacheBackendRedis || r.coordinator != nil {
+		r.redisClient = redis.NewClient(&redis.Options{
+			Addr:     r.RedisAddr,
+			Password: r.RedisPassword,
+		})
+	}
+	if r.coordinator != nil {
+		r.coordinator.client = r.redisClient
+	}
+	if r.PersistCachePath != "" {
+		if r.CacheBackend == cacheBackendRedis {
+			return fmt.Errorf("persist_cache_path only applies to the memory cache backend")
+		}
+		// Keys are HMACs under the secret; with a random one every restored
+		// entry would be unreachable
+		if r.CacheKeySecret == "" {
+			return fmt.Errorf("persist_cache_path requires cache_key_secret")
+		}
+	}
+
+	// Track cache keys per username so entries can be evicted through the admin API
+	var maxIndexed int
+	if r.CacheBackend == cacheBackendRedis {
+		maxIndexed = r.CacheMaxSize
+	}
+	r.cacheIndex = newUsernameIndex(r.MaxCacheEntriesPerUser, maxIndexed)
+
 	if cacheTTL > 0 {
-		r.cache = cache.New(cacheTTL, time.Second)
+		r.cache = r.newCacheProvider(cacheTTL, "pos")
 	} else {
 		r.cache = nil
 	}
+	if negativeCacheTTL > 0 {
+		r.negativeCache = r.newCacheProvider(negativeCacheTTL, "neg")
+	} else {
+		r.negativeCache = nil
+	}
+	if r.PersistCachePath != "" {
+		// A missing or unreadable file only costs a cold cache
+		n, err := r.loadCache()
+		if err != nil {
+			r.logger.Warn("restoring persisted cache failed",
+				zap.String("path", r.PersistCachePath), zap.Error(err))
+		} else if n > 0 {
+			r.logger.Info("restored persisted cache entries",
+				zap.String("path", r.PersistCachePath), zap.Int("entries", n))
+		}
+	}
 
 	// Validate server addresses
 	valid := make([]string, 0, len(r.Servers))
@@ -75,76 +418,1274 @@ func (r *HTTPRadiusAuth) Provision(ctx caddy.Context) error {
 	if len(r.Servers) == 0 {
 		return fmt.Errorf("no valid RADIUS servers remain after validation")
 	}
+	r.stripServerSchemes(r.Servers)
+
+	if r.ErrorFormat == "" {
+		r.ErrorFormat = errorFormatText
+	}
+	if r.RejectStatusCode == 0 {
+		r.RejectStatusCode = http.StatusUnauthorized
+	}
+	if r.FailBehavior == "" {
+		r.FailBehavior = failDeny
+	}
+	if r.UnknownCodePolicy == "" {
+		r.UnknownCodePolicy = unknownCodeDeny
+	}
+	if r.RoleHeader != "" && r.RoleAttribute == "" {
+		r.RoleAttribute = "Filter-Id"
+	}
+	if err := r.checkFallback(); err != nil {
+		return err
+	}
+	if r.AuthProtocol == "" {
+		r.AuthProtocol = authProtocolPAP
+	}
+	if r.Strategy == "" {
+		r.Strategy = strategyConcurrent
+	}
+	r.rrCounter = new(atomic.Uint64)
+	r.cacheVersion = new(atomic.Int64)
+	r.cacheVersion.Store(r.CacheKeyVersion)
+	r.nasPortCounter = new(atomic.Uint32)
+	if r.NASPortMode == "" {
+		r.NASPortMode = nasPortNone
+	}
+	if r.QuorumPolicy == "" {
+		r.QuorumPolicy = quorumAny
+	}
+
+	if r.MaxConcurrent > 0 {
+		r.sem = make(chan struct{}, r.MaxConcurrent)
+	}
+
+	if r.SingleFlight == nil || *r.SingleFlight {
+		r.group = new(singleflight.Group)
+	}
+
+	if r.RetryDelay == "" {
+		r.RetryDelay = "0s"
+	}
+	r.retryDelay, err = time.ParseDuration(r.RetryDelay)
+	if err != nil {
+		return fmt.Errorf("invalid retry_delay duration: %v", err)
+	}
+
+	// Set up a circuit breaker per server
+	if r.BreakerThreshold == 0 {
+		r.BreakerThreshold = 5
+	}
+	if r.BreakerCooldown == "" {
+		r.BreakerCooldown = "30s"
+	}
+	breakerCooldown, err := time.ParseDuration(r.BreakerCooldown)
+	if err != nil {
+		return fmt.Errorf("invalid breaker_cooldown duration: %v", err)
+	}
+	var newBreaker func() *circuitBreaker
+	if r.BreakerThreshold > 0 {
+		newBreaker = func() *circuitBreaker {
+			return newCircuitBreaker(r.BreakerThreshold, breakerCooldown)
+		}
+	}
+	r.pool = newServerPool(r.Servers, newBreaker)
+	if err := r.provisionRealms(newBreaker); err != nil {
+		return err
+	}
+
+	if r.HealthCheckInterval == "" {
+		r.HealthCheckInterval = "30s"
+	}
+	healthCheckInterval, err := time.ParseDuration(r.HealthCheckInterval)
+	if err != nil {
+		return fmt.Errorf("invalid health_check_interval duration: %v", err)
+	}
+
+	var srvRefresh time.Duration
+	if r.SRVName != "" {
+		if r.SRVRefreshInterval == "" {
+			r.SRVRefreshInterval = "5m"
+		}
+		srvRefresh, err = time.ParseDuration(r.SRVRefreshInterval)
+		if err != nil || srvRefresh <= 0 {
+			return fmt.Errorf("invalid srv_refresh_interval duration: %s", r.SRVRefreshInterval)
+		}
+	}
+
+	// Load RadSec certificates when any server uses RadSec; tls:// servers
+	// work without a tls block, verifying against the system roots
+	poolSize, idleTimeout := 5, time.Minute
+	if r.TLS != nil && r.TLS.Enabled || r.hasServerTransport(transportTLS) {
+		if r.TLS == nil {
+			r.TLS = new(TLSConfig)
+		}
+		r.tlsConfig, err = r.TLS.buildTLSConfig()
+		if err != nil {
+			return fmt.Errorf("tls: %v", err)
+		}
+		if r.TLS.PoolSize == 0 {
+			r.TLS.PoolSize = 5
+		}
+		if r.TLS.IdleConnTimeout == "" {
+			r.TLS.IdleConnTimeout = "60s"
+		}
+		// Validate refuses a negative pool_size or a bad idle_conn_timeout,
+		// but a probe or health check may use the pool, and the reaper
+		// starts, before it runs
+		if d, err := time.ParseDuration(r.TLS.IdleConnTimeout); err == nil && d > 0 {
+			idleTimeout = d
+		}
+		poolSize = max(r.TLS.PoolSize, 0)
+	}
+	// RadSec and TCP connections share one pool, with the tls block's pool
+	// settings when there is one
+	if r.tlsConfig != nil || r.TCPMode || r.hasServerTransport(transportTCP) {
+		r.connPool = newConnPool(poolSize, idleTimeout)
+	}
+
+	// RADIUS servers expect the NAS to identify itself by name or address
+	if r.NASIPAddress != "" {
+		r.nasIP = net.ParseIP(r.NASIPAddress)
+		if r.nasIP == nil {
+			return fmt.Errorf("invalid nas_ip_address: %s", r.NASIPAddress)
+		}
+	} else if r.NASIdentifier == "" {
+		r.nasIP = outboundIP(r.Servers[0])
+		if r.nasIP == nil {
+			r.logger.Warn("could not detect NAS-IP-Address; set nas_ip_address or nas_identifier")
+		}
+	}
+
+	r.dict = nil
+	if len(r.DictionaryFiles) > 0 {
+		if r.dict, err = loadDictionaries(r.DictionaryFiles); err != nil {
+			return fmt.Errorf("dictionary_files: %v", err)
+		}
+	}
+
+	r.requestIDAttr = nil
+	if r.RequestIDAttribute != "" {
+		def, err := r.attributes().parseRequestIDAttribute(r.RequestIDAttribute)
+		if err != nil {
+			return fmt.Errorf("request_id_attribute: %v", err)
+		}
+		r.requestIDAttr = &def
+	}
+
+	if r.UsernameAttribute == "" {
+		r.UsernameAttribute = "User-Name"
+	}
+	if r.usernameType, err = parseUsernameAttribute(r.UsernameAttribute); err != nil {
+		return fmt.Errorf("username_attribute: %v", err)
+	}
+
+	if r.ServiceType != "" {
+		var ok bool
+		if r.serviceType, ok = parseServiceType(r.ServiceType); !ok {
+			return fmt.Errorf("unknown service_type: %s", r.ServiceType)
+		}
+	}
+	if r.NASPortType != "" {
+		portType, ok := parseNASPortType(r.NASPortType)
+		if !ok {
+			return fmt.Errorf("unknown nas_port_type: %s", r.NASPortType)
+		}
+		r.nasPortType = &portType
+	}
+
+	if r.AccessChallenge {
+		r.challenges = newChallengeStore()
+	}
+	if r.SupportDigest {
+		r.digestNonces = newDigestNonceUses()
+	}
+
+	if r.RateLimit != nil {
+		if r.rateLimiter, err = newRateLimiter(r.RateLimit); err != nil {
+			return err
+		}
+	}
+	if r.LockoutThreshold != 0 {
+		if r.lockout, err = newLockoutTracker(r.LockoutThreshold, r.LockoutDuration); err != nil {
+			return err
+		}
+	}
+
+	if r.UsernameTransform != nil {
+		if err := r.UsernameTransform.provision(); err != nil {
+			return err
+		}
+	}
+	r.ipAllowList = nil
+	for _, cidr := range r.IPAllowList {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid ip_allowlist entry: %v", err)
+		}
+		r.ipAllowList = append(r.ipAllowList, ipNet)
+	}
+	r.bypass = nil
+	if r.BypassIf != "" {
+		r.bypass = &caddyhttp.MatchExpression{Expr: r.BypassIf}
+		if err := r.bypass.Provision(ctx); err != nil {
+			return fmt.Errorf("bypass_if: %v", err)
+		}
+	}
+
+	if r.JWT != nil && r.JWT.Enabled {
+		if err := r.JWT.provision(r.CacheMaxSize); err != nil {
+			return err
+		}
+	}
+
+	// Accounting defaults
+	if r.Accounting != nil && r.Accounting.Enabled {
+		if r.Accounting.Port == "" {
+			r.Accounting.Port = "1813"
+		}
+		if r.Accounting.InterimInterval == "" {
+			r.Accounting.InterimInterval = "0s"
+		}
+		r.interimInterval, err = time.ParseDuration(r.Accounting.InterimInterval)
+		if err != nil {
+			return fmt.Errorf("invalid accounting interim_interval duration: %v", err)
+		}
+		r.uncountedOutput = new(atomic.Bool)
+	}
+
+	if r.DryRun {
+		r.logger.Warn("DRY-RUN MODE: every request is accepted without RADIUS authentication; never use this in production")
+	}
+
+	// Validate refuses probe_on_start together with dry_run
+	if r.ProbeOnStart && !r.DryRun {
+		if r.ProbeTimeout == "" {
+			r.ProbeTimeout = "5s"
+		}
+		probeTimeout, err := time.ParseDuration(r.ProbeTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid probe_timeout duration: %v", err)
+		}
+		if err := r.probeServers(probeTimeout); err != nil {
+			return err
+		}
+	}
+
+	// Register Prometheus metrics
+	initRadiusMetrics()
+	if registry := ctx.GetMetricsRegistry(); registry != nil {
+		if err := registerMetrics(registry); err != nil {
+			return fmt.Errorf("registering metrics: %v", err)
+		}
+		r.metrics = registry
+	}
+
+	if healthCheckInterval > 0 {
+		// Method values copy the instance here, not once the goroutine
+		// runs and the caller may already be changing it
+		runHealthChecks := r.runHealthChecks
+		r.inflight.enter()
+		go func() {
+			defer r.inflight.leave()
+			runHealthChecks(r.shutdownCtx, healthCheckInterval)
+		}()
+	}
+	if r.SRVName != "" {
+		refreshSRV := r.refreshSRV
+		r.inflight.enter()
+		go func() {
+			defer r.inflight.leave()
+			refreshSRV(r.shutdownCtx, srvRefresh)
+		}()
+	}
+	if r.connPool != nil {
+		r.inflight.enter()
+		go func() {
+			defer r.inflight.leave()
+			r.connPool.reap(r.shutdownCtx)
+		}()
+	}
+
+	instances.Store(r, struct{}{})
+
+	r.logProvisioned()
+	return nil
+}
+
+// logProvisioned logs the effective configuration once, so it can be
+// checked in Caddy's log without debug logging. Secrets are never logged.
+func (r *HTTPRadiusAuth) logProvisioned() {
+	fields := []zap.Field{
+		zap.String("version", Version),
+		zap.Strings("servers", r.Servers),
+		zap.String("strategy", r.Strategy),
+		zap.String("timeout", r.Timeout),
+		zap.String("connect_timeout", r.ConnectTimeout),
+		zap.String("response_timeout", r.ResponseTimeout),
+		zap.Bool("cache", r.cache != nil),
+	}
+	if r.cache != nil {
+		fields = append(fields, zap.String("cache_backend", r.CacheBackend), zap.String("cache_ttl", r.CacheTTL))
+	}
+	if r.Secret != "" || len(r.ServerSecrets) > 0 {
+		fields = append(fields, zap.String("secret", "[REDACTED]"))
+	}
+	if r.SRVName != "" {
+		fields = append(fields, zap.String("srv_name", r.SRVName))
+	}
+	if len(r.Realms) > 0 {
+		realms := make([]string, len(r.Realms))
+		for i, realm := range r.Realms {
+			realms[i] = realm.Realm
+		}
+		fields = append(fields, zap.Strings("realms", realms))
+	}
+	r.logger.Info("radius_auth provisioned", fields...)
+}
+
+// Validate checks the provisioned configuration for semantic errors, so
+// `caddy validate` reports them before any traffic is served
+func (r *HTTPRadiusAuth) Validate() error {
+	timeout, err := time.ParseDuration(r.Timeout)
+	if err != nil || timeout <= 0 {
+		return fmt.Errorf("invalid timeout duration: %s", r.Timeout)
+	}
+	if d, err := time.ParseDuration(r.ResponseTimeout); err != nil || d <= 0 {
+		return fmt.Errorf("invalid response_timeout duration: %s", r.ResponseTimeout)
+	}
+	if d, err := time.ParseDuration(r.ConnectTimeout); err != nil || d <= 0 {
+		return fmt.Errorf("invalid connect_timeout duration: %s", r.ConnectTimeout)
+	}
+	for name, ttl := range map[string]string{"cache_ttl": r.CacheTTL, "negative_cache_ttl": r.NegativeCacheTTL} {
+		if d, _ := time.ParseDuration(ttl); d < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+	if r.RetryCount < 0 {
+		return fmt.Errorf("retry_count must not be negative")
+	}
+	if r.CacheMaxSize < 0 {
+		return fmt.Errorf("cache_max_size must be positive")
+	}
+	if r.MaxCacheMemoryMB < 0 {
+		return fmt.Errorf("max_cache_memory_mb must not be negative")
+	}
+	if r.MaxCacheEntriesPerUser < 0 {
+		return fmt.Errorf("max_cache_entries_per_user must not be negative")
+	}
+	if r.retryDelay < 0 {
+		return fmt.Errorf("retry_delay must not be negative")
+	}
+	if r.MaxConcurrent < 0 {
+		return fmt.Errorf("max_concurrent must not be negative")
+	}
+	if r.DryRun && r.ProbeOnStart {
+		return fmt.Errorf("dry_run cannot be combined with probe_on_start")
+	}
+	if r.RejectStatusCode < 400 || r.RejectStatusCode > 499 {
+		return fmt.Errorf("reject_status_code must be a 4xx status, got %d", r.RejectStatusCode)
+	}
+	for _, code := range r.AcceptCodes {
+		switch radius.Code(code) {
+		case radius.CodeAccessReject, radius.CodeAccessChallenge:
+			return fmt.Errorf("accept_codes cannot include %v", radius.Code(code))
+		}
+		if code < 1 || code > 255 {
+			return fmt.Errorf("accept_codes: invalid RADIUS code %d", code)
+		}
+	}
+	if r.TLS != nil {
+		if r.TLS.PoolSize < 0 {
+			return fmt.Errorf("tls: pool_size must not be negative")
+		}
+		if r.TLS.IdleConnTimeout != "" {
+			if d, err := time.ParseDuration(r.TLS.IdleConnTimeout); err != nil || d <= 0 {
+				return fmt.Errorf("tls: invalid idle_conn_timeout: %s", r.TLS.IdleConnTimeout)
+			}
+		}
+	}
+	if r.Accounting != nil && r.Accounting.Enabled && r.interimInterval < 0 {
+		return fmt.Errorf("accounting interim_interval must not be negative")
+	}
+
+	// RFC 7617 defines no other charset
+	if r.RealmCharset != "" && !strings.EqualFold(r.RealmCharset, "UTF-8") {
+		return fmt.Errorf("realm_charset must be UTF-8")
+	}
+	switch r.NASPortMode {
+	case nasPortNone, nasPortHashIP, nasPortSequential:
+	default:
+		return fmt.Errorf("unknown nas_port_mode: %s", r.NASPortMode)
+	}
+	switch r.ErrorFormat {
+	case errorFormatText, errorFormatJSON:
+	default:
+		return fmt.Errorf("unknown error_format: %s", r.ErrorFormat)
+	}
+	switch r.FailBehavior {
+	case failDeny, failError, failAllow, failServiceUnavailable:
+	default:
+		return fmt.Errorf("unknown fail_behavior: %s", r.FailBehavior)
+	}
+	switch r.UnknownCodePolicy {
+	case unknownCodeDeny, unknownCodeAllow, unknownCodeError:
+	default:
+		return fmt.Errorf("unknown unknown_code_policy: %s", r.UnknownCodePolicy)
+	}
+	switch r.AuthProtocol {
+	case authProtocolPAP, authProtocolCHAP:
+	default:
+		return fmt.Errorf("unknown auth_protocol: %s", r.AuthProtocol)
+	}
+	switch r.Strategy {
+	case strategyConcurrent, strategyRoundRobin, strategyFailover, strategyWeighted:
+	default:
+		return fmt.Errorf("unknown strategy: %s", r.Strategy)
+	}
+	for addr, weight := range r.ServerWeights {
+		if r.SRVName == "" && !slices.Contains(r.Servers, addr) {
+			return fmt.Errorf("server_weights: %s is not a configured RADIUS server", addr)
+		}
+		if weight <= 0 {
+			return fmt.Errorf("server_weights: weight for %s must be positive", addr)
+		}
+	}
+	switch r.QuorumPolicy {
+	case quorumAny, quorumAll, quorumMajority:
+	default:
+		return fmt.Errorf("unknown quorum_policy: %s", r.QuorumPolicy)
+	}
+	// A challenge answer goes to a single server, which would bypass the quorum
+	if r.AccessChallenge && r.QuorumPolicy != quorumAny {
+		return fmt.Errorf("access_challenge requires quorum_policy any")
+	}
+	// EAP consumes the server's challenges itself
+	if r.EAP && r.AccessChallenge {
+		return fmt.Errorf("eap cannot be combined with access_challenge")
+	}
+	if r.EAP && r.AuthProtocol != authProtocolPAP {
+		return fmt.Errorf("eap cannot be combined with auth_protocol %s", r.AuthProtocol)
+	}
+	if r.EAP && r.SupportDigest {
+		return fmt.Errorf("eap cannot be combined with support_digest")
+	}
+
+	// Every per-server setting must belong to a configured server. Discovered
+	// servers change at runtime, so they are not checked.
+	for addr := range r.ServerSecrets {
+		if r.SRVName == "" && !slices.Contains(r.Servers, addr) {
+			return fmt.Errorf("server_secrets: %s is not a configured RADIUS server", addr)
+		}
+	}
+	for addr, timeout := range r.ServerTimeouts {
+		if r.SRVName == "" && !slices.Contains(r.Servers, addr) {
+			return fmt.Errorf("server_timeouts: %s is not a configured RADIUS server", addr)
+		}
+		if d, err := time.ParseDuration(timeout); err != nil || d <= 0 {
+			return fmt.Errorf("invalid server_timeouts duration for %s: %s", addr, timeout)
+		}
+	}
+
+	for name := range r.AttributeHeaders {
+		if _, ok := r.attributes().lookup(name); !ok {
+			return fmt.Errorf("attribute_headers: unknown RADIUS attribute %s", name)
+		}
+	}
+	if err := r.checkRequestAttributes(); err != nil {
+		return err
+	}
+	if err := r.checkUsernameAttribute(); err != nil {
+		return err
+	}
+	if r.RoleAttribute != "" {
+		if r.RoleHeader == "" {
+			return fmt.Errorf("role_attribute requires role_header")
+		}
+		if _, ok := r.attributes().lookup(r.RoleAttribute); !ok {
+			return fmt.Errorf("role_attribute: unknown RADIUS attribute %s", r.RoleAttribute)
+		}
+	}
+	for _, pattern := range append(slices.Clone(r.UsernameAllowList), r.UsernameDenyList...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid username pattern %q: %v", pattern, err)
+		}
+	}
+
+	// A server listed twice would be sent every request twice
+	seen := make(map[string]struct{}, len(r.Servers))
+	for _, server := range r.Servers {
+		if _, ok := seen[server]; ok {
+			return fmt.Errorf("duplicate RADIUS server: %s", server)
+		}
+		seen[server] = struct{}{}
+	}
+	servers := slices.Clone(r.Servers)
+	for _, realm := range r.Realms {
+		servers = append(servers, realm.Servers...)
+	}
+	for _, server := range servers {
+		_, port, _ := net.SplitHostPort(server)
+		if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			return fmt.Errorf("invalid port for RADIUS server %s", server)
+		}
+	}
+
+	// Weak settings still work, so they are only reported
+	r.warnWeakSecret("secret", r.Secret)
+	for addr, secret := range r.ServerSecrets {
+		r.warnWeakSecret("server_secrets: "+addr, secret)
+	}
+	for _, realm := range r.Realms {
+		r.warnWeakSecret("realm "+realm.Realm, realm.Secret)
+	}
+	if ttl, _ := time.ParseDuration(r.CacheTTL); ttl > 24*time.Hour {
+		r.logger.Warn("cache_ttl exceeds 24 hours; revoked or changed credentials stay valid that long",
+			zap.String("cache_ttl", r.CacheTTL))
+	}
+
+	// Servers that do not resolve would only fail once traffic arrives
+	if r.DryRun {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	resolved := make(map[string]string) // ip:port -> server
+	for i, server := range servers {
+		host, port, _ := net.SplitHostPort(server)
+		addrs := []string{host}
+		if _, err := netip.ParseAddr(host); err != nil {
+			var err error
+			if addrs, err = net.DefaultResolver.LookupHost(ctx, host); err != nil {
+				return fmt.Errorf("resolving RADIUS server %s: %v", server, err)
+			}
+		}
+		// Only the top-level servers are queried together
+		if i >= len(r.Servers) {
+			continue
+		}
+		for _, addr := range addrs {
+			key := net.JoinHostPort(addr, port)
+			if other, ok := resolved[key]; ok && other != server {
+				r.logger.Warn("RADIUS servers resolve to the same address",
+					zap.String("server", server),
+					zap.String("other", other),
+					zap.String("address", key))
+			}
+			resolved[key] = server
+		}
+	}
+	return nil
+}
+
+// minSecretLength is the shortest shared secret not reported as weak, the
+// length RFC 2865 recommends
+const minSecretLength = 16
+
+// warnWeakSecret logs a warning if secret, set by the named setting, is
+// shorter than minSecretLength. Only the length is logged.
+func (r *HTTPRadiusAuth) warnWeakSecret(setting, secret string) {
+	if secret != "" && len(secret) < minSecretLength {
+		r.logger.Warn("RADIUS shared secret is shorter than 16 bytes and easily guessed",
+			zap.String("setting", setting),
+			zap.Int("length", len(secret)))
+	}
+}
+
+// expandPlaceholders resolves global placeholders such as {env.RADIUS_SECRET}
+// in string settings
+func (r *HTTPRadiusAuth) expandPlaceholders() {
+	repl := caddy.NewReplacer()
+	for _, field := range []*string{
+		&r.Secret, &r.SecretFile, &r.Realm, &r.Timeout, &r.ConnectTimeout, &r.ResponseTimeout, &r.CacheTTL, &r.CacheKeySecret,
+		&r.RedisAddr, &r.RedisPassword, &r.SRVName, &r.NASIdentifier, &r.NASIPAddress,
+	} {
+		*field = repl.ReplaceAll(*field, "")
+	}
+	for i, s := range r.Servers {
+		r.Servers[i] = repl.ReplaceAll(s, "")
+	}
+	for addr, secret := range r.ServerSecrets {
+		r.ServerSecrets[addr] = repl.ReplaceAll(secret, "")
+	}
+	if r.JWT != nil {
+		r.JWT.SigningKey = repl.ReplaceAll(r.JWT.SigningKey, "")
+	}
+	for i := range r.Realms {
+		r.Realms[i].Secret = repl.ReplaceAll(r.Realms[i].Secret, "")
+	}
+}
+
+// Error response formats
+const (
+	errorFormatText = "text"
+	errorFormatJSON = "json"
+)
+
+// shutdownTimeout bounds how long Cleanup waits for in-flight exchanges
+const shutdownTimeout = 5 * time.Second
+
+// inflightTracker counts running exchanges and background goroutines. Once
+// closed it admits no new work, so Cleanup cannot race a request that is
+// still being served by the old config: a bare sync.WaitGroup must not see
+// Add after Wait has started.
+type inflightTracker struct {
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// enter registers new work and reports whether it may start
+func (t *inflightTracker) enter() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	t.wg.Add(1)
+	return true
+}
+
+// leave marks work registered with enter as finished
+func (t *inflightTracker) leave() {
+	t.wg.Done()
+}
+
+// close stops admitting work and waits up to timeout for running work,
+// reporting whether it all finished
+func (t *inflightTracker) close(timeout time.Duration) bool {
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
 
+// Cleanup stops the background goroutines, cancels in-flight RADIUS
+// exchanges, waits briefly for them to finish and releases resources held
+// by the module
+func (r *HTTPRadiusAuth) Cleanup() error {
+	instances.Delete(r)
+	if r.shutdown != nil {
+		r.shutdown()
+		if !r.inflight.close(shutdownTimeout) {
+			r.logger.Warn("timed out waiting for in-flight RADIUS requests to finish")
+		}
+	}
+	if r.metrics != nil {
+		unregisterMetrics(r.metrics)
+	}
+	if r.PersistCachePath != "" && r.CacheBackend != cacheBackendRedis {
+		if err := r.saveCache(); err != nil {
+			r.logger.Warn("persisting cache failed",
+				zap.String("path", r.PersistCachePath), zap.Error(err))
+		}
+	}
+	// Release cached entries of the old config right away. Redis entries
+	// are shared with other instances and stay.
+	if r.CacheBackend != cacheBackendRedis {
+		if r.cache != nil {
+			r.cache.Flush()
+		}
+		if r.negativeCache != nil {
+			r.negativeCache.Flush()
+		}
+	}
+	if r.JWT != nil && r.JWT.tokens != nil {
+		r.JWT.tokens.Purge()
+	}
+	if r.rateLimiter != nil {
+		r.rateLimiter.reset()
+	}
+	if r.lockout != nil {
+		r.lockout.reset()
+	}
+	if r.connPool != nil {
+		r.connPool.close()
+	}
+	if r.redisClient != nil {
+		return r.redisClient.Close()
+	}
 	return nil
 }
 
-// isValidServerAddr validates a host:port format
+// hostnamePattern matches an ASCII hostname; internationalized names are
+// converted to their punycode form before matching
+var hostnamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9\-\.]{0,252}$`)
+
+// isValidServerAddr validates a host:port address whose host is an IP
+// address or a hostname
 func isValidServerAddr(addr string) bool {
+	scheme, addr := splitServerURL(addr)
+	if scheme != "" && scheme != transportUDP && scheme != transportTLS && scheme != transportTCP {
+		return false
+	}
 	host, port, err := net.SplitHostPort(addr)
 	if err != nil || host == "" || port == "" {
 		return false
 	}
-	if net.ParseIP(host) == nil && strings.Contains(host, " ") {
+	// IPv6 literals arrive unbracketed from SplitHostPort and may carry a
+	// zone, e.g. [fe80::1%eth0]:1812
+	if _, err := netip.ParseAddr(host); err == nil {
+		return true
+	}
+	ascii, err := idna.Lookup.ToASCII(host)
+	if err != nil {
 		return false
 	}
-	return true
+	return hostnamePattern.MatchString(ascii)
+}
+
+// outboundIP returns the local address used to reach server. Dialing UDP
+// sends no packets; it only selects a route.
+func outboundIP(server string) net.IP {
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil
+	}
+	return addr.IP
 }
 
 // Authenticate ServeHTTP handles HTTP requests and performs RADIUS authentication
 func (r HTTPRadiusAuth) Authenticate(w http.ResponseWriter, req *http.Request) (caddyauth.User, bool, error) {
-	user, pass, ok := req.BasicAuth()
+	r.clearAttributeHeaders(req)
+
+	// Tag the request and every log entry about it with a session ID, which
+	// also becomes the Acct-Session-Id. Setting the header unconditionally
+	// replaces any value sent by the client.
+	var sessionID string
+	if r.SessionIDHeader != "" {
+		id, err := newSessionID()
+		if err != nil {
+			r.logger.Error("generating session id", zap.Error(err))
+			r.writeError(w, http.StatusInternalServerError, "Internal Server Error")
+			return caddyauth.User{}, false, nil
+		}
+		sessionID = id
+		req.Header.Set(r.SessionIDHeader, sessionID)
+		r.logger = r.logger.With(zap.String("session_id", sessionID))
+	}
+
+	if r.bypass != nil {
+		match, err := r.bypass.MatchWithError(req)
+		if err != nil {
+			// Authenticating is the safe choice when the expression fails
+			r.logger.Warn("evaluating bypass_if", zap.Error(err))
+		} else if match {
+			r.logger.Debug("request matches bypass_if, skipping authentication")
+			return caddyauth.User{ID: "__bypass__"}, true, nil
+		}
+	}
+
+	if r.ipAllowed(req) {
+		r.logger.Debug("client IP in allowlist, skipping authentication", zap.String("client_ip", r.clientIP(req)))
+		return caddyauth.User{ID: "__allowlist__"}, true, nil
+	}
+
+	user, pass, ok := r.credentials(req)
+	var digest *digestCredentials
+	if !ok && r.SupportDigest {
+		var err error
+		if digest, ok, err = r.digestCredentials(req); err != nil {
+			r.logger.Debug("refusing digest credentials", zap.Error(err))
+			r.setAuthenticateHeaders(w, errors.Is(err, errStaleNonce))
+			return caddyauth.User{}, false, nil
+		}
+		if ok {
+			user = digest.username
+		}
+	}
 	if !ok {
 		return r.promptForCredentials(w, nil)
 	}
 
+	start := time.Now()
+
+	// Refuse oversized credentials before doing any work on them. The audit
+	// entry keeps the username within the limit, so it cannot flood the log.
+	if len(user) > r.MaxUsernameLength || len(pass) > r.MaxPasswordLength {
+		r.logger.Warn("refusing over-length credentials",
+			zap.String("client_ip", r.clientIP(req)),
+			zap.Int("username_length", len(user)),
+			zap.Int("password_length", len(pass)))
+		observeOutcome(outcomeReject)
+		r.audit(req, user[:min(len(user), r.MaxUsernameLength)], outcomeReject, "", false, start)
+		r.writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return r.promptForCredentials(w, nil)
+	}
+
+	if r.DryRun {
+		r.logger.Warn("[DRY-RUN] RADIUS auth skipped", zap.String("username", user))
+		return caddyauth.User{ID: user}, true, nil
+	}
+
+	// Users of a configured realm are authenticated against its own servers
+	if realm := r.matchRealm(user); realm != nil {
+		r = r.withRealm(realm)
+	}
+
+	// The original username is reported to Caddy; RADIUS sees the transformed one
+	radiusUser := r.UsernameTransform.apply(user)
+
+	if !r.usernamePermitted(radiusUser) {
+		observeOutcome(outcomeReject)
+		r.audit(req, user, outcomeReject, "", false, start)
+		r.writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return r.promptForCredentials(w, nil)
+	}
+
+	// Users with too many recent failures are turned away before RADIUS or
+	// the cache see the attempt
+	if r.rateLimiter != nil {
+		if wait := r.rateLimiter.retryAfter(radiusUser); wait > 0 {
+			observeOutcome(outcomeRateLimited)
+			r.audit(req, user, outcomeRateLimited, "", false, start)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			r.writeError(w, http.StatusTooManyRequests, "Too Many Requests")
+			return caddyauth.User{}, false, nil
+		}
+	}
+	if r.lockout != nil {
+		if wait := r.lockout.lockedFor(radiusUser); wait > 0 {
+			observeOutcome(outcomeLockedOut)
+			r.audit(req, user, outcomeLockedOut, "", false, start)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			r.writeError(w, http.StatusForbidden, "Forbidden")
+			return caddyauth.User{}, false, nil
+		}
+	}
+
+	info, err := r.newRequestInfo(req)
+	if err != nil {
+		r.logger.Debug("invalid request attribute", zap.Error(err))
+		r.writeError(w, http.StatusBadRequest, "Bad Request")
+		return caddyauth.User{}, false, nil
+	}
+
+	// A digest response is only valid for its nonce, so it is neither
+	// cached nor shared with concurrent requests
+	if digest != nil {
+		info.digest = digest
+		res, err := r.checkRadiusConcurrent(req.Context(), radiusUser, "", info)
+		return r.finishAuthentication(w, req, user, radiusUser, "", res, err, start)
+	}
+
+	// An answer to an Access-Challenge goes back to the server that issued it
+	// and is never cached
+	if r.challenges != nil {
+		if pending, ok := r.takeChallenge(req, radiusUser); ok {
+			res, err := r.answerChallenge(req.Context(), radiusUser, pass, info, pending)
+			return r.finishAuthentication(w, req, user, radiusUser, "", res, err, start)
+		}
+	}
+
 	// Check cache first
-	cacheKey := fmt.Sprintf("%s:%s", user, pass)
+	cacheKey := r.cacheKey(radiusUser, pass, info.cacheScope())
+	if r.negativeCache != nil {
+		if _, found := r.negativeCache.Get(cacheKey); found {
+			observeOutcome(outcomeCacheHit)
+			r.audit(req, user, outcomeReject, "", true, start)
+			r.recordFailure(radiusUser)
+			r.writeReject(w)
+			return r.promptForCredentials(w, nil)
+		}
+	}
 	if r.cache != nil {
-		if cachedResult, found := r.cache.Get(cacheKey); found {
-			if cachedResult.(bool) {
-				return caddyauth.User{ID: user}, true, nil
+		if session, found := r.cache.Get(cacheKey); found {
+			observeOutcome(outcomeCacheHit)
+			if session.Allowed {
+				r.audit(req, user, outcomeAccept, "", true, start)
+				return r.accept(w, req, user, radiusUser, session.Attributes)
 			} else {
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				r.audit(req, user, outcomeReject, "", true, start)
+				r.recordFailure(radiusUser)
+				r.writeReject(w)
 				return r.promptForCredentials(w, nil)
 			}
 		}
 	}
 
 	// Perform RADIUS authentication
-	ok, err := r.checkRadiusConcurrent(user, pass)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("RADIUS error: %v", err), http.StatusInternalServerError)
-		return r.promptForCredentials(w, nil)
+	res, err := r.checkRadius(req.Context(), cacheKey, radiusUser, pass, info)
+
+	// Cache the result; rejects go to the negative cache when it is enabled
+	ok = res.ok
+	if err == nil {
+		session := cachedSession{Allowed: ok}
+		var maxTTL time.Duration
+		if ok {
+			session.Attributes = r.attributes().replyAttributes(res.reply)
+			maxTTL = r.sessionTimeout(res.reply)
+		}
+		if !ok && r.negativeCache != nil {
+			r.negativeCache.Set(cacheKey, session, 0)
+			r.recordCacheKey(radiusUser, cacheKey)
+		} else if r.cache != nil && maxTTL >= 0 {
+			r.cache.Set(cacheKey, session, maxTTL)
+			r.recordCacheKey(radiusUser, cacheKey)
+		}
 	}
 
-	// Cache the result
-	if r.cache != nil {
-		r.cache.SetDefault(cacheKey, ok)
+	return r.finishAuthentication(w, req, user, radiusUser, pass, res, err, start)
+}
+
+// finishAuthentication responds to the outcome of a RADIUS exchange. pass is
+// checked against the fallback credentials when RADIUS is unavailable; it is
+// empty for challenge answers and digest responses, which cannot be.
+func (r HTTPRadiusAuth) finishAuthentication(w http.ResponseWriter, req *http.Request, user, radiusUser, pass string, res radiusResult, err error, start time.Time) (caddyauth.User, bool, error) {
+	var challenge *challengeError
+	if errors.As(err, &challenge) {
+		r.audit(req, user, outcomeChallenge, res.server, false, start)
+		return r.sendChallenge(w, req, radiusUser, challenge)
+	}
+	if errors.Is(err, errSaturated) {
+		observeOutcome(outcomeError)
+		r.audit(req, user, outcomeError, res.server, false, start)
+		r.writeError(w, http.StatusServiceUnavailable, "Service Unavailable")
+		return caddyauth.User{}, false, nil
+	}
+	if err != nil && req.Context().Err() != nil {
+		// The client went away; there is nobody to answer
+		r.logger.Debug("client disconnected during RADIUS authentication", zap.String("username", user))
+		return caddyauth.User{}, false, nil
+	}
+	if err != nil && r.FallbackProvider == fallbackBasicAuth {
+		// Unlike fail_behavior allow, the credentials still have to match
+		r.logger.Warn("RADIUS unavailable, checking fallback credentials",
+			zap.String("username", user),
+			zap.Error(err))
+		if r.fallbackAuthenticate(user, pass) {
+			observeOutcome(outcomeAccept)
+			r.audit(req, user, outcomeAccept, "", false, start)
+			r.recordSuccess(radiusUser)
+			return caddyauth.User{ID: user}, true, nil
+		}
+		observeOutcome(outcomeReject)
+		r.audit(req, user, outcomeReject, "", false, start)
+		r.recordFailure(radiusUser)
+		r.writeReject(w)
+		return r.promptForCredentials(w, nil)
+	}
+	if err != nil {
+		observeOutcome(outcomeError)
+		r.audit(req, user, outcomeError, res.server, false, start)
+		switch r.FailBehavior {
+		case failAllow:
+			r.logger.Warn("RADIUS unavailable, allowing request",
+				zap.String("username", user),
+				zap.Error(err))
+			return caddyauth.User{ID: radiusDownUser}, true, nil
+		case failServiceUnavailable:
+			r.writeError(w, http.StatusServiceUnavailable, "Service Unavailable")
+			return caddyauth.User{}, false, nil
+		case failError:
+			r.writeError(w, http.StatusInternalServerError, fmt.Sprintf("RADIUS error: %v", err))
+			return r.promptForCredentials(w, nil)
+		default:
+			r.writeError(w, http.StatusForbidden, "Forbidden")
+			return caddyauth.User{}, false, nil
+		}
 	}
 
-	if !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	if !res.ok {
+		observeOutcome(outcomeReject)
+		r.audit(req, user, outcomeReject, res.server, false, start)
+		r.recordFailure(radiusUser)
+		r.writeReject(w)
 		return r.promptForCredentials(w, nil)
 	}
 
+	observeOutcome(outcomeAccept)
+	r.audit(req, user, outcomeAccept, res.server, false, start)
+	return r.accept(w, req, user, radiusUser, r.attributes().replyAttributes(res.reply))
+}
+
+// accept grants access to user, whose RADIUS reply carried attrs. It is
+// shared by cache hits and RADIUS accepts, so both are accounted alike.
+func (r HTTPRadiusAuth) accept(w http.ResponseWriter, req *http.Request, user, radiusUser string, attrs map[string][]string) (caddyauth.User, bool, error) {
+	r.recordSuccess(radiusUser)
+	r.exportAttributes(req, attrs)
+	r.setAttributeHeaders(req, attrs)
+	r.issueJWTIfEnabled(w, req, user)
+
+	if r.Accounting != nil && r.Accounting.Enabled {
+		var sessionID string
+		if r.SessionIDHeader != "" {
+			sessionID = req.Header.Get(r.SessionIDHeader)
+		}
+		r.startAccounting(w, req, radiusUser, sessionID)
+	}
+
 	return caddyauth.User{ID: user}, true, nil
 }
 
+// recordFailure counts a failed login against username's rate limit and
+// lockout
+func (r HTTPRadiusAuth) recordFailure(username string) {
+	if r.rateLimiter != nil {
+		r.rateLimiter.failure(username)
+	}
+	if r.lockout != nil && r.lockout.failure(username) {
+		r.logger.Warn("locking out username after consecutive rejects",
+			zap.String("username", username),
+			zap.Duration("duration", r.lockout.duration))
+	}
+}
+
+// recordSuccess clears the consecutive rejects counted for username
+func (r HTTPRadiusAuth) recordSuccess(username string) {
+	if r.lockout != nil {
+		r.lockout.success(username)
+	}
+}
+
+// sessionTimeout returns the Session-Timeout of an accept to cap its cache
+// TTL with, 0 if there is none or it is ignored, or -1 if the session must
+// not be cached at all
+func (r HTTPRadiusAuth) sessionTimeout(reply *radius.Packet) time.Duration {
+	if reply == nil || (r.RespectSessionTimeout != nil && !*r.RespectSessionTimeout) {
+		return 0
+	}
+	timeout, err := rfc2865.SessionTimeout_Lookup(reply)
+	if err != nil {
+		return 0
+	}
+	if timeout == 0 {
+		return -1
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+// checkRadius performs RADIUS authentication, sharing a single in-flight
+// exchange between concurrent requests with the same credentials when
+// single-flight is enabled, and between instances with coordination. It
+// returns early with ctx's error when the client goes away.
+func (r HTTPRadiusAuth) checkRadius(ctx context.Context, key, user, pass string, info requestInfo) (radiusResult, error) {
+	check := func(ctx context.Context) (radiusResult, error) {
+		if r.coordinator == nil {
+			return r.checkRadiusConcurrent(ctx, user, pass, info)
+		}
+		return r.coordinator.do(ctx, key, func() (radiusResult, error) {
+			return r.checkRadiusConcurrent(ctx, user, pass, info)
+		})
+	}
+	if r.group == nil {
+		return check(ctx)
+	}
+	ch := r.group.DoChan(key, func() (interface{}, error) {
+		// The exchange is shared, so one caller going away must not cancel it
+		return check(context.WithoutCancel(ctx))
+	})
+	select {
+	case res := <-ch:
+		return res.Val.(radiusResult), res.Err
+	case <-ctx.Done():
+		return radiusResult{}, ctx.Err()
+	}
+}
+
+// audit logs an authentication attempt unless audit logging is disabled.
+// Only the username is logged, never the password.
+func (r HTTPRadiusAuth) audit(req *http.Request, username, outcome, server string, cacheHit bool, start time.Time) {
+	if r.AuditLog != nil && !*r.AuditLog {
+		return
+	}
+	fields := []zap.Field{
+		zap.String("username", username),
+		zap.String("client_ip", r.clientIP(req)),
+		zap.String("outcome", outcome),
+		zap.Bool("cache_hit", cacheHit),
+		zap.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+	}
+	if server != "" {
+		fields = append(fields, zap.String("server", server))
+	}
+	r.logger.Info("authentication attempt", fields...)
+}
+
+// issueJWTIfEnabled issues a JWT for an accepted user when configured. A
+// signing failure is logged and does not fail the request.
+func (r HTTPRadiusAuth) issueJWTIfEnabled(w http.ResponseWriter, req *http.Request, username string) {
+	if r.JWT == nil || !r.JWT.Enabled {
+		return
+	}
+	if err := r.issueJWT(w, req, username); err != nil {
+		r.logger.Error("issuing JWT", zap.String("username", username), zap.Error(err))
+	}
+}
+
+// credentials returns the username and password from the configured
+// credential headers when both are present, or from Basic Auth otherwise
+func (r HTTPRadiusAuth) credentials(req *http.Request) (string, string, bool) {
+	if h := r.CredentialHeaders; h != nil && h.UsernameHeader != "" && h.PasswordHeader != "" {
+		user, pass := req.Header.Get(h.UsernameHeader), req.Header.Get(h.PasswordHeader)
+		if user != "" && pass != "" {
+			return user, pass, true
+		}
+	}
+	return req.BasicAuth()
+}
+
+// usernamePermitted checks username against the deny list, then the allow list
+func (r HTTPRadiusAuth) usernamePermitted(username string) bool {
+	if matchesAny(r.UsernameDenyList, username) {
+		return false
+	}
+	return len(r.UsernameAllowList) == 0 || matchesAny(r.UsernameAllowList, username)
+}
+
+// matchesAny reports whether name matches any of the glob patterns
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ipAllowed reports whether the client IP is in IPAllowList
+func (r HTTPRadiusAuth) ipAllowed(req *http.Request) bool {
+	if len(r.ipAllowList) == 0 {
+		return false
+	}
+	ip := net.ParseIP(r.clientIP(req))
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range r.ipAllowList {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the HTTP client, taken from the first
+// X-Forwarded-For entry when TrustForwardedFor is set
+func (r HTTPRadiusAuth) clientIP(req *http.Request) string {
+	if r.TrustForwardedFor {
+		if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
+			first, _, _ := strings.Cut(xff, ",")
+			if ip := strings.TrimSpace(first); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// radiusResult is the outcome of a RADIUS authentication
+type radiusResult struct {
+	ok     bool
+	reply  *radius.Packet // Access-Accept reply, nil unless ok
+	server string         // Server whose answer decided the outcome, if any
+}
+
+// cacheKey derives the cache key for a credential pair as
+// HMAC-SHA256(user:pass) so plaintext passwords never end up in the cache.
+// A non-empty scope, such as the request attribute values, is mixed in.
+// Each cache key version uses its own HMAC key, so bumping the version
+// orphans every existing entry.
+func (r HTTPRadiusAuth) cacheKey(user, pass, scope string) string {
+	secret := r.cacheKeySecret
+	if v := r.cacheVersion.Load(); v != 0 {
+		derive := hmac.New(sha256.New, secret)
+		derive.Write([]byte("cache key version " + strconv.FormatInt(v, 10)))
+		secret = derive.Sum(nil)
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(user + ":" + pass))
+	if scope != "" {
+		mac.Write([]byte("\x00" + scope))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
 func (r HTTPRadiusAuth) promptForCredentials(w http.ResponseWriter, err error) (caddyauth.User, bool, error) {
+	r.setAuthenticateHeader(w)
+	return caddyauth.User{}, false, err
+}
+
+func (r HTTPRadiusAuth) setAuthenticateHeader(w http.ResponseWriter) {
+	r.setAuthenticateHeaders(w, false)
+}
+
+// setAuthenticateHeaders offers Basic and, when enabled, Digest; stale
+// tells Digest clients to retry with a fresh nonce without asking the user
+func (r HTTPRadiusAuth) setAuthenticateHeaders(w http.ResponseWriter, stale bool) {
 	// browsers show a message that says something like:
 	// "The website says: <realm>"
 	// which is kinda dumb, but whatever.
-	realm := r.Realm
-	if realm == "" {
-		realm = "restricted"
+	challenge := fmt.Sprintf(`Basic realm="%s"`, r.realmName())
+	if r.RealmCharset != "" {
+		// RFC 7617 section 2.1
+		challenge += fmt.Sprintf(`, charset="%s"`, r.RealmCharset)
 	}
-	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, realm))
-	return caddyauth.User{}, false, err
+	w.Header().Set("WWW-Authenticate", challenge)
+	if r.SupportDigest {
+		w.Header().Add("WWW-Authenticate", r.digestChallenge(stale))
+	}
+}
+
+// realmName returns the configured realm, "restricted" by default
+func (r HTTPRadiusAuth) realmName() string {
+	if r.Realm == "" {
+		return "restricted"
+	}
+	return r.Realm
+}
+
+// writeReject answers a rejected login with RejectStatusCode
+func (r HTTPRadiusAuth) writeReject(w http.ResponseWriter) {
+	r.writeError(w, r.RejectStatusCode, http.StatusText(r.RejectStatusCode))
+}
+
+// writeError answers with status in the configured ErrorFormat. A 401 or 500
+// gets its WWW-Authenticate header before the response is written. JSON
+// bodies never include RADIUS error details.
+func (r HTTPRadiusAuth) writeError(w http.ResponseWriter, status int, message string) {
+	if status == http.StatusUnauthorized || status == http.StatusInternalServerError {
+		r.setAuthenticateHeader(w)
+	}
+	if r.ErrorFormat != errorFormatJSON {
+		http.Error(w, message, status)
+		return
+	}
+	if status == http.StatusInternalServerError {
+		message = "RADIUS authentication failed"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+		Code  int    `json:"code"`
+	}{message, status})
 }
 
 // Interface guards
 var (
 	_ caddy.Provisioner       = (*HTTPRadiusAuth)(nil)
+	_ caddy.Validator         = (*HTTPRadiusAuth)(nil)
+	_ caddy.CleanerUpper      = (*HTTPRadiusAuth)(nil)
 	_ caddyauth.Authenticator = (*HTTPRadiusAuth)(nil)
 )
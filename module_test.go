@@ -0,0 +1,626 @@
+package caddy2_radius_auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/wxccs/caddy2-radius-auth/internal/testradius"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2866"
+)
+
+// newTestContext returns a fresh Caddy context that is cancelled when the
+// test ends
+func newTestContext(tb testing.TB) caddy.Context {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	tb.Cleanup(cancel)
+	return ctx
+}
+
+// provision provisions r in a fresh Caddy context and cleans it up when the
+// test ends
+func provision(tb testing.TB, r *HTTPRadiusAuth) caddy.Context {
+	tb.Helper()
+	ctx := newTestContext(tb)
+	if err := r.Provision(ctx); err != nil {
+		tb.Fatalf("Provision: %v", err)
+	}
+	tb.Cleanup(func() { r.Cleanup() })
+	return ctx
+}
+
+func TestCacheKeyHidesPassword(t *testing.T) {
+	r := HTTPRadiusAuth{cacheKeySecret: []byte("key secret"), cacheVersion: new(atomic.Int64)}
+	const password = "correct horse battery staple"
+
+	key := r.cacheKey("alice", password, "")
+	if strings.Contains(key, password) {
+		t.Fatalf("cache key %q contains the password", key)
+	}
+	for _, part := range strings.Fields(password) {
+		if strings.Contains(key, part) {
+			t.Errorf("cache key %q contains part of the password %q", key, part)
+		}
+	}
+
+	if again := r.cacheKey("alice", password, ""); again != key {
+		t.Errorf("cache key is not stable: %q then %q", key, again)
+	}
+	if other := r.cacheKey("alice", "another password", ""); other == key {
+		t.Error("different passwords map to the same cache key")
+	}
+	r.cacheVersion.Add(1)
+	if r.cacheKey("alice", password, "") == key {
+		t.Error("cache key does not depend on the cache key version")
+	}
+	r.cacheVersion.Store(0)
+	r.cacheKeySecret = []byte("other secret")
+	if r.cacheKey("alice", password, "") == key {
+		t.Error("cache key does not depend on the cache key secret")
+	}
+}
+
+func TestProvisionResolvesEnvPlaceholders(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+	t.Setenv("RADIUS_TEST_SERVER", mock.Addr())
+	t.Setenv("RADIUS_TEST_SECRET", testradius.Secret)
+	t.Setenv("RADIUS_TEST_TIMEOUT", "2s")
+	t.Setenv("RADIUS_TEST_REALM", "Intranet")
+
+	r := &HTTPRadiusAuth{
+		Servers: []string{"{env.RADIUS_TEST_SERVER}"},
+		Secret:  "{env.RADIUS_TEST_SECRET}",
+		Timeout: "{env.RADIUS_TEST_TIMEOUT}",
+		Realm:   "{env.RADIUS_TEST_REALM}",
+	}
+	provision(t, r)
+
+	if len(r.Servers) != 1 || r.Servers[0] != mock.Addr() {
+		t.Errorf("servers = %q, want [%s]", r.Servers, mock.Addr())
+	}
+	if r.Secret != testradius.Secret {
+		t.Errorf("secret = %q, want %q", r.Secret, testradius.Secret)
+	}
+	if r.Timeout != "2s" {
+		t.Errorf("timeout = %q, want 2s", r.Timeout)
+	}
+	if r.Realm != "Intranet" {
+		t.Errorf("realm = %q, want Intranet", r.Realm)
+	}
+
+	// The resolved secret must be the one used on the wire
+	req, _ := newCaddyRequest("alice", "password")
+	if _, ok, err := r.Authenticate(httptest.NewRecorder(), req); !ok || err != nil {
+		t.Fatalf("Authenticate = %v, %v", ok, err)
+	}
+}
+
+func TestIsValidServerAddr(t *testing.T) {
+	for _, tc := range []struct {
+		addr string
+		want bool
+	}{
+		{"192.0.2.1:1812", true},
+		{"[2001:db8::1]:1812", true},
+		{"[::1]:1812", true},
+		{"[fe80::1%eth0]:1812", true},
+		{"localhost:1812", true},
+		{"radius.corp.example.com:1812", true},
+		{"radius-2.example.com:2083", true},
+		{"bücher.example:1812", true},
+		{"радиус.example.рф:1812", true},
+		{"192.0.2.1", false},
+		{"[::1]", false},
+		{"::1:1812", false},
+		{":1812", false},
+		{"radius.example.com:", false},
+		{"radius server:1812", false},
+		{"-radius.example.com:1812", false},
+		{"radius_1.example.com:1812", false},
+		{"radius.example.com/auth:1812", false},
+	} {
+		if got := isValidServerAddr(tc.addr); got != tc.want {
+			t.Errorf("isValidServerAddr(%q) = %v, want %v", tc.addr, got, tc.want)
+		}
+	}
+}
+
+func TestPreferIPv6(t *testing.T) {
+	ctx := context.Background()
+	// The expected address of localhost depends on the host's resolver
+	wantLocalhost := "localhost:1812"
+	if ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip6", "localhost"); err == nil && len(ips) > 0 {
+		wantLocalhost = net.JoinHostPort(ips[0].String(), "1812")
+	}
+
+	for _, tc := range []struct {
+		server     string
+		preferIPv6 bool
+		want       string
+	}{
+		{"localhost:1812", false, "localhost:1812"},
+		{"localhost:1812", true, wantLocalhost},
+		{"192.0.2.1:1812", true, "192.0.2.1:1812"},
+		{"[2001:db8::1]:1812", true, "[2001:db8::1]:1812"},
+		{"[::1]:1812", true, "[::1]:1812"},
+		{"radius.invalid:1812", true, "radius.invalid:1812"},
+	} {
+		r := HTTPRadiusAuth{PreferIPv6: tc.preferIPv6}
+		if got := r.dialAddr(ctx, tc.server); got != tc.want {
+			t.Errorf("dialAddr(%s) with prefer_ipv6 %v = %s, want %s", tc.server, tc.preferIPv6, got, tc.want)
+		}
+	}
+}
+
+func TestValidateWarnings(t *testing.T) {
+	const weak = "short"
+	for _, tc := range []struct {
+		name     string
+		secret   string
+		cacheTTL string
+		want     []string
+	}{
+		{"strong secret", "a-long-enough-shared-secret", "1h", nil},
+		{"weak secret", weak, "", []string{"RADIUS shared secret is shorter than 16 bytes and easily guessed"}},
+		{"long cache_ttl", "a-long-enough-shared-secret", "48h", []string{"cache_ttl exceeds 24 hours; revoked or changed credentials stay valid that long"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &HTTPRadiusAuth{Servers: []string{"127.0.0.1:1812"}, Secret: tc.secret, CacheTTL: tc.cacheTTL}
+			provision(t, r)
+			core, logs := observer.New(zapcore.WarnLevel)
+			r.logger = zap.New(core)
+
+			if err := r.Validate(); err != nil {
+				t.Fatalf("Validate: %v", err)
+			}
+			var got []string
+			for _, entry := range logs.All() {
+				got = append(got, entry.Message)
+				if strings.Contains(fmt.Sprint(entry.ContextMap()), weak) {
+					t.Errorf("warning %v contains the secret", entry.ContextMap())
+				}
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("warnings = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateServerErrors(t *testing.T) {
+	for _, server := range []string{
+		"127.0.0.1:0",
+		"127.0.0.1:65536",
+		"radius.invalid:1812",
+	} {
+		r := &HTTPRadiusAuth{Servers: []string{server}, Secret: testradius.Secret, Timeout: "1s"}
+		provision(t, r)
+		if err := r.Validate(); err == nil {
+			t.Errorf("Validate accepted server %s", server)
+		}
+	}
+}
+
+func TestValidateRanges(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		set  func(r *HTTPRadiusAuth)
+	}{
+		{"cache_max_size", func(r *HTTPRadiusAuth) { r.CacheMaxSize = -1 }},
+		{"max_cache_memory_mb", func(r *HTTPRadiusAuth) { r.MaxCacheMemoryMB = -1 }},
+		{"max_cache_entries_per_user", func(r *HTTPRadiusAuth) { r.MaxCacheEntriesPerUser = -1 }},
+		{"reject_status_code", func(r *HTTPRadiusAuth) { r.RejectStatusCode = 500 }},
+		{"tls pool_size", func(r *HTTPRadiusAuth) { r.TLS = &TLSConfig{Enabled: true, PoolSize: -1} }},
+		{"tls idle_conn_timeout", func(r *HTTPRadiusAuth) { r.TLS = &TLSConfig{Enabled: true, IdleConnTimeout: "0s"} }},
+		{"tls idle_conn_timeout unparsable", func(r *HTTPRadiusAuth) { r.TLS = &TLSConfig{Enabled: true, IdleConnTimeout: "soon"} }},
+		{"interim_interval", func(r *HTTPRadiusAuth) {
+			r.Accounting = &AccountingConfig{Enabled: true, InterimInterval: "-1m"}
+		}},
+	} {
+		r := &HTTPRadiusAuth{Servers: []string{"127.0.0.1:1812"}, Secret: testradius.Secret, CacheTTL: "1m"}
+		tc.set(r)
+		// Provision leaves range checks to Validate, as `caddy validate`
+		// runs both
+		provision(t, r)
+		if r.connPool != nil && r.connPool.idleTimeout <= 0 {
+			t.Errorf("%s: pool idle timeout %v, want the default until Validate refuses it", tc.name, r.connPool.idleTimeout)
+		}
+		if err := r.Validate(); err == nil {
+			t.Errorf("Validate accepted an invalid %s", tc.name)
+		}
+	}
+}
+
+func TestLogProvisioned(t *testing.T) {
+	const secret = "provisioned-secret"
+	r := &HTTPRadiusAuth{
+		Servers:  []string{"127.0.0.1:1812", "127.0.0.2:1812"},
+		Secret:   secret,
+		Strategy: "failover",
+		CacheTTL: "5m",
+	}
+	provision(t, r)
+	r.logger = zap.NewNop()
+	r.logProvisioned()
+
+	core, logs := observer.New(zapcore.InfoLevel)
+	r.logger = zap.New(core)
+	r.logProvisioned()
+
+	entries := logs.FilterMessage("radius_auth provisioned").All()
+	if len(entries) != 1 {
+		t.Fatalf("logged %d entries, want 1", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	for key, want := range map[string]any{
+		"version":  Version,
+		"servers":  []any{"127.0.0.1:1812", "127.0.0.2:1812"},
+		"strategy": "failover",
+		"timeout":  r.Timeout,
+		"cache":    true,
+		"secret":   "[REDACTED]",
+	} {
+		if got := fields[key]; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s = %#v, want %#v", key, got, want)
+		}
+	}
+	if strings.Contains(fmt.Sprint(fields), secret) {
+		t.Errorf("fields %v contain the secret", fields)
+	}
+}
+
+func TestErrorFormat(t *testing.T) {
+	// carol's requests are dropped, which times out as a RADIUS error
+	mock := testradius.NewMockServer(t, map[string]radius.Code{
+		"bob":   radius.CodeAccessReject,
+		"carol": 0,
+	})
+
+	for _, tc := range []struct {
+		format     string
+		username   string
+		wantStatus int
+		wantType   string
+		wantBody   string
+		wantPrompt bool
+	}{
+		{errorFormatText, "bob", http.StatusUnauthorized, "text/plain; charset=utf-8", "Unauthorized\n", true},
+		{errorFormatJSON, "bob", http.StatusUnauthorized, "application/json", `{"error":"Unauthorized","code":401}` + "\n", true},
+		{errorFormatJSON, "carol", http.StatusInternalServerError, "application/json", `{"error":"RADIUS authentication failed","code":500}` + "\n", true},
+	} {
+		t.Run(tc.format+"/"+tc.username, func(t *testing.T) {
+			r := &HTTPRadiusAuth{
+				Servers:      []string{mock.Addr()},
+				Secret:       testradius.Secret,
+				Timeout:      "100ms",
+				ErrorFormat:  tc.format,
+				FailBehavior: failError,
+			}
+			provision(t, r)
+
+			req, _ := newCaddyRequest(tc.username, "password")
+			w := httptest.NewRecorder()
+			if _, ok, _ := r.Authenticate(w, req); ok {
+				t.Fatal("Authenticate succeeded")
+			}
+			if w.Code != tc.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tc.wantStatus)
+			}
+			if got := w.Header().Get("Content-Type"); got != tc.wantType {
+				t.Errorf("Content-Type = %q, want %q", got, tc.wantType)
+			}
+			if got := w.Body.String(); got != tc.wantBody {
+				t.Errorf("body = %q, want %q", got, tc.wantBody)
+			}
+			// Only headers set before the body was written reach the client
+			if got := w.Result().Header.Get("WWW-Authenticate"); (got != "") != tc.wantPrompt {
+				t.Errorf("WWW-Authenticate = %q, want prompt %v", got, tc.wantPrompt)
+			}
+		})
+	}
+}
+
+func TestRealmCharset(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessReject})
+
+	for _, tc := range []struct {
+		charset string
+		want    string
+	}{
+		{"", `Basic realm="Staff Only"`},
+		{"UTF-8", `Basic realm="Staff Only", charset="UTF-8"`},
+	} {
+		r := &HTTPRadiusAuth{
+			Servers:      []string{mock.Addr()},
+			Secret:       testradius.Secret,
+			Realm:        "Staff Only",
+			RealmCharset: tc.charset,
+		}
+		provision(t, r)
+
+		req, _ := newCaddyRequest("alice", "password")
+		w := httptest.NewRecorder()
+		r.Authenticate(w, req)
+		if got := w.Result().Header.Get("WWW-Authenticate"); got != tc.want {
+			t.Errorf("charset %q: WWW-Authenticate = %q, want %q", tc.charset, got, tc.want)
+		}
+	}
+}
+
+func TestRealmCharsetCaddyfile(t *testing.T) {
+	var ra HTTPRadiusAuth
+	if err := json.Unmarshal(parseToJSON(t, `radius_auth {
+		servers 10.0.0.1:1812
+		secret s3cret
+		realm_charset UTF-8
+	}`), &ra); err != nil {
+		t.Fatal(err)
+	}
+	if ra.RealmCharset != "UTF-8" {
+		t.Errorf("RealmCharset = %q, want UTF-8", ra.RealmCharset)
+	}
+
+	ra = HTTPRadiusAuth{Servers: []string{"10.0.0.1:1812"}, Secret: "s3cret", RealmCharset: "ISO-8859-1"}
+	provision(t, &ra)
+	if err := ra.Validate(); err == nil {
+		t.Error("Validate accepted realm_charset ISO-8859-1")
+	}
+}
+
+func TestSessionIDHeader(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+	_, port, _ := net.SplitHostPort(mock.Addr())
+	r := &HTTPRadiusAuth{
+		Servers:         []string{mock.Addr()},
+		Secret:          testradius.Secret,
+		SessionIDHeader: "X-RADIUS-Session-ID",
+		Accounting:      &AccountingConfig{Enabled: true, Port: port},
+	}
+	provision(t, r)
+	core, logs := observer.New(zapcore.InfoLevel)
+	r.logger = zap.New(core)
+
+	req, _ := newCaddyRequest("alice", "password")
+	req.Header.Set("X-RADIUS-Session-ID", "spoofed")
+	if _, ok, err := r.Authenticate(httptest.NewRecorder(), req); !ok || err != nil {
+		t.Fatalf("Authenticate = %v, %v", ok, err)
+	}
+
+	id := req.Header.Get("X-RADIUS-Session-ID")
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(id) {
+		t.Fatalf("session ID header = %q, want a UUID v4", id)
+	}
+
+	entries := logs.FilterMessage("authentication attempt").All()
+	if len(entries) != 1 || entries[0].ContextMap()["session_id"] != id {
+		t.Errorf("audit entries %v do not carry session_id %s", entries, id)
+	}
+
+	// The Start record goes out asynchronously
+	deadline := time.Now().Add(time.Second)
+	for {
+		var start *radius.Packet
+		for _, packet := range mock.Requests() {
+			if packet.Code == radius.CodeAccountingRequest {
+				start = packet
+			}
+		}
+		if start != nil {
+			if got := rfc2866.AcctSessionID_GetString(start); got != id {
+				t.Errorf("Acct-Session-Id = %q, want %q", got, id)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no accounting Start record was sent")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitForStop returns the accounting Stop record mock received, waiting up
+// to a second for it
+func waitForStop(t *testing.T, mock *testradius.MockServer) *radius.Packet {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		for _, packet := range mock.Requests() {
+			if packet.Code == radius.CodeAccountingRequest && rfc2866.AcctStatusType_Get(packet) == rfc2866.AcctStatusType_Value_Stop {
+				return packet
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no accounting Stop record was sent")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAccountingByteCounts(t *testing.T) {
+	const inSize, outSize = 1234, 5678
+
+	for _, tc := range []struct {
+		name  string
+		serve func(w http.ResponseWriter, req *http.Request, next caddyhttp.Handler) error
+	}{
+		{"access log", func(w http.ResponseWriter, req *http.Request, next caddyhttp.Handler) error {
+			// Caddy wraps the response in a recorder when access logs are enabled
+			return next.ServeHTTP(caddyhttp.NewResponseRecorder(w, nil, nil), req)
+		}},
+		{"byte counter", ByteCounter{}.ServeHTTP},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+			_, port, _ := net.SplitHostPort(mock.Addr())
+			r := &HTTPRadiusAuth{
+				Servers:    []string{mock.Addr()},
+				Secret:     testradius.Secret,
+				Accounting: &AccountingConfig{Enabled: true, Port: port, ByteCounts: true},
+			}
+			provision(t, r)
+
+			req, _ := newCaddyRequest("alice", "password")
+			ctx, cancel := context.WithCancel(req.Context())
+			defer cancel()
+			req = req.WithContext(ctx)
+			req.Body = io.NopCloser(strings.NewReader(strings.Repeat("i", inSize)))
+
+			// Authentication and the rest of the handler chain, which reads
+			// the body and writes the response in two ways
+			chain := caddyhttp.HandlerFunc(func(w http.ResponseWriter, req *http.Request) error {
+				if _, ok, err := r.Authenticate(w, req); !ok || err != nil {
+					t.Fatalf("Authenticate = %v, %v", ok, err)
+				}
+				if _, err := io.Copy(io.Discard, req.Body); err != nil {
+					return err
+				}
+				if _, err := w.Write([]byte(strings.Repeat("o", outSize/2))); err != nil {
+					return err
+				}
+				// A reader without WriteTo makes io.Copy use the writer's ReadFrom
+				_, err := io.Copy(w, io.LimitReader(strings.NewReader(strings.Repeat("o", outSize)), outSize-outSize/2))
+				return err
+			})
+			if err := tc.serve(httptest.NewRecorder(), req, chain); err != nil {
+				t.Fatal(err)
+			}
+			cancel()
+
+			stop := waitForStop(t, mock)
+			if got := rfc2866.AcctInputOctets_Get(stop); got != inSize {
+				t.Errorf("Acct-Input-Octets = %d, want %d", got, inSize)
+			}
+			if got := rfc2866.AcctOutputOctets_Get(stop); got != outSize {
+				t.Errorf("Acct-Output-Octets = %d, want %d", got, outSize)
+			}
+		})
+	}
+}
+
+func TestAccountingByteCountsUncounted(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+	_, port, _ := net.SplitHostPort(mock.Addr())
+	r := &HTTPRadiusAuth{
+		Servers:    []string{mock.Addr()},
+		Secret:     testradius.Secret,
+		Accounting: &AccountingConfig{Enabled: true, Port: port, ByteCounts: true},
+	}
+	provision(t, r)
+	core, logs := observer.New(zapcore.WarnLevel)
+	r.logger = zap.New(core)
+
+	// Neither a byte counter nor an access log recorder wraps the response
+	for i := 0; i < 2; i++ {
+		req, _ := newCaddyRequest("alice", "password")
+		ctx, cancel := context.WithCancel(req.Context())
+		req = req.WithContext(ctx)
+		w := httptest.NewRecorder()
+		if _, ok, err := r.Authenticate(w, req); !ok || err != nil {
+			t.Fatalf("Authenticate = %v, %v", ok, err)
+		}
+		w.WriteString("response")
+		cancel()
+	}
+
+	if n := logs.FilterMessageSnippet("cannot count response bytes").Len(); n != 1 {
+		t.Errorf("logged %d warnings about uncounted output, want 1", n)
+	}
+	if stop := waitForStop(t, mock); stop.Get(rfc2866.AcctOutputOctets_Type) != nil {
+		t.Error("Stop record carries Acct-Output-Octets without a count")
+	}
+}
+
+func TestAccountingCacheHit(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+	_, port, _ := net.SplitHostPort(mock.Addr())
+	r := &HTTPRadiusAuth{
+		Servers:    []string{mock.Addr()},
+		Secret:     testradius.Secret,
+		CacheTTL:   "1m",
+		Accounting: &AccountingConfig{Enabled: true, Port: port},
+	}
+	provision(t, r)
+
+	for i := 0; i < 2; i++ {
+		req, _ := newCaddyRequest("alice", "password")
+		if _, ok, err := r.Authenticate(httptest.NewRecorder(), req); !ok || err != nil {
+			t.Fatalf("Authenticate = %v, %v", ok, err)
+		}
+	}
+
+	// The Start records go out asynchronously
+	deadline := time.Now().Add(time.Second)
+	for {
+		var access, starts int
+		for _, packet := range mock.Requests() {
+			switch {
+			case packet.Code == radius.CodeAccessRequest:
+				access++
+			case rfc2866.AcctStatusType_Get(packet) == rfc2866.AcctStatusType_Value_Start:
+				starts++
+			}
+		}
+		if access != 1 {
+			t.Fatalf("RADIUS received %d Access-Requests, want 1", access)
+		}
+		if starts == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("sent %d accounting Start records, want 2 including the cache hit", starts)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProvisionTwice(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+	r := &HTTPRadiusAuth{
+		Servers:       []string{mock.Addr()},
+		ServerEntries: []ServerEntry{{Host: "127.0.0.1", Port: 1812}},
+		Secret:        testradius.Secret,
+		CacheTTL:      "1m",
+	}
+	ctx := provision(t, r)
+
+	authenticate := func() {
+		t.Helper()
+		req, _ := newCaddyRequest("alice", "password")
+		if _, ok, err := r.Authenticate(httptest.NewRecorder(), req); !ok || err != nil {
+			t.Fatalf("Authenticate = %v, %v", ok, err)
+		}
+	}
+	authenticate()
+	firstCache := r.cache
+
+	if err := r.Provision(ctx); err != nil {
+		t.Fatalf("second Provision: %v", err)
+	}
+	if n := firstCache.Flush(); n != 0 {
+		t.Errorf("first cache still held %d entries after re-provisioning", n)
+	}
+	if len(r.Servers) != 2 {
+		t.Errorf("Servers = %v after re-provisioning, want the 2 configured", r.Servers)
+	}
+
+	authenticate()
+	if n := mock.RequestCount(); n != 2 {
+		t.Errorf("RADIUS received %d requests, want 2", n)
+	}
+}
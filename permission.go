@@ -0,0 +1,134 @@
+package caddy2_radius_auth
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(PermissionByRADIUS{})
+}
+
+// PermissionByRADIUS decides whether on-demand TLS may obtain a certificate
+// by asking the RADIUS servers: the name is sent as the username and Token
+// as the password, and only an Access-Accept allows the certificate. It
+// takes every setting of the radius_auth authentication provider.
+type PermissionByRADIUS struct {
+	HTTPRadiusAuth
+
+	// Token is the password sent with every name, a literal or a global
+	// placeholder such as "{env.RADIUS_TLS_TOKEN}"
+	Token string `json:"token,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (PermissionByRADIUS) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "tls.permission.radius_auth",
+		New: func() caddy.Module { return new(PermissionByRADIUS) },
+	}
+}
+
+// Provision sets up the RADIUS client and resolves Token
+func (p *PermissionByRADIUS) Provision(ctx caddy.Context) error {
+	p.permission = true
+	if err := p.HTTPRadiusAuth.Provision(ctx); err != nil {
+		return err
+	}
+	p.Token = caddy.NewReplacer().ReplaceAll(p.Token, "")
+	if p.Token == "" {
+		return fmt.Errorf("token is required")
+	}
+	return nil
+}
+
+// CertificateAllowed returns nil if the RADIUS servers accept name. Results
+// are cached like credentials, so a handshake rarely waits for RADIUS.
+func (p *PermissionByRADIUS) CertificateAllowed(ctx context.Context, name string) error {
+	r := p.HTTPRadiusAuth
+	var info requestInfo
+	key := r.cacheKey(name, p.Token, info.cacheScope())
+
+	if r.negativeCache != nil {
+		if _, found := r.negativeCache.Get(key); found {
+			observeOutcome(outcomeCacheHit)
+			return fmt.Errorf("%s: %w", name, caddytls.ErrPermissionDenied)
+		}
+	}
+	if r.cache != nil {
+		if session, found := r.cache.Get(key); found {
+			observeOutcome(outcomeCacheHit)
+			if !session.Allowed {
+				return fmt.Errorf("%s: %w", name, caddytls.ErrPermissionDenied)
+			}
+			return nil
+		}
+	}
+
+	res, err := r.checkRadius(ctx, key, name, p.Token, info)
+	if err != nil {
+		observeOutcome(outcomeError)
+		return fmt.Errorf("checking RADIUS permission for %s: %v", name, err)
+	}
+	if !res.ok {
+		observeOutcome(outcomeReject)
+		r.logger.Info("certificate denied by RADIUS", zap.String("name", name), zap.String("server", res.server))
+		if r.negativeCache != nil {
+			r.negativeCache.Set(key, cachedSession{}, 0)
+			r.recordCacheKey(name, key)
+		}
+		return fmt.Errorf("%s: %w", name, caddytls.ErrPermissionDenied)
+	}
+	observeOutcome(outcomeAccept)
+	if r.cache != nil {
+		r.cache.Set(key, cachedSession{Allowed: true}, 0)
+		r.recordCacheKey(name, key)
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the permission from Caddyfile tokens, as the
+// permission of the on_demand_tls global option:
+//
+//	permission radius_auth <token> {
+//	    servers 192.0.2.10:1812
+//	    secret  s3cr3t
+//	}
+//
+// The block takes the options of the radius_auth directive except pool.
+func (p *PermissionByRADIUS) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume module name
+	if !d.NextArg() {
+		return d.Err("radius_auth permission requires a token")
+	}
+	p.Token = d.Val()
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	pool, err := parseRadiusBlock(d, &p.HTTPRadiusAuth)
+	if err != nil {
+		return err
+	}
+	if pool != "" {
+		return d.Err("pool is not supported in a radius_auth permission")
+	}
+	if len(p.Servers) == 0 && p.SRVName == "" {
+		return d.Err("at least one RADIUS server (or srv_name) must be defined")
+	}
+	if p.Secret == "" && p.SecretFile == "" && p.SecretEnv == "" {
+		return d.Err("radius secret must be set (secret, secret_file or secret_env)")
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddytls.OnDemandPermission = (*PermissionByRADIUS)(nil)
+	_ caddy.Provisioner           = (*PermissionByRADIUS)(nil)
+	_ caddyfile.Unmarshaler       = (*PermissionByRADIUS)(nil)
+)
@@ -0,0 +1,215 @@
+package caddy2_radius_auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+	"github.com/wxccs/caddy2-radius-auth/internal/testradius"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+// provisionPermission provisions p in a fresh Caddy context and cleans it
+// up when the test ends
+func provisionPermission(t *testing.T, p *PermissionByRADIUS) {
+	t.Helper()
+	if err := p.Provision(newTestContext(t)); err != nil {
+		t.Fatalf("Provision: %v", err)
+	}
+	t.Cleanup(func() { p.Cleanup() })
+}
+
+func TestPermissionAllowed(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{
+		"allowed.example.com": radius.CodeAccessAccept,
+		"denied.example.com":  radius.CodeAccessReject,
+		"silent.example.com":  0,
+	})
+	p := &PermissionByRADIUS{
+		HTTPRadiusAuth: HTTPRadiusAuth{Servers: []string{mock.Addr()}, Secret: testradius.Secret, Timeout: "200ms"},
+		Token:          "tls token",
+	}
+	provisionPermission(t, p)
+
+	if err := p.CertificateAllowed(context.Background(), "allowed.example.com"); err != nil {
+		t.Errorf("accepted name: %v", err)
+	}
+	if err := p.CertificateAllowed(context.Background(), "denied.example.com"); !errors.Is(err, caddytls.ErrPermissionDenied) {
+		t.Errorf("rejected name: got %v, want %v", err, caddytls.ErrPermissionDenied)
+	}
+
+	// A RADIUS failure is an error, but not a denial Caddy would cache
+	err := p.CertificateAllowed(context.Background(), "silent.example.com")
+	if err == nil || errors.Is(err, caddytls.ErrPermissionDenied) {
+		t.Errorf("unanswered name: got %v, want a non-denial error", err)
+	}
+
+	// Every request carries the name and the token
+	for _, packet := range mock.Requests() {
+		if got := rfc2865.UserPassword_GetString(packet); got != "tls token" {
+			t.Errorf("%s: User-Password = %q, want the token", rfc2865.UserName_GetString(packet), got)
+		}
+	}
+}
+
+func TestPermissionCached(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{
+		"allowed.example.com": radius.CodeAccessAccept,
+		"denied.example.com":  radius.CodeAccessReject,
+	})
+	p := &PermissionByRADIUS{
+		HTTPRadiusAuth: HTTPRadiusAuth{
+			Servers:          []string{mock.Addr()},
+			Secret:           testradius.Secret,
+			CacheTTL:         "1m",
+			NegativeCacheTTL: "1m",
+		},
+		Token: "tls token",
+	}
+	provisionPermission(t, p)
+
+	for i := 0; i < 3; i++ {
+		if err := p.CertificateAllowed(context.Background(), "allowed.example.com"); err != nil {
+			t.Errorf("accepted name, attempt %d: %v", i+1, err)
+		}
+		if err := p.CertificateAllowed(context.Background(), "denied.example.com"); !errors.Is(err, caddytls.ErrPermissionDenied) {
+			t.Errorf("rejected name, attempt %d: got %v, want %v", i+1, err, caddytls.ErrPermissionDenied)
+		}
+	}
+	if n := mock.RequestCount(); n != 2 {
+		t.Errorf("RADIUS received %d requests, want one per name", n)
+	}
+
+	// The cached answers are kept per name
+	mock.SetResponse("allowed.example.com", radius.CodeAccessReject)
+	mock.SetResponse("denied.example.com", radius.CodeAccessAccept)
+	if err := p.CertificateAllowed(context.Background(), "allowed.example.com"); err != nil {
+		t.Errorf("cached accept: %v", err)
+	}
+	if err := p.CertificateAllowed(context.Background(), "denied.example.com"); !errors.Is(err, caddytls.ErrPermissionDenied) {
+		t.Errorf("cached reject: got %v, want %v", err, caddytls.ErrPermissionDenied)
+	}
+	if n := mock.RequestCount(); n != 2 {
+		t.Errorf("RADIUS received %d requests after the answers changed, want 2", n)
+	}
+}
+
+func TestPermissionToken(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"allowed.example.com": radius.CodeAccessAccept})
+	t.Setenv("RADIUS_TEST_TLS_TOKEN", "from the environment")
+
+	p := &PermissionByRADIUS{
+		HTTPRadiusAuth: HTTPRadiusAuth{Servers: []string{mock.Addr()}, Secret: testradius.Secret},
+		Token:          "{env.RADIUS_TEST_TLS_TOKEN}",
+	}
+	provisionPermission(t, p)
+	if p.Token != "from the environment" {
+		t.Errorf("token = %q, want the environment value", p.Token)
+	}
+	if err := p.CertificateAllowed(context.Background(), "allowed.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if got := rfc2865.UserPassword_GetString(mock.Requests()[0]); got != "from the environment" {
+		t.Errorf("User-Password = %q, want the resolved token", got)
+	}
+
+	// A placeholder that resolves to nothing leaves no token
+	empty := &PermissionByRADIUS{
+		HTTPRadiusAuth: HTTPRadiusAuth{Servers: []string{mock.Addr()}, Secret: testradius.Secret},
+		Token:          "{env.RADIUS_TEST_UNSET_TOKEN}",
+	}
+	if err := empty.Provision(newTestContext(t)); err == nil {
+		empty.Cleanup()
+		t.Error("Provision accepted a token that resolves to nothing")
+	}
+}
+
+func TestPermissionCaddyfile(t *testing.T) {
+	var p PermissionByRADIUS
+	d := caddyfile.NewTestDispenser(`radius_auth {env.RADIUS_TLS_TOKEN} {
+		servers 10.0.0.1:1812 10.0.0.2:1812
+		secret s3cret
+		cache_ttl 5m
+		negative_cache_ttl 1m
+	}`)
+	if err := p.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if p.Token != "{env.RADIUS_TLS_TOKEN}" || len(p.Servers) != 2 || p.Secret != "s3cret" ||
+		p.CacheTTL != "5m" || p.NegativeCacheTTL != "1m" {
+		t.Errorf("got %+v", p)
+	}
+
+	for _, input := range []string{
+		`radius_auth`,
+		`radius_auth token extra {
+			servers 10.0.0.1:1812
+			secret s3cret
+		}`,
+		`radius_auth token {
+			secret s3cret
+		}`,
+		`radius_auth token {
+			servers 10.0.0.1:1812
+		}`,
+		`radius_auth token {
+			servers 10.0.0.1:1812
+			secret s3cret
+			pool shared
+		}`,
+	} {
+		var p PermissionByRADIUS
+		if err := p.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err == nil {
+			t.Errorf("parsed %q", input)
+		}
+	}
+
+	// As the permission of the on_demand_tls global option
+	adapter := caddyfile.Adapter{ServerType: httpcaddyfile.ServerType{}}
+	out, _, err := adapter.Adapt([]byte(`{
+		on_demand_tls {
+			permission radius_auth tls-token {
+				servers 10.0.0.1:1812
+				secret s3cret
+			}
+		}
+	}
+
+	https:// {
+		tls {
+			on_demand
+		}
+	}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg struct {
+		Apps struct {
+			TLS struct {
+				Automation struct {
+					OnDemand struct {
+						Permission json.RawMessage `json:"permission"`
+					} `json:"on_demand"`
+				} `json:"automation"`
+			} `json:"tls"`
+		} `json:"apps"`
+	}
+	if err := json.Unmarshal(out, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	var permission struct {
+		Module string `json:"module"`
+		PermissionByRADIUS
+	}
+	if err := json.Unmarshal(cfg.Apps.TLS.Automation.OnDemand.Permission, &permission); err != nil {
+		t.Fatalf("permission in %s: %v", out, err)
+	}
+	if permission.Module != "radius_auth" || permission.Token != "tls-token" || permission.Secret != "s3cret" {
+		t.Errorf("permission = %s", cfg.Apps.TLS.Automation.OnDemand.Permission)
+	}
+}
@@ -0,0 +1,115 @@
+package caddy2_radius_auth
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// persistedCache is the on-disk form of the memory caches, written by
+// Cleanup and read back by Provision so a restart starts with a warm cache
+type persistedCache struct {
+	Positive []persistedEntry
+	Negative []persistedEntry
+}
+
+// persistedEntry is one cached result with the username it belongs to, so
+// the username index can be rebuilt
+type persistedEntry struct {
+	Key      string
+	Username string
+	Session  cachedSession
+	Expires  time.Time
+}
+
+// snapshot returns the unexpired entries of m, least recently used first
+func (m *memoryCache) snapshot(index *usernameIndex) []persistedEntry {
+	var entries []persistedEntry
+	m.c.each(func(key string, session cachedSession, expires time.Time) {
+		username, _ := index.username(key)
+		entries = append(entries, persistedEntry{
+			Key:      key,
+			Username: username,
+			Session:  session,
+			Expires:  expires,
+		})
+	})
+	return entries
+}
+
+// restore adds the entries that have not expired yet, indexing them with
+// record, and returns how many were added
+func (m *memoryCache) restore(entries []persistedEntry, record func(username, key string)) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	n := 0
+	for _, e := range entries {
+		if !now.Before(e.Expires) {
+			continue
+		}
+		m.makeRoom(e.Key, entrySize(e.Key, e.Session))
+		m.c.addUntil(e.Key, e.Session, e.Expires)
+		if e.Username != "" {
+			record(e.Username, e.Key)
+		}
+		n++
+	}
+	return n
+}
+
+// saveCache writes the memory caches to PersistCachePath. The file is
+// written next to the target and renamed over it so a crash never leaves a
+// truncated cache behind.
+func (r *HTTPRadiusAuth) saveCache() error {
+	var p persistedCache
+	if m, ok := r.cache.(*memoryCache); ok {
+		p.Positive = m.snapshot(r.cacheIndex)
+	}
+	if m, ok := r.negativeCache.(*memoryCache); ok {
+		p.Negative = m.snapshot(r.cacheIndex)
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(p); err != nil {
+		return err
+	}
+	tmp := r.PersistCachePath + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, r.PersistCachePath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// loadCache fills the memory caches from PersistCachePath, skipping expired
+// entries, and returns how many entries were restored. A missing file is
+// not an error.
+func (r *HTTPRadiusAuth) loadCache() (int, error) {
+	data, err := os.ReadFile(r.PersistCachePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var p persistedCache
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&p); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	if m, ok := r.cache.(*memoryCache); ok {
+		n += m.restore(p.Positive, r.recordCacheKey)
+	}
+	if m, ok := r.negativeCache.(*memoryCache); ok {
+		n += m.restore(p.Negative, r.recordCacheKey)
+	}
+	return n, nil
+}
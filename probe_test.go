@@ -0,0 +1,103 @@
+package caddy2_radius_auth
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wxccs/caddy2-radius-auth/internal/testradius"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+// closedUDPAddr returns a loopback address nothing is listening on
+func closedUDPAddr(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+	return addr
+}
+
+func TestProbeOnStart(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		responses map[string]radius.Code
+		warning   string
+	}{
+		{name: "reject", responses: nil},
+		{name: "timeout", responses: map[string]radius.Code{"": 0}, warning: "RADIUS server did not answer probe"},
+		{name: "unexpected code", responses: map[string]radius.Code{"": radius.CodeAccessAccept}, warning: "unexpected reply to RADIUS probe"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := testradius.NewMockServer(t, tc.responses)
+			r := &HTTPRadiusAuth{
+				Servers:      []string{mock.Addr()},
+				Secret:       testradius.Secret,
+				ProbeOnStart: true,
+				ProbeTimeout: "100ms",
+			}
+			provision(t, r)
+
+			requests := mock.Requests()
+			if len(requests) != 1 {
+				t.Fatalf("server received %d probes, want 1", len(requests))
+			}
+			if user := rfc2865.UserName_GetString(requests[0]); user != "" {
+				t.Errorf("probe sent username %q, want empty", user)
+			}
+
+			// Probe again with an observed logger to check the warning
+			core, logs := observer.New(zapcore.WarnLevel)
+			r.logger = zap.New(core)
+			if err := r.probeServers(100 * time.Millisecond); err != nil {
+				t.Fatalf("probeServers: %v", err)
+			}
+			var messages []string
+			for _, entry := range logs.All() {
+				messages = append(messages, entry.Message)
+			}
+			if tc.warning == "" && len(messages) > 0 {
+				t.Errorf("unexpected warnings %q", messages)
+			}
+			if tc.warning != "" && (len(messages) != 1 || messages[0] != tc.warning) {
+				t.Errorf("warnings = %q, want [%q]", messages, tc.warning)
+			}
+		})
+	}
+}
+
+func TestProbeOnStartAllServersFail(t *testing.T) {
+	r := &HTTPRadiusAuth{
+		Servers:      []string{closedUDPAddr(t), closedUDPAddr(t)},
+		Secret:       testradius.Secret,
+		ProbeOnStart: true,
+		ProbeTimeout: "1s",
+	}
+	err := r.Provision(newTestContext(t))
+	if err == nil {
+		r.Cleanup()
+		t.Fatal("Provision succeeded although no server is reachable")
+	}
+	if !strings.Contains(err.Error(), "startup probe") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestProbeOnStartOneServerFails(t *testing.T) {
+	mock := testradius.NewMockServer(t, nil)
+	r := &HTTPRadiusAuth{
+		Servers:      []string{closedUDPAddr(t), mock.Addr()},
+		Secret:       testradius.Secret,
+		ProbeOnStart: true,
+		ProbeTimeout: "1s",
+	}
+	provision(t, r)
+}
@@ -0,0 +1,78 @@
+package caddy2_radius_auth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/wxccs/caddy2-radius-auth/internal/testradius"
+	"layeh.com/radius"
+)
+
+func TestQuorumPolicy(t *testing.T) {
+	const (
+		accept = radius.CodeAccessAccept
+		reject = radius.CodeAccessReject
+		drop   = radius.Code(0) // no answer, counts as an error
+	)
+
+	tests := []struct {
+		codes []radius.Code
+		// expected outcome per policy: "accept", "reject" or "error"
+		any, all, majority string
+	}{
+		{[]radius.Code{accept, accept, accept}, "accept", "accept", "accept"},
+		{[]radius.Code{accept, accept, reject}, "accept", "reject", "accept"},
+		{[]radius.Code{accept, reject, reject}, "accept", "reject", "reject"},
+		{[]radius.Code{reject, reject, reject}, "reject", "reject", "reject"},
+		{[]radius.Code{accept, drop, drop}, "accept", "accept", "accept"},
+		{[]radius.Code{accept, reject, drop}, "accept", "reject", "reject"},
+		{[]radius.Code{accept, accept, drop}, "accept", "accept", "accept"},
+		{[]radius.Code{reject, drop, drop}, "reject", "reject", "reject"},
+		{[]radius.Code{drop, drop, drop}, "error", "error", "error"},
+	}
+
+	for _, tc := range tests {
+		servers := make([]string, len(tc.codes))
+		for i, code := range tc.codes {
+			servers[i] = testradius.NewMockServer(t, map[string]radius.Code{"alice": code}).Addr()
+		}
+
+		for policy, want := range map[string]string{
+			quorumAny:      tc.any,
+			quorumAll:      tc.all,
+			quorumMajority: tc.majority,
+		} {
+			r := &HTTPRadiusAuth{
+				Servers:      servers,
+				Secret:       testradius.Secret,
+				Timeout:      "100ms",
+				QuorumPolicy: policy,
+			}
+			provision(t, r)
+
+			res, err := r.checkRadiusConcurrent(context.Background(), "alice", "password", requestInfo{})
+			got := "reject"
+			switch {
+			case err != nil:
+				got = "error"
+			case res.ok:
+				got = "accept"
+			}
+			if got != want {
+				t.Errorf("%v with policy %s: got %s, want %s (err %v)", tc.codes, policy, got, want, err)
+			}
+		}
+	}
+}
+
+func TestQuorumPolicyInvalid(t *testing.T) {
+	r := &HTTPRadiusAuth{
+		Servers:      []string{"127.0.0.1:1812"},
+		Secret:       testradius.Secret,
+		QuorumPolicy: "most",
+	}
+	provision(t, r)
+	if err := r.Validate(); err == nil {
+		t.Error("Validate accepted an unknown quorum_policy")
+	}
+}
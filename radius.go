@@ -2,96 +2,232 @@ package caddy2_radius_auth
 
 import (
 	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"math/rand"
+	"net"
+	"slices"
 	"sync"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
 	"layeh.com/radius"
 	"layeh.com/radius/rfc2865"
 )
 
-// checkRadiusConcurrent sends concurrent requests to multiple RADIUS servers
-// Returns true, nil if any server returns Access-Accept
-// Returns false, nil if no Access-Accept but any server returns Reject
-// Returns false, error for other cases (errors or unknown response codes)
-func (r HTTPRadiusAuth) checkRadiusConcurrent(username, password string) (bool, error) {
-	if len(r.Servers) == 0 {
-		return false, errors.New("no RADIUS servers configured")
-	}
+// Server selection strategies
+const (
+	strategyConcurrent = "concurrent"
+	strategyRoundRobin = "round_robin"
+	strategyFailover   = "failover"
+	strategyWeighted   = "weighted_random"
+)
 
-	packet := radius.New(radius.CodeAccessRequest, []byte(r.Secret))
-	err := rfc2865.UserName_SetString(packet, username)
-	if err != nil {
-		return false, fmt.Errorf("rfc2865: setting username string error: %w", err)
-	}
-	err = rfc2865.UserPassword_SetString(packet, password)
-	if err != nil {
-		return false, fmt.Errorf("rfc2865: setting password string error: %w", err)
-	}
+// Quorum policies deciding how many accepts grant access
+const (
+	quorumAny      = "any"
+	quorumAll      = "all"
+	quorumMajority = "majority"
+)
+
+// NAS-Port assignment modes
+const (
+	nasPortNone       = "none"
+	nasPortHashIP     = "hash_client_ip"
+	nasPortSequential = "sequential"
+)
+
+// Responses when no RADIUS server could be reached
+const (
+	failDeny               = "deny"
+	failError              = "error"
+	failAllow              = "allow"
+	failServiceUnavailable = "service_unavailable"
+)
 
-	timeout, _ := time.ParseDuration(r.Timeout)
+// Handling of response codes other than Access-Accept, Access-Reject and
+// Access-Challenge
+const (
+	unknownCodeDeny  = "deny"
+	unknownCodeAllow = "allow"
+	unknownCodeError = "error"
+)
+
+// unknownCodeErr is returned for a response code the module does not
+// understand when UnknownCodePolicy is "error"
+type unknownCodeErr struct {
+	server string
+	code   radius.Code
+}
+
+func (e *unknownCodeErr) Error() string {
+	return fmt.Sprintf("%s returned unknown code: %v", e.server, e.code)
+}
+
+// radiusDownUser is the user ID granted by FailBehavior "allow"
+const radiusDownUser = "__radius_down__"
 
-	type result struct {
-		code   radius.Code
-		err    error
-		server string
+// errShuttingDown is reported for exchanges attempted after Cleanup
+var errShuttingDown = errors.New("radius_auth is shutting down")
+
+// errSaturated is reported when no request slot frees up before the server timeout
+var errSaturated = errors.New("too many concurrent RADIUS requests")
+
+// serverResult is the outcome of a single RADIUS exchange
+type serverResult struct {
+	code   radius.Code
+	resp   *radius.Packet
+	err    error
+	server string
+}
+
+// checkRadiusConcurrent sends requests to the RADIUS servers chosen by the
+// configured strategy (all servers concurrently by default)
+// Returns an accepted result with the reply if the accepts satisfy the quorum policy
+// Returns a *challengeError if Access-Challenge is enabled and a server challenges
+// Returns a rejected result if the policy is not satisfied and any server returns Reject
+// Returns an error for other cases (errors or unknown response codes)
+func (r HTTPRadiusAuth) checkRadiusConcurrent(ctx context.Context, username, password string, info requestInfo) (res radiusResult, err error) {
+	servers := r.selectServers()
+	if len(servers) == 0 {
+		return radiusResult{}, errors.New("no RADIUS servers configured")
 	}
 
-	ch := make(chan result, len(r.Servers))
-	var wg sync.WaitGroup
+	ctx, span := r.startSpan(ctx, "radius.authenticate")
+	defer func() { endAuthenticateSpan(span, res.ok, err) }()
 
-	for _, server := range r.Servers {
-		wg.Add(1)
-		go func(srv string) {
-			defer wg.Done()
-			ctx, cancel := context.WithTimeout(context.TODO(), timeout)
-			defer cancel()
-			resp, err := radius.Exchange(ctx, packet, srv)
-			if err != nil {
-				ch <- result{code: 0, err: err, server: srv}
-				return
-			}
-			ch <- result{code: resp.Code, err: nil, server: srv}
-		}(server)
+	// Each server may use its own shared secret, so build one packet per
+	// server. EAP builds its packets as the conversation goes.
+	packets := make(map[string]*radius.Packet, len(servers))
+	for _, server := range servers {
+		if r.EAP {
+			continue
+		}
+		packet, err := r.newAccessRequest(server, username, password, info)
+		if err != nil {
+			return radiusResult{}, err
+		}
+		packets[server] = packet
 	}
+	authenticate := func(server string) serverResult {
+		if r.EAP {
+			return r.exchangeEAP(ctx, server, username, password, info)
+		}
+		return r.exchangeServer(ctx, packets[server], server)
+	}
+
+	ch := make(chan serverResult, len(servers))
 
-	go func() {
-		wg.Wait()
+	if r.Strategy == strategyFailover {
+		// Try servers in order, moving on only when a server fails to respond
+		for _, server := range servers {
+			res := authenticate(server)
+			ch <- res
+			if res.err == nil {
+				break
+			}
+		}
 		close(ch)
-	}()
+	} else {
+		var wg sync.WaitGroup
+		for _, server := range servers {
+			wg.Add(1)
+			go func(srv string) {
+				defer wg.Done()
+				ch <- authenticate(srv)
+			}(server)
+		}
+		go func() {
+			wg.Wait()
+			close(ch)
+		}()
+	}
 
-	hasAccessAccept := false
-	hasReject := false
+	var accepted, rejected, challenge, unknown *serverResult
+	accepts, rejects := 0, 0
 	serverResults := make(map[string]struct {
 		code radius.Code
 		err  error
 	})
 
-	for res := range ch {
-		serverResults[res.server] = struct {
+	for sr := range ch {
+		serverResults[sr.server] = struct {
 			code radius.Code
 			err  error
-		}{code: res.code, err: res.err}
+		}{code: sr.code, err: sr.err}
 
-		if res.code == radius.CodeAccessAccept {
-			hasAccessAccept = true
-		} else if res.code == radius.CodeAccessReject {
-			hasReject = true
+		if r.isAccept(sr.code) {
+			accepts++
+			if accepted == nil {
+				accepted = &sr
+			}
+		} else if sr.code == radius.CodeAccessReject {
+			rejects++
+			if rejected == nil {
+				rejected = &sr
+			}
+		} else if sr.code == radius.CodeAccessChallenge {
+			if r.AccessChallenge && challenge == nil {
+				challenge = &sr
+			}
+		} else if sr.code != 0 {
+			// Some other code: vote as the unknown code policy says
+			switch r.UnknownCodePolicy {
+			case unknownCodeAllow:
+				r.logger.Warn("treating unknown RADIUS response code as accept",
+					zap.String("server", sr.server), zap.Stringer("code", sr.code))
+				accepts++
+				if accepted == nil {
+					accepted = &sr
+				}
+			case unknownCodeError:
+				if unknown == nil {
+					unknown = &sr
+				}
+			default:
+				rejects++
+				if rejected == nil {
+					rejected = &sr
+				}
+			}
 		}
 	}
 
-	// Case 1: Any server returns Access-Accept
-	if hasAccessAccept {
-		return true, nil
+	// Case 1: The accepts satisfy the quorum policy. Servers that did not
+	// answer do not vote.
+	if r.quorumReached(accepts, rejects) {
+		return radiusResult{ok: true, reply: accepted.resp, server: accepted.server}, nil
+	}
+
+	// A challenge takes precedence over rejects from other servers, since the
+	// challenging server may still accept the user
+	if challenge != nil {
+		return radiusResult{server: challenge.server}, newChallengeError(challenge.server, challenge.resp)
 	}
 
-	// Case 2: No Access-Accept but any server returns Reject
-	if hasReject {
-		return false, nil
+	// Case 2: The policy is not satisfied and any server voted
+	if rejected != nil {
+		return radiusResult{server: rejected.server}, nil
+	}
+
+	if unknown != nil {
+		return radiusResult{server: unknown.server}, &unknownCodeErr{server: unknown.server, code: unknown.code}
 	}
 
 	// Case 3: Other cases - wrap errors or unknown codes
+	saturated := true
+	for _, result := range serverResults {
+		if !errors.Is(result.err, errSaturated) {
+			saturated = false
+			break
+		}
+	}
+	if saturated {
+		return radiusResult{}, errSaturated
+	}
+
 	errorMsg := "RADIUS authentication issues: "
 	for server, result := range serverResults {
 		if result.err != nil {
@@ -103,5 +239,441 @@ func (r HTTPRadiusAuth) checkRadiusConcurrent(username, password string) (bool,
 		}
 	}
 
-	return false, fmt.Errorf(errorMsg)
+	return radiusResult{}, errors.New(errorMsg)
+}
+
+// isAccept reports whether code grants access: Access-Accept, or one of the
+// vendor codes listed in AcceptCodes
+func (r HTTPRadiusAuth) isAccept(code radius.Code) bool {
+	return code == radius.CodeAccessAccept || slices.Contains(r.AcceptCodes, int(code))
+}
+
+// quorumReached reports whether accepts out of accepts+rejects votes grant access
+func (r HTTPRadiusAuth) quorumReached(accepts, rejects int) bool {
+	if accepts == 0 {
+		return false
+	}
+	switch r.QuorumPolicy {
+	case quorumAll:
+		return rejects == 0
+	case quorumMajority:
+		return accepts > rejects
+	default:
+		return true
+	}
+}
+
+// selectServers returns the servers to query for a single authentication,
+// leaving out servers that failed their last health check
+func (r HTTPRadiusAuth) selectServers() []string {
+	all := r.pool.healthy()
+	if (r.Strategy != strategyRoundRobin && r.Strategy != strategyWeighted) || len(all) == 0 {
+		return all
+	}
+
+	// Pass over servers with an open breaker, unless every breaker is open
+	candidates := make([]string, 0, len(all))
+	for _, server := range all {
+		if breaker := r.pool.breaker(server); breaker != nil {
+			if state, _ := breaker.state(); state == breakerOpen {
+				continue
+			}
+		}
+		candidates = append(candidates, server)
+	}
+	if len(candidates) == 0 {
+		candidates = all
+	}
+
+	if r.Strategy == strategyWeighted {
+		return []string{weightedRandom(candidates, r.ServerWeights)}
+	}
+	// Pick the next server in turn; a server of weight n gets n turns
+	next := r.rrCounter.Add(1) - 1
+	prefix := weightPrefixSums(candidates, r.ServerWeights)
+	return []string{candidates[pickWeighted(prefix, int64(next%uint64(prefix[len(prefix)-1])))]}
+}
+
+// weightedRandom picks one of servers at random, biased by weights.
+// Servers without a weight have weight 1.
+func weightedRandom(servers []string, weights map[string]int) string {
+	prefix := weightPrefixSums(servers, weights)
+	return servers[pickWeighted(prefix, rand.Int63n(prefix[len(prefix)-1]))]
+}
+
+// weightPrefixSums returns the running total of the servers' weights
+func weightPrefixSums(servers []string, weights map[string]int) []int64 {
+	prefix := make([]int64, len(servers))
+	var total int64
+	for i, server := range servers {
+		w, ok := weights[server]
+		if !ok {
+			w = 1
+		}
+		total += int64(w)
+		prefix[i] = total
+	}
+	return prefix
+}
+
+// pickWeighted returns the index of the server owning position n, where
+// 0 <= n < the total weight
+func pickWeighted(prefix []int64, n int64) int {
+	i, _ := slices.BinarySearch(prefix, n+1)
+	return i
+}
+
+// exchangeServer performs an exchange with server, retrying on errors up to
+// RetryCount times and honouring the concurrency limit and the server's
+// circuit breaker
+func (r HTTPRadiusAuth) exchangeServer(ctx context.Context, packet *radius.Packet, server string) (res serverResult) {
+	if !r.inflight.enter() {
+		return serverResult{err: errShuttingDown, server: server}
+	}
+	defer r.inflight.leave()
+
+	timeout := r.timeoutFor(server)
+
+	ctx, span := r.startSpan(ctx, "radius.exchange", attribute.String("radius.server", server))
+	defer func() { endExchangeSpan(span, res) }()
+
+	// Wait at most the server timeout for a free slot
+	if r.sem != nil {
+		wait := time.NewTimer(timeout)
+		select {
+		case r.sem <- struct{}{}:
+			wait.Stop()
+			defer func() { <-r.sem }()
+		case <-wait.C:
+			return serverResult{code: 0, err: errSaturated, server: server}
+		case <-ctx.Done():
+			wait.Stop()
+			return serverResult{code: 0, err: ctx.Err(), server: server}
+		}
+	}
+
+	breaker := r.pool.breaker(server)
+	if breaker != nil && !breaker.allow() {
+		r.logger.Warn("skipping RADIUS server with open circuit breaker", zap.String("server", server))
+		return serverResult{code: 0, err: errBreakerOpen, server: server}
+	}
+
+	var resp *radius.Packet
+	var err error
+	var elapsed time.Duration
+	for attempt := 0; attempt <= r.RetryCount; attempt++ {
+		if attempt > 0 {
+			r.logger.Debug("retrying RADIUS server",
+				zap.String("server", server),
+				zap.Int("attempt", attempt),
+				zap.Error(err))
+			select {
+			case <-time.After(r.retryDelay):
+			case <-ctx.Done():
+			}
+			if ctx.Err() != nil {
+				err = ctx.Err()
+				break
+			}
+		}
+		// Abort when Cleanup runs, e.g. on a config reload
+		exchangeCtx, cancel := context.WithTimeout(ctx, timeout)
+		stop := context.AfterFunc(r.shutdownCtx, cancel)
+		start := time.Now()
+		resp, err = r.exchange(exchangeCtx, packet, server)
+		elapsed = time.Since(start)
+		observeDuration(server, elapsed.Seconds())
+		stop()
+		cancel()
+		if err == nil {
+			break
+		}
+	}
+	// Cancellation by the caller, e.g. once another server has answered, or
+	// by Cleanup says nothing about the server's health
+	if err != nil && (ctx.Err() != nil || r.shutdownCtx.Err() != nil) {
+		if breaker != nil {
+			breaker.release()
+		}
+		return serverResult{code: 0, err: err, server: server}
+	}
+	r.pool.observe(server, elapsed, err)
+	if err != nil {
+		if breaker != nil {
+			breaker.failure()
+		}
+		return serverResult{code: 0, err: err, server: server}
+	}
+	if breaker != nil {
+		breaker.success()
+	}
+	observeResponseCode(server, resp.Code)
+	return serverResult{code: resp.Code, resp: resp, err: nil, server: server}
+}
+
+// probeServers sends an Access-Request with empty credentials to every server.
+// A reject or a timeout shows the server is reachable; it fails only when
+// every server returns a network error.
+func (r HTTPRadiusAuth) probeServers(timeout time.Duration) error {
+	var errs []error
+	for _, server := range r.Servers {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		resp, err := r.probeServer(ctx, server)
+		cancel()
+		switch {
+		case errors.Is(err, context.DeadlineExceeded):
+			r.logger.Warn("RADIUS server did not answer probe", zap.String("server", server))
+		case err != nil:
+			r.logger.Warn("RADIUS server probe failed", zap.String("server", server), zap.Error(err))
+			errs = append(errs, fmt.Errorf("%s: %w", server, err))
+		case resp.Code != radius.CodeAccessReject:
+			r.logger.Warn("unexpected reply to RADIUS probe",
+				zap.String("server", server),
+				zap.Stringer("code", resp.Code))
+		}
+	}
+	if len(errs) == len(r.Servers) {
+		return fmt.Errorf("no RADIUS server passed the startup probe: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// probeServer sends an Access-Request with empty credentials to server
+func (r HTTPRadiusAuth) probeServer(ctx context.Context, server string) (*radius.Packet, error) {
+	packet, err := r.newAccessRequest(server, "", "", requestInfo{})
+	if err != nil {
+		return nil, err
+	}
+	return r.exchange(ctx, packet, server)
+}
+
+// exchange sends packet to server over its transport: RadSec, TCP or UDP
+func (r HTTPRadiusAuth) exchange(ctx context.Context, packet *radius.Packet, server string) (*radius.Packet, error) {
+	return r.exchangeVia(ctx, packet, server, r.transportFor(server))
+}
+
+// exchangeVia sends packet to server over transport, for addresses such as
+// accounting ports whose transport is that of another server
+func (r HTTPRadiusAuth) exchangeVia(ctx context.Context, packet *radius.Packet, server, transport string) (*radius.Packet, error) {
+	r.logPacket("sending RADIUS packet", server, packet)
+	var resp *radius.Packet
+	var err error
+	switch transport {
+	case transportTLS:
+		resp, err = r.exchangeTLS(ctx, packet, server)
+	case transportTCP:
+		resp, err = r.exchangeTCP(ctx, packet, server)
+	default:
+		resp, err = r.exchangeUDP(ctx, packet, server)
+	}
+	if err == nil {
+		r.logPacket("received RADIUS packet", server, resp)
+	}
+	var nonAuthentic *radius.NonAuthenticResponseError
+	if r.DebugSecretCheck && errors.As(err, &nonAuthentic) {
+		r.logger.Warn("possible shared-secret mismatch", zap.String("server", server))
+	}
+	return resp, err
+}
+
+// exchangeUDP sends packet to server over UDP. The client drops responses
+// that fail verification and keeps waiting, so with debug_secret_check
+// they are verified here instead and returned as a
+// radius.NonAuthenticResponseError.
+func (r HTTPRadiusAuth) exchangeUDP(ctx context.Context, packet *radius.Packet, server string) (*radius.Packet, error) {
+	server = r.dialAddr(ctx, server)
+	client := radius.Client{
+		Dialer:          net.Dialer{Timeout: r.connectTimeout},
+		Retry:           radius.DefaultClient.Retry,
+		MaxPacketErrors: radius.DefaultClient.MaxPacketErrors,
+	}
+	if !r.DebugSecretCheck {
+		return client.Exchange(ctx, packet, server)
+	}
+	wire, err := packet.Encode()
+	if err != nil {
+		return nil, err
+	}
+	client.InsecureSkipVerify = true
+	resp, err := client.Exchange(ctx, packet, server)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := resp.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	if !radius.IsAuthenticResponse(raw, wire, packet.Secret) {
+		return nil, &radius.NonAuthenticResponseError{}
+	}
+	return resp, nil
+}
+
+// packetAttribute is the logged form of one RADIUS attribute
+type packetAttribute struct {
+	Type  radius.Type `json:"type"`
+	Value string      `json:"value"`
+}
+
+// logPacket logs the code and attributes of packet at debug level when
+// debug_packets is on. Passwords are redacted; other values are logged as
+// text when printable and as hex otherwise.
+func (r HTTPRadiusAuth) logPacket(msg, server string, packet *radius.Packet) {
+	if !r.DebugPackets {
+		return
+	}
+	attrs := make([]packetAttribute, 0, len(packet.Attributes))
+	for _, avp := range packet.Attributes {
+		var value string
+		switch {
+		case avp.Type == rfc2865.UserPassword_Type, avp.Type == rfc2865.CHAPPassword_Type:
+			value = "[REDACTED]"
+		case isPrintable(avp.Attribute):
+			value = string(avp.Attribute)
+		default:
+			value = hex.EncodeToString(avp.Attribute)
+		}
+		attrs = append(attrs, packetAttribute{Type: avp.Type, Value: value})
+	}
+	r.logger.Debug(msg,
+		zap.String("server", server),
+		zap.Stringer("code", packet.Code),
+		zap.Uint8("identifier", packet.Identifier),
+		zap.Any("attributes", attrs))
+}
+
+// isPrintable reports whether b is non-empty printable ASCII
+func isPrintable(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// requestInfo carries the per-request attributes added to every
+// Access-Request sent for one HTTP request
+type requestInfo struct {
+	clientIP string        // Sent as Calling-Station-Id
+	nasPort  *uint32       // NAS-Port from NASPortMode, nil when not sent
+	attrs    []*radius.AVP // Evaluated RequestAttributes
+	id       *radius.AVP   // HTTP request ID in RequestIDAttribute, nil when not sent
+
+	digest *digestCredentials // Digest credentials sent instead of a password, nil for Basic
+}
+
+// newAccessRequest builds an Access-Request packet for the given server
+func (r HTTPRadiusAuth) newAccessRequest(server, username, password string, info requestInfo) (*radius.Packet, error) {
+	packet, err := r.newRequest(server, username, info)
+	if err != nil {
+		return nil, err
+	}
+	if info.digest != nil {
+		return packet, setDigestAttributes(packet, info.digest)
+	}
+	if r.AuthProtocol == authProtocolCHAP {
+		err = r.setCHAPPassword(packet, username, password)
+	} else {
+		err = rfc2865.UserPassword_SetString(packet, password)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("rfc2865: setting password string error: %w", err)
+	}
+	return packet, nil
+}
+
+// newRequest builds an Access-Request for the given server with every
+// attribute but the credentials
+func (r HTTPRadiusAuth) newRequest(server, username string, info requestInfo) (*radius.Packet, error) {
+	packet := radius.New(radius.CodeAccessRequest, []byte(r.secretFor(server)))
+	var err error
+	if r.usernameType == rfc2865.UserName_Type {
+		err = rfc2865.UserName_SetString(packet, username)
+	} else {
+		// Servers expecting the username elsewhere get it as a raw string
+		packet.Add(r.usernameType, radius.Attribute(username))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("rfc2865: setting username string error: %w", err)
+	}
+	if info.clientIP != "" {
+		err = rfc2865.CallingStationID_SetString(packet, info.clientIP)
+		if err != nil {
+			return nil, fmt.Errorf("rfc2865: setting calling station id error: %w", err)
+		}
+	}
+	if info.nasPort != nil {
+		err = rfc2865.NASPort_Set(packet, rfc2865.NASPort(*info.nasPort))
+		if err != nil {
+			return nil, fmt.Errorf("rfc2865: setting nas port error: %w", err)
+		}
+	}
+	if r.serviceType != 0 {
+		err = rfc2865.ServiceType_Set(packet, r.serviceType)
+		if err != nil {
+			return nil, fmt.Errorf("rfc2865: setting service type error: %w", err)
+		}
+	}
+	if r.nasPortType != nil {
+		err = rfc2865.NASPortType_Set(packet, *r.nasPortType)
+		if err != nil {
+			return nil, fmt.Errorf("rfc2865: setting nas port type error: %w", err)
+		}
+	}
+	if err := r.setNASAttributes(packet); err != nil {
+		return nil, err
+	}
+	// The request ID differs for every request, so unlike attrs it is not
+	// part of the cache scope
+	if info.id != nil {
+		packet.Add(info.id.Type, info.id.Attribute)
+	}
+	// Configured attributes replace any the module set itself, except
+	// Vendor-Specific, which may appear once per vendor attribute
+	for _, avp := range info.attrs {
+		if avp.Type == rfc2865.VendorSpecific_Type {
+			packet.Add(avp.Type, avp.Attribute)
+			continue
+		}
+		packet.Set(avp.Type, avp.Attribute)
+	}
+	return packet, nil
+}
+
+// setNASAttributes adds the configured NAS-Identifier and NAS-IP-Address to packet
+func (r HTTPRadiusAuth) setNASAttributes(packet *radius.Packet) error {
+	if r.NASIdentifier != "" {
+		if err := rfc2865.NASIdentifier_SetString(packet, r.NASIdentifier); err != nil {
+			return fmt.Errorf("rfc2865: setting nas identifier error: %w", err)
+		}
+	}
+	if r.nasIP != nil {
+		if err := rfc2865.NASIPAddress_Set(packet, r.nasIP); err != nil {
+			return fmt.Errorf("rfc2865: setting nas ip address error: %w", err)
+		}
+	}
+	return nil
+}
+
+// timeoutFor returns how long to wait for an answer from a server, falling
+// back to the global response timeout
+func (r HTTPRadiusAuth) timeoutFor(server string) time.Duration {
+	if timeout, ok := r.ServerTimeouts[server]; ok && timeout != "" {
+		d, _ := time.ParseDuration(timeout)
+		return d
+	}
+	d, _ := time.ParseDuration(r.ResponseTimeout)
+	return d
+}
+
+// secretFor returns the shared secret for a server, falling back to the global secret
+func (r HTTPRadiusAuth) secretFor(server string) string {
+	if secret, ok := r.ServerSecrets[server]; ok && secret != "" {
+		return secret
+	}
+	return r.Secret
 }
@@ -0,0 +1,262 @@
+package caddy2_radius_auth
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wxccs/caddy2-radius-auth/internal/testradius"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+func BenchmarkCheckRadiusSingleFlight(b *testing.B) {
+	for _, tc := range []struct {
+		name         string
+		singleFlight bool
+	}{
+		{"disabled", false},
+		{"enabled", true},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			mock := testradius.NewMockServer(b, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+			mock.SetDelay(5 * time.Millisecond)
+			r := &HTTPRadiusAuth{
+				Servers:      []string{mock.Addr()},
+				Secret:       testradius.Secret,
+				SingleFlight: &tc.singleFlight,
+			}
+			provision(b, r)
+			key := r.cacheKey("alice", "password", "")
+
+			const concurrency = 50
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var wg sync.WaitGroup
+				for j := 0; j < concurrency; j++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						if res, err := r.checkRadius(context.Background(), key, "alice", "password", requestInfo{}); !res.ok || err != nil {
+							b.Errorf("checkRadius = %v, %v", res.ok, err)
+						}
+					}()
+				}
+				wg.Wait()
+			}
+			b.ReportMetric(float64(mock.RequestCount())/float64(b.N), "radius_calls/op")
+		})
+	}
+}
+
+func TestCallingStationID(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		trustForward  bool
+		forwardedFor  string
+		wantStationID string
+	}{
+		{name: "remote addr", wantStationID: "192.0.2.10"},
+		{name: "header ignored", forwardedFor: "198.51.100.7", wantStationID: "192.0.2.10"},
+		{name: "header trusted", trustForward: true, forwardedFor: "198.51.100.7, 203.0.113.1", wantStationID: "198.51.100.7"},
+		{name: "trusted without header", trustForward: true, wantStationID: "192.0.2.10"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+			r := &HTTPRadiusAuth{
+				Servers:           []string{mock.Addr()},
+				Secret:            testradius.Secret,
+				TrustForwardedFor: tc.trustForward,
+			}
+			provision(t, r)
+
+			req, _ := newCaddyRequest("alice", "password")
+			req.RemoteAddr = "192.0.2.10:51234"
+			if tc.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tc.forwardedFor)
+			}
+			if _, ok, err := r.Authenticate(httptest.NewRecorder(), req); !ok || err != nil {
+				t.Fatalf("Authenticate = %v, %v", ok, err)
+			}
+
+			requests := mock.Requests()
+			if len(requests) != 1 {
+				t.Fatalf("RADIUS received %d requests, want 1", len(requests))
+			}
+			if got := rfc2865.CallingStationID_GetString(requests[0]); got != tc.wantStationID {
+				t.Errorf("Calling-Station-Id = %q, want %q", got, tc.wantStationID)
+			}
+		})
+	}
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	const users = 10
+	responses := make(map[string]radius.Code, users)
+	for i := 0; i < users; i++ {
+		responses[fmt.Sprintf("user%d", i)] = radius.CodeAccessAccept
+	}
+	mock := testradius.NewMockServer(t, responses)
+	mock.SetDelay(20 * time.Millisecond)
+
+	r := &HTTPRadiusAuth{
+		Servers:       []string{mock.Addr()},
+		Secret:        testradius.Secret,
+		MaxConcurrent: 2,
+	}
+	provision(t, r)
+
+	var wg sync.WaitGroup
+	for user := range responses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := newCaddyRequest(user, "password")
+			if _, ok, err := r.Authenticate(httptest.NewRecorder(), req); !ok || err != nil {
+				t.Errorf("Authenticate(%s) = %v, %v", user, ok, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := mock.RequestCount(); n != users {
+		t.Errorf("RADIUS received %d requests, want %d", n, users)
+	}
+	if peak := mock.PeakConcurrency(); peak > 2 {
+		t.Errorf("%d RADIUS exchanges ran at once, want at most 2", peak)
+	}
+}
+
+func TestMaxConcurrentSaturated(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+	r := &HTTPRadiusAuth{
+		Servers:       []string{mock.Addr()},
+		Secret:        testradius.Secret,
+		Timeout:       "50ms",
+		MaxConcurrent: 1,
+	}
+	provision(t, r)
+
+	// Hold the only slot so the request cannot get one before its timeout
+	r.sem <- struct{}{}
+	defer func() { <-r.sem }()
+
+	req, _ := newCaddyRequest("alice", "password")
+	w := httptest.NewRecorder()
+	if _, ok, _ := r.Authenticate(w, req); ok {
+		t.Fatal("Authenticate succeeded without a free slot")
+	}
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if n := mock.RequestCount(); n != 0 {
+		t.Errorf("RADIUS received %d requests, want 0", n)
+	}
+}
+
+func TestServerWeights(t *testing.T) {
+	servers := []string{"192.0.2.1:1812", "192.0.2.2:1812", "192.0.2.3:1812"}
+	weights := map[string]int{servers[0]: 1, servers[1]: 3} // servers[2] defaults to 1
+	want := []float64{0.2, 0.6, 0.2}
+	const requests = 10000
+
+	for _, strategy := range []string{strategyWeighted, strategyRoundRobin} {
+		t.Run(strategy, func(t *testing.T) {
+			r := &HTTPRadiusAuth{
+				Servers:       servers,
+				Secret:        testradius.Secret,
+				Strategy:      strategy,
+				ServerWeights: weights,
+			}
+			provision(t, r)
+			if err := r.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			counts := make(map[string]int)
+			for i := 0; i < requests; i++ {
+				selected := r.selectServers()
+				if len(selected) != 1 {
+					t.Fatalf("selected %d servers, want 1", len(selected))
+				}
+				counts[selected[0]]++
+			}
+			for i, server := range servers {
+				if got := float64(counts[server]) / requests; math.Abs(got-want[i]) > 0.05 {
+					t.Errorf("%s selected %.1f%% of the time, want %.1f%%", server, got*100, want[i]*100)
+				}
+			}
+		})
+	}
+}
+
+func TestServerWeightsInvalid(t *testing.T) {
+	for _, weights := range []map[string]int{
+		{"192.0.2.9:1812": 2},
+		{"192.0.2.1:1812": 0},
+	} {
+		r := &HTTPRadiusAuth{
+			Servers:       []string{"192.0.2.1:1812"},
+			Secret:        testradius.Secret,
+			Strategy:      strategyWeighted,
+			ServerWeights: weights,
+		}
+		provision(t, r)
+		if err := r.Validate(); err == nil {
+			t.Errorf("Validate accepted server_weights %v", weights)
+		}
+	}
+}
+
+func TestAcceptCodes(t *testing.T) {
+	// Any code outside the Access-* set will do; the mock can only encode
+	// codes its RADIUS library knows. Code 11, often suggested for this, is
+	// Access-Challenge.
+	const vendorAccept = radius.CodeCoAACK
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": vendorAccept})
+
+	for _, tc := range []struct {
+		name        string
+		acceptCodes []int
+		want        bool
+	}{
+		{"not configured", nil, false},
+		{"configured", []int{int(vendorAccept)}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &HTTPRadiusAuth{
+				Servers:     []string{mock.Addr()},
+				Secret:      testradius.Secret,
+				AcceptCodes: tc.acceptCodes,
+			}
+			provision(t, r)
+			if err := r.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			req, _ := newCaddyRequest("alice", "password")
+			if _, ok, _ := r.Authenticate(httptest.NewRecorder(), req); ok != tc.want {
+				t.Errorf("Authenticate = %v, want %v", ok, tc.want)
+			}
+		})
+	}
+}
+
+func TestAcceptCodesInvalid(t *testing.T) {
+	for _, code := range []int{int(radius.CodeAccessReject), int(radius.CodeAccessChallenge), 0, 256} {
+		r := &HTTPRadiusAuth{
+			Servers:     []string{"127.0.0.1:1812"},
+			Secret:      testradius.Secret,
+			AcceptCodes: []int{code},
+		}
+		provision(t, r)
+		if err := r.Validate(); err == nil {
+			t.Errorf("Validate accepted accept_codes [%d]", code)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package caddy2_radius_auth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"layeh.com/radius"
+)
+
+// TLSConfig configures RADIUS over TLS (RadSec, RFC 6614)
+type TLSConfig struct {
+	Enabled         bool   `json:"enabled,omitempty"`           // Use RadSec instead of UDP
+	CACert          string `json:"ca_cert,omitempty"`           // PEM CA bundle used to verify servers (system roots if empty)
+	ClientCert      string `json:"client_cert,omitempty"`       // PEM client certificate
+	ClientKey       string `json:"client_key,omitempty"`        // PEM client private key
+	ServerName      string `json:"server_name,omitempty"`       // Expected server name (defaults to the server host)
+	PoolSize        int    `json:"pool_size,omitempty"`         // Idle connections kept per server (default 5)
+	IdleConnTimeout string `json:"idle_conn_timeout,omitempty"` // Pooled connections idle longer are closed (default "60s")
+	MinVersion      string `json:"min_version,omitempty"`       // Lowest TLS version accepted: "1.2" (default) or "1.3"
+
+	// RequireClientCert makes a client certificate mandatory, for servers
+	// that verify the identity of their clients (mutual TLS)
+	RequireClientCert bool `json:"require_client_cert,omitempty"`
+
+	// CertRotation reloads the client certificate when its files change,
+	// so a renewed certificate is picked up without restarting Caddy
+	CertRotation bool `json:"cert_rotation,omitempty"`
+}
+
+// connPool keeps idle RadSec and RADIUS over TCP connections per server for
+// reuse, sparing a handshake per request. Connections idle longer than
+// idleTimeout are closed, before a firewall silently drops them.
+type connPool struct {
+	size        int
+	idleTimeout time.Duration
+	conns       sync.Map // server address -> chan idleConn
+}
+
+// idleConn is a pooled connection and the time it was returned
+type idleConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+func newConnPool(size int, idleTimeout time.Duration) *connPool {
+	return &connPool{size: size, idleTimeout: idleTimeout}
+}
+
+func (p *connPool) idle(addr string) chan idleConn {
+	ch, _ := p.conns.LoadOrStore(addr, make(chan idleConn, p.size))
+	return ch.(chan idleConn)
+}
+
+// get returns an idle connection to addr, or nil if there is none.
+// Connections idle too long are closed instead of being returned.
+func (p *connPool) get(addr string) net.Conn {
+	for {
+		select {
+		case c := <-p.idle(addr):
+			if time.Since(c.since) <= p.idleTimeout {
+				return c.conn
+			}
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// put returns conn to the pool, closing it if the pool is full
+func (p *connPool) put(addr string, conn net.Conn) {
+	conn.SetDeadline(time.Time{})
+	select {
+	case p.idle(addr) <- idleConn{conn: conn, since: time.Now()}:
+	default:
+		conn.Close()
+	}
+}
+
+// reap closes connections idle longer than idleTimeout every half timeout
+// until ctx is done
+func (p *connPool) reap(ctx context.Context) {
+	ticker := time.NewTicker(p.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		p.conns.Range(func(_, v any) bool {
+			ch := v.(chan idleConn)
+			// Each connection is taken out once and put back if still fresh
+			for range len(ch) {
+				select {
+				case c := <-ch:
+					if time.Since(c.since) > p.idleTimeout {
+						c.conn.Close()
+						continue
+					}
+					select {
+					case ch <- c:
+					default:
+						c.conn.Close()
+					}
+				default:
+				}
+			}
+			return true
+		})
+	}
+}
+
+// close closes every idle connection
+func (p *connPool) close() {
+	p.conns.Range(func(_, ch any) bool {
+		for {
+			select {
+			case c := <-ch.(chan idleConn):
+				c.conn.Close()
+			default:
+				return true
+			}
+		}
+	})
+}
+
+// parseTLSVersion resolves a min_version value. RFC 6614 requires at least
+// TLS 1.2, so older versions are refused.
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported tls min_version: %s (must be 1.2 or 1.3)", version)
+	}
+}
+
+// buildTLSConfig loads the certificates referenced by the RadSec configuration
+func (c *TLSConfig) buildTLSConfig() (*tls.Config, error) {
+	minVersion, err := parseTLSVersion(c.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		ServerName: c.ServerName,
+		MinVersion: minVersion,
+	}
+
+	if c.CACert != "" {
+		pem, err := os.ReadFile(c.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("reading ca_cert: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca_cert %s", c.CACert)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if (c.ClientCert == "") != (c.ClientKey == "") {
+		return nil, fmt.Errorf("client_cert and client_key must be set together")
+	}
+	if c.RequireClientCert && c.ClientCert == "" {
+		return nil, fmt.Errorf("require_client_cert needs client_cert and client_key")
+	}
+	if c.ClientCert != "" && c.CertRotation {
+		reloader := &clientCertReloader{certFile: c.ClientCert, keyFile: c.ClientKey, check: c.RequireClientCert}
+		if _, err := reloader.GetClientCertificate(nil); err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = reloader.GetClientCertificate
+	} else if c.ClientCert != "" {
+		cert, err := loadClientCert(c.ClientCert, c.ClientKey, c.RequireClientCert)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// loadClientCert loads a client certificate and, if check is set, verifies
+// that it is usable for client authentication
+func loadClientCert(certFile, keyFile string, check bool) (tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("loading client certificate: %v", err)
+	}
+	if check {
+		if err := checkClientCert(cert); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	return cert, nil
+}
+
+// clientCertReloader serves the client certificate for new connections,
+// loading it again whenever the modification time of the certificate or key
+// file changes. If the files cannot be loaded, for instance halfway through
+// being replaced, the previous certificate stays in use.
+type clientCertReloader struct {
+	certFile, keyFile string
+	check             bool
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate
+func (l *clientCertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	certMod, keyMod, statErr := l.modTimes()
+
+	l.mu.RLock()
+	cert := l.cert
+	current := certMod.Equal(l.certMod) && keyMod.Equal(l.keyMod)
+	l.mu.RUnlock()
+	if cert != nil && (current || statErr != nil) {
+		return cert, nil
+	}
+	if statErr != nil {
+		return nil, fmt.Errorf("loading client certificate: %v", statErr)
+	}
+
+	loaded, err := loadClientCert(l.certFile, l.keyFile, l.check)
+	if err != nil {
+		if cert != nil {
+			return cert, nil
+		}
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cert, l.certMod, l.keyMod = &loaded, certMod, keyMod
+	return l.cert, nil
+}
+
+// modTimes returns the modification times of the certificate and key files
+func (l *clientCertReloader) modTimes() (certMod, keyMod time.Time, err error) {
+	info, err := os.Stat(l.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	certMod = info.ModTime()
+	if info, err = os.Stat(l.keyFile); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certMod, info.ModTime(), nil
+}
+
+// checkClientCert verifies that the leaf of cert parses and may be used for
+// client authentication, so a server demanding one will accept it
+func checkClientCert(cert tls.Certificate) error {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("parsing client certificate: %v", err)
+	}
+	if now := time.Now(); now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return fmt.Errorf("client certificate is not valid now (valid %s to %s)",
+			leaf.NotBefore.Format(time.RFC3339), leaf.NotAfter.Format(time.RFC3339))
+	}
+	// No extended key usage means any usage is allowed
+	if len(leaf.ExtKeyUsage) > 0 &&
+		!slices.Contains(leaf.ExtKeyUsage, x509.ExtKeyUsageClientAuth) &&
+		!slices.Contains(leaf.ExtKeyUsage, x509.ExtKeyUsageAny) {
+		return fmt.Errorf("client certificate is not valid for client authentication")
+	}
+	return nil
+}
+
+// exchangeTLS sends packet to addr over a TLS connection and waits for the
+// response
+func (r HTTPRadiusAuth) exchangeTLS(ctx context.Context, packet *radius.Packet, addr string) (*radius.Packet, error) {
+	return r.exchangeStream(ctx, packet, addr, func(ctx context.Context) (net.Conn, error) {
+		cfg := r.tlsConfig.Clone()
+		if cfg.ServerName == "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			cfg.ServerName = host
+		}
+		dialer := tls.Dialer{NetDialer: &net.Dialer{Timeout: r.connectTimeout}, Config: cfg}
+		return dialer.DialContext(ctx, "tcp", r.dialAddr(ctx, addr))
+	})
+}
+
+// exchangeStream sends packet to addr over a stream connection and waits for
+// the response. Pooled connections are reused; if one turns out to be closed
+// by the server, the packet is sent again on a connection from dial.
+func (r HTTPRadiusAuth) exchangeStream(ctx context.Context, packet *radius.Packet, addr string, dial func(context.Context) (net.Conn, error)) (*radius.Packet, error) {
+	wire, err := packet.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	if conn := r.connPool.get(addr); conn != nil {
+		resp, err := r.roundTrip(ctx, conn, addr, packet, wire)
+		if err == nil || ctx.Err() != nil {
+			return resp, err
+		}
+	}
+
+	conn, err := dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return r.roundTrip(ctx, conn, addr, packet, wire)
+}
+
+// roundTrip writes wire to conn and reads the response. conn goes back to
+// the pool after a successful exchange and is closed otherwise.
+func (r HTTPRadiusAuth) roundTrip(ctx context.Context, conn net.Conn, addr string, packet *radius.Packet, wire []byte) (*radius.Packet, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(wire); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	resp, err := readPacket(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !radius.IsAuthenticResponse(resp, wire, packet.Secret) {
+		conn.Close()
+		return nil, &radius.NonAuthenticResponseError{}
+	}
+	r.connPool.put(addr, conn)
+	return radius.Parse(resp, packet.Secret)
+}
+
+// readPacket reads a single length-delimited RADIUS packet from a stream
+func readPacket(rd io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(rd, header); err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint16(header[2:4]))
+	if length < 20 || length > radius.MaxPacketLength {
+		return nil, errors.New("radius: invalid packet length")
+	}
+	buf := make([]byte, length)
+	copy(buf, header)
+	if _, err := io.ReadFull(rd, buf[4:]); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
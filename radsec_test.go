@@ -0,0 +1,499 @@
+package caddy2_radius_auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wxccs/caddy2-radius-auth/internal/testradius"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+// newTestCertificate creates a self-signed certificate valid for 127.0.0.1
+// and writes it to a PEM file usable as ca_cert
+func newTestCertificate(t testing.TB) (tls.Certificate, string) {
+	return newCertificate(t, x509.ExtKeyUsageServerAuth)
+}
+
+// newCertificate creates a self-signed certificate for usage and writes it
+// to a PEM file usable as a CA bundle
+func newCertificate(t testing.TB, usage x509.ExtKeyUsage) (tls.Certificate, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "radsec test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{usage},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, caFile
+}
+
+// writeKeyPair writes cert and its private key to PEM files usable as
+// client_cert and client_key
+func writeKeyPair(t testing.TB, cert tls.Certificate) (certFile, keyFile string) {
+	t.Helper()
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// newTLSAuth provisions an instance using RadSec against a mock server
+// presenting a certificate signed by the CA in caFile
+func newTLSAuth(tb testing.TB, server, caFile string) *HTTPRadiusAuth {
+	tb.Helper()
+	r := &HTTPRadiusAuth{
+		Servers: []string{server},
+		Secret:  testradius.Secret,
+		TLS:     &TLSConfig{Enabled: true, CACert: caFile},
+	}
+	provision(tb, r)
+	return r
+}
+
+func newAccessRequest(username string) *radius.Packet {
+	packet := radius.New(radius.CodeAccessRequest, []byte(testradius.Secret))
+	rfc2865.UserName_SetString(packet, username)
+	return packet
+}
+
+func TestExchangeTLS(t *testing.T) {
+	cert, caFile := newTestCertificate(t)
+	mock := testradius.NewMockTLSServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept},
+		&tls.Config{Certificates: []tls.Certificate{cert}})
+	r := newTLSAuth(t, mock.Addr(), caFile)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		resp, err := r.exchange(ctx, newAccessRequest("alice"), mock.Addr())
+		if err != nil {
+			t.Fatalf("exchange over TLS: %v", err)
+		}
+		if resp.Code != radius.CodeAccessAccept {
+			t.Errorf("got %v, want Access-Accept", resp.Code)
+		}
+	}
+	if n := mock.ConnectionCount(); n != 1 {
+		t.Errorf("opened %d connections for 3 exchanges, want 1", n)
+	}
+}
+
+func TestTLSIdleConnTimeout(t *testing.T) {
+	cert, caFile := newTestCertificate(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Run("server closes idle connections", func(t *testing.T) {
+		mock := testradius.NewMockTLSServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept},
+			&tls.Config{Certificates: []tls.Certificate{cert}})
+		mock.SetIdleTimeout(50 * time.Millisecond)
+		r := newTLSAuth(t, mock.Addr(), caFile)
+
+		for i := 0; i < 2; i++ {
+			if i > 0 {
+				time.Sleep(150 * time.Millisecond)
+			}
+			resp, err := r.exchange(ctx, newAccessRequest("alice"), mock.Addr())
+			if err != nil {
+				t.Fatalf("exchange %d: %v", i+1, err)
+			}
+			if resp.Code != radius.CodeAccessAccept {
+				t.Errorf("exchange %d: got %v, want Access-Accept", i+1, resp.Code)
+			}
+		}
+		if n := mock.ConnectionCount(); n != 2 {
+			t.Errorf("opened %d connections, want 2 (the closed one redialed)", n)
+		}
+	})
+
+	t.Run("pool closes idle connections", func(t *testing.T) {
+		mock := testradius.NewMockTLSServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept},
+			&tls.Config{Certificates: []tls.Certificate{cert}})
+		r := &HTTPRadiusAuth{
+			Servers: []string{mock.Addr()},
+			Secret:  testradius.Secret,
+			TLS:     &TLSConfig{Enabled: true, CACert: caFile, IdleConnTimeout: "50ms"},
+		}
+		provision(t, r)
+
+		if _, err := r.exchange(ctx, newAccessRequest("alice"), mock.Addr()); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(r.connPool.idle(mock.Addr())); n != 1 {
+			t.Fatalf("pool holds %d connections after an exchange, want 1", n)
+		}
+		time.Sleep(150 * time.Millisecond)
+		if n := len(r.connPool.idle(mock.Addr())); n != 0 {
+			t.Errorf("pool holds %d connections after idle_conn_timeout, want 0", n)
+		}
+		if _, err := r.exchange(ctx, newAccessRequest("alice"), mock.Addr()); err != nil {
+			t.Fatal(err)
+		}
+		if n := mock.ConnectionCount(); n != 2 {
+			t.Errorf("opened %d connections, want 2", n)
+		}
+	})
+}
+
+func TestExchangeTLSUntrustedServer(t *testing.T) {
+	cert, _ := newTestCertificate(t)
+	_, otherCA := newTestCertificate(t)
+	mock := testradius.NewMockTLSServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept},
+		&tls.Config{Certificates: []tls.Certificate{cert}})
+	r := newTLSAuth(t, mock.Addr(), otherCA)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := r.exchange(ctx, newAccessRequest("alice"), mock.Addr()); err == nil {
+		t.Fatal("exchange succeeded against a server signed by an untrusted CA")
+	}
+}
+
+// BenchmarkExchangeTLS compares a TLS handshake per request against reusing
+// pooled connections
+func BenchmarkExchangeTLS(b *testing.B) {
+	cert, caFile := newTestCertificate(b)
+	mock := testradius.NewMockTLSServer(b, map[string]radius.Code{"alice": radius.CodeAccessAccept},
+		&tls.Config{Certificates: []tls.Certificate{cert}})
+
+	for _, tc := range []struct {
+		name     string
+		poolSize int
+	}{
+		{"dial", 0},
+		{"pooled", 5},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			r := newTLSAuth(b, mock.Addr(), caFile)
+			r.connPool = newConnPool(tc.poolSize, time.Minute)
+			ctx := context.Background()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := r.exchange(ctx, newAccessRequest("alice"), mock.Addr()); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			r.connPool.close()
+		})
+	}
+}
+
+func TestExchangeMutualTLS(t *testing.T) {
+	serverCert, caFile := newTestCertificate(t)
+	clientCert, _ := newCertificate(t, x509.ExtKeyUsageClientAuth)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(mustParseCertificate(t, clientCert))
+	mock := testradius.NewMockTLSServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept}, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})
+	certFile, keyFile := writeKeyPair(t, clientCert)
+
+	for _, tc := range []struct {
+		name    string
+		tls     TLSConfig
+		wantErr bool
+	}{
+		{
+			name: "client certificate",
+			tls:  TLSConfig{Enabled: true, CACert: caFile, ClientCert: certFile, ClientKey: keyFile, RequireClientCert: true},
+		},
+		{
+			name:    "no client certificate",
+			tls:     TLSConfig{Enabled: true, CACert: caFile},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &HTTPRadiusAuth{Servers: []string{mock.Addr()}, Secret: testradius.Secret, TLS: &tc.tls}
+			provision(t, r)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			resp, err := r.exchange(ctx, newAccessRequest("alice"), mock.Addr())
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("exchange succeeded without the client certificate the server requires")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("exchange over mutual TLS: %v", err)
+			}
+			if resp.Code != radius.CodeAccessAccept {
+				t.Errorf("got %v, want Access-Accept", resp.Code)
+			}
+		})
+	}
+}
+
+func TestRequireClientCertInvalid(t *testing.T) {
+	_, caFile := newTestCertificate(t)
+	// A certificate limited to server authentication cannot identify a client
+	serverCert, _ := newTestCertificate(t)
+	serverCertFile, serverKeyFile := writeKeyPair(t, serverCert)
+
+	for _, tc := range []struct {
+		name string
+		tls  TLSConfig
+	}{
+		{"no client certificate", TLSConfig{Enabled: true, CACert: caFile, RequireClientCert: true}},
+		{"server certificate", TLSConfig{Enabled: true, CACert: caFile, ClientCert: serverCertFile, ClientKey: serverKeyFile, RequireClientCert: true}},
+	} {
+		if _, err := tc.tls.buildTLSConfig(); err == nil {
+			t.Errorf("%s: buildTLSConfig accepted the configuration", tc.name)
+		}
+	}
+}
+
+func mustParseCertificate(t testing.TB, cert tls.Certificate) *x509.Certificate {
+	t.Helper()
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf
+}
+
+func TestClientCertRotation(t *testing.T) {
+	serverCert, caFile := newTestCertificate(t)
+	first, _ := newCertificate(t, x509.ExtKeyUsageClientAuth)
+	second, _ := newCertificate(t, x509.ExtKeyUsageClientAuth)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(mustParseCertificate(t, first))
+	clientCAs.AddCert(mustParseCertificate(t, second))
+
+	presented := make(chan []byte, 10)
+	mock := testradius.NewMockTLSServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept}, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			presented <- rawCerts[0]
+			return nil
+		},
+	})
+
+	certFile, keyFile := writeKeyPair(t, first)
+	r := &HTTPRadiusAuth{
+		Servers: []string{mock.Addr()},
+		Secret:  testradius.Secret,
+		TLS: &TLSConfig{
+			Enabled:      true,
+			CACert:       caFile,
+			ClientCert:   certFile,
+			ClientKey:    keyFile,
+			CertRotation: true,
+		},
+	}
+	provision(t, r)
+
+	exchange := func(want tls.Certificate) {
+		t.Helper()
+		// Only new connections present a certificate
+		r.connPool.close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := r.exchange(ctx, newAccessRequest("alice"), mock.Addr()); err != nil {
+			t.Fatalf("exchange: %v", err)
+		}
+		if got := <-presented; !bytes.Equal(got, want.Certificate[0]) {
+			t.Error("the server was presented a stale client certificate")
+		}
+	}
+	exchange(first)
+
+	// Replace the files, moving their modification time on in case the
+	// file system's timestamps are too coarse to tell the writes apart
+	newCertFile, newKeyFile := writeKeyPair(t, second)
+	for _, f := range [][2]string{{newCertFile, certFile}, {newKeyFile, keyFile}} {
+		data, err := os.ReadFile(f[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(f[1], data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		later := time.Now().Add(time.Minute)
+		if err := os.Chtimes(f[1], later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exchange(second)
+	exchange(second)
+}
+
+func TestConnectTimeout(t *testing.T) {
+	cert, caFile := newTestCertificate(t)
+
+	// A server that accepts connections but never completes the handshake
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	r := &HTTPRadiusAuth{
+		Servers:         []string{ln.Addr().String()},
+		Secret:          testradius.Secret,
+		TLS:             &TLSConfig{Enabled: true, CACert: caFile},
+		ConnectTimeout:  "100ms",
+		ResponseTimeout: "5s",
+	}
+	provision(t, r)
+	start := time.Now()
+	req, _ := newCaddyRequest("alice", "password")
+	if _, ok, _ := r.Authenticate(httptest.NewRecorder(), req); ok {
+		t.Fatal("authenticated against a server that never answered")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("stalled handshake took %v, want connect_timeout to end it", elapsed)
+	}
+
+	// Once connected, a slow answer is bounded by response_timeout only
+	mock := testradius.NewMockTLSServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept},
+		&tls.Config{Certificates: []tls.Certificate{cert}})
+	mock.SetDelay(300 * time.Millisecond)
+	r = &HTTPRadiusAuth{
+		Servers:         []string{mock.Addr()},
+		Secret:          testradius.Secret,
+		TLS:             &TLSConfig{Enabled: true, CACert: caFile},
+		ConnectTimeout:  "100ms",
+		ResponseTimeout: "2s",
+	}
+	provision(t, r)
+	req, _ = newCaddyRequest("alice", "password")
+	if _, ok, err := r.Authenticate(httptest.NewRecorder(), req); !ok || err != nil {
+		t.Errorf("slow RadSec answer: Authenticate = %v, %v, want an accept within response_timeout", ok, err)
+	}
+}
+
+func TestConnectTimeoutUDP(t *testing.T) {
+	// A UDP server whose name does not resolve fails within connect_timeout
+	// rather than waiting for response_timeout
+	r := &HTTPRadiusAuth{
+		Servers:         []string{"radius.invalid:1812"},
+		Secret:          testradius.Secret,
+		ConnectTimeout:  "100ms",
+		ResponseTimeout: "5s",
+	}
+	provision(t, r)
+	if r.connectTimeout != 100*time.Millisecond {
+		t.Fatalf("connectTimeout = %v, want 100ms", r.connectTimeout)
+	}
+	packet := radius.New(radius.CodeAccessRequest, []byte(testradius.Secret))
+	rfc2865.UserName_SetString(packet, "alice")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if _, err := r.exchangeUDP(ctx, packet, "radius.invalid:1812"); err == nil {
+		t.Fatal("exchange with an unresolvable server succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("unresolvable server took %v, want connect_timeout to end it", elapsed)
+	}
+}
+
+func TestResponseTimeout(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+	mock.SetDelay(300 * time.Millisecond)
+
+	for _, tc := range []struct {
+		connect, response string
+		want              bool
+	}{
+		// connect_timeout ends at socket setup, not the UDP answer
+		{"50ms", "2s", true},
+		{"5s", "100ms", false},
+	} {
+		r := &HTTPRadiusAuth{
+			Servers:         []string{mock.Addr()},
+			Secret:          testradius.Secret,
+			ConnectTimeout:  tc.connect,
+			ResponseTimeout: tc.response,
+		}
+		provision(t, r)
+		start := time.Now()
+		req, _ := newCaddyRequest("alice", "password")
+		if _, ok, _ := r.Authenticate(httptest.NewRecorder(), req); ok != tc.want {
+			t.Errorf("connect_timeout %s, response_timeout %s: authenticated = %v, want %v",
+				tc.connect, tc.response, ok, tc.want)
+		}
+		if elapsed := time.Since(start); !tc.want && elapsed > time.Second {
+			t.Errorf("response_timeout %s: gave up after %v", tc.response, elapsed)
+		}
+	}
+}
+
+func TestTimeoutsInvalid(t *testing.T) {
+	for _, tc := range []struct{ connect, response string }{
+		{"soon", ""},
+		{"-1s", ""},
+		{"", "0s"},
+	} {
+		r := &HTTPRadiusAuth{
+			Servers:         []string{"127.0.0.1:1812"},
+			Secret:          testradius.Secret,
+			ConnectTimeout:  tc.connect,
+			ResponseTimeout: tc.response,
+		}
+		provision(t, r)
+		if err := r.Validate(); err == nil {
+			t.Errorf("Validate accepted connect_timeout %q, response_timeout %q", tc.connect, tc.response)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package caddy2_radius_auth
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// rateBuckets is the number of buckets a rate limit window is split into.
+// Failures age out one bucket at a time, approximating a sliding window.
+const rateBuckets = 10
+
+// RateLimitConfig limits failed logins per username
+type RateLimitConfig struct {
+	MaxAttempts int    `json:"max_attempts,omitempty"` // Failed logins allowed within Window
+	Window      string `json:"window,omitempty"`       // Sliding window duration (default "1m")
+}
+
+// failureWindow counts one user's failures per bucket. slots holds the
+// bucket number each count belongs to, so stale counts are recognised
+// without a timer.
+type failureWindow struct {
+	counts [rateBuckets]int
+	slots  [rateBuckets]int64
+}
+
+// rateLimiter tracks failed logins per username
+type rateLimiter struct {
+	mu        sync.Mutex
+	max       int
+	bucket    time.Duration
+	users     map[string]*failureWindow
+	lastSweep int64
+}
+
+// newRateLimiter validates c and creates its limiter
+func newRateLimiter(c *RateLimitConfig) (*rateLimiter, error) {
+	if c.MaxAttempts <= 0 {
+		return nil, fmt.Errorf("rate_limit: max_attempts must be positive")
+	}
+	if c.Window == "" {
+		c.Window = "1m"
+	}
+	window, err := time.ParseDuration(c.Window)
+	if err != nil || window < rateBuckets*time.Millisecond {
+		return nil, fmt.Errorf("rate_limit: invalid window duration: %s", c.Window)
+	}
+	return &rateLimiter{
+		max:    c.MaxAttempts,
+		bucket: window / rateBuckets,
+		users:  make(map[string]*failureWindow),
+	}, nil
+}
+
+// retryAfter reports how long username must wait before trying again, or 0
+// if it is below the limit
+func (l *rateLimiter) retryAfter(username string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fw, ok := l.users[username]
+	if !ok {
+		return 0
+	}
+	now := time.Now().UnixNano()
+	slot := now / int64(l.bucket)
+	total, oldest := 0, slot
+	for i := range fw.counts {
+		if fw.counts[i] > 0 && fw.slots[i] > slot-rateBuckets {
+			total += fw.counts[i]
+			oldest = min(oldest, fw.slots[i])
+		}
+	}
+	if total < l.max {
+		return 0
+	}
+	// The oldest bucket leaves the window first
+	return time.Duration((oldest+rateBuckets)*int64(l.bucket) - now)
+}
+
+// failure records a failed login for username
+func (l *rateLimiter) failure(username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	slot := time.Now().UnixNano() / int64(l.bucket)
+	l.sweep(slot)
+	fw, ok := l.users[username]
+	if !ok {
+		fw = new(failureWindow)
+		l.users[username] = fw
+	}
+	i := slot % rateBuckets
+	if fw.slots[i] != slot {
+		fw.slots[i], fw.counts[i] = slot, 0
+	}
+	fw.counts[i]++
+}
+
+// sweep forgets users without failures in the window, at most once per
+// window. l.mu must be held.
+func (l *rateLimiter) sweep(slot int64) {
+	if slot-l.lastSweep < rateBuckets {
+		return
+	}
+	l.lastSweep = slot
+	for username, fw := range l.users {
+		if slices.Max(fw.slots[:]) <= slot-rateBuckets {
+			delete(l.users, username)
+		}
+	}
+}
+
+// reset forgets every recorded failure
+func (l *rateLimiter) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.users = make(map[string]*failureWindow)
+}
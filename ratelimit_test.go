@@ -0,0 +1,90 @@
+package caddy2_radius_auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/wxccs/caddy2-radius-auth/internal/testradius"
+	"layeh.com/radius"
+)
+
+func TestRateLimit(t *testing.T) {
+	const maxAttempts = 3
+	mock := testradius.NewMockServer(t, map[string]radius.Code{
+		"alice": radius.CodeAccessReject,
+		"bob":   radius.CodeAccessAccept,
+	})
+	r := &HTTPRadiusAuth{
+		Servers:   []string{mock.Addr()},
+		Secret:    testradius.Secret,
+		RateLimit: &RateLimitConfig{MaxAttempts: maxAttempts, Window: "1m"},
+	}
+	provision(t, r)
+
+	authenticate := func(user string) *httptest.ResponseRecorder {
+		t.Helper()
+		req, _ := newCaddyRequest(user, "password")
+		w := httptest.NewRecorder()
+		r.Authenticate(w, req)
+		return w
+	}
+
+	for i := 0; i < maxAttempts; i++ {
+		if w := authenticate("alice"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: status = %d, want %d", i+1, w.Code, http.StatusUnauthorized)
+		}
+	}
+	w := authenticate("alice")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("attempt %d: status = %d, want %d", maxAttempts+1, w.Code, http.StatusTooManyRequests)
+	}
+	if secs, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || secs < 1 || secs > 60 {
+		t.Errorf("Retry-After = %q, want 1 to 60 seconds", w.Header().Get("Retry-After"))
+	}
+	if n := mock.RequestCount(); n != maxAttempts {
+		t.Errorf("RADIUS received %d requests, want %d", n, maxAttempts)
+	}
+
+	// Other users are not affected
+	if w := authenticate("bob"); w.Code != http.StatusOK {
+		t.Errorf("bob: status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	if err := r.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if wait := r.rateLimiter.retryAfter("alice"); wait != 0 {
+		t.Errorf("alice still limited for %v after Cleanup", wait)
+	}
+}
+
+func TestRateLimitWindowExpires(t *testing.T) {
+	l, err := newRateLimiter(&RateLimitConfig{MaxAttempts: 2, Window: "100ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.failure("alice")
+	l.failure("alice")
+	if l.retryAfter("alice") == 0 {
+		t.Fatal("alice not limited after reaching max_attempts")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if wait := l.retryAfter("alice"); wait != 0 {
+		t.Errorf("alice still limited for %v after the window passed", wait)
+	}
+}
+
+func TestRateLimitInvalid(t *testing.T) {
+	for _, c := range []RateLimitConfig{
+		{MaxAttempts: 0},
+		{MaxAttempts: 5, Window: "soon"},
+		{MaxAttempts: 5, Window: "1ms"},
+	} {
+		if _, err := newRateLimiter(&c); err == nil {
+			t.Errorf("newRateLimiter accepted %+v", c)
+		}
+	}
+}
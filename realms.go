@@ -0,0 +1,79 @@
+package caddy2_radius_auth
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// RealmConfig routes users of one or more domains to their own RADIUS servers
+type RealmConfig struct {
+	Realm   string   `json:"realm,omitempty"`   // Username domain, exact or glob (e.g. "*.example.com")
+	Servers []string `json:"servers,omitempty"` // RADIUS servers for this realm
+	Secret  string   `json:"secret,omitempty"`  // Shared secret (defaults to the top-level secret)
+	Timeout string   `json:"timeout,omitempty"` // Exchange timeout (defaults to the top-level timeout)
+
+	pool *serverPool
+}
+
+// provisionRealms validates the realms and creates their server pools
+func (r *HTTPRadiusAuth) provisionRealms(newBreaker func() *circuitBreaker) error {
+	for i := range r.Realms {
+		realm := &r.Realms[i]
+		if realm.Realm == "" {
+			return fmt.Errorf("realms: realm name is required")
+		}
+		if _, err := path.Match(realm.Realm, ""); err != nil {
+			return fmt.Errorf("realms: invalid realm pattern %q: %v", realm.Realm, err)
+		}
+		if len(realm.Servers) == 0 {
+			return fmt.Errorf("realms: %s has no servers", realm.Realm)
+		}
+		for _, s := range realm.Servers {
+			if !isValidServerAddr(s) {
+				return fmt.Errorf("realms: %s: invalid RADIUS server: %s", realm.Realm, s)
+			}
+		}
+		r.stripServerSchemes(realm.Servers)
+		if realm.Secret == "" {
+			realm.Secret = r.Secret
+		}
+		if realm.Timeout == "" {
+			realm.Timeout = r.ResponseTimeout
+		}
+		if _, err := time.ParseDuration(realm.Timeout); err != nil {
+			return fmt.Errorf("realms: %s: invalid timeout duration: %v", realm.Realm, err)
+		}
+		realm.pool = newServerPool(realm.Servers, newBreaker)
+	}
+	return nil
+}
+
+// matchRealm returns the realm for the domain of username (the part after
+// the last "@"), or nil if it has no domain or no realm matches
+func (r HTTPRadiusAuth) matchRealm(username string) *RealmConfig {
+	i := strings.LastIndex(username, "@")
+	if i < 0 || len(r.Realms) == 0 {
+		return nil
+	}
+	domain := strings.ToLower(username[i+1:])
+	for j := range r.Realms {
+		if ok, _ := path.Match(strings.ToLower(r.Realms[j].Realm), domain); ok {
+			return &r.Realms[j]
+		}
+	}
+	return nil
+}
+
+// withRealm returns a copy of r that authenticates against the realm's servers
+func (r HTTPRadiusAuth) withRealm(realm *RealmConfig) HTTPRadiusAuth {
+	r.pool = realm.pool
+	r.Secret = realm.Secret
+	r.Timeout = realm.Timeout
+	r.ResponseTimeout = realm.Timeout
+	r.ServerSecrets = nil
+	r.ServerTimeouts = nil
+	r.ServerWeights = nil
+	return r
+}
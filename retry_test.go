@@ -0,0 +1,65 @@
+package caddy2_radius_auth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/wxccs/caddy2-radius-auth/internal/testradius"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"layeh.com/radius"
+)
+
+func TestRetry(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		retryCount int
+		failFirst  int
+		wantOK     bool
+		wantCalls  int
+	}{
+		{name: "no failures", retryCount: 2, failFirst: 0, wantOK: true, wantCalls: 1},
+		{name: "recovers", retryCount: 2, failFirst: 2, wantOK: true, wantCalls: 3},
+		{name: "gives up", retryCount: 1, failFirst: 2, wantOK: false, wantCalls: 2},
+		{name: "no retries", retryCount: 0, failFirst: 1, wantOK: false, wantCalls: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+			mock.FailFirst(tc.failFirst)
+
+			r := &HTTPRadiusAuth{
+				Servers:    []string{mock.Addr()},
+				Secret:     testradius.Secret,
+				Timeout:    "100ms",
+				RetryCount: tc.retryCount,
+				RetryDelay: "10ms",
+			}
+			provision(t, r)
+			core, logs := observer.New(zapcore.DebugLevel)
+			r.logger = zap.New(core)
+
+			res, err := r.checkRadiusConcurrent(context.Background(), "alice", "password", requestInfo{})
+			if res.ok != tc.wantOK {
+				t.Errorf("checkRadiusConcurrent = %v, %v, want ok %v", res.ok, err, tc.wantOK)
+			}
+			if n := mock.RequestCount(); n != tc.wantCalls {
+				t.Errorf("server received %d requests, want %d", n, tc.wantCalls)
+			}
+
+			retries := logs.FilterMessage("retrying RADIUS server").All()
+			if len(retries) != tc.wantCalls-1 {
+				t.Fatalf("logged %d retries, want %d", len(retries), tc.wantCalls-1)
+			}
+			for i, entry := range retries {
+				fields := entry.ContextMap()
+				if fields["server"] != mock.Addr() {
+					t.Errorf("retry %d logged server %v, want %s", i, fields["server"], mock.Addr())
+				}
+				if fields["attempt"] != int64(i+1) {
+					t.Errorf("retry %d logged attempt %v, want %d", i, fields["attempt"], i+1)
+				}
+			}
+		})
+	}
+}
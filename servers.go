@@ -0,0 +1,163 @@
+package caddy2_radius_auth
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Server address schemes choosing the transport of a single server
+const (
+	transportUDP = "udp"
+	transportTLS = "tls"
+	transportTCP = "tcp"
+)
+
+// splitServerURL splits "udp://host:port", "tls://host:port" or
+// "tcp://host:port" into the scheme and the address; bare addresses have no
+// scheme
+func splitServerURL(s string) (scheme, addr string) {
+	if scheme, addr, ok := strings.Cut(s, "://"); ok {
+		return strings.ToLower(scheme), addr
+	}
+	return "", s
+}
+
+// stripServerSchemes removes the scheme of every server URL in servers,
+// recording the transport it selects in r.serverTransport. The per-server
+// maps may be keyed by either form and are rekeyed to the bare address.
+func (r *HTTPRadiusAuth) stripServerSchemes(servers []string) {
+	if r.serverTransport == nil {
+		r.serverTransport = make(map[string]string)
+	}
+	for i, s := range servers {
+		if scheme, addr := splitServerURL(s); scheme != "" {
+			r.serverTransport[addr] = scheme
+			servers[i] = addr
+		}
+	}
+	for _, m := range []map[string]string{r.ServerSecrets, r.ServerTimeouts} {
+		for key, value := range m {
+			if scheme, addr := splitServerURL(key); scheme != "" {
+				delete(m, key)
+				m[addr] = value
+			}
+		}
+	}
+	for key, weight := range r.ServerWeights {
+		if scheme, addr := splitServerURL(key); scheme != "" {
+			delete(r.ServerWeights, key)
+			r.ServerWeights[addr] = weight
+		}
+	}
+}
+
+// hasServerTransport reports whether any server was given as a URL with the
+// scheme of transport
+func (r HTTPRadiusAuth) hasServerTransport(transport string) bool {
+	for _, t := range r.serverTransport {
+		if t == transport {
+			return true
+		}
+	}
+	return false
+}
+
+// transportFor returns the transport server is reached over: as its URL
+// scheme says, or for bare addresses RadSec when the tls block is enabled,
+// TCP with tcp_mode and UDP otherwise
+func (r HTTPRadiusAuth) transportFor(server string) string {
+	if transport, ok := r.serverTransport[server]; ok {
+		return transport
+	}
+	switch {
+	case r.TLS != nil && r.TLS.Enabled:
+		return transportTLS
+	case r.TCPMode:
+		return transportTCP
+	}
+	return transportUDP
+}
+
+// usesTLS reports whether server is reached over RadSec
+func (r HTTPRadiusAuth) usesTLS(server string) bool {
+	return r.transportFor(server) == transportTLS
+}
+
+// dialAddr returns the address to dial for server. With prefer_ipv6 a
+// hostname with AAAA records is dialed at its first IPv6 address; IP
+// addresses, and names without AAAA records or that fail to resolve, are
+// left to the dialer, which tries them in its usual order.
+func (r HTTPRadiusAuth) dialAddr(ctx context.Context, server string) string {
+	if !r.PreferIPv6 {
+		return server
+	}
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		return server
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return server
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip6", host)
+	if err != nil || len(ips) == 0 {
+		return server
+	}
+	return net.JoinHostPort(ips[0].String(), port)
+}
+
+// ServerEntry is a RADIUS server together with its own settings, a richer
+// alternative to listing "host:port" in Servers
+type ServerEntry struct {
+	Host    string `json:"host"`
+	Port    int    `json:"port,omitempty"`    // Default 1812, or 2083 with RadSec
+	Secret  string `json:"secret,omitempty"`  // Shared secret (defaults to the top-level secret)
+	Weight  int    `json:"weight,omitempty"`  // Weight for round_robin and weighted_random (default 1)
+	Timeout string `json:"timeout,omitempty"` // Exchange timeout (defaults to the top-level timeout)
+}
+
+// mergeServerEntries appends ServerEntries to Servers as host:port addresses
+// and records their settings in the per-server maps, so the rest of the
+// module only deals with Servers
+func (r *HTTPRadiusAuth) mergeServerEntries() error {
+	for _, e := range r.ServerEntries {
+		if e.Host == "" {
+			return fmt.Errorf("server_entries: host is required")
+		}
+		port := e.Port
+		if port == 0 {
+			port = 1812
+			if r.TLS != nil && r.TLS.Enabled {
+				port = 2083
+			}
+		}
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("server_entries: invalid port %d for %s", e.Port, e.Host)
+		}
+		addr := net.JoinHostPort(e.Host, strconv.Itoa(port))
+		r.Servers = append(r.Servers, addr)
+
+		if e.Secret != "" {
+			if r.ServerSecrets == nil {
+				r.ServerSecrets = make(map[string]string)
+			}
+			r.ServerSecrets[addr] = e.Secret
+		}
+		if e.Weight != 0 {
+			if r.ServerWeights == nil {
+				r.ServerWeights = make(map[string]int)
+			}
+			r.ServerWeights[addr] = e.Weight
+		}
+		if e.Timeout != "" {
+			if r.ServerTimeouts == nil {
+				r.ServerTimeouts = make(map[string]string)
+			}
+			r.ServerTimeouts[addr] = e.Timeout
+		}
+	}
+	return nil
+}
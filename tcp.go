@@ -0,0 +1,18 @@
+package caddy2_radius_auth
+
+import (
+	"context"
+	"net"
+
+	"layeh.com/radius"
+)
+
+// exchangeTCP sends packet to addr over a plain TCP connection (RFC 6613)
+// and waits for the response. Packets are framed by their own RADIUS Length
+// field, as with RadSec, and connections are pooled the same way.
+func (r HTTPRadiusAuth) exchangeTCP(ctx context.Context, packet *radius.Packet, addr string) (*radius.Packet, error) {
+	return r.exchangeStream(ctx, packet, addr, func(ctx context.Context) (net.Conn, error) {
+		dialer := net.Dialer{Timeout: r.connectTimeout}
+		return dialer.DialContext(ctx, "tcp", r.dialAddr(ctx, addr))
+	})
+}
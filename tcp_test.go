@@ -0,0 +1,118 @@
+package caddy2_radius_auth
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/wxccs/caddy2-radius-auth/internal/testradius"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+func TestTCPMode(t *testing.T) {
+	mock := testradius.NewMockTCPServer(t, map[string]radius.Code{
+		"alice": radius.CodeAccessAccept,
+		"bob":   radius.CodeAccessReject,
+	})
+	r := &HTTPRadiusAuth{
+		Servers: []string{mock.Addr()},
+		Secret:  testradius.Secret,
+		TCPMode: true,
+	}
+	provision(t, r)
+
+	for _, tc := range []struct {
+		username string
+		want     bool
+	}{
+		{"alice", true},
+		{"bob", false},
+		{"alice", true},
+	} {
+		req, _ := newCaddyRequest(tc.username, "password")
+		if _, ok, err := r.Authenticate(httptest.NewRecorder(), req); ok != tc.want || err != nil {
+			t.Errorf("%s: Authenticate = %v, %v, want %v", tc.username, ok, err, tc.want)
+		}
+	}
+	if n := mock.RequestCount(); n != 3 {
+		t.Errorf("RADIUS received %d requests over TCP, want 3", n)
+	}
+	if n := mock.ConnectionCount(); n != 1 {
+		t.Errorf("opened %d connections for 3 requests, want 1", n)
+	}
+}
+
+// TestTCPFraming checks packets are framed by their RADIUS Length field
+// (RFC 6613), with nothing before or after them on the stream. The mock
+// reads each frame by that field: a length prefix would be read as a bogus
+// header, and trailing bytes would break the next frame and make the mock
+// close the connection.
+func TestTCPFraming(t *testing.T) {
+	mock := testradius.NewMockTCPServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+	r := &HTTPRadiusAuth{
+		Servers: []string{mock.Addr()},
+		Secret:  testradius.Secret,
+		TCPMode: true,
+	}
+	provision(t, r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		packet := newAccessRequest("alice")
+		resp, err := r.exchange(ctx, packet, mock.Addr())
+		if err != nil {
+			t.Fatalf("exchange %d: %v", i+1, err)
+		}
+		if resp.Code != radius.CodeAccessAccept || resp.Identifier != packet.Identifier {
+			t.Errorf("exchange %d: got %v for identifier %d, want Access-Accept for %d",
+				i+1, resp.Code, resp.Identifier, packet.Identifier)
+		}
+	}
+
+	requests := mock.Requests()
+	if len(requests) != 3 {
+		t.Fatalf("mock parsed %d packets, want 3", len(requests))
+	}
+	for i, packet := range requests {
+		if packet.Code != radius.CodeAccessRequest || rfc2865.UserName_GetString(packet) != "alice" {
+			t.Errorf("packet %d: got %v for %q, want an Access-Request for alice",
+				i+1, packet.Code, rfc2865.UserName_GetString(packet))
+		}
+	}
+	if n := mock.ConnectionCount(); n != 1 {
+		t.Errorf("mock accepted %d connections, want 1 kept in sync", n)
+	}
+}
+
+func TestTCPAccounting(t *testing.T) {
+	auth := testradius.NewMockTCPServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+	acct := testradius.NewMockTCPServer(t, nil)
+	_, port, _ := net.SplitHostPort(acct.Addr())
+	r := &HTTPRadiusAuth{
+		Servers:    []string{"tcp://" + auth.Addr()},
+		Secret:     testradius.Secret,
+		Accounting: &AccountingConfig{Enabled: true, Port: port},
+	}
+	provision(t, r)
+
+	req, _ := newCaddyRequest("alice", "password")
+	if _, ok, err := r.Authenticate(httptest.NewRecorder(), req); !ok || err != nil {
+		t.Fatalf("Authenticate = %v, %v", ok, err)
+	}
+
+	// The Start record goes out asynchronously, over TCP like the Access-Request
+	deadline := time.Now().Add(time.Second)
+	for acct.RequestCount() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no accounting record reached the server's TCP accounting port")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if packet := acct.Requests()[0]; packet.Code != radius.CodeAccountingRequest {
+		t.Errorf("accounting port received %v, want Accounting-Request", packet.Code)
+	}
+}
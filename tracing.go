@@ -0,0 +1,49 @@
+package caddy2_radius_auth
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/wxccs/caddy2-radius-auth"
+
+// startSpan starts a span as a child of the one in ctx when tracing is
+// enabled. The tracer comes from the parent span's provider, so spans join
+// the trace started by Caddy's tracing handler; without a parent the global
+// provider is used. When tracing is disabled a no-op span is returned.
+func (r HTTPRadiusAuth) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if !r.Tracing {
+		return ctx, trace.SpanFromContext(context.Background())
+	}
+	parent := trace.SpanFromContext(ctx)
+	provider := parent.TracerProvider()
+	if !parent.SpanContext().IsValid() {
+		provider = otel.GetTracerProvider()
+	}
+	return provider.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endAuthenticateSpan records the outcome of checkRadiusConcurrent and ends span
+func endAuthenticateSpan(span trace.Span, ok bool, err error) {
+	span.SetAttributes(attribute.Bool("radius.accepted", ok))
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// endExchangeSpan records the outcome of a single server exchange and ends span
+func endExchangeSpan(span trace.Span, res serverResult) {
+	if res.code != 0 {
+		span.SetAttributes(attribute.Int("radius.response_code", int(res.code)))
+	}
+	if res.err != nil {
+		span.SetAttributes(attribute.String("radius.error", res.err.Error()))
+		span.SetStatus(codes.Error, res.err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,198 @@
+package caddy2_radius_auth
+
+import (
+	"context"
+	"crypto/rand"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/wxccs/caddy2-radius-auth/internal/testradius"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/embedded"
+	"layeh.com/radius"
+)
+
+// spanRecorder is a TracerProvider that keeps every span it creates, standing
+// in for the SDK's in-memory exporter
+type spanRecorder struct {
+	embedded.TracerProvider
+
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+func (p *spanRecorder) Tracer(string, ...trace.TracerOption) trace.Tracer {
+	return recordingTracer{provider: p}
+}
+
+// ended returns the spans that have ended, in the order they were started
+func (p *spanRecorder) ended() []*recordedSpan {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var spans []*recordedSpan
+	for _, s := range p.spans {
+		if s.ended {
+			spans = append(spans, s)
+		}
+	}
+	return spans
+}
+
+type recordingTracer struct {
+	embedded.Tracer
+	provider *spanRecorder
+}
+
+func (t recordingTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	cfg := trace.NewSpanStartConfig(opts...)
+	parent := trace.SpanContextFromContext(ctx)
+
+	sc := trace.SpanContextConfig{TraceID: parent.TraceID(), TraceFlags: trace.FlagsSampled}
+	if !parent.IsValid() {
+		rand.Read(sc.TraceID[:])
+	}
+	rand.Read(sc.SpanID[:])
+
+	s := &recordedSpan{
+		provider: t.provider,
+		name:     name,
+		parent:   parent,
+		sc:       trace.NewSpanContext(sc),
+		attrs:    make(map[attribute.Key]attribute.Value),
+	}
+	s.SetAttributes(cfg.Attributes()...)
+
+	t.provider.mu.Lock()
+	t.provider.spans = append(t.provider.spans, s)
+	t.provider.mu.Unlock()
+	return trace.ContextWithSpan(ctx, s), s
+}
+
+type recordedSpan struct {
+	embedded.Span
+	provider *spanRecorder
+
+	name   string
+	parent trace.SpanContext
+	sc     trace.SpanContext
+	attrs  map[attribute.Key]attribute.Value
+	status codes.Code
+	ended  bool
+}
+
+func (s *recordedSpan) End(...trace.SpanEndOption) {
+	s.provider.mu.Lock()
+	defer s.provider.mu.Unlock()
+	s.ended = true
+}
+
+func (s *recordedSpan) SetAttributes(kv ...attribute.KeyValue) {
+	s.provider.mu.Lock()
+	defer s.provider.mu.Unlock()
+	for _, attr := range kv {
+		s.attrs[attr.Key] = attr.Value
+	}
+}
+
+func (s *recordedSpan) SetStatus(code codes.Code, _ string) {
+	s.provider.mu.Lock()
+	defer s.provider.mu.Unlock()
+	s.status = code
+}
+
+func (s *recordedSpan) AddEvent(string, ...trace.EventOption)   {}
+func (s *recordedSpan) AddLink(trace.Link)                      {}
+func (s *recordedSpan) IsRecording() bool                       { return true }
+func (s *recordedSpan) RecordError(error, ...trace.EventOption) {}
+func (s *recordedSpan) SpanContext() trace.SpanContext          { return s.sc }
+func (s *recordedSpan) SetName(name string)                     { s.name = name }
+func (s *recordedSpan) TracerProvider() trace.TracerProvider    { return s.provider }
+
+func TestTracingSpans(t *testing.T) {
+	accepting := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+	silent := testradius.NewMockServer(t, map[string]radius.Code{"alice": 0})
+
+	r := &HTTPRadiusAuth{
+		Servers: []string{accepting.Addr(), silent.Addr()},
+		Secret:  testradius.Secret,
+		Timeout: "100ms",
+		Tracing: true,
+	}
+	provision(t, r)
+
+	// The span Caddy's tracing handler would have started for the request
+	recorder := &spanRecorder{}
+	_, root := recorder.Tracer("test").Start(context.Background(), "http")
+
+	req, _ := newCaddyRequest("alice", "password")
+	req = req.WithContext(trace.ContextWithSpan(req.Context(), root))
+	if _, ok, err := r.Authenticate(httptest.NewRecorder(), req); !ok || err != nil {
+		t.Fatalf("Authenticate = %v, %v", ok, err)
+	}
+	root.End()
+
+	var authenticate *recordedSpan
+	exchanges := make(map[string]*recordedSpan)
+	for _, s := range recorder.ended() {
+		switch s.name {
+		case "radius.authenticate":
+			authenticate = s
+		case "radius.exchange":
+			exchanges[s.attrs["radius.server"].AsString()] = s
+		}
+	}
+
+	if authenticate == nil {
+		t.Fatal("no radius.authenticate span")
+	}
+	if authenticate.parent.SpanID() != root.SpanContext().SpanID() {
+		t.Error("radius.authenticate is not a child of the request span")
+	}
+	if len(exchanges) != 2 {
+		t.Fatalf("got %d radius.exchange spans, want 2", len(exchanges))
+	}
+	for _, s := range exchanges {
+		if s.parent.SpanID() != authenticate.sc.SpanID() {
+			t.Errorf("%s: radius.exchange is not a child of radius.authenticate", s.attrs["radius.server"].AsString())
+		}
+	}
+
+	accepted := exchanges[accepting.Addr()]
+	if code := accepted.attrs["radius.response_code"].AsInt64(); code != int64(radius.CodeAccessAccept) {
+		t.Errorf("radius.response_code = %d, want %d", code, radius.CodeAccessAccept)
+	}
+	if _, ok := accepted.attrs["radius.error"]; ok {
+		t.Error("successful exchange has radius.error")
+	}
+
+	failed := exchanges[silent.Addr()]
+	if failed.attrs["radius.error"].AsString() == "" {
+		t.Error("failed exchange has no radius.error")
+	}
+	if failed.status != codes.Error {
+		t.Errorf("failed exchange status = %v, want Error", failed.status)
+	}
+}
+
+func TestTracingDisabled(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+	r := &HTTPRadiusAuth{
+		Servers: []string{mock.Addr()},
+		Secret:  testradius.Secret,
+	}
+	provision(t, r)
+
+	recorder := &spanRecorder{}
+	ctx, root := recorder.Tracer("test").Start(context.Background(), "http")
+	if res, err := r.checkRadiusConcurrent(ctx, "alice", "password", requestInfo{}); !res.ok || err != nil {
+		t.Fatalf("checkRadiusConcurrent = %v, %v", res.ok, err)
+	}
+	root.End()
+
+	if spans := recorder.ended(); len(spans) != 1 {
+		t.Errorf("recorded %d spans with tracing disabled, want only the request span", len(spans))
+	}
+}
@@ -0,0 +1,75 @@
+package caddy2_radius_auth
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// UsernameTransform rewrites the username before it is sent to RADIUS.
+// Rules are applied in order: prefix, suffix, regexp, then case folding.
+type UsernameTransform struct {
+	LowerCase     bool   `json:"lower_case,omitempty"`     // Fold the username to lower case
+	StripSuffix   string `json:"strip_suffix,omitempty"`   // Suffix to strip, e.g. "@corp.example.com" ("@" strips any domain)
+	StripPrefix   string `json:"strip_prefix,omitempty"`   // Prefix to strip, e.g. `CORP\` (`\` strips any domain)
+	Regexp        string `json:"regexp,omitempty"`         // Regular expression to rewrite
+	RegexpReplace string `json:"regexp_replace,omitempty"` // Replacement for Regexp matches
+
+	re *regexp.Regexp
+}
+
+// provision compiles the regexp rule
+func (t *UsernameTransform) provision() error {
+	if t.Regexp == "" {
+		return nil
+	}
+	re, err := regexp.Compile(t.Regexp)
+	if err != nil {
+		return fmt.Errorf("invalid username_transform regexp: %v", err)
+	}
+	t.re = re
+	return nil
+}
+
+// apply returns the transformed username. Applying it to an already
+// transformed name leaves the name unchanged for the prefix, suffix and case
+// rules: the `\` wildcard strips up to the last backslash, the "@" wildcard
+// from the first "@", and literal affixes are stripped as often as they
+// repeat. Regexp rules should be written so that the same holds.
+func (t *UsernameTransform) apply(username string) string {
+	if t == nil {
+		return username
+	}
+
+	switch {
+	case t.StripPrefix == `\`:
+		if i := strings.LastIndex(username, `\`); i >= 0 {
+			username = username[i+1:]
+		}
+	case t.StripPrefix != "":
+		for len(username) >= len(t.StripPrefix) && strings.EqualFold(username[:len(t.StripPrefix)], t.StripPrefix) {
+			username = username[len(t.StripPrefix):]
+		}
+	}
+
+	switch {
+	case t.StripSuffix == "@":
+		if i := strings.Index(username, "@"); i >= 0 {
+			username = username[:i]
+		}
+	case t.StripSuffix != "":
+		for len(username) >= len(t.StripSuffix) && strings.EqualFold(username[len(username)-len(t.StripSuffix):], t.StripSuffix) {
+			username = username[:len(username)-len(t.StripSuffix)]
+		}
+	}
+
+	if t.re != nil {
+		username = t.re.ReplaceAllString(username, t.RegexpReplace)
+	}
+
+	if t.LowerCase {
+		username = strings.ToLower(username)
+	}
+
+	return username
+}
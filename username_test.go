@@ -0,0 +1,149 @@
+package caddy2_radius_auth
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/wxccs/caddy2-radius-auth/internal/testradius"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+func TestUsernameTransformCombinations(t *testing.T) {
+	const input = `CORP\Alice.Smith@Example.com`
+
+	tests := []struct {
+		lower, prefix, suffix, regexp bool
+		want                          string
+	}{
+		{want: `CORP\Alice.Smith@Example.com`},
+		{lower: true, want: `corp\alice.smith@example.com`},
+		{prefix: true, want: `Alice.Smith@Example.com`},
+		{suffix: true, want: `CORP\Alice.Smith`},
+		{regexp: true, want: `CORP\Alice_Smith@Example_com`},
+		{lower: true, prefix: true, want: `alice.smith@example.com`},
+		{lower: true, suffix: true, want: `corp\alice.smith`},
+		{lower: true, regexp: true, want: `corp\alice_smith@example_com`},
+		{prefix: true, suffix: true, want: `Alice.Smith`},
+		{prefix: true, regexp: true, want: `Alice_Smith@Example_com`},
+		{suffix: true, regexp: true, want: `CORP\Alice_Smith`},
+		{lower: true, prefix: true, suffix: true, want: `alice.smith`},
+		{lower: true, prefix: true, regexp: true, want: `alice_smith@example_com`},
+		{lower: true, suffix: true, regexp: true, want: `corp\alice_smith`},
+		{prefix: true, suffix: true, regexp: true, want: `Alice_Smith`},
+		{lower: true, prefix: true, suffix: true, regexp: true, want: `alice_smith`},
+	}
+
+	for _, tc := range tests {
+		transform := &UsernameTransform{LowerCase: tc.lower}
+		if tc.prefix {
+			transform.StripPrefix = `corp\`
+		}
+		if tc.suffix {
+			transform.StripSuffix = "@example.com"
+		}
+		if tc.regexp {
+			transform.Regexp = `\.`
+			transform.RegexpReplace = "_"
+		}
+		if err := transform.provision(); err != nil {
+			t.Fatal(err)
+		}
+
+		got := transform.apply(input)
+		if got != tc.want {
+			t.Errorf("%+v: apply(%q) = %q, want %q", *transform, input, got, tc.want)
+		}
+
+		// Every name comes out unchanged by a second pass, including
+		// those with repeated separators and affixes
+		for _, name := range []string{
+			input,
+			`A\B\c`,
+			`a@b@c`,
+			`corp\corp\x`,
+			`x@example.com@example.com`,
+			`CORP\corp\A\b@c@example.com@Example.com`,
+		} {
+			for _, wildcards := range []bool{false, true} {
+				transform := *transform
+				if wildcards && tc.prefix {
+					transform.StripPrefix = `\`
+				}
+				if wildcards && tc.suffix {
+					transform.StripSuffix = "@"
+				}
+				once := transform.apply(name)
+				if again := transform.apply(once); again != once {
+					t.Errorf("%+v: not idempotent for %q: %q then %q", transform, name, once, again)
+				}
+			}
+		}
+	}
+}
+
+func TestUsernameTransformWildcards(t *testing.T) {
+	tests := []struct {
+		transform UsernameTransform
+		input     string
+		want      string
+	}{
+		{UsernameTransform{StripPrefix: `\`}, `CORP\alice`, "alice"},
+		{UsernameTransform{StripPrefix: `\`}, `alice`, "alice"},
+		{UsernameTransform{StripPrefix: `corp\`}, `OTHER\alice`, `OTHER\alice`},
+		{UsernameTransform{StripSuffix: "@"}, "alice@example.com", "alice"},
+		{UsernameTransform{StripSuffix: "@"}, "alice@host@example.com", "alice"},
+		{UsernameTransform{StripPrefix: `\`}, `A\B\c`, "c"},
+		{UsernameTransform{StripPrefix: `corp\`}, `corp\CORP\x`, "x"},
+		{UsernameTransform{StripSuffix: "@example.com"}, "x@example.com@Example.com", "x"},
+		{UsernameTransform{StripSuffix: "@"}, "alice", "alice"},
+		{UsernameTransform{StripSuffix: "@example.com"}, "alice@other.com", "alice@other.com"},
+		{UsernameTransform{StripSuffix: "@example.com"}, "@example.com", ""},
+		{UsernameTransform{StripPrefix: `\`, StripSuffix: "@"}, `CORP\alice@example.com`, "alice"},
+	}
+
+	for _, tc := range tests {
+		if got := tc.transform.apply(tc.input); got != tc.want {
+			t.Errorf("%+v: apply(%q) = %q, want %q", tc.transform, tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestUsernameTransformNil(t *testing.T) {
+	var transform *UsernameTransform
+	if got := transform.apply(`CORP\Alice`); got != `CORP\Alice` {
+		t.Errorf("nil transform changed the username to %q", got)
+	}
+}
+
+func TestUsernameTransformInvalidRegexp(t *testing.T) {
+	transform := &UsernameTransform{Regexp: "("}
+	if err := transform.provision(); err == nil {
+		t.Error("provision accepted an invalid regexp")
+	}
+}
+
+func TestAuthenticateTransformsUsername(t *testing.T) {
+	mock := testradius.NewMockServer(t, map[string]radius.Code{"alice": radius.CodeAccessAccept})
+
+	r := &HTTPRadiusAuth{
+		Servers:           []string{mock.Addr()},
+		Secret:            testradius.Secret,
+		UsernameTransform: &UsernameTransform{StripPrefix: `\`, LowerCase: true},
+	}
+	provision(t, r)
+
+	req, _ := newCaddyRequest(`CORP\Alice`, "password")
+	user, ok, err := r.Authenticate(httptest.NewRecorder(), req)
+	if err != nil || !ok {
+		t.Fatalf("Authenticate = %v, %v", ok, err)
+	}
+	if user.ID != `CORP\Alice` {
+		t.Errorf("user ID = %q, want the original username", user.ID)
+	}
+
+	requests := mock.Requests()
+	if len(requests) != 1 || rfc2865.UserName_GetString(requests[0]) != "alice" {
+		t.Errorf("RADIUS saw %d requests, want one for alice", len(requests))
+	}
+}